@@ -36,13 +36,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/NYTimes/gziphandler"
+	"github.com/teonet-go/teoproxy/metrics"
 	"github.com/teonet-go/teoproxy/teonet/server"
+	"github.com/teonet-go/teoproxy/tracing"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -52,6 +61,9 @@ const (
 	appVersion = "0.0.3"
 )
 
+// shutdownTimeout is the time allowed to finish requests on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 var domain string
 
 // main is the entry point of the program.
@@ -60,18 +72,34 @@ var domain string
 // registers the handler function to handle all requests, creates a file server
 // to serve static files, registers a websocket server, starts an HTTPS server
 // if a domain is set, or starts an HTTP server if a domain is not set.
+// On SIGINT or SIGTERM it gracefully shuts down the servers.
 func main() {
 
 	// Parse application parameters
 	var monitor, laddr string
-	var gzip bool
+	var logLevel, tracingExporter, otlpEndpoint string
+	var gzip, metricsOn, logPayload, rest bool
 	//
 	flag.StringVar(&domain, "domain", "", "domain name to process HTTP/s server")
 	flag.StringVar(&laddr, "laddr", "localhost:8081", "local address of http, used if domain doesn't set")
 	flag.StringVar(&monitor, "monitor", "", "teonet monitor address")
 	flag.BoolVar(&gzip, "gzip", false, "gzip http files")
+	flag.BoolVar(&metricsOn, "metrics", false, "serve prometheus metrics at /metrics")
+	flag.BoolVar(&rest, "rest", false, "serve REST gateway to Teonet APIs at /api/")
+	flag.StringVar(&logLevel, "loglevel", "info", "log level: debug, info, warn or error")
+	flag.BoolVar(&logPayload, "logpayload", false, "log commands data")
+	flag.StringVar(&tracingExporter, "tracing", "", "tracing exporter: stdout or otlp")
+	flag.StringVar(&otlpEndpoint, "otlp", "localhost:4318", "OTLP collector http address")
 	flag.Parse()
 
+	// Create structured logger
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		log.Fatalln("Wrong log level:", err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr,
+		&slog.HandlerOptions{Level: level}))
+
 	// Define Hello handler function for the HTTP requests
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Hello, World!")
@@ -89,39 +117,92 @@ func main() {
 	}
 	http.Handle("/", frontendFS)
 
+	// Register metrics handler
+	var m *metrics.Metrics
+	if metricsOn {
+		m = metrics.New()
+		http.Handle("/metrics", m.Handler())
+	}
+
+	// Teonet proxy server options
+	opts := []server.Option{
+		server.WithLogger(logger),
+		server.WithPayloadLogging(logPayload),
+		server.WithMetrics(m),
+	}
+	if len(tracingExporter) > 0 {
+		opts = append(opts, server.WithTracing(tracing.Config{
+			Exporter: tracingExporter,
+			Endpoint: otlpEndpoint,
+			Insecure: true,
+		}))
+	}
+
 	// Register teonet proxy server handler
 	serve, err := server.New(appShort, &server.TeonetMonitor{
 		Addr:       monitor,
 		AppName:    appName,
 		AppShort:   appShort,
 		AppVersion: appVersion,
-	})
+	}, opts...)
 	if err != nil {
 		fmt.Println("Create teonet proxy server error:", err)
 		return
 	}
 	http.HandleFunc("/ws", serve.HandleWebSocket)
+	http.Handle("/ws/http/", serve.FallbackHandler("/ws/http"))
+	if rest {
+		http.Handle("/api/", serve.RestHandler("/api"))
+	}
+
+	// Shutdown servers on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM)
+	defer stop()
 
 	// Start HTTPS server if domain is set
-	if len(domain) > 0 {
-
-		// Redirect HTTP requests to HTTPS
-		go func() {
-			err := http.ListenAndServe(":80", http.HandlerFunc(redirectTLS))
-			if err != nil {
-				log.Fatalf("ListenAndServe error: %v", err)
-			}
-		}()
-
-		// Start HTTPS server and create certificate for domain
-		log.Println("Start https serve with domain:", domain)
-		log.Fatal(http.Serve(autocert.NewListener(domain), nil))
-		return
+	srv := &http.Server{}
+	go func() {
+		var err error
+		if len(domain) > 0 {
+
+			// Redirect HTTP requests to HTTPS
+			go func() {
+				err := http.ListenAndServe(":80", http.HandlerFunc(redirectTLS))
+				if err != nil {
+					log.Fatalf("ListenAndServe error: %v", err)
+				}
+			}()
+
+			// Start HTTPS server and create certificate for domain
+			log.Println("Start https serve with domain:", domain)
+			err = srv.Serve(autocert.NewListener(domain))
+		} else {
+
+			// Start HTTP server
+			log.Println("Start http serve at:", laddr)
+			srv.Addr = laddr
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalln(err)
+		}
+	}()
+
+	// Wait for signal and shutdown teonet proxy and http servers. The proxy
+	// server is shut down first, it closes websocket and http fallback
+	// sessions and drains in-flight requests, so the http server does not
+	// wait for long-poll and event stream requests
+	<-ctx.Done()
+	log.Println("Shutdown servers")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := serve.Shutdown(ctx); err != nil {
+		log.Println("Teonet proxy server shutdown error:", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Http server shutdown error:", err)
 	}
-
-	// Start HTTP server
-	log.Println("Start http serve at:", laddr)
-	log.Fatalln(http.ListenAndServe(laddr, nil))
 }
 
 // redirectTLS redirects the HTTP request to HTTPS.
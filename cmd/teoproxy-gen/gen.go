@@ -0,0 +1,349 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !wasm
+
+// Typed client code generator module.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// paramRe matches the usage and return parameter "<name type>".
+var paramRe = regexp.MustCompile(`<\s*([A-Za-z_][A-Za-z0-9_]*)\s+([^<>\s]+)\s*>`)
+
+// goTypes maps usage parameter types to Go types.
+var goTypes = map[string]string{
+	"string":  "string",
+	"[]byte":  "[]byte",
+	"bytes":   "[]byte",
+	"int":     "int",
+	"int64":   "int64",
+	"uint32":  "uint32",
+	"uint64":  "uint64",
+	"bool":    "bool",
+	"float64": "float64",
+	"json":    "json.RawMessage",
+}
+
+// reserved are names of the generated code variables, parameters with these
+// names are renamed.
+var reserved = map[string]bool{"c": true, "ctx": true, "data": true,
+	"answer": true, "err": true, "v": true}
+
+// genOptions are the generated code options.
+type genOptions struct {
+	Source  string // Description source for the generated code header
+	Package string // Package name
+	Type    string // Client type name
+}
+
+// param is the api command parameter or result.
+type param struct {
+	Name string // Go name
+	Type string // Go type
+}
+
+// method is the typed client method of the api command.
+type method struct {
+	Name    string   // Go method name
+	Command string   // Api command name
+	Doc     []string // Doc comment lines
+	Params  []param  // Arguments, nil if Raw
+	Raw     bool     // Usage is not parsed, the method has data argument
+	Result  string   // Result Go type
+	Encode  string   // Arguments encoding code
+	Decode  string   // Answer decoding code
+}
+
+// file is the generated file data.
+type file struct {
+	genOptions
+	Doc     []string // Client type doc comment lines
+	Imports []string // Standard library imports
+	Methods []method
+}
+
+// fileTemplate is the generated file template.
+var fileTemplate = template.Must(template.New("file").Parse(
+	`// Code generated by teoproxy-gen from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{range .Imports}}	"{{.}}"
+{{end}}
+	"github.com/teonet-go/teoproxy/teonet/client"
+)
+
+{{range .Doc}}//{{if .}} {{.}}{{end}}
+{{end}}type {{.Type}} struct {
+	*client.APIClient
+}
+
+// New{{.Type}} returns the typed client of the peer api client.
+func New{{.Type}}(api *client.APIClient) *{{.Type}} {
+	return &{{.Type}}{api}
+}
+{{range .Methods}}
+{{range .Doc}}//{{if .}} {{.}}{{end}}
+{{end}}func (c *{{$.Type}}) {{.Name}}(ctx context.Context{{if .Raw}}, data []byte{{end}}{{range .Params}}, {{.Name}} {{.Type}}{{end}}) ({{.Result}}, error) {
+{{.Encode}}	answer, err := c.APIClient.Call(ctx, {{printf "%q" .Command}}, data)
+{{.Decode}}}
+{{end}}`))
+
+// generate returns Go source of the typed client of the api description.
+func generate(d *command.APIDescription, o genOptions) ([]byte, error) {
+	f := file{genOptions: o}
+	f.Doc = append([]string{o.Type + " is the typed client of the " + d.Name +
+		" peer api."}, lines(d.Long)...)
+	imports := map[string]bool{"context": true}
+	names := make(map[string]bool)
+	for _, c := range d.Commands {
+		m, err := newMethod(c)
+		if err != nil {
+			return nil, err
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("duplicate method %s of command %s",
+				m.Name, c.Name)
+		}
+		names[m.Name] = true
+		code := m.Encode + m.Decode
+		for pkg, used := range map[string]bool{
+			"encoding/json": strings.Contains(code, "json.") ||
+				strings.Contains(m.Result, "json."),
+			"strconv": strings.Contains(code, "strconv."),
+			"strings": strings.Contains(code, "strings."),
+		} {
+			imports[pkg] = imports[pkg] || used
+		}
+		for _, p := range m.Params {
+			if strings.HasPrefix(p.Type, "json.") {
+				imports["encoding/json"] = true
+			}
+		}
+		f.Methods = append(f.Methods, m)
+	}
+	for _, pkg := range []string{"context", "encoding/json", "strconv",
+		"strings"} {
+		if imports[pkg] {
+			f.Imports = append(f.Imports, pkg)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := fileTemplate.Execute(&buf, f); err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("can't format generated code, error: %w", err)
+	}
+	return src, nil
+}
+
+// newMethod creates the typed client method of the api command. The usage
+// "<name type>..." parameters become the method arguments joined with comma
+// in the command data, and the return "<name type>" parameter becomes the
+// method result. The method of the command with other usage has the data
+// argument, and the method of the command with other return has the []byte
+// result.
+func newMethod(c command.APICommand) (m method, err error) {
+	m = method{Name: exported(c.Name), Command: c.Name, Result: "[]byte"}
+	if m.Name == "" {
+		err = fmt.Errorf("wrong command name %q", c.Name)
+		return
+	}
+
+	// Doc comment
+	doc := m.Name + " calls the " + c.Name + " api command"
+	if c.Short != "" {
+		doc += ": " + c.Short
+	}
+	m.Doc = append(m.Doc, strings.TrimSuffix(doc, ".")+".")
+	if c.Long != "" {
+		m.Doc = append(append(m.Doc, ""), lines(c.Long)...)
+	}
+	if c.Usage != "" || c.Return != "" {
+		m.Doc = append(m.Doc, "",
+			"\tusage:  "+strings.TrimSpace(c.Name+" "+c.Usage),
+			"\treturn: "+c.Return)
+	}
+
+	// Arguments
+	usage := strings.TrimSpace(c.Usage)
+	usage = strings.TrimSpace(strings.TrimPrefix(usage, c.Name+" "))
+	params, ok := parseParams(usage)
+	if ok {
+		m.Params, m.Encode, ok = encode(params)
+	}
+	if !ok {
+		m.Params, m.Raw, m.Encode = nil, true, ""
+	}
+
+	// Result
+	if results, ok := parseParams(c.Return); ok && len(results) == 1 {
+		m.Result = results[0].Type
+	}
+	m.Decode = decode(m.Result)
+	return
+}
+
+// parseParams returns parameters of the usage or return string. It returns
+// false if the string has other text than parameters or unknown types.
+func parseParams(s string) (params []param, ok bool) {
+	if strings.Trim(paramRe.ReplaceAllString(s, ""), " ,") != "" {
+		return nil, false
+	}
+	names := make(map[string]bool)
+	for _, sm := range paramRe.FindAllStringSubmatch(s, -1) {
+		t, ok := goTypes[sm[2]]
+		if !ok {
+			return nil, false
+		}
+		name := unexported(sm[1])
+		for reserved[name] || names[name] || token.IsKeyword(name) {
+			name += "Arg"
+		}
+		names[name] = true
+		params = append(params, param{name, t})
+	}
+	return params, true
+}
+
+// encode returns the code which encodes params to the data variable. It
+// returns false if a string or raw bytes param is not the last one, its
+// commas could not be told from the params separators.
+func encode(params []param) (_ []param, code string, ok bool) {
+	if len(params) == 0 {
+		return nil, "\tvar data []byte\n", true
+	}
+	if len(params) == 1 && isBytes(params[0].Type) {
+		return params, fmt.Sprintf("\tdata := []byte(%s)\n", params[0].Name),
+			true
+	}
+	var b strings.Builder
+	b.WriteString("\tvar data []byte\n")
+	for i, p := range params {
+		if i > 0 {
+			b.WriteString("\tdata = append(data, ',')\n")
+		}
+		switch p.Type {
+		case "string", "[]byte", "json.RawMessage":
+			if i != len(params)-1 {
+				return nil, "", false
+			}
+			fmt.Fprintf(&b, "\tdata = append(data, %s...)\n", p.Name)
+		case "int":
+			fmt.Fprintf(&b, "\tdata = strconv.AppendInt(data, int64(%s), 10)\n",
+				p.Name)
+		case "int64":
+			fmt.Fprintf(&b, "\tdata = strconv.AppendInt(data, %s, 10)\n", p.Name)
+		case "uint32":
+			fmt.Fprintf(&b, "\tdata = strconv.AppendUint(data, uint64(%s), 10)\n",
+				p.Name)
+		case "uint64":
+			fmt.Fprintf(&b, "\tdata = strconv.AppendUint(data, %s, 10)\n", p.Name)
+		case "bool":
+			fmt.Fprintf(&b, "\tdata = strconv.AppendBool(data, %s)\n", p.Name)
+		case "float64":
+			fmt.Fprintf(&b, "\tdata = strconv.AppendFloat(data, %s, 'g', -1, 64)\n",
+				p.Name)
+		}
+	}
+	return params, b.String(), true
+}
+
+// decode returns the code which checks the Call error and decodes the
+// answer variable to the result type.
+func decode(result string) string {
+	zero := map[string]string{"string": `""`, "bool": "false", "[]byte": "nil",
+		"json.RawMessage": "nil"}[result]
+	if zero == "" {
+		zero = "0"
+	}
+	code := "\tif err != nil {\n\t\treturn " + zero + ", err\n\t}\n"
+	text := "strings.TrimSpace(string(answer))"
+	switch result {
+	case "string":
+		code += "\treturn string(answer), nil\n"
+	case "[]byte":
+		code += "\treturn answer, nil\n"
+	case "json.RawMessage":
+		code += "\treturn json.RawMessage(answer), nil\n"
+	case "int":
+		code += "\tv, err := strconv.ParseInt(" + text + ", 10, 64)\n" +
+			"\treturn int(v), err\n"
+	case "int64":
+		code += "\treturn strconv.ParseInt(" + text + ", 10, 64)\n"
+	case "uint32":
+		code += "\tv, err := strconv.ParseUint(" + text + ", 10, 32)\n" +
+			"\treturn uint32(v), err\n"
+	case "uint64":
+		code += "\treturn strconv.ParseUint(" + text + ", 10, 64)\n"
+	case "bool":
+		code += "\treturn strconv.ParseBool(" + text + ")\n"
+	case "float64":
+		code += "\treturn strconv.ParseFloat(" + text + ", 64)\n"
+	}
+	return code
+}
+
+// lines returns trimmed lines of the description text.
+func lines(text string) (l []string) {
+	for _, s := range strings.Split(strings.TrimSpace(text), "\n") {
+		l = append(l, strings.TrimRight(s, " \t\r"))
+	}
+	if len(l) == 1 && l[0] == "" {
+		l = nil
+	}
+	return
+}
+
+// isBytes returns true if the Go type is raw bytes.
+func isBytes(t string) bool { return t == "[]byte" || t == "json.RawMessage" }
+
+// exported returns the exported Go name of the api command or application
+// name, f.e. "get-user" is "GetUser".
+func exported(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r) || (unicode.IsDigit(r) && b.Len() > 0):
+			if upper {
+				r = unicode.ToUpper(r)
+			}
+			b.WriteRune(r)
+			upper = false
+		case unicode.IsDigit(r):
+		default:
+			upper = true
+		}
+	}
+	return b.String()
+}
+
+// unexported returns the unexported Go name of the parameter.
+func unexported(name string) string {
+	s := exported(name)
+	if s == "" {
+		return "arg"
+	}
+	r := []rune(s)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
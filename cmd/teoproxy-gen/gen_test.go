@@ -0,0 +1,140 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+var update = flag.Bool("update", false, "update testdata/fortune/fortune.go")
+
+const (
+	descriptionFile = "testdata/fortune.json"
+	goldenFile      = "testdata/fortune/fortune.go"
+)
+
+// TestGenerate checks the generated code of the description file is equal to
+// the golden file.
+func TestGenerate(t *testing.T) {
+	d, err := readDescription(descriptionFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := generate(d, genOptions{Source: "fortune.json",
+		Package: "teofortune", Type: "TeofortuneClient"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *update {
+		if err := os.WriteFile(goldenFile, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := os.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, golden) {
+		t.Fatalf("generated code differs from %s, run go test -update",
+			goldenFile)
+	}
+}
+
+// TestGenerateBuild checks the golden file builds for native and wasm
+// clients.
+func TestGenerateBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip build in short mode")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go not found")
+	}
+
+	for _, env := range [][]string{nil, {"GOOS=js", "GOARCH=wasm"}} {
+		cmd := exec.Command(gobin, "vet", "./testdata/fortune")
+		cmd.Env = append(os.Environ(), env...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("can't build %v generated code: %v\n%s", env, err, out)
+		}
+	}
+}
+
+// TestNewMethod checks the api command usage and return parsing.
+func TestNewMethod(t *testing.T) {
+	tests := []struct {
+		cmd    command.APICommand
+		name   string
+		params []param
+		raw    bool
+		result string
+	}{
+		// Test case 1: no usage and return
+		{command.APICommand{Name: "fortb"}, "Fortb", nil, false, "[]byte"},
+
+		// Test case 2: parameters and result
+		{command.APICommand{Name: "get-user",
+			Usage: "<id uint32>, <name string>", Return: "<user json>"},
+			"GetUser", []param{{"id", "uint32"}, {"name", "string"}}, false,
+			"json.RawMessage"},
+
+		// Test case 3: usage with the command name and reserved names
+		{command.APICommand{Name: "set", Usage: "set <func int>,<data string>"},
+			"Set", []param{{"funcArg", "int"}, {"dataArg", "string"}}, false,
+			"[]byte"},
+
+		// Test case 4: free text usage and return
+		{command.APICommand{Name: "echo", Usage: "[text]", Return: "text"},
+			"Echo", nil, true, "[]byte"},
+
+		// Test case 5: unknown parameter type
+		{command.APICommand{Name: "echo", Usage: "<t time.Time>",
+			Return: "<t string>"}, "Echo", nil, true, "string"},
+
+		// Test case 6: raw bytes parameter is not the last one
+		{command.APICommand{Name: "put", Usage: "<data []byte>,<n int>"},
+			"Put", nil, true, "[]byte"},
+
+		// Test case 7: string parameter is not the last one
+		{command.APICommand{Name: "add", Usage: "<author string>,<n int>"},
+			"Add", nil, true, "[]byte"},
+	}
+
+	for i, tt := range tests {
+		m, err := newMethod(tt.cmd)
+		if err != nil {
+			t.Fatalf("test case %d: %v", i+1, err)
+		}
+		if m.Name != tt.name || m.Raw != tt.raw || m.Result != tt.result ||
+			len(m.Params) != len(tt.params) {
+			t.Fatalf("test case %d: wrong method %+v", i+1, m)
+		}
+		for j := range tt.params {
+			if m.Params[j] != tt.params[j] {
+				t.Fatalf("test case %d: wrong param %d %+v", i+1, j,
+					m.Params[j])
+			}
+		}
+	}
+
+	// Test case 8: wrong command name
+	if _, err := newMethod(command.APICommand{Name: "-"}); err == nil {
+		t.Fatal("test case 8: no error of wrong command name")
+	}
+
+	// Test case 9: duplicate method names
+	_, err := generate(&command.APIDescription{Name: "dup",
+		Commands: []command.APICommand{{Name: "get-user"}, {Name: "getUser"}}},
+		genOptions{Package: "dup", Type: "DupClient"})
+	if err == nil || !strings.Contains(err.Error(), "duplicate method") {
+		t.Fatalf("test case 9: wrong error: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !wasm
+
+// Teoproxy-gen generates typed Go clients of Teonet peer APIs.
+//
+// It reads the API description of the Teonet peer, or a local description
+// file in the DescribeAPI command JSON format, and generates the client type
+// which wraps teonet/client.APIClient with a typed method for each API
+// command. The generated code builds for wasm and native applications.
+//
+// The API command usage parameters "<name type>" become the method arguments
+// which are sent to the peer joined with comma, and the return parameter
+// "<name type>" becomes the method result. The supported types are string,
+// []byte, int, int64, uint32, uint64, bool, float64 and json, the string,
+// []byte and json parameter may be the last one only. The method of the
+// command with other usage has the raw data argument, and the method of the
+// command with other return has the []byte result.
+//
+// Usage:
+//
+//	teoproxy-gen -peer <address> -pkg <package> [-type <name>] [-out <file>]
+//	teoproxy-gen -file <description.json> -pkg <package> [-out <file>]
+//
+// or with go generate:
+//
+//	//go:generate go run github.com/teonet-go/teoproxy/cmd/teoproxy-gen -file fortune.json -pkg fortune -out fortune_client.go
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/teonet-go/teoproxy/teonet/client"
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// appShort is the Teonet application short name.
+const appShort = "teoproxy-gen"
+
+func main() {
+	var (
+		file = flag.String("file", "", "api description json file")
+		peer = flag.String("peer", "", "teonet peer address to get api description from")
+		pkg  = flag.String("pkg", "", "generated package name, default is the api name")
+		typ  = flag.String("type", "", "generated client type name, default is <Api>Client")
+		out  = flag.String("out", "", "output file, default is stdout")
+	)
+	flag.Parse()
+
+	if err := run(*file, *peer, *pkg, *typ, *out); err != nil {
+		fmt.Fprintln(os.Stderr, "teoproxy-gen:", err)
+		os.Exit(1)
+	}
+}
+
+// run generates the typed client and writes it to the out file or stdout.
+func run(file, peer, pkg, typ, out string) (err error) {
+	var d *command.APIDescription
+	var source string
+	switch {
+	case file != "" && peer != "":
+		return fmt.Errorf("use -file or -peer, not both")
+	case file != "":
+		d, err = readDescription(file)
+		source = filepath.Base(file)
+	case peer != "":
+		d, err = describePeer(peer)
+		source = "peer " + peer
+	default:
+		flag.Usage()
+		return fmt.Errorf("no -file or -peer")
+	}
+	if err != nil {
+		return
+	}
+
+	name := d.Short
+	if name == "" {
+		name = d.Name
+	}
+	o := genOptions{Source: source, Package: pkg, Type: typ}
+	if o.Package == "" {
+		o.Package = unexported(name)
+	}
+	if o.Type == "" {
+		o.Type = exported(name) + "Client"
+	}
+
+	src, err := generate(d, o)
+	if err != nil {
+		return
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(src)
+		return
+	}
+	return os.WriteFile(out, src, 0644)
+}
+
+// readDescription reads the api description json file.
+func readDescription(file string) (d *command.APIDescription, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	d = new(command.APIDescription)
+	if err = json.Unmarshal(data, d); err != nil {
+		err = fmt.Errorf("can't parse api description %s, error: %w", file, err)
+	}
+	return
+}
+
+// describePeer connects to the Teonet peer and returns its api description.
+func describePeer(addr string) (d *command.APIDescription, err error) {
+	teo, err := client.New(appShort, nil)
+	if err != nil {
+		return
+	}
+	defer teo.Close()
+
+	if err = teo.Connect(); err != nil {
+		err = fmt.Errorf("can't connect to Teonet, error: %w", err)
+		return
+	}
+	if err = teo.ConnectTo(addr); err != nil {
+		err = fmt.Errorf("can't connect to peer %s, error: %w", addr, err)
+		return
+	}
+	api, err := teo.NewAPIClient(addr)
+	if err != nil {
+		err = fmt.Errorf("can't get peer %s api, error: %w", addr, err)
+		return
+	}
+	return api.Describe()
+}
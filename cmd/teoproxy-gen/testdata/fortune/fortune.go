@@ -0,0 +1,137 @@
+// Code generated by teoproxy-gen from fortune.json. DO NOT EDIT.
+
+package teofortune
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/teonet-go/teoproxy/teonet/client"
+)
+
+// TeofortuneClient is the typed client of the Teonet fortune application peer api.
+// Teonet fortune peer sends fortune messages.
+type TeofortuneClient struct {
+	*client.APIClient
+}
+
+// NewTeofortuneClient returns the typed client of the peer api client.
+func NewTeofortuneClient(api *client.APIClient) *TeofortuneClient {
+	return &TeofortuneClient{api}
+}
+
+// Fortb calls the fortb api command: get fortune message in binary format.
+//
+//	usage:  fortb
+//	return: <msg string>
+func (c *TeofortuneClient) Fortb(ctx context.Context) (string, error) {
+	var data []byte
+	answer, err := c.APIClient.Call(ctx, "fortb", data)
+	if err != nil {
+		return "", err
+	}
+	return string(answer), nil
+}
+
+// Fortune calls the fortune api command: get fortune message by number.
+//
+//	usage:  fortune <num int>
+//	return: <msg string>
+func (c *TeofortuneClient) Fortune(ctx context.Context, num int) (string, error) {
+	var data []byte
+	data = strconv.AppendInt(data, int64(num), 10)
+	answer, err := c.APIClient.Call(ctx, "fortune", data)
+	if err != nil {
+		return "", err
+	}
+	return string(answer), nil
+}
+
+// Count calls the count api command: get number of fortune messages.
+//
+//	usage:  count
+//	return: <count uint64>
+func (c *TeofortuneClient) Count(ctx context.Context) (uint64, error) {
+	var data []byte
+	answer, err := c.APIClient.Call(ctx, "count", data)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(answer)), 10, 64)
+}
+
+// AddFortune calls the add-fortune api command: add fortune message.
+//
+// Adds the message to the author fortunes and returns the message number.
+//
+//	usage:  add-fortune <author string>,<type string>,<favorite bool>,<text []byte>
+//	return: <num int>
+func (c *TeofortuneClient) AddFortune(ctx context.Context, data []byte) (int, error) {
+	answer, err := c.APIClient.Call(ctx, "add-fortune", data)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(answer)), 10, 64)
+	return int(v), err
+}
+
+// SetAuthor calls the set-author api command: set fortune message author.
+//
+//	usage:  set-author <num int>,<favorite bool>,<author string>
+//	return: <ok bool>
+func (c *TeofortuneClient) SetAuthor(ctx context.Context, num int, favorite bool, author string) (bool, error) {
+	var data []byte
+	data = strconv.AppendInt(data, int64(num), 10)
+	data = append(data, ',')
+	data = strconv.AppendBool(data, favorite)
+	data = append(data, ',')
+	data = append(data, author...)
+	answer, err := c.APIClient.Call(ctx, "set-author", data)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(strings.TrimSpace(string(answer)))
+}
+
+// Rate calls the rate api command: rate fortune message.
+//
+//	usage:  rate <num int64>,<rating float64>
+//	return: <ok bool>
+func (c *TeofortuneClient) Rate(ctx context.Context, num int64, rating float64) (bool, error) {
+	var data []byte
+	data = strconv.AppendInt(data, num, 10)
+	data = append(data, ',')
+	data = strconv.AppendFloat(data, rating, 'g', -1, 64)
+	answer, err := c.APIClient.Call(ctx, "rate", data)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(strings.TrimSpace(string(answer)))
+}
+
+// Search calls the search api command: search fortune messages.
+//
+//	usage:  search <query json>
+//	return: <result json>
+func (c *TeofortuneClient) Search(ctx context.Context, query json.RawMessage) (json.RawMessage, error) {
+	data := []byte(query)
+	answer, err := c.APIClient.Call(ctx, "search", data)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(answer), nil
+}
+
+// Raw calls the raw api command: send raw data.
+//
+//	usage:  raw [data]
+//	return: data
+func (c *TeofortuneClient) Raw(ctx context.Context, data []byte) ([]byte, error) {
+	answer, err := c.APIClient.Call(ctx, "raw", data)
+	if err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
@@ -0,0 +1,277 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teoproxy configuration module.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/teonet-go/teoproxy/teonet/server"
+	"github.com/teonet-go/teoproxy/ws/command"
+	ws "github.com/teonet-go/teoproxy/ws/server"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of environment variables which override the
+// configuration, f.e. TEOPROXY_LISTEN or TEOPROXY_TIMEOUTS_API.
+const envPrefix = "TEOPROXY_"
+
+// Config is the teoproxy server configuration. It is read from YAML or TOML
+// file and environment variables, the keys are the same in both formats.
+type Config struct {
+	Name         string   `yaml:"name" toml:"name"`                   // Teonet application short name
+	Listen       string   `yaml:"listen" toml:"listen"`               // HTTP or HTTPS server address
+	TLS          TLS      `yaml:"tls" toml:"tls"`                     // HTTPS server
+	Static       string   `yaml:"static" toml:"static"`               // Static files directory, disabled if empty
+	WSPath       string   `yaml:"ws_path" toml:"ws_path"`             // Websocket path
+	FallbackPath string   `yaml:"fallback_path" toml:"fallback_path"` // HTTP fallback path, disabled if empty
+	RESTPath     string   `yaml:"rest_path" toml:"rest_path"`         // REST gateway path, disabled if empty
+	MetricsPath  string   `yaml:"metrics_path" toml:"metrics_path"`   // Prometheus metrics path, disabled if empty
+	Origins      []string `yaml:"origins" toml:"origins"`             // Allowed websocket origins, server host if empty
+	Peers        []string `yaml:"peers" toml:"peers"`                 // Allowed peers, all if empty
+	Monitor      string   `yaml:"monitor" toml:"monitor"`             // Teonet monitor address, disabled if empty
+	Timeouts     Timeouts `yaml:"timeouts" toml:"timeouts"`           // Timeouts
+	Limits       Limits   `yaml:"limits" toml:"limits"`               // Messages limits
+	Log          Log      `yaml:"log" toml:"log"`                     // Logging
+	Tracing      Tracing  `yaml:"tracing" toml:"tracing"`             // Tracing
+
+	Upstreams []Upstream            `yaml:"upstreams" toml:"upstreams"` // Peers routed to upstreams
+	Cache     Cache                 `yaml:"cache" toml:"cache"`         // Api answers cache
+	Coalesce  []server.CoalesceRule `yaml:"coalesce" toml:"coalesce"`   // Api requests coalescing rules
+}
+
+// TLS configures the HTTPS server. The certificates of the domains are
+// obtained from Let's Encrypt, otherwise the certificate files are used.
+type TLS struct {
+	Domains  []string `yaml:"domains" toml:"domains"`     // Autocert domains
+	CacheDir string   `yaml:"cache_dir" toml:"cache_dir"` // Autocert certificates directory
+	CertFile string   `yaml:"cert_file" toml:"cert_file"` // Certificate file
+	KeyFile  string   `yaml:"key_file" toml:"key_file"`   // Private key file
+	Redirect string   `yaml:"redirect" toml:"redirect"`   // HTTP address redirected to HTTPS, disabled if empty
+}
+
+// Timeouts configures the server timeouts.
+type Timeouts struct {
+	API        time.Duration `yaml:"api" toml:"api"`                 // Peer api answer
+	ReadHeader time.Duration `yaml:"read_header" toml:"read_header"` // HTTP request header read
+	Read       time.Duration `yaml:"read" toml:"read"`               // HTTP request read
+	Write      time.Duration `yaml:"write" toml:"write"`             // HTTP response write
+	Idle       time.Duration `yaml:"idle" toml:"idle"`               // HTTP keep-alive idle
+	Shutdown   time.Duration `yaml:"shutdown" toml:"shutdown"`       // Graceful shutdown
+}
+
+// Limits configures the binary protocol messages limits.
+type Limits struct {
+	FragmentSize int   `yaml:"fragment_size" toml:"fragment_size"` // Answers fragment size, 0 disables
+	Compression  int   `yaml:"compression" toml:"compression"`     // Answers compression threshold, 0 disables
+	MaxMessage   int   `yaml:"max_message" toml:"max_message"`     // Reassembled message size
+	ReadLimit    int64 `yaml:"read_limit" toml:"read_limit"`       // Websocket message size, 0 is unlimited
+}
+
+// Log configures logging.
+type Log struct {
+	Level   string `yaml:"level" toml:"level"`     // debug, info, warn or error
+	Format  string `yaml:"format" toml:"format"`   // text or json
+	Payload bool   `yaml:"payload" toml:"payload"` // Log commands data
+}
+
+// Tracing configures tracing.
+type Tracing struct {
+	Exporter string `yaml:"exporter" toml:"exporter"` // stdout or otlp, disabled if empty
+	Endpoint string `yaml:"endpoint" toml:"endpoint"` // OTLP collector address
+	Insecure bool   `yaml:"insecure" toml:"insecure"` // Use http to connect OTLP collector
+}
+
+// Upstream routes commands to the peer name to the other backend.
+type Upstream struct {
+	Name     string        `yaml:"name" toml:"name"`         // Peer name
+	Type     string        `yaml:"type" toml:"type"`         // peer, http or tcp
+	Addr     string        `yaml:"addr" toml:"addr"`         // Teonet address, base URL or host:port
+	Timeout  time.Duration `yaml:"timeout" toml:"timeout"`   // Request timeout, default if zero
+	Commands []string      `yaml:"commands" toml:"commands"` // Api commands labeled in metrics, others are "other"
+}
+
+// Cache configures the api answers cache, it is enabled if it has rules.
+type Cache struct {
+	Size  int                `yaml:"size" toml:"size"`   // Maximum cached data size
+	Rules []server.CacheRule `yaml:"rules" toml:"rules"` // Cache rules
+}
+
+// defaultConfig returns the configuration with default values.
+func defaultConfig() *Config {
+	return &Config{
+		Name:         appShort,
+		Listen:       "localhost:8081",
+		WSPath:       "/ws",
+		FallbackPath: "/ws/http",
+		Timeouts: Timeouts{
+			API:        server.DefaultTimeout,
+			ReadHeader: 10 * time.Second,
+			Idle:       2 * time.Minute,
+			Shutdown:   10 * time.Second,
+		},
+		Limits: Limits{
+			FragmentSize: command.DefaultFragmentSize,
+			Compression:  command.DefaultCompressThreshold,
+			MaxMessage:   command.DefaultMaxMessage,
+			ReadLimit:    ws.DefaultReadLimit,
+		},
+		Log:     Log{Level: "info", Format: "text"},
+		Tracing: Tracing{Endpoint: "localhost:4318"},
+		Cache:   Cache{Size: server.DefaultCacheSize},
+	}
+}
+
+// loadConfig returns the default configuration overridden by the YAML or
+// TOML file, if it is set, and by the environment variables.
+func loadConfig(file string, lookupEnv func(string) (string, bool)) (
+	c *Config, err error) {
+
+	c = defaultConfig()
+	if file != "" {
+		if err = c.readFile(file); err != nil {
+			return
+		}
+	}
+	if err = setEnv(reflect.ValueOf(c).Elem(), envPrefix, lookupEnv); err != nil {
+		return
+	}
+	err = c.validate()
+	return
+}
+
+// readFile reads the configuration file, its format is selected by the file
+// extension. Unknown keys are errors.
+func (c *Config) readFile(file string) (err error) {
+	ext := filepath.Ext(file)
+	if ext != ".yaml" && ext != ".yml" && ext != ".toml" {
+		return fmt.Errorf("unknown config file format %q", ext)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	switch ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(c); errors.Is(err, io.EOF) {
+			err = nil // Empty file
+		}
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if keys := md.Undecoded(); err == nil && len(keys) > 0 {
+			err = fmt.Errorf("unknown key %s", keys[0])
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("can't read config %s, error: %w", file, err)
+	}
+	return
+}
+
+// setEnv sets fields of the struct v from environment variables named by the
+// prefix and the fields keys, f.e. TEOPROXY_TLS_DOMAINS. Lists are comma
+// separated, lists of tables can be set in the file only.
+func setEnv(v reflect.Value, prefix string,
+	lookupEnv func(string) (string, bool)) (err error) {
+
+	for i := 0; i < v.NumField(); i++ {
+		field, key := v.Field(i), v.Type().Field(i).Tag.Get("yaml")
+		name := prefix + strings.ToUpper(key)
+		if field.Kind() == reflect.Struct {
+			if err = setEnv(field, name+"_", lookupEnv); err != nil {
+				return
+			}
+			continue
+		}
+		value, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err = setValue(field, value); err != nil {
+			return fmt.Errorf("wrong environment variable %s, error: %w",
+				name, err)
+		}
+	}
+	return
+}
+
+// setValue sets the field from the environment variable value.
+func setValue(field reflect.Value, value string) (err error) {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		var b bool
+		b, err = strconv.ParseBool(value)
+		field.SetBool(b)
+	case int, int64:
+		var n int64
+		n, err = strconv.ParseInt(value, 10, 64)
+		field.SetInt(n)
+	case time.Duration:
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		field.SetInt(int64(d))
+	case []string:
+		var list []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	}
+	return
+}
+
+// validate checks the configuration values.
+func (c *Config) validate() error {
+	switch {
+	case c.Listen == "":
+		return fmt.Errorf("listen address is not set")
+	case !strings.HasPrefix(c.WSPath, "/"):
+		return fmt.Errorf("wrong ws_path %q", c.WSPath)
+	case c.TLS.CertFile != "" && c.TLS.KeyFile == "",
+		c.TLS.CertFile == "" && c.TLS.KeyFile != "":
+		return fmt.Errorf("tls cert_file and key_file must be set together")
+	case c.TLS.CertFile != "" && len(c.TLS.Domains) > 0:
+		return fmt.Errorf("tls domains and cert_file can't be set together")
+	case c.Log.Format != "text" && c.Log.Format != "json":
+		return fmt.Errorf("wrong log format %q", c.Log.Format)
+	}
+	for _, path := range []string{c.FallbackPath, c.RESTPath, c.MetricsPath} {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("wrong path %q", path)
+		}
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return fmt.Errorf("wrong log level %q", c.Log.Level)
+	}
+	for _, u := range c.Upstreams {
+		switch {
+		case u.Name == "" || u.Addr == "":
+			return fmt.Errorf("upstream name and addr must be set")
+		case u.Type != "peer" && u.Type != "http" && u.Type != "tcp":
+			return fmt.Errorf("wrong upstream %s type %q", u.Name, u.Type)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/teoproxy/teonet/server"
+)
+
+// env returns lookupEnv function of the environment variables map.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (value string, ok bool) {
+		value, ok = vars[name]
+		return
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	// Test case 1: defaults and the example config
+	c, err := loadConfig("", env(nil))
+	if err != nil {
+		t.Fatalf("test case 1: %v", err)
+	}
+	if !reflect.DeepEqual(c, defaultConfig()) {
+		t.Fatalf("test case 1: wrong defaults: %+v", c)
+	}
+	example, err := loadConfig("teoproxy.yaml", env(nil))
+	if err != nil {
+		t.Fatalf("test case 1: %v", err)
+	}
+	if fmt.Sprintf("%+v", example) != fmt.Sprintf("%+v", c) {
+		t.Fatalf("test case 1: example config differs from defaults:\n%+v\n%+v",
+			example, c)
+	}
+
+	// Test case 2: YAML and TOML files
+	for _, file := range []string{"testdata/teoproxy.yaml",
+		"testdata/teoproxy.toml"} {
+
+		c, err := loadConfig(file, env(nil))
+		if err != nil {
+			t.Fatalf("test case 2: %v", err)
+		}
+		expected := defaultConfig()
+		expected.Name, expected.Listen = "teoproxy-test", ":8443"
+		expected.WSPath, expected.RESTPath = "/proxy", "/api"
+		expected.MetricsPath = "/metrics"
+		expected.Origins = []string{"https://example.com"}
+		expected.Peers = []string{"fortune", "users"}
+		expected.TLS = TLS{Domains: []string{"example.com"},
+			CacheDir: "/var/cache/teoproxy", Redirect: ":80"}
+		expected.Timeouts.API = 10 * time.Second
+		expected.Timeouts.Write = 30 * time.Second
+		expected.Limits.ReadLimit = 1 << 20
+		expected.Log.Level, expected.Log.Format = "debug", "json"
+		expected.Upstreams = []Upstream{
+			{Name: "fortune", Type: "peer",
+				Addr: "8agv3IrXQk7INHy5rVlbCxMWVmOOCoQgZBF"},
+			{Name: "users", Type: "http", Addr: "http://users:8080/api",
+				Timeout: 3 * time.Second, Commands: []string{"list", "get"}},
+		}
+		expected.Cache.Rules = []server.CacheRule{
+			{Peer: "fortune", Command: "fortb", TTL: time.Minute}}
+		expected.Coalesce = []server.CoalesceRule{{Peer: "users"}}
+		if !reflect.DeepEqual(c, expected) {
+			t.Fatalf("test case 2: wrong %s config:\n%+v\n%+v", file, c,
+				expected)
+		}
+	}
+
+	// Test case 3: environment variables override the file
+	c, err = loadConfig("testdata/teoproxy.yaml", env(map[string]string{
+		"TEOPROXY_LISTEN":            "localhost:9000",
+		"TEOPROXY_TLS_DOMAINS":       "a.example.com, b.example.com",
+		"TEOPROXY_TIMEOUTS_API":      "1m",
+		"TEOPROXY_LIMITS_READ_LIMIT": "1024",
+		"TEOPROXY_LOG_PAYLOAD":       "true",
+		"TEOPROXY_PEERS":             "",
+	}))
+	if err != nil {
+		t.Fatalf("test case 3: %v", err)
+	}
+	if c.Listen != "localhost:9000" || c.Timeouts.API != time.Minute ||
+		!reflect.DeepEqual(c.TLS.Domains,
+			[]string{"a.example.com", "b.example.com"}) ||
+		c.Limits.ReadLimit != 1024 || !c.Log.Payload || c.Peers != nil ||
+		c.Name != "teoproxy-test" {
+		t.Fatalf("test case 3: wrong config: %+v", c)
+	}
+
+	// Test case 4: wrong values
+	for _, tt := range []struct {
+		file string
+		env  map[string]string
+		err  string
+	}{
+		{"config.json", nil, "unknown config file format"},
+		{"testdata/none.yaml", nil, "no such file"},
+		{"", map[string]string{"TEOPROXY_TIMEOUTS_API": "5"},
+			"TEOPROXY_TIMEOUTS_API"},
+		{"", map[string]string{"TEOPROXY_LOG_PAYLOAD": "yes"},
+			"TEOPROXY_LOG_PAYLOAD"},
+		{"", map[string]string{"TEOPROXY_LISTEN": ""}, "listen address"},
+		{"", map[string]string{"TEOPROXY_WS_PATH": "ws"}, "wrong ws_path"},
+		{"", map[string]string{"TEOPROXY_REST_PATH": "api"}, "wrong path"},
+		{"", map[string]string{"TEOPROXY_LOG_LEVEL": "trace"},
+			"wrong log level"},
+		{"", map[string]string{"TEOPROXY_LOG_FORMAT": "xml"},
+			"wrong log format"},
+		{"", map[string]string{"TEOPROXY_TLS_CERT_FILE": "cert.pem"},
+			"must be set together"},
+		{"", map[string]string{"TEOPROXY_TLS_CERT_FILE": "cert.pem",
+			"TEOPROXY_TLS_KEY_FILE": "key.pem",
+			"TEOPROXY_TLS_DOMAINS":  "example.com"}, "can't be set together"},
+	} {
+		_, err := loadConfig(tt.file, env(tt.env))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("test case 4: %s %v: expected error %q, got: %v",
+				tt.file, tt.env, tt.err, err)
+		}
+	}
+}
+
+func TestReadFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name, data, err string
+	}{
+		// Test case 1: unknown keys
+		{"unknown.yaml", "listen: :80\nlisen: :81\n", "lisen"},
+		{"unknown.toml", "listen = \":80\"\nlisen = \":81\"\n", "lisen"},
+
+		// Test case 2: empty files are valid
+		{"empty.yaml", "", ""},
+		{"empty.toml", "", ""},
+
+		// Test case 3: wrong upstream
+		{"upstream.yaml", "upstreams:\n  - name: a\n    type: udp\n" +
+			"    addr: a:1\n", "wrong upstream a type"},
+		{"upstream.toml", "[[upstreams]]\nname = \"a\"\ntype = \"tcp\"\n",
+			"upstream name and addr"},
+	} {
+		file := dir + "/" + tt.name
+		if err := os.WriteFile(file, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(file, env(nil))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected error %q, got: %v", tt.name, tt.err, err)
+		}
+	}
+}
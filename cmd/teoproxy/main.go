@@ -0,0 +1,292 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teoproxy is the standalone Teonet proxy server.
+//
+// It serves the Teonet proxy websocket, http fallback and REST gateway
+// endpoints, static web application files and metrics, configured with YAML
+// or TOML file and environment variables instead of Go code:
+//
+//	teoproxy -config teoproxy.yaml
+//
+// Every configuration value, except lists of tables like upstreams, can be
+// overridden by the environment variable named by the TEOPROXY_ prefix and
+// the value key path, f.e. TEOPROXY_LISTEN, TEOPROXY_TLS_DOMAINS or
+// TEOPROXY_TIMEOUTS_API. Lists are comma separated. The configuration file
+// name can be set with the TEOPROXY_CONFIG environment variable.
+//
+// See teoproxy.yaml for all configuration values and their defaults.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/teonet-go/teoproxy/metrics"
+	"github.com/teonet-go/teoproxy/teonet/server"
+	"github.com/teonet-go/teoproxy/tracing"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	appShort   = "teoproxy"
+	appName    = "Teonet proxy server"
+	appVersion = "0.0.4"
+)
+
+func main() {
+	config := flag.String("config", os.Getenv(envPrefix+"CONFIG"),
+		"YAML or TOML configuration file")
+	flag.Parse()
+
+	c, err := loadConfig(*config, os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "teoproxy:", err)
+		os.Exit(1)
+	}
+
+	// Shutdown servers on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, c); err != nil {
+		fmt.Fprintln(os.Stderr, "teoproxy:", err)
+		os.Exit(1)
+	}
+}
+
+// run starts the Teonet proxy and http servers and shuts them down when the
+// ctx is done.
+func run(ctx context.Context, c *Config) (err error) {
+	logger := newLogger(c.Log)
+
+	// Teonet proxy server
+	var m *metrics.Metrics
+	if c.MetricsPath != "" {
+		m = metrics.New()
+	}
+	teo, err := server.New(c.Name, monitor(c), serverOptions(c, logger, m)...)
+	if err != nil {
+		return fmt.Errorf("can't create teonet proxy server, error: %w", err)
+	}
+	addUpstreams(teo, m, c.Upstreams)
+
+	// Http server
+	srv := &http.Server{
+		Addr:              c.Listen,
+		Handler:           newHandler(c, teo, m),
+		ReadHeaderTimeout: c.Timeouts.ReadHeader,
+		ReadTimeout:       c.Timeouts.Read,
+		WriteTimeout:      c.Timeouts.Write,
+		IdleTimeout:       c.Timeouts.Idle,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	servers := []*http.Server{srv}
+	errs := make(chan error, 2)
+	serve := func(srv *http.Server, listen func() error) {
+		if err := listen(); !errors.Is(err, http.ErrServerClosed) {
+			errs <- err
+		}
+	}
+
+	switch {
+	case len(c.TLS.Domains) > 0:
+		// Get certificates of the domains from Let's Encrypt
+		cm := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.TLS.Domains...),
+		}
+		if c.TLS.CacheDir != "" {
+			cm.Cache = autocert.DirCache(c.TLS.CacheDir)
+		}
+		srv.TLSConfig = cm.TLSConfig()
+		if c.TLS.Redirect != "" {
+			redirect := newRedirect(c.TLS.Redirect, cm.HTTPHandler(nil))
+			servers = append(servers, redirect)
+			go serve(redirect, redirect.ListenAndServe)
+		}
+		logger.Info("start https server", "addr", c.Listen,
+			"domains", c.TLS.Domains)
+		go serve(srv, func() error { return srv.ListenAndServeTLS("", "") })
+	case c.TLS.CertFile != "":
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if c.TLS.Redirect != "" {
+			redirect := newRedirect(c.TLS.Redirect, redirectTLS(c.Listen))
+			servers = append(servers, redirect)
+			go serve(redirect, redirect.ListenAndServe)
+		}
+		logger.Info("start https server", "addr", c.Listen)
+		go serve(srv, func() error {
+			return srv.ListenAndServeTLS(c.TLS.CertFile, c.TLS.KeyFile)
+		})
+	default:
+		logger.Info("start http server", "addr", c.Listen)
+		go serve(srv, srv.ListenAndServe)
+	}
+
+	// Wait for signal or error and shutdown teonet proxy and http servers.
+	// The proxy server is shut down first, it closes websocket and http
+	// fallback sessions and drains in-flight requests, so the http servers do
+	// not wait for long-poll and event stream requests
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+		logger.Error("http server error", "err", err)
+	}
+	logger.Info("shutdown servers")
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx),
+		c.Timeouts.Shutdown)
+	defer cancel()
+	if e := teo.Shutdown(ctx); e != nil {
+		logger.Warn("teonet proxy server shutdown error", "err", e)
+	}
+	for _, srv := range servers {
+		if e := srv.Shutdown(ctx); e != nil {
+			logger.Warn("http server shutdown error", "addr", srv.Addr, "err", e)
+		}
+	}
+	return
+}
+
+// newLogger creates structured logger.
+func newLogger(c Log) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	if c.Format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// monitor returns the Teonet monitor or nil if it is not set.
+func monitor(c *Config) *server.TeonetMonitor {
+	if c.Monitor == "" {
+		return nil
+	}
+	return &server.TeonetMonitor{
+		Addr:       c.Monitor,
+		AppName:    appName,
+		AppShort:   c.Name,
+		AppVersion: appVersion,
+	}
+}
+
+// serverOptions returns the Teonet proxy server options.
+func serverOptions(c *Config, logger *slog.Logger,
+	m *metrics.Metrics) []server.Option {
+
+	opts := []server.Option{
+		server.WithLogger(logger),
+		server.WithPayloadLogging(c.Log.Payload),
+		server.WithMetrics(m),
+		server.WithTimeout(c.Timeouts.API),
+		server.WithFragmentSize(c.Limits.FragmentSize),
+		server.WithCompression(c.Limits.Compression),
+		server.WithMaxMessage(c.Limits.MaxMessage),
+		server.WithReadLimit(c.Limits.ReadLimit),
+		server.WithOrigins(c.Origins...),
+	}
+	if len(c.Peers) > 0 {
+		opts = append(opts, server.WithAllowedPeers(c.Peers...))
+	}
+	if c.Tracing.Exporter != "" {
+		opts = append(opts, server.WithTracing(tracing.Config{
+			Exporter: c.Tracing.Exporter,
+			Endpoint: c.Tracing.Endpoint,
+			Insecure: c.Tracing.Insecure,
+		}))
+	}
+	if len(c.Cache.Rules) > 0 {
+		opts = append(opts, server.WithCache(server.NewCache(c.Cache.Size,
+			c.Cache.Rules...)))
+	}
+	if len(c.Coalesce) > 0 {
+		opts = append(opts, server.WithCoalescing(c.Coalesce...))
+	}
+	return opts
+}
+
+// addUpstreams adds the upstreams to the Teonet proxy server. The peer
+// upstreams use the server backend. The upstreams commands are set to metrics
+// because http and tcp upstreams have no API description.
+func addUpstreams(teo *server.TeonetServer, m *metrics.Metrics,
+	upstreams []Upstream) {
+
+	for _, u := range upstreams {
+		if len(u.Commands) > 0 {
+			m.SetCommands(u.Name, u.Commands...)
+		}
+		switch u.Type {
+		case "peer":
+			teo.AddUpstream(u.Name, server.NewPeerUpstream(teo.Backend(), u.Addr))
+		case "http":
+			var client *http.Client
+			if u.Timeout > 0 {
+				client = &http.Client{Timeout: u.Timeout}
+			}
+			teo.AddUpstream(u.Name, server.NewHTTPUpstream(u.Addr, client))
+		case "tcp":
+			teo.AddUpstream(u.Name, server.NewTCPUpstream(u.Addr, u.Timeout))
+		}
+	}
+}
+
+// newHandler returns the http handler of the Teonet proxy server endpoints,
+// metrics and static files.
+func newHandler(c *Config, teo *server.TeonetServer,
+	m *metrics.Metrics) http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(c.WSPath, teo.HandleWebSocket)
+	if c.FallbackPath != "" {
+		path := strings.TrimSuffix(c.FallbackPath, "/")
+		mux.Handle(path+"/", teo.FallbackHandler(path))
+	}
+	if c.RESTPath != "" {
+		path := strings.TrimSuffix(c.RESTPath, "/")
+		mux.Handle(path+"/", teo.RestHandler(path))
+	}
+	if m != nil {
+		mux.Handle(c.MetricsPath, m.Handler())
+	}
+	if c.Static != "" {
+		mux.Handle("/", http.FileServer(http.Dir(c.Static)))
+	}
+	return mux
+}
+
+// newRedirect creates the http server which redirects requests to HTTPS.
+func newRedirect(addr string, handler http.Handler) *http.Server {
+	return &http.Server{Addr: addr, Handler: handler,
+		ReadHeaderTimeout: defaultConfig().Timeouts.ReadHeader}
+}
+
+// redirectTLS returns the handler which redirects requests to the HTTPS
+// server address.
+func redirectTLS(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(),
+			http.StatusMovedPermanently)
+	})
+}
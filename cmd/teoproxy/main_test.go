@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/teonet-go/teoproxy/metrics"
+	"github.com/teonet-go/teoproxy/teonet/server"
+)
+
+func TestHandler(t *testing.T) {
+	static := t.TempDir()
+	if err := os.WriteFile(static+"/index.html", []byte("index"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := defaultConfig()
+	c.Static, c.RESTPath, c.MetricsPath = static, "/api", "/metrics"
+	m := metrics.New()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	teo, err := server.New(c.Name, nil, append(serverOptions(c, logger, m),
+		server.WithBackend(server.NewMemoryBackend()))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { teo.Shutdown(context.Background()) })
+	ts := httptest.NewServer(newHandler(c, teo, m))
+	t.Cleanup(ts.Close)
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		// Test case 1: static files
+		{"/", http.StatusOK, "index"},
+
+		// Test case 2: websocket endpoint requires upgrade
+		{"/ws", http.StatusBadRequest, ""},
+
+		// Test case 3: REST gateway accepts POST requests only
+		{"/api/fortune/fortb", http.StatusMethodNotAllowed, ""},
+
+		// Test case 4: metrics
+		{"/metrics", http.StatusOK, ""},
+	} {
+		resp, err := http.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status ||
+			(tt.body != "" && string(body) != tt.body) {
+			t.Errorf("%s: wrong answer %d: %s", tt.path, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestRedirectTLS(t *testing.T) {
+	for _, tt := range []struct {
+		listen, url, location string
+	}{
+		{":443", "http://example.com/ws?a=1", "https://example.com/ws?a=1"},
+		{":8443", "http://example.com:8080/", "https://example.com:8443/"},
+	} {
+		w := httptest.NewRecorder()
+		redirectTLS(tt.listen).ServeHTTP(w, httptest.NewRequest("GET", tt.url,
+			nil))
+		if w.Code != http.StatusMovedPermanently ||
+			w.Header().Get("Location") != tt.location {
+			t.Errorf("%s: wrong redirect %d %s", tt.url, w.Code,
+				w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package e2e provides end-to-end encryption of api commands data between
+// Teonet proxy clients and Teonet peers, so the proxy server forwards opaque
+// data it can not read.
+//
+// The client and the peer share keys with X25519 key exchange. The client
+// sends its ephemeral public key to the peer with the KeyExchange proxy
+// command, the proxy server forwards it to the peer KeyExchangeCommand api
+// command. The peer answers with its ephemeral public key signed by its
+// long-term ed25519 key, and the client verifies the signature with the peer
+// public key it knows in advance, so the proxy server can not substitute the
+// keys. Both sides derive AES-256-GCM keys for each direction with HKDF.
+//
+// Encrypted data has the format:
+//
+//	<session id 8 bytes><sequence number 8 bytes><ciphertext and tag>
+//
+// The sequence number is counted by the sender from 1 and is the GCM nonce.
+// The api command name is not encrypted because the proxy server routes the
+// command by it, but it is authenticated with the session id and the sequence
+// number, so the proxy server can not send the data to other api command. The
+// receiver rejects sequence numbers it has received or which are older than
+// ReplayWindow, so the data can not be replayed.
+package e2e
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// KeyExchangeCommand is the peer api command which answers key exchange
+// requests.
+const KeyExchangeCommand = "e2e.keyx"
+
+// ReplayWindow is the number of latest sequence numbers the receiver keeps,
+// data with older sequence numbers is rejected.
+const ReplayWindow = 1024
+
+const (
+	idLen     = 8                              // Session id length
+	seqLen    = 8                              // Sequence number length
+	keyLen    = 32                             // X25519 public key length
+	nonceLen  = 12                             // AES-GCM nonce length
+	answerLen = keyLen + ed25519.SignatureSize // Key exchange answer length
+)
+
+var (
+	ErrWrongKey        = errors.New("wrong key exchange data")
+	ErrWrongSignature  = errors.New("wrong peer key signature")
+	ErrSessionNotFound = errors.New("e2e session not found")
+	ErrDecrypt         = errors.New("can't decrypt data")
+	ErrReplay          = errors.New("replayed data")
+)
+
+// Session contains the keys shared by the client and the peer. The client
+// and the peer sessions seal data with different keys, so one side data can
+// not be replayed to it back. It is safe for concurrent use.
+type Session struct {
+	id     []byte        // Session id
+	seal   cipher.AEAD   // Encrypts sent data
+	open   cipher.AEAD   // Decrypts received data
+	seq    atomic.Uint64 // Last sent sequence number
+	window *replayWindow // Received sequence numbers
+}
+
+// ID returns the session id in hex.
+func (s *Session) ID() string { return hex.EncodeToString(s.id) }
+
+// Seal encrypts data of the api command.
+func (s *Session) Seal(apiCmd string, data []byte) []byte {
+	out := make([]byte, idLen+seqLen, idLen+seqLen+len(data)+
+		s.seal.Overhead())
+	copy(out, s.id)
+	binary.BigEndian.PutUint64(out[idLen:], s.seq.Add(1))
+	return s.seal.Seal(out, nonce(out[idLen:]), data,
+		additionalData(out[:idLen+seqLen], apiCmd))
+}
+
+// Open decrypts data of the api command encrypted by the other side of the
+// session. It returns ErrReplay if the data sequence number has been received
+// or is older than ReplayWindow.
+func (s *Session) Open(apiCmd string, data []byte) ([]byte, error) {
+	if len(data) < idLen+seqLen || !bytes.Equal(data[:idLen], s.id) {
+		return nil, ErrDecrypt
+	}
+	out, err := s.open.Open(nil, nonce(data[idLen:idLen+seqLen]),
+		data[idLen+seqLen:], additionalData(data[:idLen+seqLen], apiCmd))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	if !s.window.add(binary.BigEndian.Uint64(data[idLen:])) {
+		return nil, ErrReplay
+	}
+	return out, nil
+}
+
+// nonce returns the GCM nonce of the sequence number.
+func nonce(seq []byte) []byte {
+	return append(make([]byte, nonceLen-seqLen, nonceLen), seq...)
+}
+
+// additionalData returns the GCM additional data of the session id and
+// sequence number header and the api command.
+func additionalData(header []byte, apiCmd string) []byte {
+	return append(append([]byte{}, header...), apiCmd...)
+}
+
+// replayWindow keeps the last ReplayWindow received sequence numbers.
+type replayWindow struct {
+	last   uint64                    // Largest received sequence number
+	bitmap [ReplayWindow / 64]uint64 // Received sequence numbers bits
+	*sync.Mutex
+}
+
+// newReplayWindow creates empty replay window.
+func newReplayWindow() *replayWindow {
+	return &replayWindow{Mutex: &sync.Mutex{}}
+}
+
+// add adds the received sequence number. It returns false if the sequence
+// number has been received or is out of the window.
+func (w *replayWindow) add(seq uint64) bool {
+	w.Lock()
+	defer w.Unlock()
+	switch {
+	case seq == 0 || seq+ReplayWindow <= w.last:
+		return false
+	case seq <= w.last &&
+		w.bitmap[seq/64%uint64(len(w.bitmap))]&(1<<(seq%64)) != 0:
+		return false
+	}
+	if seq > w.last {
+		// Clear bits of skipped sequence numbers in the window
+		n := w.last + 1
+		if seq >= ReplayWindow {
+			n = max(n, seq-ReplayWindow+1)
+		}
+		for ; n < seq; n++ {
+			w.bitmap[n/64%uint64(len(w.bitmap))] &^= 1 << (n % 64)
+		}
+		w.last = seq
+	}
+	w.bitmap[seq/64%uint64(len(w.bitmap))] |= 1 << (seq % 64)
+	return true
+}
+
+// KeyExchange is the client side of key exchange.
+type KeyExchange struct {
+	key     *ecdh.PrivateKey  // Client ephemeral key
+	peerKey ed25519.PublicKey // Peer long-term public key
+}
+
+// NewKeyExchange creates the client side of key exchange with the peer
+// long-term public key. If peerKey is nil the peer answer is not verified and
+// the proxy server may substitute the keys, use it for tests only.
+func NewKeyExchange(peerKey ed25519.PublicKey) (k *KeyExchange, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		err = fmt.Errorf("can't generate key, error: %w", err)
+		return
+	}
+	k = &KeyExchange{key: key, peerKey: peerKey}
+	return
+}
+
+// Request returns the key exchange request data sent to the peer.
+func (k *KeyExchange) Request() []byte { return k.key.PublicKey().Bytes() }
+
+// Session verifies the peer key exchange answer and returns the session.
+func (k *KeyExchange) Session(answer []byte) (s *Session, err error) {
+	if len(answer) != answerLen {
+		err = ErrWrongKey
+		return
+	}
+	request := k.Request()
+	peerPub, sig := answer[:keyLen], answer[keyLen:]
+	if k.peerKey != nil &&
+		!ed25519.Verify(k.peerKey, signed(request, peerPub), sig) {
+		err = ErrWrongSignature
+		return
+	}
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		err = ErrWrongKey
+		return
+	}
+	secret, err := k.key.ECDH(pub)
+	if err != nil {
+		err = ErrWrongKey
+		return
+	}
+	return newSession(secret, request, peerPub, false)
+}
+
+// newSession derives the session keys from the shared secret and the client
+// and peer public keys.
+func newSession(secret, clientPub, peerPub []byte, peer bool) (
+	s *Session, err error) {
+
+	salt := append(append([]byte{}, clientPub...), peerPub...)
+	prk := hmacSum(salt, secret)
+	c2p, err := newAEAD(expand(prk, "teoproxy e2e client to peer"))
+	if err != nil {
+		return
+	}
+	p2c, err := newAEAD(expand(prk, "teoproxy e2e peer to client"))
+	if err != nil {
+		return
+	}
+	id := sha256.Sum256(salt)
+	s = &Session{id: id[:idLen], seal: c2p, open: p2c,
+		window: newReplayWindow()}
+	if peer {
+		s.seal, s.open = p2c, c2p
+	}
+	return
+}
+
+// hmacSum returns HMAC-SHA256 of data with key, it is the HKDF extract step
+// with key as salt.
+func hmacSum(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// expand returns the first 32 bytes block of HKDF-SHA256 expand step.
+func expand(prk []byte, info string) []byte {
+	return hmacSum(prk, append([]byte(info), 1))
+}
+
+// newAEAD creates AES-256-GCM cipher with the key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// signed returns the data signed by the peer in the key exchange answer.
+func signed(clientPub, peerPub []byte) []byte {
+	data := []byte("teoproxy e2e key exchange")
+	data = append(data, clientPub...)
+	return append(data, peerPub...)
+}
@@ -0,0 +1,142 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+func TestE2E(t *testing.T) {
+	peerPub, peerKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("can't generate peer key: %v", err)
+	}
+	peer := NewPeer(peerKey, 2)
+
+	// Test case 1: key exchange and data encryption in both directions
+	k, err := NewKeyExchange(peerPub)
+	if err != nil {
+		t.Fatalf("can't create key exchange: %v", err)
+	}
+	answer, err := peer.KeyExchange(k.Request())
+	if err != nil {
+		t.Fatalf("peer key exchange error: %v", err)
+	}
+	s, err := k.Session(answer)
+	if err != nil {
+		t.Fatalf("can't create session: %v", err)
+	}
+	request := s.Seal("secret", []byte("secret request"))
+	if bytes.Contains(request, []byte("secret")) {
+		t.Errorf("request is not encrypted")
+	}
+	data, ps, err := peer.Open("secret", request)
+	if err != nil || string(data) != "secret request" {
+		t.Fatalf("peer can't open request: %v", err)
+	}
+	if ps.ID() != s.ID() {
+		t.Errorf("expected session id %s, got: %s", s.ID(), ps.ID())
+	}
+	data, err = s.Open("secret", ps.Seal("secret", []byte("secret answer")))
+	if err != nil || string(data) != "secret answer" {
+		t.Errorf("client can't open answer: %v", err)
+	}
+
+	// Test case 2: data can not be replayed to its sender
+	if _, err = s.Open("secret", request); err != ErrDecrypt {
+		t.Errorf("expected ErrDecrypt, got: %v", err)
+	}
+
+	// Test case 3: modified data
+	request = s.Seal("secret", []byte("secret request"))
+	request[len(request)-1] ^= 1
+	if _, _, err = peer.Open("secret", request); err != ErrDecrypt {
+		t.Errorf("expected ErrDecrypt, got: %v", err)
+	}
+
+	// Test case 4: data sent to other api command is rejected
+	request = s.Seal("read", []byte("secret request"))
+	if _, _, err = peer.Open("delete", request); err != ErrDecrypt {
+		t.Errorf("expected ErrDecrypt, got: %v", err)
+	}
+	if _, _, err = peer.Open("read", request); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Test case 5: replayed data and answers are rejected
+	if _, _, err = peer.Open("read", request); err != ErrReplay {
+		t.Errorf("expected ErrReplay, got: %v", err)
+	}
+	answer = ps.Seal("read", []byte("secret answer"))
+	if _, err = s.Open("read", answer); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err = s.Open("read", answer); err != ErrReplay {
+		t.Errorf("expected ErrReplay, got: %v", err)
+	}
+
+	// Test case 6: answer signed by other key is rejected
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	k, _ = NewKeyExchange(otherPub)
+	answer, _ = peer.KeyExchange(k.Request())
+	if _, err = k.Session(answer); err != ErrWrongSignature {
+		t.Errorf("expected ErrWrongSignature, got: %v", err)
+	}
+
+	// Test case 7: the oldest session is removed
+	k, _ = NewKeyExchange(peerPub)
+	answer, _ = peer.KeyExchange(k.Request())
+	if peer.Len() != 2 {
+		t.Errorf("expected 2 sessions, got: %d", peer.Len())
+	}
+	if _, _, err = peer.Open("secret", s.Seal("secret", nil)); !errors.Is(err,
+		ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	// Test case 8: wrong key exchange data
+	if _, err = peer.KeyExchange([]byte("short")); err != ErrWrongKey {
+		t.Errorf("expected ErrWrongKey, got: %v", err)
+	}
+	if _, err = k.Session(answer[1:]); err != ErrWrongKey {
+		t.Errorf("expected ErrWrongKey, got: %v", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	w := newReplayWindow()
+
+	// Test case 1: sequence numbers are accepted once in any order
+	for _, seq := range []uint64{1, 3, 2, 10, 5} {
+		if !w.add(seq) {
+			t.Errorf("sequence number %d is rejected", seq)
+		}
+	}
+	for _, seq := range []uint64{0, 1, 3, 10} {
+		if w.add(seq) {
+			t.Errorf("sequence number %d is accepted again", seq)
+		}
+	}
+
+	// Test case 2: sequence numbers out of the window are rejected, skipped
+	// sequence numbers in the window are accepted
+	if !w.add(10 + ReplayWindow) {
+		t.Errorf("sequence number %d is rejected", 10+ReplayWindow)
+	}
+	for _, seq := range []uint64{4, 10} {
+		if w.add(seq) {
+			t.Errorf("old sequence number %d is accepted", seq)
+		}
+	}
+	for _, seq := range []uint64{11, 9 + ReplayWindow} {
+		if !w.add(seq) {
+			t.Errorf("sequence number %d is rejected", seq)
+		}
+	}
+
+	// Test case 3: bits of skipped sequence numbers are cleared
+	if !w.add(20+3*ReplayWindow) || !w.add(15+3*ReplayWindow) {
+		t.Errorf("skipped sequence number is rejected")
+	}
+}
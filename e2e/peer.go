@@ -0,0 +1,133 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Peer side e2e module.
+
+package e2e
+
+import (
+	"container/list"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+// DefaultMaxSessions is the default number of sessions kept by the Peer.
+const DefaultMaxSessions = 10000
+
+// Peer is the Teonet peer side of e2e encryption. It answers key exchange
+// requests and keeps the clients sessions by session id. The oldest sessions
+// are removed when there are more than maxSessions, so clients repeat key
+// exchange when the peer answers with ErrSessionNotFound. It is safe for
+// concurrent use.
+//
+// Use it in the peer api commands:
+//
+//	peer := e2e.NewPeer(signKey, e2e.DefaultMaxSessions)
+//
+//	// KeyExchangeCommand api command handler
+//	answer, err := peer.KeyExchange(data)
+//
+//	// Encrypted api command handler
+//	request, s, err := peer.Open(apiCmd, data)
+//	...
+//	answer := s.Seal(apiCmd, reply)
+type Peer struct {
+	signKey     ed25519.PrivateKey       // Peer long-term key
+	maxSessions int                      // Maximum number of sessions
+	m           map[string]*list.Element // Sessions by id
+	order       *list.List               // Sessions from oldest to newest
+	*sync.Mutex
+}
+
+// NewPeer creates the peer side of e2e encryption with the peer long-term
+// ed25519 key. Clients verify key exchange answers with its public key.
+func NewPeer(signKey ed25519.PrivateKey, maxSessions int) *Peer {
+	return &Peer{
+		signKey:     signKey,
+		maxSessions: maxSessions,
+		m:           make(map[string]*list.Element),
+		order:       list.New(),
+		Mutex:       &sync.Mutex{},
+	}
+}
+
+// KeyExchange answers the client key exchange request and creates the client
+// session.
+func (p *Peer) KeyExchange(request []byte) (answer []byte, err error) {
+	clientPub, err := ecdh.X25519().NewPublicKey(request)
+	if err != nil {
+		err = ErrWrongKey
+		return
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		err = fmt.Errorf("can't generate key, error: %w", err)
+		return
+	}
+	secret, err := key.ECDH(clientPub)
+	if err != nil {
+		err = ErrWrongKey
+		return
+	}
+	peerPub := key.PublicKey().Bytes()
+	s, err := newSession(secret, request, peerPub, true)
+	if err != nil {
+		return
+	}
+	p.add(s)
+
+	answer = append(peerPub, ed25519.Sign(p.signKey, signed(request, peerPub))...)
+	return
+}
+
+// Open decrypts the client data of the api command and returns it with the
+// client session. Use the session to encrypt the answer. Data sent to other
+// api command or replayed is rejected.
+func (p *Peer) Open(apiCmd string, data []byte) (out []byte, s *Session,
+	err error) {
+
+	if len(data) < idLen {
+		err = ErrDecrypt
+		return
+	}
+	p.Lock()
+	e, ok := p.m[string(data[:idLen])]
+	if ok {
+		p.order.MoveToBack(e)
+		s = e.Value.(*Session)
+	}
+	p.Unlock()
+	if !ok {
+		err = ErrSessionNotFound
+		return
+	}
+	out, err = s.Open(apiCmd, data)
+	return
+}
+
+// Len returns the number of sessions.
+func (p *Peer) Len() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.m)
+}
+
+// add adds the session and removes the oldest sessions if there are more
+// than maxSessions.
+func (p *Peer) add(s *Session) {
+	p.Lock()
+	defer p.Unlock()
+	if e, ok := p.m[string(s.id)]; ok {
+		p.order.Remove(e)
+	}
+	p.m[string(s.id)] = p.order.PushBack(s)
+	for p.maxSessions > 0 && len(p.m) > p.maxSessions {
+		e := p.order.Front()
+		p.order.Remove(e)
+		delete(p.m, string(e.Value.(*Session).id))
+	}
+}
@@ -0,0 +1,174 @@
+package js
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+var update = flag.Bool("update", false, "update testdata/fixtures.json")
+
+const fixturesFile = "testdata/fixtures.json"
+
+// packetFixture is the valid command packet and its fields.
+type packetFixture struct {
+	Name        string  `json:"name"`
+	Id          uint32  `json:"id"`
+	Cmd         byte    `json:"cmd"`
+	Data        []byte  `json:"data"`
+	Err         *string `json:"err"`
+	TraceParent string  `json:"traceParent"`
+	Fragment    uint16  `json:"fragment"`
+	Fragments   uint16  `json:"fragments"`
+	Codec       byte    `json:"codec"`
+	Accept      byte    `json:"accept"`
+	NoCache     bool    `json:"noCache"`
+	Packet      []byte  `json:"packet"`
+}
+
+// errorFixture is the wrong packet and its unmarshal error.
+type errorFixture struct {
+	Name   string `json:"name"`
+	Packet []byte `json:"packet"`
+	Error  string `json:"error"`
+}
+
+// fixtures contains the wire compatibility fixtures.
+type fixtures struct {
+	Packets []packetFixture `json:"packets"`
+	Errors  []errorFixture  `json:"errors"`
+}
+
+// newFixtures creates fixtures from command.TeonetCmd packets.
+func newFixtures(t *testing.T) (f fixtures) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	// addPacket marshals command and adds packet fixture
+	addPacket := func(name string, cmd *command.TeonetCmd) {
+		packet, err := cmd.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: can't marshal command: %v", name, err)
+		}
+		p := packetFixture{Name: name, Id: cmd.Id, Cmd: byte(cmd.Cmd),
+			Data: cmd.Data, TraceParent: cmd.TraceParent, Fragment: cmd.Fragment,
+			Fragments: cmd.Fragments, Codec: byte(cmd.Codec),
+			Accept: byte(cmd.Accept), NoCache: cmd.NoCache, Packet: packet}
+		if cmd.Err != nil {
+			e := cmd.Err.Error()
+			p.Err, p.Data = &e, nil
+		}
+		if p.Data == nil {
+			p.Data = []byte{}
+		}
+		f.Packets = append(f.Packets, p)
+	}
+
+	// addError adds wrong packet fixture with its unmarshal error
+	addError := func(name string, packet []byte, checksum bool) {
+		if checksum {
+			var sum byte
+			for _, b := range packet {
+				sum += b
+			}
+			packet = append(packet, sum)
+		}
+		err := command.NewEmpty().UnmarshalBinary(packet)
+		if err == nil {
+			t.Fatalf("%s: expected unmarshal error", name)
+		}
+		f.Errors = append(f.Errors, errorFixture{name, packet, err.Error()})
+	}
+
+	// Every known command
+	for c := command.Command(1); c.String() != "Unknown"; c++ {
+		addPacket("command "+c.String(), &command.TeonetCmd{Id: uint32(c),
+			Cmd: c, Data: []byte("data")})
+	}
+
+	// Packet fields
+	addPacket("empty data", &command.TeonetCmd{Cmd: command.Connect})
+	addPacket("max id", &command.TeonetCmd{Id: 0xFFFFFFFF,
+		Cmd: command.ConnectTo, Data: []byte("peer")})
+	addPacket("binary data", &command.TeonetCmd{Id: 7, Cmd: command.ApiSendTo,
+		Data: []byte{0, 1, 0x80, 0xFF, '\n'}})
+	addPacket("error", &command.TeonetCmd{Id: 8, Cmd: command.ApiSendTo,
+		Err: errString("timeout")})
+	addPacket("trace", &command.TeonetCmd{Id: 9, Cmd: command.ApiSendTo,
+		Data: []byte("peer,cmd,data"), TraceParent: traceParent})
+	addPacket("trace and error", &command.TeonetCmd{Id: 10,
+		Cmd: command.ApiSendTo, Err: errString("timeout"),
+		TraceParent: traceParent})
+	addPacket("fragment", &command.TeonetCmd{Id: 11, Cmd: command.ApiSendTo,
+		Data: []byte("data"), Fragment: 1, Fragments: 0x102})
+	addPacket("trace and fragment", &command.TeonetCmd{Id: 12,
+		Cmd: command.ApiSendTo, Data: []byte("data"), TraceParent: traceParent,
+		Fragments: 2})
+	addPacket("accept", &command.TeonetCmd{Id: 13, Cmd: command.Connect,
+		Accept: command.SupportedCodecs})
+	compressed := &command.TeonetCmd{Id: 14, Cmd: command.ApiSendTo,
+		Data: bytes.Repeat([]byte("data"), 16), Accept: command.SupportedCodecs}
+	compressed.Compress(command.SupportedCodecs, 1)
+	addPacket("compressed", compressed)
+	addPacket("no cache", &command.TeonetCmd{Id: 15, Cmd: command.ApiSendTo,
+		Data: []byte("peer,cmd,data"), NoCache: true})
+
+	// Wrong packets
+	addError("short packet", []byte{1}, false)
+	addError("wrong checksum", []byte{0, 0, 0, 0, 1, 2, 4}, false)
+	addError("unknown command", []byte{0, 0, 0, 0, 0x3F, 2}, true)
+	addError("zero command", []byte{0, 0, 0, 0, 0, 2}, true)
+	addError("wrong header flags", []byte{0, 0, 0, 0, 0x41, 0x80}, true)
+	addError("empty header", []byte{0, 0, 0, 0, 0x41}, true)
+	addError("short trace", []byte{0, 0, 0, 0, 0x41, 1, 10, 'a'}, true)
+	addError("short fragment", []byte{0, 0, 0, 0, 0x45, 2, 0, 0, 1}, true)
+	addError("short codec", []byte{0, 0, 0, 0, 0x45, 4}, true)
+	addError("wrong fragment index", []byte{0, 0, 0, 0, 0x45, 2, 2, 0, 2, 0},
+		true)
+
+	return
+}
+
+// errString is the error with text.
+type errString string
+
+func (e errString) Error() string { return string(e) }
+
+func TestFixtures(t *testing.T) {
+	data, err := json.MarshalIndent(newFixtures(t), "", "  ")
+	if err != nil {
+		t.Fatalf("can't marshal fixtures: %v", err)
+	}
+	data = append(data, '\n')
+
+	if *update {
+		if err = os.WriteFile(fixturesFile, data, 0644); err != nil {
+			t.Fatalf("can't write fixtures: %v", err)
+		}
+		return
+	}
+	golden, err := os.ReadFile(fixturesFile)
+	if err != nil {
+		t.Fatalf("can't read fixtures: %v", err)
+	}
+	if !bytes.Equal(golden, data) {
+		t.Errorf("%s is outdated, regenerate it with: go test ./js -update",
+			fixturesFile)
+	}
+}
+
+func TestJavaScript(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	out, err := exec.Command(node, "test/compat.mjs", fixturesFile).
+		CombinedOutput()
+	if err != nil {
+		t.Errorf("javascript test failed: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package js contains the Teonet proxy JavaScript client library and its
+// wire compatibility test harness.
+//
+// The teoproxy.js module implements the ws/command binary protocol, the
+// packet Id multiplexer, reconnect, api calls and push subscriptions for
+// browsers and Node.js without the Go wasm bundle. The Go tests generate
+// testdata/fixtures.json from command.TeonetCmd packets and run the
+// JavaScript test against them with Node.js, so the library stays in sync
+// with ws/command. Regenerate fixtures after protocol changes with:
+//
+//	go test ./js -update
+package js
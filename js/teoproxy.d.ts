@@ -0,0 +1,200 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy JavaScript client type definitions.
+
+export declare const Command: Readonly<{
+  Connect: 1;
+  Disconnect: 2;
+  ConnectTo: 3;
+  NewApiClient: 4;
+  ApiSendTo: 5;
+  StreamStart: 6;
+  StreamChunk: 7;
+  StreamEnd: 8;
+  StreamCredit: 9;
+  KeyExchange: 10;
+  Batch: 11;
+  Cancel: 12;
+  Ping: 13;
+  Pong: 14;
+  Peers: 15;
+  Resolve: 16;
+  DescribeAPI: 17;
+}>;
+
+export declare const Flags: Readonly<{
+  Trace: 1;
+  Fragment: 2;
+  Compress: 4;
+  Accept: 8;
+  NoCache: 16;
+}>;
+
+export declare const Codec: Readonly<{ Deflate: 1 }>;
+export declare const SupportedCodecs: number;
+export declare const DefaultCompressThreshold: number;
+
+export declare const DefaultFragmentSize: number;
+export declare const DefaultMaxMessage: number;
+
+export declare const ErrNotEnoughData: string;
+export declare const ErrWrongChecksum: string;
+export declare const ErrUnknownCommand: string;
+export declare const ErrWrongHeader: string;
+export declare const ErrFieldTooBig: string;
+export declare const ErrTooManyFragments: string;
+export declare const ErrWrongFragment: string;
+export declare const ErrMessageTooBig: string;
+export declare const ErrWrongPing: string;
+export declare const ErrUnknownCodec: string;
+export declare const ErrDecompress: string;
+
+/** Data sent in commands, strings are UTF-8 encoded. */
+export type Data = string | Uint8Array;
+
+/** Command packet of the Teonet proxy protocol. */
+export interface TeonetCmd {
+  id: number;
+  cmd: number;
+  data: Uint8Array;
+  err?: string;
+  traceParent: string;
+  fragment: number;
+  fragments: number;
+  codec: number;
+  accept: number;
+  noCache: boolean;
+}
+
+/** Command to marshal, fields default to zero values. */
+export interface TeonetCmdInit {
+  id?: number;
+  cmd: number;
+  data?: Data;
+  err?: string;
+  traceParent?: string;
+  fragment?: number;
+  fragments?: number;
+  codec?: number;
+  accept?: number;
+  noCache?: boolean;
+}
+
+export declare class ProtocolError extends Error {}
+
+export declare class CommandError extends Error {
+  cmd: TeonetCmd;
+}
+
+export declare function checksum(data: Uint8Array): number;
+export declare function commandName(cmd: number): string;
+export declare function marshal(cmd: TeonetCmdInit): Uint8Array;
+export declare function unmarshal(packet: Uint8Array): TeonetCmd;
+export declare function encode(cmd: TeonetCmdInit): string;
+export declare function decode(message: string): TeonetCmd;
+export declare function compress<T extends TeonetCmdInit>(cmd: T,
+  accept: number, threshold: number): Promise<T>;
+export declare function decompress(cmd: TeonetCmd,
+  limit?: number): Promise<TeonetCmd>;
+export declare function split(cmd: TeonetCmdInit, size: number): TeonetCmdInit[];
+
+export declare class Reassembler {
+  constructor(maxSize?: number);
+  add(cmd: TeonetCmd): TeonetCmd | undefined;
+}
+
+export interface ClientOptions {
+  /** Call answer timeout in ms, default 5000. */
+  timeout?: number;
+  /** Delay before reconnect in ms, default 1000. */
+  reconnectDelay?: number;
+  /** Called after the client reconnected. */
+  onReconnected?: () => void;
+  /** Maximum data size of sent packets, default 64 KB, 0 disables. */
+  fragmentSize?: number;
+  /** Maximum size of buffered and decompressed answers, default 16 MB. */
+  maxMessage?: number;
+  /** Minimum size of compressed commands data, default 1 KB, 0 disables. */
+  compressThreshold?: number;
+  /** WebSocket implementation, default globalThis.WebSocket. */
+  WebSocket?: typeof WebSocket;
+}
+
+export interface CallOptions {
+  /** Answer timeout in ms. */
+  timeout?: number;
+  /** W3C trace context traceparent. */
+  traceParent?: string;
+  /** Bypass the proxy server answers cache. */
+  noCache?: boolean;
+  /** Cancel the call on the proxy server when aborted. */
+  signal?: AbortSignal;
+}
+
+export interface PeerInfo {
+  /** Peer name used in commands. */
+  name: string;
+  /** Peer address if the name is an alias. */
+  address?: string;
+}
+
+export interface APICommand {
+  name: string;
+  short?: string;
+  long?: string;
+  /** Parameters. */
+  usage?: string;
+  /** Return type. */
+  return?: string;
+}
+
+export interface APIDescription {
+  name: string;
+  short?: string;
+  long?: string;
+  commands: APICommand[];
+}
+
+export interface Pong {
+  /** Round-trip time to the proxy server in ms. */
+  rtt: number;
+  /** Round-trip time from the proxy server to the peer in ms. */
+  peerRtt: number;
+  /** Proxy server time of the answer. */
+  serverTime: Date;
+}
+
+export interface Health {
+  /** The last ping is answered. */
+  healthy: boolean;
+  /** Last answered ping round-trip time in ms. */
+  latency: number;
+  /** Last answered ping proxy server to peer round-trip time in ms. */
+  peerRtt: number;
+  /** The last ping error. */
+  err?: Error;
+  /** Number of failed pings in a row. */
+  failures: number;
+}
+
+export declare class Client {
+  /** Last answered ping round-trip time in ms. */
+  latency: number;
+  constructor(url: string, options?: ClientOptions);
+  connect(): Promise<Uint8Array>;
+  close(): void;
+  call(cmd: number, data?: Data, options?: CallOptions): Promise<Uint8Array>;
+  connectTo(peer: string): Promise<Uint8Array>;
+  newApiClient(peer: string): Promise<Uint8Array>;
+  apiCall(peer: string, command: string, data?: Data,
+    options?: CallOptions): Promise<Uint8Array>;
+  peers(): Promise<PeerInfo[]>;
+  resolve(name: string): Promise<string>;
+  describeApi(peer: string): Promise<APIDescription>;
+  ping(peer?: string, options?: CallOptions): Promise<Pong>;
+  monitorHealth(interval: number, report: (health: Health) => void,
+    peer?: string): () => void;
+  subscribe(listener: (cmd: TeonetCmd) => void): () => void;
+}
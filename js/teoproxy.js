@@ -0,0 +1,664 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy JavaScript client.
+//
+// The module implements the Teonet proxy binary protocol of the Go
+// ws/command package and the websocket client with packet Id multiplexer,
+// reconnect, api calls and push subscriptions. It has no dependencies and
+// works in browsers and in Node.js with a WebSocket implementation.
+
+// Commands. Keep in sync with ws/command/command.go.
+export const Command = Object.freeze({
+  Connect: 1, // Connect to Teonet
+  Disconnect: 2, // Disconnect from Teonet
+  ConnectTo: 3, // Connect to peer
+  NewApiClient: 4, // New API Client
+  ApiSendTo: 5, // Send API Command to peer
+  StreamStart: 6, // Start API Command stream
+  StreamChunk: 7, // API Command stream data chunk
+  StreamEnd: 8, // End of API Command stream
+  StreamCredit: 9, // API Command stream flow control credits
+  KeyExchange: 10, // E2E encryption key exchange with peer
+  Batch: 11, // Batch of API Commands
+  Cancel: 12, // Cancel request with the packet id
+  Ping: 13, // Ping proxy server and optionally peer
+  Pong: 14, // Answer to Ping
+  Peers: 15, // List peers
+  Resolve: 16, // Resolve peer alias to address
+  DescribeAPI: 17, // Get peer API description
+});
+
+// Number of commands, the first unknown command number.
+const cmdCount = 18;
+
+// Command byte bits. Keep in sync with ws/command/header.go.
+const cmdErrBit = 0x80; // The data contains error message
+const cmdExtBit = 0x40; // The packet contains header extension
+const cmdMask = 0x3f; // Command number mask
+
+// Header extension flags.
+export const Flags = Object.freeze({
+  Trace: 1, // W3C trace context traceparent field
+  Fragment: 2, // Fragment index and number of fragments
+  Compress: 4, // Codec of compressed data
+  Accept: 8, // Codecs accepted in answers
+  NoCache: 16, // Answer must not be taken from cache
+});
+const flagsAll = 32; // All known flags mask (next flag bit)
+
+// Fragmentation defaults. Keep in sync with ws/command/fragment.go.
+export const DefaultFragmentSize = 64 << 10; // Maximum fragment data size
+export const DefaultMaxMessage = 16 << 20; // Maximum reassembled data size
+
+// Compression codecs. Keep in sync with ws/command/compress.go.
+export const Codec = Object.freeze({
+  Deflate: 1, // Raw deflate, RFC 1951
+});
+export const DefaultCompressThreshold = 1 << 10; // Minimum compressed data size
+
+// Mask of codecs supported by the runtime, zero if it has no compression
+// streams.
+export const SupportedCodecs =
+  typeof CompressionStream !== "undefined" &&
+  typeof DecompressionStream !== "undefined" ? 1 << (Codec.Deflate - 1) : 0;
+
+// Protocol errors, the messages are the same as the Go errors messages.
+export const ErrNotEnoughData = "not enough data";
+export const ErrWrongChecksum = "wrong checksum";
+export const ErrUnknownCommand = "unknown command";
+export const ErrWrongHeader = "wrong header extension";
+export const ErrFieldTooBig = "header extension field too big";
+export const ErrTooManyFragments = "too many fragments";
+export const ErrUnknownCodec = "unknown codec";
+export const ErrDecompress = "can't decompress data";
+export const ErrWrongFragment = "wrong fragment";
+export const ErrMessageTooBig = "message too big";
+export const ErrWrongPing = "wrong ping data";
+
+// ProtocolError is thrown when a packet can not be marshalled or
+// unmarshalled.
+export class ProtocolError extends Error {
+  constructor(message) {
+    super(message);
+    this.name = "ProtocolError";
+  }
+}
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+// bytes converts string or Uint8Array to Uint8Array.
+function bytes(data) {
+  if (data === undefined || data === null) return new Uint8Array(0);
+  if (typeof data === "string") return encoder.encode(data);
+  return data;
+}
+
+// checksum calculates additive byte checksum of data.
+export function checksum(data) {
+  let sum = 0;
+  for (const b of data) sum = (sum + b) & 0xff;
+  return sum;
+}
+
+// commandName returns the command name.
+export function commandName(cmd) {
+  return (
+    Object.keys(Command).find((k) => Command[k] === (cmd & cmdMask)) ||
+    "Unknown"
+  );
+}
+
+// marshal converts command object
+// {id, cmd, data, err, traceParent, fragment, fragments, codec, accept,
+// noCache} to the binary packet.
+export function marshal({
+  id = 0, cmd, data, err, traceParent = "", fragment = 0, fragments = 0,
+  codec = 0, accept = 0, noCache = false,
+}) {
+  const trace = encoder.encode(traceParent);
+  if (trace.length > 0xff) throw new ProtocolError(ErrFieldTooBig);
+  const body = err !== undefined && err !== null ? bytes(err) : bytes(data);
+
+  let cmdByte = cmd;
+  let flags = 0;
+  const header = [];
+  if (trace.length > 0) {
+    flags |= Flags.Trace;
+    header.push(trace.length, ...trace);
+  }
+  if (fragments > 0) {
+    flags |= Flags.Fragment;
+    header.push(fragment & 0xff, fragment >> 8, fragments & 0xff, fragments >> 8);
+  }
+  if (codec !== 0) {
+    flags |= Flags.Compress;
+    header.push(codec);
+  }
+  if (accept !== 0) {
+    flags |= Flags.Accept;
+    header.push(accept);
+  }
+  if (noCache) flags |= Flags.NoCache;
+  if (flags !== 0) {
+    cmdByte |= cmdExtBit;
+    header.unshift(flags);
+  }
+  if (err !== undefined && err !== null) cmdByte |= cmdErrBit;
+
+  const packet = new Uint8Array(4 + 1 + header.length + body.length + 1);
+  new DataView(packet.buffer).setUint32(0, id >>> 0, true);
+  packet[4] = cmdByte;
+  packet.set(header, 5);
+  packet.set(body, 5 + header.length);
+  packet[packet.length - 1] = checksum(packet.subarray(0, packet.length - 1));
+  return packet;
+}
+
+// unmarshal converts the binary packet to command object
+// {id, cmd, data, err, traceParent, fragment, fragments, codec, accept,
+// noCache}. The err is undefined if the packet does not contain error message.
+export function unmarshal(packet) {
+  if (packet.length < 6) throw new ProtocolError(ErrNotEnoughData);
+  const end = packet.length - 1;
+  if (checksum(packet.subarray(0, end)) !== packet[end]) {
+    throw new ProtocolError(ErrWrongChecksum);
+  }
+
+  const cmdByte = packet[4];
+  const cmd = cmdByte & cmdMask;
+  if (!(cmd > 0 && cmd < cmdCount)) {
+    throw new ProtocolError(ErrUnknownCommand);
+  }
+  const id = new DataView(packet.buffer, packet.byteOffset).getUint32(0, true);
+
+  // Get header extension
+  let idx = 5;
+  let traceParent = "";
+  let fragment = 0;
+  let fragments = 0;
+  let codec = 0;
+  let accept = 0;
+  let noCache = false;
+  if (cmdByte & cmdExtBit) {
+    if (idx >= end) throw new ProtocolError(ErrNotEnoughData);
+    const flags = packet[idx];
+    if (flags === 0 || flags & ~(flagsAll - 1)) {
+      throw new ProtocolError(ErrWrongHeader);
+    }
+    idx++;
+    if (flags & Flags.Trace) {
+      if (idx + 1 > end || idx + 1 + packet[idx] > end) {
+        throw new ProtocolError(ErrNotEnoughData);
+      }
+      const l = packet[idx];
+      traceParent = decoder.decode(packet.subarray(idx + 1, idx + 1 + l));
+      idx += 1 + l;
+    }
+    if (flags & Flags.Fragment) {
+      if (idx + 4 > end) throw new ProtocolError(ErrNotEnoughData);
+      fragment = packet[idx] | (packet[idx + 1] << 8);
+      fragments = packet[idx + 2] | (packet[idx + 3] << 8);
+      if (fragment >= fragments) throw new ProtocolError(ErrWrongHeader);
+      idx += 4;
+    }
+    if (flags & Flags.Compress) {
+      if (idx + 1 > end) throw new ProtocolError(ErrNotEnoughData);
+      codec = packet[idx++];
+    }
+    if (flags & Flags.Accept) {
+      if (idx + 1 > end) throw new ProtocolError(ErrNotEnoughData);
+      accept = packet[idx++];
+    }
+    noCache = (flags & Flags.NoCache) !== 0;
+  }
+
+  const body = packet.slice(idx, end);
+  if (cmdByte & cmdErrBit) {
+    return { id, cmd, data: new Uint8Array(0), err: decoder.decode(body),
+      traceParent, fragment, fragments, codec, accept, noCache };
+  }
+  return { id, cmd, data: body, err: undefined, traceParent, fragment, fragments,
+    codec, accept, noCache };
+}
+
+// pipe passes data through the compression stream and returns its output. It
+// throws ProtocolError if the output is larger than limit.
+async function pipe(stream, data, limit = Infinity) {
+  const writer = stream.writable.getWriter();
+  writer.write(data).catch(() => {});
+  writer.close().catch(() => {});
+  const reader = stream.readable.getReader();
+  const chunks = [];
+  let size = 0;
+  for (;;) {
+    let result;
+    try {
+      result = await reader.read();
+    } catch (e) {
+      throw new ProtocolError(ErrDecompress + ": " + e.message);
+    }
+    if (result.done) break;
+    size += result.value.length;
+    if (size > limit) {
+      reader.cancel().catch(() => {});
+      throw new ProtocolError(ErrDecompress + ": " + ErrMessageTooBig);
+    }
+    chunks.push(result.value);
+  }
+  const out = new Uint8Array(size);
+  let offset = 0;
+  for (const chunk of chunks) {
+    out.set(chunk, offset);
+    offset += chunk.length;
+  }
+  return out;
+}
+
+// compress returns the command with data compressed by a codec from accepted
+// codecs if the data is not smaller than threshold. The command is returned
+// as is if there is no supported codec in accept, threshold is zero or the
+// compressed data is not smaller than the original.
+export async function compress(cmd, accept, threshold) {
+  const data = bytes(cmd.data);
+  if (cmd.codec || (cmd.err !== undefined && cmd.err !== null) || !(threshold > 0) ||
+      data.length < threshold || !(accept & SupportedCodecs)) {
+    return cmd;
+  }
+  const compressed = await pipe(new CompressionStream("deflate-raw"), data);
+  if (compressed.length >= data.length) return cmd;
+  return { ...cmd, data: compressed, codec: Codec.Deflate };
+}
+
+// decompress returns the command with decompressed data. The limit is the
+// maximum size of decompressed data.
+export async function decompress(cmd, limit = DefaultMaxMessage) {
+  if (!cmd.codec) return cmd;
+  if (cmd.codec !== Codec.Deflate || !SupportedCodecs) {
+    throw new ProtocolError(ErrUnknownCodec + ": " + cmd.codec);
+  }
+  const data = await pipe(new DecompressionStream("deflate-raw"), cmd.data, limit);
+  return { ...cmd, data, codec: 0 };
+}
+
+// split splits the command object to fragments with data not larger than
+// size. It returns the command itself if its data is not larger than size or
+// size is zero.
+export function split(cmd, size) {
+  const data = bytes(cmd.data);
+  if (!(size > 0) || data.length <= size || (cmd.err !== undefined && cmd.err !== null)) {
+    return [cmd];
+  }
+  const fragments = Math.ceil(data.length / size);
+  if (fragments > 0xffff) throw new ProtocolError(ErrTooManyFragments);
+  const cmds = [];
+  for (let i = 0; i < fragments; i++) {
+    cmds.push({ ...cmd, data: data.subarray(i * size, (i + 1) * size),
+      fragment: i, fragments });
+  }
+  return cmds;
+}
+
+// Reassembler collects fragments of commands by packet id. The total size of
+// buffered data is limited by maxSize.
+export class Reassembler {
+  constructor(maxSize = DefaultMaxMessage) {
+    this.maxSize = maxSize;
+    this.buffers = new Map(); // Reassembly buffers by packet id
+    this.size = 0; // Size of buffered data
+  }
+
+  // add adds the command fragment. It returns the whole command when all
+  // fragments are received and undefined while the command is incomplete.
+  // Not fragmented commands are returned as is. On error the command
+  // reassembly buffer is dropped and ProtocolError is thrown.
+  add(cmd) {
+    if (!cmd.fragments) return cmd;
+    let b = this.buffers.get(cmd.id);
+    if (!b) {
+      b = { cmd: cmd.cmd, data: new Array(cmd.fragments), received: 0, size: 0 };
+      this.buffers.set(cmd.id, b);
+    }
+    if (b.cmd !== cmd.cmd || b.data.length !== cmd.fragments ||
+        b.data[cmd.fragment] !== undefined) {
+      this.drop(cmd.id, b);
+      throw new ProtocolError(ErrWrongFragment);
+    }
+    if (this.size + cmd.data.length > this.maxSize) {
+      this.drop(cmd.id, b);
+      throw new ProtocolError(ErrMessageTooBig);
+    }
+    b.data[cmd.fragment] = cmd.data;
+    b.received++;
+    b.size += cmd.data.length;
+    this.size += cmd.data.length;
+    if (b.received < b.data.length) return undefined;
+
+    const data = new Uint8Array(b.size);
+    let offset = 0;
+    for (const d of b.data) {
+      data.set(d, offset);
+      offset += d.length;
+    }
+    this.drop(cmd.id, b);
+    return { ...cmd, data, fragment: 0, fragments: 0 };
+  }
+
+  // drop removes the reassembly buffer.
+  drop(id, b) {
+    this.size -= b.size;
+    this.buffers.delete(id);
+  }
+}
+
+// encode marshals command to base64 websocket message.
+export function encode(cmd) {
+  let s = "";
+  for (const b of marshal(cmd)) s += String.fromCharCode(b);
+  return btoa(s);
+}
+
+// decode unmarshals command from base64 websocket message.
+export function decode(message) {
+  const s = atob(message);
+  const packet = new Uint8Array(s.length);
+  for (let i = 0; i < s.length; i++) packet[i] = s.charCodeAt(i);
+  return unmarshal(packet);
+}
+
+// CommandError is the error answered by the proxy server or by the peer.
+export class CommandError extends Error {
+  constructor(message, cmd) {
+    super(message);
+    this.name = "CommandError";
+    this.cmd = cmd;
+  }
+}
+
+// Client is the Teonet proxy websocket client. It sends commands with unique
+// packet ids and resolves the call promises with answers of the same id.
+// The answers with zero id are server pushes delivered to subscribers.
+export class Client {
+  // Create client for the proxy server websocket url, f.e.
+  // "wss://example.com/ws". Options:
+  //   timeout         - call answer timeout in ms, default 5000
+  //   reconnectDelay  - delay before reconnect in ms, default 1000
+  //   onReconnected   - called after the client reconnected
+  //   fragmentSize    - maximum data size of sent packets, larger commands
+  //                     are sent in fragments, default 64 KB, 0 disables
+  //   maxMessage      - maximum size of buffered answer fragments and of
+  //                     decompressed answers, default 16 MB
+  //   compressThreshold - minimum data size of compressed commands, the
+  //                     client accepts compressed answers when it is not 0,
+  //                     default 1 KB
+  //   WebSocket       - WebSocket implementation, default globalThis.WebSocket
+  constructor(url, options = {}) {
+    this.url = url;
+    this.timeout = options.timeout ?? 5000;
+    this.reconnectDelay = options.reconnectDelay ?? 1000;
+    this.onReconnected = options.onReconnected;
+    this.fragmentSize = options.fragmentSize ?? DefaultFragmentSize;
+    this.maxMessage = options.maxMessage ?? DefaultMaxMessage;
+    this.reassembler = new Reassembler(this.maxMessage);
+    this.compressThreshold = options.compressThreshold ?? DefaultCompressThreshold;
+    this.accept = 0; // Codecs accepted by the proxy server
+    this.WebSocket = options.WebSocket ?? globalThis.WebSocket;
+    this.id = 0; // Last packet id
+    this.latency = 0; // Last answered ping round-trip time in ms
+    this.pending = new Map(); // Calls waiting for answers by packet id
+    this.subscribers = new Set(); // Push subscribers
+    this.closed = false; // Closed by Close method
+    this.connected = false; // Connected at least once
+    this.ws = null;
+  }
+
+  // connect opens the websocket connection and sends the Connect command.
+  // It resolves when the proxy server answers.
+  async connect() {
+    this.closed = false;
+    await this.open(false);
+    return this.call(Command.Connect);
+  }
+
+  // open opens the websocket connection. It resolves when the connection is
+  // established.
+  open(reconnect) {
+    return new Promise((resolve, reject) => {
+      const ws = new this.WebSocket(reconnect ? this.url + "?reconnect=1" : this.url);
+      this.ws = ws;
+      let opened = false;
+      ws.onopen = () => {
+        opened = true;
+        resolve();
+        if (this.connected) this.onReconnected?.();
+        this.connected = true;
+      };
+      ws.onmessage = (event) => this.receive(event.data);
+      ws.onclose = () => {
+        this.rejectPending(new Error("connection closed"));
+        if (!opened && !this.connected) {
+          reject(new Error("can't connect to " + this.url));
+          return;
+        }
+        if (!this.closed) {
+          setTimeout(() => this.open(true).catch(() => {}), this.reconnectDelay);
+        }
+      };
+    });
+  }
+
+  // close closes the connection without reconnect.
+  close() {
+    this.closed = true;
+    this.ws?.close();
+  }
+
+  // receive processes the websocket message.
+  receive(message) {
+    let cmd;
+    try {
+      cmd = decode(message);
+    } catch (e) {
+      return;
+    }
+    const id = cmd.id;
+    try {
+      cmd = this.reassembler.add(cmd);
+    } catch (e) {
+      this.settle(id, e);
+      return;
+    }
+    if (cmd === undefined) return;
+    if (cmd.accept) this.accept = cmd.accept;
+    if (cmd.codec) {
+      decompress(cmd, this.maxMessage).then((c) => this.deliver(c),
+        (e) => this.settle(id, e));
+      return;
+    }
+    this.deliver(cmd);
+  }
+
+  // deliver delivers the whole command to subscribers or to the waiting call.
+  deliver(cmd) {
+    if (cmd.id === 0) {
+      for (const subscriber of this.subscribers) subscriber(cmd);
+      return;
+    }
+    if (cmd.err !== undefined) this.settle(cmd.id, new CommandError(cmd.err, cmd));
+    else this.settle(cmd.id, undefined, cmd.data);
+  }
+
+  // settle resolves the waiting call with data or rejects it with err.
+  settle(id, err, data) {
+    const call = this.pending.get(id);
+    if (!call) return;
+    this.pending.delete(id);
+    call.release();
+    if (err !== undefined) call.reject(err);
+    else call.resolve(data);
+  }
+
+  // rejectPending rejects all waiting calls.
+  rejectPending(err) {
+    for (const call of this.pending.values()) {
+      call.release();
+      call.reject(err);
+    }
+    this.pending.clear();
+  }
+
+  // cancel rejects the waiting call with err and sends the Cancel command,
+  // so the proxy server stops waiting for the peer answer and does not
+  // answer the call.
+  cancel(id, err) {
+    if (!this.pending.has(id)) return;
+    const b = this.reassembler.buffers.get(id);
+    if (b) this.reassembler.drop(id, b);
+    this.settle(id, err);
+    if (this.ws && this.ws.readyState === 1) {
+      this.ws.send(encode({ id, cmd: Command.Cancel }));
+    }
+  }
+
+  // nextId returns the next packet id, the zero id is reserved for pushes.
+  nextId() {
+    this.id = (this.id + 1) >>> 0 || 1;
+    return this.id;
+  }
+
+  // call sends the command with data and resolves with the answer data.
+  // Options: timeout in ms, W3C traceParent, noCache to bypass the proxy
+  // server answers cache and AbortSignal signal to cancel the call. The
+  // call is canceled on the proxy server on timeout and on abort.
+  call(cmd, data, { timeout = this.timeout, traceParent = "", noCache = false, signal } = {}) {
+    return new Promise((resolve, reject) => {
+      if (!this.ws || this.ws.readyState !== 1) {
+        reject(new Error("not connected"));
+        return;
+      }
+      if (signal?.aborted) {
+        reject(signal.reason);
+        return;
+      }
+      const id = this.nextId();
+      const timer = setTimeout(() => this.cancel(id, new Error("timeout")), timeout);
+      const abort = () => this.cancel(id, signal.reason);
+      signal?.addEventListener("abort", abort);
+      const release = () => {
+        clearTimeout(timer);
+        signal?.removeEventListener("abort", abort);
+      };
+      this.pending.set(id, { resolve, reject, release });
+      this.send({ id, cmd, data, traceParent, noCache }).catch((e) => this.settle(id, e));
+    });
+  }
+
+  // send sends the command. The command announces codecs accepted in the
+  // answer and is compressed if the proxy server accepts compression. It is
+  // sent in fragments if its data is larger than the fragment size.
+  async send(cmd) {
+    if (this.compressThreshold > 0 && SupportedCodecs) {
+      cmd = { ...cmd, accept: SupportedCodecs };
+      if (this.accept) cmd = await compress(cmd, this.accept, this.compressThreshold);
+    }
+    const ws = this.ws;
+    for (const c of split(cmd, this.fragmentSize)) ws.send(encode(c));
+  }
+
+  // connectTo connects the proxy server to the Teonet peer.
+  connectTo(peer) {
+    return this.call(Command.ConnectTo, peer);
+  }
+
+  // newApiClient connects the proxy server to the Teonet peer api.
+  newApiClient(peer) {
+    return this.call(Command.NewApiClient, peer);
+  }
+
+  // apiCall sends the api command with data to the Teonet peer and resolves
+  // with the peer answer.
+  apiCall(peer, command, data, options) {
+    const prefix = encoder.encode(peer + "," + command + ",");
+    const body = bytes(data);
+    const packet = new Uint8Array(prefix.length + body.length);
+    packet.set(prefix);
+    packet.set(body, prefix.length);
+    return this.call(Command.ApiSendTo, packet, options);
+  }
+
+  // peers resolves with array of {name, address} of peers the proxy server
+  // is connected to and of its upstreams.
+  async peers() {
+    return JSON.parse(decoder.decode(await this.call(Command.Peers)));
+  }
+
+  // resolve resolves with the peer address of the proxy server upstream name.
+  async resolve(name) {
+    return decoder.decode(await this.call(Command.Resolve, name));
+  }
+
+  // describeApi resolves with the API description {name, short, long,
+  // commands} published by the peer, the commands are {name, short, long,
+  // usage, return}. The proxy server should be connected to the peer api.
+  async describeApi(peer) {
+    return JSON.parse(decoder.decode(await this.call(Command.DescribeAPI, peer)));
+  }
+
+  // ping sends the Ping command, with the peer name to probe the proxy
+  // server to peer round-trip time if it is not empty, and resolves with
+  // {rtt, peerRtt, serverTime}. The rtt and peerRtt are in ms, the rtt is
+  // saved in the latency field.
+  async ping(peer = "", options) {
+    const packet = new Uint8Array(8 + encoder.encode(peer).length);
+    new DataView(packet.buffer).setBigInt64(0, BigInt(Date.now()) * 1000000n, true);
+    packet.set(encoder.encode(peer), 8);
+    const start = performance.now();
+    const pong = await this.call(Command.Ping, packet, options);
+    const rtt = performance.now() - start;
+    if (pong.length !== 24) throw new ProtocolError(ErrWrongPing);
+    const view = new DataView(pong.buffer, pong.byteOffset, pong.length);
+    this.latency = rtt;
+    return {
+      rtt,
+      peerRtt: Number(view.getBigInt64(16, true)) / 1e6,
+      serverTime: new Date(Number(view.getBigInt64(8, true) / 1000000n)),
+    };
+  }
+
+  // monitorHealth pings the proxy server, and the peer if it is not empty,
+  // every interval ms and calls report with {healthy, latency, peerRtt, err,
+  // failures} after each ping. The ping which is not answered during the
+  // interval fails, so a connection with open websocket and stuck proxy
+  // server is reported unhealthy. It returns the function which stops the
+  // monitor.
+  monitorHealth(interval, report, peer = "") {
+    const health = { healthy: false, latency: 0, peerRtt: 0, err: undefined, failures: 0 };
+    let timer;
+    let stopped = false;
+    const check = async () => {
+      try {
+        const pong = await this.ping(peer, { timeout: interval });
+        Object.assign(health, { healthy: true, latency: pong.rtt, peerRtt: pong.peerRtt, err: undefined, failures: 0 });
+      } catch (err) {
+        Object.assign(health, { healthy: false, err, failures: health.failures + 1 });
+      }
+      if (stopped) return;
+      report({ ...health });
+      timer = setTimeout(check, interval);
+    };
+    check();
+    return () => {
+      stopped = true;
+      clearTimeout(timer);
+    };
+  }
+
+  // subscribe adds the push listener, it is called with the command object
+  // of every server push. It returns the unsubscribe function.
+  subscribe(listener) {
+    this.subscribers.add(listener);
+    return () => this.subscribers.delete(listener);
+  }
+}
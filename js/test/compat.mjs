@@ -0,0 +1,206 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy JavaScript client wire compatibility test.
+//
+// Usage: node test/compat.mjs <fixtures.json>
+//
+// The fixtures are generated from the Go command.TeonetCmd by the Go test
+// harness in this directory. The test checks the JavaScript marshal and
+// unmarshal against them and checks the client packet Id multiplexer with a
+// fake WebSocket.
+
+import { readFileSync } from "node:fs";
+import * as teoproxy from "../teoproxy.js";
+
+const { Client, Command } = teoproxy;
+let failed = 0;
+
+function fail(name, message) {
+  failed++;
+  console.log(`FAIL ${name}: ${message}`);
+}
+
+const fromBase64 = (s) => Uint8Array.from(atob(s), (c) => c.charCodeAt(0));
+const toBase64 = (b) => btoa(String.fromCharCode(...b));
+const text = (b) => new TextDecoder().decode(b);
+
+// Check fixtures
+const fixtures = JSON.parse(readFileSync(process.argv[2], "utf8"));
+for (const f of fixtures.packets) {
+  const packet = fromBase64(f.packet);
+  const want = { id: f.id, cmd: f.cmd, data: f.data, err: f.err ?? undefined,
+    traceParent: f.traceParent, fragment: f.fragment, fragments: f.fragments,
+    codec: f.codec, accept: f.accept, noCache: f.noCache };
+
+  // Unmarshal Go packet
+  try {
+    const c = teoproxy.unmarshal(packet);
+    const got = { id: c.id, cmd: c.cmd, data: c.err === undefined ? toBase64(c.data) : "",
+      err: c.err, traceParent: c.traceParent, fragment: c.fragment,
+      fragments: c.fragments, codec: c.codec, accept: c.accept,
+      noCache: c.noCache };
+    if (JSON.stringify(got) !== JSON.stringify(want)) {
+      fail(f.name, `unmarshal: want ${JSON.stringify(want)}, got ${JSON.stringify(got)}`);
+    }
+  } catch (e) {
+    fail(f.name, `unmarshal: ${e.message}`);
+  }
+
+  // Marshal the same packet
+  try {
+    const got = toBase64(teoproxy.marshal({ ...want, data: fromBase64(f.data) }));
+    if (got !== f.packet) fail(f.name, `marshal: want ${f.packet}, got ${got}`);
+  } catch (e) {
+    fail(f.name, `marshal: ${e.message}`);
+  }
+}
+// Decompress Go compressed data
+for (const f of fixtures.packets.filter((f) => f.codec)) {
+  try {
+    const c = await teoproxy.decompress(teoproxy.unmarshal(fromBase64(f.packet)));
+    if (text(c.data) !== "data".repeat(16)) fail(f.name, `decompress: got ${text(c.data)}`);
+  } catch (e) {
+    fail(f.name, `decompress: ${e.message}`);
+  }
+}
+for (const f of fixtures.errors) {
+  try {
+    teoproxy.unmarshal(fromBase64(f.packet));
+    fail(f.name, `want error ${f.error}, got none`);
+  } catch (e) {
+    if (!(e instanceof teoproxy.ProtocolError) || e.message !== f.error) {
+      fail(f.name, `want error ${f.error}, got ${e.message}`);
+    }
+  }
+}
+
+// FakeWebSocket answers commands with the answer function result.
+class FakeWebSocket {
+  static answer = () => [];
+  static sent = 0;
+  static compressed = 0;
+  constructor(url) {
+    this.url = url;
+    this.readyState = 1;
+    setTimeout(() => this.onopen());
+  }
+  send(message) {
+    FakeWebSocket.sent++;
+    let cmd = teoproxy.decode(message);
+    if (cmd.codec) FakeWebSocket.compressed++;
+    teoproxy.decompress(cmd).then(async (cmd) => {
+      for (const answer of await FakeWebSocket.answer(cmd)) {
+        this.onmessage({ data: teoproxy.encode(answer) });
+      }
+    });
+  }
+  close() {
+    this.readyState = 3;
+    setTimeout(() => this.onclose());
+  }
+}
+
+// Check client
+const client = new Client("ws://localhost/ws", { WebSocket: FakeWebSocket, timeout: 100 });
+const pushes = [];
+client.subscribe((cmd) => pushes.push(text(cmd.data)));
+FakeWebSocket.answer = (cmd) => {
+  switch (cmd.cmd) {
+    case Command.Connect:
+      return [{ cmd: Command.Connect, data: "pushed" }, { ...cmd, data: "connected" }];
+    case Command.ApiSendTo:
+      if (text(cmd.data).startsWith("zip,")) {
+        return Promise.all([teoproxy.compress({ ...cmd, codec: 0, data: cmd.data },
+          cmd.accept, 16)]);
+      }
+      return text(cmd.data).endsWith(",fail,")
+        ? [{ ...cmd, err: "peer error" }]
+        : [{ ...cmd, data: text(cmd.data).toUpperCase() }];
+    default:
+      return [];
+  }
+};
+
+const tests = [
+  ["connect and push", async () => {
+    const data = await client.connect();
+    if (text(data) !== "connected") throw new Error(`got ${text(data)}`);
+    if (pushes.join() !== "pushed") throw new Error(`pushes ${pushes.join()}`);
+  }],
+  ["multiplexed calls", async () => {
+    const answers = await Promise.all(["a", "b", "c"].map((d) =>
+      client.apiCall("peer", "cmd", d)));
+    const got = answers.map(text).join();
+    if (got !== "PEER,CMD,A,PEER,CMD,B,PEER,CMD,C") throw new Error(`got ${got}`);
+  }],
+  ["error answer", async () => {
+    try {
+      await client.apiCall("peer", "fail");
+      throw new Error("want error");
+    } catch (e) {
+      if (!(e instanceof teoproxy.CommandError) || e.message !== "peer error") throw e;
+    }
+  }],
+  ["timeout", async () => {
+    try {
+      await client.connectTo("peer");
+      throw new Error("want timeout");
+    } catch (e) {
+      if (e.message !== "timeout") throw e;
+    }
+  }],
+  ["fragmented call", async () => {
+    const c = new Client("ws://localhost/ws", { WebSocket: FakeWebSocket, fragmentSize: 4 });
+    await c.connect();
+    const sent = FakeWebSocket.sent;
+    const got = text(await c.apiCall("peer", "cmd", "hello world"));
+    c.close();
+    if (got !== "PEER,CMD,HELLO WORLD") throw new Error(`got ${got}`);
+    if (FakeWebSocket.sent - sent !== 5) {
+      throw new Error(`want 5 fragments, sent ${FakeWebSocket.sent - sent}`);
+    }
+  }],
+  ["compressed calls", async () => {
+    const c = new Client("ws://localhost/ws", { WebSocket: FakeWebSocket,
+      compressThreshold: 16 });
+    await c.connect();
+    const compressed = FakeWebSocket.compressed;
+    const data = "fortune ".repeat(100);
+    for (let i = 0; i < 2; i++) {
+      const got = text(await c.apiCall("zip", "cmd", data));
+      if (got !== "zip,cmd," + data) throw new Error(`got ${got}`);
+    }
+    c.close();
+    // The connect answer announced accepted codecs, so both requests are
+    // compressed
+    if (FakeWebSocket.compressed - compressed !== 2) {
+      throw new Error(`want 2 compressed requests, got ${FakeWebSocket.compressed - compressed}`);
+    }
+  }],
+  ["fragmented answer too big", async () => {
+    const c = new Client("ws://localhost/ws", { WebSocket: FakeWebSocket,
+      fragmentSize: 4, maxMessage: 8 });
+    await c.connect();
+    try {
+      await c.apiCall("peer", "cmd", "hello world");
+      throw new Error("want error");
+    } catch (e) {
+      if (e.message !== teoproxy.ErrMessageTooBig) throw e;
+    } finally {
+      c.close();
+    }
+  }],
+];
+for (const [name, test] of tests) {
+  try {
+    await test();
+  } catch (e) {
+    fail(name, e.message);
+  }
+}
+client.close();
+
+if (failed > 0) process.exit(1);
+console.log("PASS");
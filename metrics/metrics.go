@@ -0,0 +1,46 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package metrics provides Teonet proxy metrics in Prometheus exposition
+// format.
+//
+// The Metrics type contains the proxy server metrics used to instrument
+// WsServer and TeonetServer. The metrics are collected with the Prometheus
+// client library in the own registry of Metrics, together with the Go runtime
+// and process metrics, and are served by the promhttp handler.
+package metrics
+
+import (
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/expfmt"
+)
+
+// newRegistry creates the Prometheus registry with the Go runtime and process
+// collectors.
+func newRegistry() *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return r
+}
+
+// Write writes all registered metrics to w in text exposition format.
+func (m *Metrics) Write(w io.Writer) (err error) {
+	families, err := m.Gather()
+	if err != nil {
+		return
+	}
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err = enc.Encode(family); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.SetCommands("fortune", "fortb")
+	m.SessionOpened(false)
+	m.Command("ApiSendTo", nil)
+	m.SendTo("fortune", "fortb", 30*time.Millisecond)
+
+	// Test case 1: the handler serves metrics in text exposition format which
+	// the Prometheus parser reads
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct,
+		"text/plain") {
+		t.Errorf("expected text/plain content type, got: %s", ct)
+	}
+	families, err := new(expfmt.TextParser).TextToMetricFamilies(w.Body)
+	if err != nil {
+		t.Fatalf("can't parse metrics: %v", err)
+	}
+	for name, typ := range map[string]dto.MetricType{
+		"teoproxy_ws_sessions":                  dto.MetricType_GAUGE,
+		"teoproxy_commands_total":               dto.MetricType_COUNTER,
+		"teoproxy_api_send_to_duration_seconds": dto.MetricType_HISTOGRAM,
+		"go_goroutines":                         dto.MetricType_GAUGE,
+	} {
+		f, ok := families[name]
+		if !ok || f.GetType() != typ {
+			t.Errorf("expected %s %s metric, got: %v", name, typ, f)
+		}
+	}
+	h := families["teoproxy_api_send_to_duration_seconds"].GetMetric()
+	if len(h) != 1 || h[0].GetHistogram().GetSampleCount() != 1 {
+		t.Errorf("expected 1 observation, got: %v", h)
+	}
+
+	// Test case 2: nil metrics handler answers not found
+	w = httptest.NewRecorder()
+	(*Metrics)(nil).Handler().ServeHTTP(w,
+		httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got: %d", w.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+
+	// Test case 1: nil metrics methods do nothing
+	var m *Metrics
+	m.SessionOpened(true)
+	m.Command("Connect", nil)
+	m.SendTo("peer", "cmd", time.Second)
+	m.SetCommands("peer", "cmd")
+
+	// Test case 2: proxy metrics
+	m = New()
+	m.SetCommands("fortune", "fortb")
+	m.SessionOpened(false)
+	m.SessionOpened(true)
+	m.SessionClosed()
+	m.BytesIn(10)
+	m.BytesOut(20)
+	m.Command("ApiSendTo", nil)
+	m.Command("ApiSendTo", errors.New("timeout"))
+	m.SendTo("fortune", "fortb", 30*time.Millisecond)
+	m.Timeout("fortune", "fortb")
+	m.Cache("fortune", "fortb", true)
+	m.Cache("fortune", "fortb", true)
+	m.Cache("fortune", "fortb", false)
+	m.Coalesced("fortune", "fortb")
+
+	// Test case 3: unknown api commands are counted with the other label
+	m.SendTo("fortune", "random-1", time.Millisecond)
+	m.SendTo("fortune", "random-2", time.Millisecond)
+	m.Timeout("users", "list")
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+	for _, line := range []string{
+		"teoproxy_ws_sessions 1",
+		"teoproxy_ws_connections_total 2",
+		"teoproxy_ws_reconnects_total 1",
+		"teoproxy_ws_received_bytes_total 10",
+		"teoproxy_ws_sent_bytes_total 20",
+		`teoproxy_commands_total{command="ApiSendTo",result="error"} 1`,
+		`teoproxy_commands_total{command="ApiSendTo",result="ok"} 1`,
+		`teoproxy_api_send_to_duration_seconds_count{command="fortb",peer="fortune"} 1`,
+		`teoproxy_api_timeouts_total{command="fortb",peer="fortune"} 1`,
+		`teoproxy_cache_hits_total{command="fortb",peer="fortune"} 2`,
+		`teoproxy_cache_misses_total{command="fortb",peer="fortune"} 1`,
+		`teoproxy_coalesced_total{command="fortb",peer="fortune"} 1`,
+		`teoproxy_api_send_to_duration_seconds_count{command="other",peer="fortune"} 2`,
+		`teoproxy_api_timeouts_total{command="other",peer="users"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected line: %s, got:\n%s", line, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "random") {
+		t.Errorf("unexpected unknown command label, got:\n%s", buf.String())
+	}
+}
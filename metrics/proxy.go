@@ -0,0 +1,230 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server metrics module.
+
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Command results used in the commands metric result label.
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+// OtherCommand is the api command label of commands which are not known for
+// the peer, see Metrics.SetCommands.
+const OtherCommand = "other"
+
+// Metrics contains the Teonet proxy server metrics. All methods are safe to
+// call on a nil *Metrics, so instrumented code does not need to check if
+// metrics are enabled. Application collectors may be registered in its
+// Registry to be served with the proxy metrics.
+type Metrics struct {
+	*prometheus.Registry
+
+	sessions    prometheus.Gauge
+	connections prometheus.Counter
+	reconnects  prometheus.Counter
+	bytesIn     prometheus.Counter
+	bytesOut    prometheus.Counter
+	commands    *prometheus.CounterVec
+	latency     *prometheus.HistogramVec
+	timeouts    *prometheus.CounterVec
+	cacheHits   *prometheus.CounterVec
+	cacheMisses *prometheus.CounterVec
+	coalesced   *prometheus.CounterVec
+
+	peerCommands *peerCommands
+}
+
+// peerCommands holds known api commands of peers.
+type peerCommands struct {
+	m map[string]map[string]struct{}
+	*sync.RWMutex
+}
+
+// New creates a new Metrics instance with its own Registry, which collects
+// the Go runtime and process metrics too.
+func New() *Metrics {
+	r := newRegistry()
+	f := promauto.With(r)
+	counter := func(name, help string) prometheus.Counter {
+		return f.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+	}
+	counterVec := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return f.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help},
+			labels)
+	}
+	return &Metrics{
+		Registry: r,
+		sessions: f.NewGauge(prometheus.GaugeOpts{Name: "teoproxy_ws_sessions",
+			Help: "Number of active websocket sessions."}),
+		connections: counter("teoproxy_ws_connections_total",
+			"Total number of websocket connections."),
+		reconnects: counter("teoproxy_ws_reconnects_total",
+			"Total number of websocket reconnections from clients."),
+		bytesIn: counter("teoproxy_ws_received_bytes_total",
+			"Total number of bytes received from websocket clients."),
+		bytesOut: counter("teoproxy_ws_sent_bytes_total",
+			"Total number of bytes sent to websocket clients."),
+		commands: counterVec("teoproxy_commands_total",
+			"Total number of processed proxy commands by type and result.",
+			"command", "result"),
+		latency: f.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "teoproxy_api_send_to_duration_seconds",
+			Help: "ApiSendTo request duration in seconds by peer and api command.",
+		}, []string{"peer", "command"}),
+		timeouts: counterVec("teoproxy_api_timeouts_total",
+			"Total number of ApiSendTo requests timed out by peer and api command.",
+			"peer", "command"),
+		cacheHits: counterVec("teoproxy_cache_hits_total",
+			"Total number of ApiSendTo answers taken from cache by peer and api command.",
+			"peer", "command"),
+		cacheMisses: counterVec("teoproxy_cache_misses_total",
+			"Total number of cacheable ApiSendTo requests sent to peer by peer and api command.",
+			"peer", "command"),
+		coalesced: counterVec("teoproxy_coalesced_total",
+			"Total number of ApiSendTo requests answered with identical in-flight request answer by peer and api command.",
+			"peer", "command"),
+		peerCommands: &peerCommands{
+			m:       make(map[string]map[string]struct{}),
+			RWMutex: new(sync.RWMutex),
+		},
+	}
+}
+
+// SetCommands sets known api commands of the peer. The api command label of
+// the peer requests metrics is the command name if it is known and
+// OtherCommand otherwise, so clients can't create unlimited number of label
+// values with random commands. The proxy server sets commands of peers from
+// their API description.
+func (m *Metrics) SetCommands(peer string, commands ...string) {
+	if m == nil {
+		return
+	}
+	known := make(map[string]struct{}, len(commands))
+	for _, command := range commands {
+		known[command] = struct{}{}
+	}
+	m.peerCommands.Lock()
+	defer m.peerCommands.Unlock()
+	m.peerCommands.m[peer] = known
+}
+
+// command returns the api command label of the peer command.
+func (m *Metrics) command(peer, command string) string {
+	m.peerCommands.RLock()
+	defer m.peerCommands.RUnlock()
+	if _, ok := m.peerCommands.m[peer][command]; !ok {
+		return OtherCommand
+	}
+	return command
+}
+
+// Handler returns promhttp handler which serves the registry metrics in the
+// exposition format negotiated with the scraper. It returns
+// http.NotFoundHandler on a nil *Metrics.
+func (m *Metrics) Handler() http.Handler {
+	if m == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// SessionOpened counts a new websocket session. The reconnect parameter is
+// true if the client reconnects after lost connection.
+func (m *Metrics) SessionOpened(reconnect bool) {
+	if m == nil {
+		return
+	}
+	m.sessions.Inc()
+	m.connections.Inc()
+	if reconnect {
+		m.reconnects.Inc()
+	}
+}
+
+// SessionClosed counts closed websocket session.
+func (m *Metrics) SessionClosed() {
+	if m == nil {
+		return
+	}
+	m.sessions.Dec()
+}
+
+// BytesIn counts bytes received from websocket client.
+func (m *Metrics) BytesIn(n int) {
+	if m == nil {
+		return
+	}
+	m.bytesIn.Add(float64(n))
+}
+
+// BytesOut counts bytes sent to websocket client.
+func (m *Metrics) BytesOut(n int) {
+	if m == nil {
+		return
+	}
+	m.bytesOut.Add(float64(n))
+}
+
+// Command counts processed proxy command with its result.
+func (m *Metrics) Command(command string, err error) {
+	if m == nil {
+		return
+	}
+	result := ResultOK
+	if err != nil {
+		result = ResultError
+	}
+	m.commands.WithLabelValues(command, result).Inc()
+}
+
+// SendTo observes ApiSendTo request duration to peer api command.
+func (m *Metrics) SendTo(peer, command string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.latency.WithLabelValues(peer, m.command(peer, command)).Observe(d.Seconds())
+}
+
+// Timeout counts ApiSendTo request to peer api command timed out.
+func (m *Metrics) Timeout(peer, command string) {
+	if m == nil {
+		return
+	}
+	m.timeouts.WithLabelValues(peer, m.command(peer, command)).Inc()
+}
+
+// Cache counts cacheable ApiSendTo request to peer api command answered from
+// cache if hit is true or sent to the peer.
+func (m *Metrics) Cache(peer, command string, hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.cacheHits.WithLabelValues(peer, m.command(peer, command)).Inc()
+	} else {
+		m.cacheMisses.WithLabelValues(peer, m.command(peer, command)).Inc()
+	}
+}
+
+// Coalesced counts ApiSendTo request to peer api command answered with the
+// answer of identical in-flight request.
+func (m *Metrics) Coalesced(peer, command string) {
+	if m == nil {
+		return
+	}
+	m.coalesced.WithLabelValues(peer, m.command(peer, command)).Inc()
+}
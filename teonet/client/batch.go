@@ -0,0 +1,58 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet client batch of API Commands module.
+//
+// The Batch collects API Commands to different peers and sends them at once:
+//
+//	results, err := teo.Batch().
+//		Add(users, "get", userID).
+//		Add(catalog, "list", nil).
+//		Send()
+//	for _, r := range results {
+//		if r.Err != nil {
+//			...
+//		}
+//		use(r.Data)
+//	}
+//
+// The wasm client sends the batch to the Teonet proxy server in one Batch
+// command, and the server sends the commands to peers in parallel. The
+// native client sends the commands to peers directly in parallel.
+
+package client
+
+import "github.com/teonet-go/teoproxy/ws/command"
+
+// BatchResult is the result of the batch API Command, it contains the answer
+// data or error.
+type BatchResult = command.BatchResult
+
+// Batch is the batch of API Commands.
+type Batch struct {
+	teo   *Teonet
+	items []batchItem
+}
+
+// batchItem is the API Command of the batch.
+type batchItem struct {
+	api    *APIClient // Peer api client
+	apiCmd string     // Peer api command
+	data   []byte     // Api command data
+}
+
+// Batch creates an empty batch of API Commands.
+func (teo *Teonet) Batch() *Batch {
+	return &Batch{teo: teo}
+}
+
+// Add adds the API Command to the batch. The results of Send are in the
+// order of added commands.
+func (b *Batch) Add(api *APIClient, apiCmd string, apiData []byte) *Batch {
+	b.items = append(b.items, batchItem{api, apiCmd, apiData})
+	return b
+}
+
+// Len returns the number of API Commands in the batch.
+func (b *Batch) Len() int { return len(b.items) }
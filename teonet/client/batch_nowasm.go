@@ -0,0 +1,47 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !wasm
+
+// Teonet native client batch of API Commands module.
+
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// Send sends the batch commands to peers in parallel and waits for the
+// results.
+func (b *Batch) Send() ([]BatchResult, error) {
+	return b.SendContext(context.Background())
+}
+
+// SendContext sends the batch commands to peers in parallel and waits for
+// the results. The error is returned if the ctx is done before the batch is
+// sent, the results contain errors of the commands.
+func (b *Batch) SendContext(ctx context.Context) (results []BatchResult,
+	err error) {
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	results = make([]BatchResult, len(b.items))
+	var wg sync.WaitGroup
+	for i, item := range b.items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := item.api.SendTo(item.apiCmd, item.data)
+			var data []byte
+			if err == nil {
+				data, err = item.api.WaitFrom(item.apiCmd, uint32(id))
+			}
+			results[i] = BatchResult{Data: data, Err: err}
+		}()
+	}
+	wg.Wait()
+	return
+}
@@ -0,0 +1,73 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build wasm
+
+// Teonet wasm client batch of API Commands module.
+
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// Send sends the batch to the proxy server and waits for the results.
+func (b *Batch) Send() ([]BatchResult, error) {
+	return b.SendContext(context.Background())
+}
+
+// SendContext sends the batch to the proxy server and waits for the results.
+// The ctx trace context and NoCache flag are applied to all commands. The
+// data of peers with encryption enabled is encrypted. The batch is canceled
+// on the proxy server when the ctx is done. The error is returned if the
+// whole batch fails, the results contain errors of the commands.
+func (b *Batch) SendContext(ctx context.Context) (results []BatchResult,
+	err error) {
+
+	items := make([]command.BatchItem, len(b.items))
+	for i, item := range b.items {
+		items[i] = command.BatchItem{Peer: item.api.addr, Command: item.apiCmd,
+			Data: b.teo.seal(item.api.addr, item.apiCmd, item.data)}
+	}
+	data, err := command.MarshalBatch(items)
+	if err != nil {
+		return
+	}
+
+	cmd := command.New(command.Batch, data)
+	cmd.Id = b.teo.getNextID()
+	cmd.TraceParent = traceParent(ctx)
+	cmd.NoCache, _ = ctx.Value(noCacheKey{}).(bool)
+	if err = b.teo.send(cmd); err != nil {
+		return
+	}
+	b.teo.watch(ctx, cmd.Id)
+	answer, err := b.teo.waitAnswer(ctx, command.Batch.String(), cmd.Id)
+	if err == nil {
+		err = answer.Err
+	}
+	if err != nil {
+		return
+	}
+
+	results, err = command.UnmarshalBatchResults(answer.Data)
+	if err != nil {
+		return
+	}
+	if len(results) != len(items) {
+		err = fmt.Errorf("%w: got %d results of %d commands",
+			command.ErrWrongBatch, len(results), len(items))
+		return
+	}
+	for i := range results {
+		if results[i].Err == nil {
+			results[i].Data, results[i].Err = b.teo.open(items[i].Peer,
+				items[i].Command, results[i].Data)
+		}
+	}
+	return
+}
@@ -0,0 +1,63 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build wasm
+
+// Teonet wasm client requests cancellation module.
+
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// requests stores a map of functions which stop watching the requests
+// contexts, keyed by request packet id. It uses a Mutex for concurrent
+// access control.
+type requests struct {
+	m map[uint32]func() bool
+	*sync.Mutex
+}
+
+// newRequests creates requests map.
+func newRequests() *requests {
+	return &requests{
+		m:     make(map[uint32]func() bool),
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// watch sends the Cancel command of the request id to the proxy server when
+// the ctx is done before the request is answered.
+func (teo *Teonet) watch(ctx context.Context, id uint32) {
+	if ctx.Done() == nil {
+		return
+	}
+	teo.requests.Lock()
+	defer teo.requests.Unlock()
+	teo.requests.m[id] = context.AfterFunc(ctx, func() { teo.cancel(id) })
+}
+
+// unwatch stops watching the ctx of the answered request id.
+func (teo *Teonet) unwatch(id uint32) {
+	teo.requests.Lock()
+	stop, ok := teo.requests.m[id]
+	delete(teo.requests.m, id)
+	teo.requests.Unlock()
+	if ok {
+		stop()
+	}
+}
+
+// cancel sends the Cancel command of the request id to the proxy server, so
+// it stops waiting for the peer answer and does not answer the request.
+func (teo *Teonet) cancel(id uint32) {
+	teo.unwatch(id)
+	data, _ := command.NewCancel(id).MarshalBinary()
+	teo.ws.SendMessage(data)
+	teo.logger.Debug("send cancel command", "id", id)
+}
@@ -8,6 +8,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/teonet-go/teonet"
@@ -17,17 +18,20 @@ import (
 // It allows extending the base teonet.Teonet client with additional methods.
 type Teonet struct {
 	*teonet.Teonet
+	options
 }
 
 // New starts Teonet client and returns a new Teonet instance.
 //
 // appShort - short application name
 // onReconnected - callback that will be called after successful reconnection
+// opts - optional client options
 //
 // Returns a new Teonet instance and error if any.
-func New(appShort string, onReconnected func()) (teo *Teonet, err error) {
+func New(appShort string, onReconnected func(), opts ...Option) (teo *Teonet,
+	err error) {
 
-	teo = new(Teonet)
+	teo = &Teonet{options: newOptions(opts...)}
 
 	// Start Teonet client
 	teo.Teonet, err = teonet.New(appShort)
@@ -56,3 +60,32 @@ func (teo *Teonet) NewAPIClient(addr string) (cli *APIClient, err error) {
 	cli = &APIClient{apicli}
 	return
 }
+
+// Call sends an API command and data to the peer and waits for the answer.
+// It stops waiting and returns the ctx error when the ctx is done.
+func (api *APIClient) Call(ctx context.Context, apiCmd string,
+	apiData []byte) (data []byte, err error) {
+
+	id, err := api.SendTo(apiCmd, apiData)
+	if err != nil {
+		return
+	}
+
+	// Api answer struct
+	type apiAnswer struct {
+		data []byte
+		err  error
+	}
+	w := make(chan apiAnswer, 1)
+	go func() {
+		data, err := api.WaitFrom(apiCmd, uint32(id))
+		w <- apiAnswer{data, err}
+	}()
+
+	select {
+	case answer := <-w:
+		return answer.data, answer.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -8,48 +8,71 @@
 package client
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"sync/atomic"
 	"time"
 
 	ws "github.com/teonet-go/teoproxy/ws/client"
 	"github.com/teonet-go/teoproxy/ws/command"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Teonet represents a Teonet client instance. It contains:
 // - ws: Websocket client
 // - id: Packet id
+// - reassembler: Fragmented answers reassembly buffers
+// - accept: Codecs accepted by the proxy server
+// - e2e: Peers end-to-end encryption sessions
+// - requests: Requests canceled when their contexts are done
+// - latency: Round-trip time to the proxy server
+// - options: Client options
 type Teonet struct {
-	ws *ws.WsClient // Websocket client
-	id uint32       // Packet id
+	ws          *ws.WsClient         // Websocket client
+	id          uint32               // Packet id
+	reassembler *command.Reassembler // Fragmented answers reassembler
+	accept      uint32               // Codecs accepted by the proxy server
+	e2e         *e2eSessions         // Peers e2e encryption sessions
+	requests    *requests            // Requests contexts watchers
+	latency     int64                // Round-trip time to the proxy server
+	options
 }
 
 // New creates a new Teonet client instance. It initializes the websocket
 // client and connects to the Teonet proxy server. The appShort string is
 // used for logging. The onReconnected callback is invoked when the
-// websocket reconnects after a disconnect. It returns a pointer to the
-// Teonet client and an error.
-func New(appShort string, onReconnected func()) (teo *Teonet, err error) {
-	teo = new(Teonet)
+// websocket reconnects after a disconnect. The opts parameters configure
+// optional client features. It returns a pointer to the Teonet client and
+// an error.
+func New(appShort string, onReconnected func(), opts ...Option) (teo *Teonet,
+	err error) {
+
+	teo = &Teonet{options: newOptions(opts...), e2e: newE2ESessions(),
+		requests: newRequests()}
+	teo.reassembler = command.NewReassembler(teo.maxMessage,
+		command.DefaultFragmentTTL)
+	teo.logger = teo.logger.With("app", appShort)
 	teo.ws = ws.NewWsClient(
 		// Common reader. It process Id 0 command answers.
 		func(message []byte) bool {
 			cmd := command.NewEmpty()
-			err = cmd.UnmarshalBinary(message)
+			err := cmd.UnmarshalBinary(message)
 			if err != nil {
-				log.Println("Can't unmarshal teonet proxy server command, error:",
-					err, string(message))
+				teo.logger.Warn("can't unmarshal teonet proxy server command",
+					"err", err)
 				return false
 			}
 			if cmd.Id == 0 {
-				log.Println("Recv id", cmd.Id, cmd.Cmd.String())
+				teo.logger.Debug("recv command", "id", cmd.Id,
+					"cmd", cmd.Cmd.String())
 				return true
 			}
 
 			return false
 		},
 	)
+	teo.ws.SetLogger(teo.logger)
+	teo.ws.SetPayloadLogging(teo.logPayload)
 	err = teo.ws.Connect(onReconnected)
 	return
 }
@@ -110,43 +133,89 @@ func (teo *Teonet) NewAPIClient(peer string) (cli *APIClient, err error) {
 // peer. It adds a reader callback to the websocket client that waits for a
 // matching response, with a timeout. It returns the response data and any
 // error. This allows waiting for async responses to requests sent to peers.
+// The response is decrypted if the peer api client encrypts data.
 func (teo *Teonet) WaitFrom(peer string, id uint32) (data []byte, err error) {
-	var readerId string
-	type resultData struct {
-		data []byte
-		err  error
+	return teo.WaitFromContext(context.Background(), peer, id)
+}
+
+// WaitFromContext waits to receive a response with the given ID like
+// WaitFrom. It stops waiting and returns the ctx error when the ctx is done,
+// the request sent by SendToContext with this ctx is canceled on the proxy
+// server.
+func (teo *Teonet) WaitFromContext(ctx context.Context, peer string,
+	id uint32) (data []byte, err error) {
+
+	cmd, err := teo.waitAnswer(ctx, peer, id)
+	if err != nil {
+		teo.e2e.command(id) // Remove the request api command
+		return
 	}
-	w := make(chan resultData, 1)
+	return teo.openAnswer(peer, id, cmd.Data)
+}
+
+// waitAnswer waits to receive the command answer with the given ID. The peer
+// is used for logging. It returns the answer command, the timeout error or
+// the ctx error. The request is canceled on the proxy server if the answer
+// is not received in time.
+func (teo *Teonet) waitAnswer(ctx context.Context, peer string, id uint32) (
+	answer *command.TeonetCmd, err error) {
+
+	var readerId string
+	w := make(chan *command.TeonetCmd, 1)
 	readerId = teo.ws.AddReader(func(message []byte) bool {
 
 		cmd := command.NewEmpty()
-		err = cmd.UnmarshalBinary(message)
+		err := cmd.UnmarshalBinary(message)
 		if err != nil {
-			log.Println("Can't unmarshal teonet proxy server command, error:",
-				err, string(message))
+			teo.logger.Warn("can't unmarshal teonet proxy server command",
+				"err", err)
 			return false
 		}
 		if cmd.Id != id {
 			return false
 		}
-		log.Println("Recv id", cmd.Id, cmd.Cmd.String())
-		log.Println("Got Teonet proxy server command:", cmd.Cmd.String(),
-			string(cmd.Data))
+
+		// Collect answer fragments and decompress the answer, the reassembly
+		// and decompression errors are the answer error
+		cmd, ok, err := teo.reassembler.Add(cmd)
+		if err == nil && ok {
+			err = cmd.Decompress(teo.maxMessage)
+		}
+		if err != nil {
+			cmd = &command.TeonetCmd{Id: id, Err: err}
+		} else if !ok {
+			return true
+		}
+		if cmd.Accept != 0 {
+			atomic.StoreUint32(&teo.accept, uint32(cmd.Accept))
+		}
+		logger := teo.logger.With("id", cmd.Id, "cmd", cmd.Cmd.String(),
+			"peer", peer)
+		if teo.logPayload {
+			logger.Debug("got Teonet proxy server command", "data",
+				string(cmd.Data))
+		} else {
+			logger.Debug("got Teonet proxy server command", "len", len(cmd.Data))
+		}
 
 		go teo.ws.RemoveReader(readerId)
-		w <- resultData{cmd.Data, nil}
+		teo.unwatch(id)
+		w <- cmd
 
 		return true
 	})
 
-	// Get answer from server or timeout
-	var answer resultData
+	// Get answer from server, timeout or ctx done
 	select {
 	case answer = <-w:
 	case <-time.After(5 * time.Second):
-		answer = resultData{nil, fmt.Errorf("timeout")}
+		go teo.ws.RemoveReader(readerId)
+		teo.cancel(id)
+		err = fmt.Errorf("timeout")
+	case <-ctx.Done():
+		go teo.ws.RemoveReader(readerId)
+		err = ctx.Err()
 	}
-	data, err = answer.data, answer.err
 
 	return
 }
@@ -169,12 +238,89 @@ func (api *APIClient) Address() string {
 // It returns a unique command ID and error. The apiCmd and apiData are
 // joined into a single byte slice that is sent as the command data.
 func (api *APIClient) SendTo(apiCmd string, apiData []byte) (id uint32, err error) {
+	return api.SendToContext(context.Background(), apiCmd, apiData)
+}
+
+// SendToContext sends an API command and data to the configured peer address
+// like SendTo. If the ctx contains OpenTelemetry span context, its W3C trace
+// context is sent in the command header, so the proxy server spans join the
+// client trace. The ctx returned by NoCache bypasses the proxy server answers
+// cache. The data is encrypted if Encrypt was called. The request is
+// canceled on the proxy server when the ctx is done before the answer is
+// received, the proxy server stops waiting for the peer and does not answer.
+func (api *APIClient) SendToContext(ctx context.Context, apiCmd string,
+	apiData []byte) (id uint32, err error) {
+
+	id = api.teo.getNextID()
 	data := []byte(api.Address() + "," + apiCmd + ",")
-	data = append(data, apiData...)
+	data = append(data, api.teo.sealRequest(id, api.addr, apiCmd, apiData)...)
 	cmd := command.New(command.ApiSendTo, data)
-	cmd.Id = api.teo.getNextID()
-	data, _ = cmd.MarshalBinary()
-	api.teo.ws.SendMessage(data)
-	id = cmd.Id
+	cmd.Id = id
+	cmd.TraceParent = traceParent(ctx)
+	cmd.NoCache, _ = ctx.Value(noCacheKey{}).(bool)
+	if err = api.teo.send(cmd); err != nil {
+		api.teo.e2e.command(id) // Remove the request api command
+		return
+	}
+	api.teo.watch(ctx, id)
 	return
 }
+
+// Call sends an API command and data to the peer with SendToContext and
+// waits for the answer with WaitFromContext. It returns the answer data.
+func (api *APIClient) Call(ctx context.Context, apiCmd string,
+	apiData []byte) (data []byte, err error) {
+
+	id, err := api.SendToContext(ctx, apiCmd, apiData)
+	if err != nil {
+		return
+	}
+	return api.teo.WaitFromContext(ctx, api.addr, id)
+}
+
+// noCacheKey is the context key of the no cache flag.
+type noCacheKey struct{}
+
+// NoCache returns the context which makes SendToContext bypass the proxy
+// server answers cache, so the answer is got from the peer.
+func NoCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+// send sends the command to the proxy server. The command announces codecs
+// accepted in the answer and is compressed if the proxy server accepts
+// compression. It is sent in fragments if its data is larger than the
+// fragment size.
+func (teo *Teonet) send(cmd *command.TeonetCmd) error {
+	if teo.compress > 0 {
+		cmd.Accept = command.SupportedCodecs
+		accept := command.Codecs(atomic.LoadUint32(&teo.accept))
+		if err := cmd.Compress(accept, teo.compress); err != nil {
+			return err
+		}
+	}
+	cmds, err := cmd.Split(teo.fragmentSize)
+	if err != nil {
+		return err
+	}
+	for _, c := range cmds {
+		data, err := c.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		teo.ws.SendMessage(data)
+	}
+	return nil
+}
+
+// traceParent returns W3C traceparent of the span context in ctx or empty
+// string if ctx has no valid span context. It is formatted here to not link
+// the OpenTelemetry propagators into the wasm client.
+func traceParent(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return "00-" + sc.TraceID().String() + "-" + sc.SpanID().String() + "-" +
+		(sc.TraceFlags() & trace.FlagsSampled).String()
+}
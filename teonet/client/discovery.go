@@ -0,0 +1,32 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet client peers discovery module.
+//
+// UIs discover services at runtime instead of using hard-coded peer
+// addresses:
+//
+//	peers, err := teo.ListPeers()
+//	addr, err := teo.Resolve("fortune")
+//	api, err := teo.NewAPIClient("fortune")
+//	d, err := api.Describe()
+//	for _, c := range d.Commands {
+//		fmt.Println(c.Name, c.Usage, c.Return)
+//	}
+//
+// The wasm client gets them from the Teonet proxy server, the native client
+// gets them from its Teonet connection.
+
+package client
+
+import "github.com/teonet-go/teoproxy/ws/command"
+
+// PeerInfo is the peer of the ListPeers result.
+type PeerInfo = command.PeerInfo
+
+// APIDescription is the peer API description.
+type APIDescription = command.APIDescription
+
+// APICommand is the peer API command description.
+type APICommand = command.APICommand
@@ -0,0 +1,56 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !wasm
+
+// Teonet native client peers discovery module.
+
+package client
+
+import (
+	"fmt"
+	"slices"
+)
+
+// ListPeers returns peers the Teonet client is connected to.
+func (teo *Teonet) ListPeers() (peers []PeerInfo, err error) {
+	addrs := teo.Teonet.Peers()
+	slices.Sort(addrs)
+	peers = make([]PeerInfo, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, PeerInfo{Name: addr})
+	}
+	return
+}
+
+// Resolve returns the connected peer address, the native client has no
+// aliases, so the address is resolved to itself.
+func (teo *Teonet) Resolve(name string) (addr string, err error) {
+	if _, ok := teo.Teonet.Channel(name); !ok {
+		err = fmt.Errorf("peer not connected: %s", name)
+		return
+	}
+	return name, nil
+}
+
+// Describe returns the API description published by the peer: its commands
+// with parameters and return types.
+func (api *APIClient) Describe() (d *APIDescription, err error) {
+	d = &APIDescription{
+		Name:     api.AppName(),
+		Short:    api.AppShort(),
+		Long:     api.AppLong(),
+		Commands: make([]APICommand, 0, len(api.Apis)),
+	}
+	for _, a := range api.Apis {
+		d.Commands = append(d.Commands, APICommand{
+			Name:   a.Name(),
+			Short:  a.Short(),
+			Long:   a.Long(),
+			Usage:  a.Usage(),
+			Return: a.Ret(),
+		})
+	}
+	return
+}
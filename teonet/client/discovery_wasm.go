@@ -0,0 +1,46 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build wasm
+
+// Teonet wasm client peers discovery module.
+
+package client
+
+import (
+	"encoding/json"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// ListPeers returns peers the proxy server is connected to and the proxy
+// server upstreams with their addresses.
+func (teo *Teonet) ListPeers() (peers []PeerInfo, err error) {
+	data, err := teo.request(command.Peers, nil)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &peers)
+	return
+}
+
+// Resolve returns the peer address of the proxy server upstream name. The
+// connected peer address is resolved to itself.
+func (teo *Teonet) Resolve(name string) (addr string, err error) {
+	data, err := teo.request(command.Resolve, []byte(name))
+	addr = string(data)
+	return
+}
+
+// Describe returns the API description published by the peer: its commands
+// with parameters and return types.
+func (api *APIClient) Describe() (d *APIDescription, err error) {
+	data, err := api.teo.request(command.DescribeAPI, []byte(api.addr))
+	if err != nil {
+		return
+	}
+	d = &APIDescription{}
+	err = json.Unmarshal(data, d)
+	return
+}
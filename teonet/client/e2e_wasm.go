@@ -0,0 +1,133 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build wasm
+
+// Teonet wasm client end-to-end encryption module.
+
+package client
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+
+	"github.com/teonet-go/teoproxy/e2e"
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// e2eSessions stores a map of e2e sessions keyed by peer address and the api
+// commands of encrypted requests keyed by packet id, the answers are
+// decrypted with them. It uses a RWMutex for concurrent access control.
+type e2eSessions struct {
+	m        map[string]*e2e.Session
+	commands map[uint32]string
+	*sync.RWMutex
+}
+
+// newE2ESessions creates e2e sessions map.
+func newE2ESessions() *e2eSessions {
+	return &e2eSessions{
+		m:        make(map[string]*e2e.Session),
+		commands: make(map[uint32]string),
+		RWMutex:  &sync.RWMutex{},
+	}
+}
+
+// get returns the peer e2e session.
+func (s *e2eSessions) get(peer string) (sess *e2e.Session, ok bool) {
+	s.RLock()
+	defer s.RUnlock()
+	sess, ok = s.m[peer]
+	return
+}
+
+// set sets the peer e2e session.
+func (s *e2eSessions) set(peer string, sess *e2e.Session) {
+	s.Lock()
+	defer s.Unlock()
+	s.m[peer] = sess
+}
+
+// setCommand sets the api command of encrypted request.
+func (s *e2eSessions) setCommand(id uint32, apiCmd string) {
+	s.Lock()
+	defer s.Unlock()
+	s.commands[id] = apiCmd
+}
+
+// command returns the api command of encrypted request and removes it.
+func (s *e2eSessions) command(id uint32) (apiCmd string) {
+	s.Lock()
+	defer s.Unlock()
+	apiCmd = s.commands[id]
+	delete(s.commands, id)
+	return
+}
+
+// Encrypt exchanges keys with the peer and enables end-to-end encryption of
+// the api commands data, so the proxy server forwards data it can not read.
+// The peerKey is the peer long-term ed25519 public key which signs the peer
+// key exchange answer. After Encrypt the SendTo data is encrypted and the
+// WaitFrom answers of the peer are decrypted. The peer should answer the
+// e2e.KeyExchangeCommand api command and decrypt requests with e2e.Peer.
+// Streams data is not encrypted.
+func (api *APIClient) Encrypt(peerKey ed25519.PublicKey) (err error) {
+	k, err := e2e.NewKeyExchange(peerKey)
+	if err != nil {
+		return
+	}
+	data := append([]byte(api.addr+","), k.Request()...)
+	answer, err := api.teo.request(command.KeyExchange, data)
+	if err != nil {
+		err = fmt.Errorf("can't exchange keys with peer %s, error: %w",
+			api.addr, err)
+		return
+	}
+	sess, err := k.Session(answer)
+	if err != nil {
+		err = fmt.Errorf("can't exchange keys with peer %s, error: %w",
+			api.addr, err)
+		return
+	}
+	api.teo.e2e.set(api.addr, sess)
+	return
+}
+
+// seal encrypts api command data if encryption with the peer is enabled.
+func (teo *Teonet) seal(peer, apiCmd string, data []byte) []byte {
+	if sess, ok := teo.e2e.get(peer); ok {
+		return sess.Seal(apiCmd, data)
+	}
+	return data
+}
+
+// sealRequest encrypts api command data of the request with the given ID
+// like seal and keeps its api command, so openAnswer decrypts the answer.
+func (teo *Teonet) sealRequest(id uint32, peer, apiCmd string,
+	data []byte) []byte {
+
+	if sess, ok := teo.e2e.get(peer); ok {
+		teo.e2e.setCommand(id, apiCmd)
+		return sess.Seal(apiCmd, data)
+	}
+	return data
+}
+
+// open decrypts the peer answer data of the api command if encryption with
+// the peer is enabled.
+func (teo *Teonet) open(peer, apiCmd string, data []byte) ([]byte, error) {
+	if sess, ok := teo.e2e.get(peer); ok {
+		return sess.Open(apiCmd, data)
+	}
+	return data, nil
+}
+
+// openAnswer decrypts the peer answer data of the request with the given ID
+// encrypted by sealRequest and removes the request api command.
+func (teo *Teonet) openAnswer(peer string, id uint32, data []byte) (
+	[]byte, error) {
+
+	return teo.open(peer, teo.e2e.command(id), data)
+}
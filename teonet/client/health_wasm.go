@@ -0,0 +1,109 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build wasm
+
+// Teonet wasm client ping and health monitor module.
+
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// Health is the proxy server connection health reported by the health
+// monitor.
+type Health struct {
+	Healthy  bool          // The last ping is answered
+	Latency  time.Duration // Last answered ping round-trip time
+	PeerRTT  time.Duration // Last answered ping proxy server to peer rtt
+	Err      error         // The last ping error
+	Failures int           // Number of failed pings in a row
+	Time     time.Time     // Time of the last ping
+}
+
+// Ping sends the Ping command to the proxy server and returns the round-trip
+// time when the Pong answer is received. It stops waiting when the ctx is
+// done.
+func (teo *Teonet) Ping(ctx context.Context) (rtt time.Duration, err error) {
+	rtt, _, err = teo.PingPeer(ctx, "")
+	return
+}
+
+// PingPeer sends the Ping command to the proxy server like Ping and returns
+// the round-trip time to the proxy server and the round-trip time from the
+// proxy server to the peer. The peer should be connected with ConnectTo.
+func (teo *Teonet) PingPeer(ctx context.Context, peer string) (rtt,
+	peerRTT time.Duration, err error) {
+
+	start := time.Now()
+	cmd := command.NewPing(teo.getNextID(), start, peer)
+	if err = teo.send(cmd); err != nil {
+		return
+	}
+	answer, err := teo.waitAnswer(ctx, command.Ping.String(), cmd.Id)
+	if err == nil {
+		err = answer.Err
+	}
+	if err != nil {
+		return
+	}
+	pong, err := answer.Pong()
+	if err != nil {
+		return
+	}
+	rtt, peerRTT = time.Since(start), pong.PeerRTT
+	atomic.StoreInt64(&teo.latency, int64(rtt))
+	return
+}
+
+// Latency returns the round-trip time to the proxy server measured by the
+// last answered Ping, zero if no Ping is answered yet.
+func (teo *Teonet) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&teo.latency))
+}
+
+// MonitorHealth pings the proxy server, and the peer if it is not empty, in
+// its own goroutine every interval until the ctx is done, and calls report
+// with the connection health after each ping. The ping which is not answered
+// during the interval fails, so a connection with open websocket and stuck
+// proxy server is reported unhealthy. The peer probe errors are reported
+// unhealthy too.
+func (teo *Teonet) MonitorHealth(ctx context.Context, interval time.Duration,
+	peer string, report func(h Health)) {
+
+	go func() {
+		var h Health
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			h.Time = time.Now()
+			rtt, peerRTT, err := teo.PingPeer(pingCtx, peer)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			h.Healthy, h.Err = err == nil, err
+			if h.Healthy {
+				h.Latency, h.PeerRTT, h.Failures = rtt, peerRTT, 0
+			} else {
+				h.Failures++
+				teo.logger.Debug("proxy server ping failed", "err", h.Err,
+					"failures", h.Failures)
+			}
+			report(h)
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,301 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build wasm
+
+// Teonet wasm client javascript Promise API module.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall/js"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// Export registers the Teonet client in the javascript global object with
+// given name, so javascript code shares the client proxy connection with Go
+// code. The exported object methods return Promises:
+//
+//	teonet.connect()                 resolves with answer text
+//	teonet.disconnect()              resolves with answer text
+//	teonet.connectTo(addr)           resolves with answer text
+//	teonet.newApiClient(addr)        resolves with api object
+//	teonet.peers()                   resolves with array of {name, address}
+//	teonet.resolve(name)             resolves with peer address
+//	api.call(cmd, data, options)     resolves with answer Uint8Array
+//	api.describe()                   resolves with api description object
+//	api.release()                    releases the api object functions
+//
+// The data may be a string or an Uint8Array. The api.call options object may
+// contain the noCache boolean field to bypass the proxy server answers cache
+// and the signal AbortSignal field to cancel the call on the proxy server.
+// The Promises are rejected with Error on proxy server and peer errors, on
+// timeout and on abort. Call api.release when the api object is not used
+// anymore. Export returns the function which removes the object and releases
+// its and not released api objects javascript functions.
+func (teo *Teonet) Export(name string) (release func()) {
+	funcs := newJSFuncs(nil)
+	method := funcs.method
+
+	// text sends the command and resolves with answer text
+	text := func(cmd command.Command, args []js.Value) js.Value {
+		var data []byte
+		if len(args) > 0 {
+			data = []byte(args[0].String())
+		}
+		return promise(func() (any, error) {
+			answer, err := teo.request(cmd, data)
+			return string(answer), err
+		})
+	}
+
+	// object sends the command and resolves with JSON answer object
+	object := func(cmd command.Command, data []byte) js.Value {
+		return promise(func() (any, error) {
+			answer, err := teo.request(cmd, data)
+			if err != nil {
+				return nil, err
+			}
+			return js.Global().Get("JSON").Call("parse", string(answer)), nil
+		})
+	}
+
+	obj := js.Global().Get("Object").New()
+	obj.Set("connect", method(func(args []js.Value) js.Value {
+		return text(command.Connect, nil)
+	}))
+	obj.Set("disconnect", method(func(args []js.Value) js.Value {
+		return text(command.Disconnect, nil)
+	}))
+	obj.Set("connectTo", method(func(args []js.Value) js.Value {
+		return text(command.ConnectTo, args)
+	}))
+	obj.Set("newApiClient", method(func(args []js.Value) js.Value {
+		if len(args) < 1 {
+			return rejected(errors.New("addr argument required"))
+		}
+		addr := args[0].String()
+		return promise(func() (any, error) {
+			if _, err := teo.request(command.NewApiClient,
+				[]byte(addr)); err != nil {
+				return nil, err
+			}
+			api := &APIClient{teo: teo, addr: addr}
+			return api.export(newJSFuncs(funcs), object), nil
+		})
+	}))
+	obj.Set("peers", method(func(args []js.Value) js.Value {
+		return object(command.Peers, nil)
+	}))
+	obj.Set("resolve", method(func(args []js.Value) js.Value {
+		return text(command.Resolve, args)
+	}))
+	js.Global().Set(name, obj)
+
+	return func() {
+		js.Global().Delete(name)
+		funcs.release()
+	}
+}
+
+// jsFuncs keeps javascript functions to release them. The functions of child
+// objects are released with the parent functions. It is safe for concurrent
+// use.
+type jsFuncs struct {
+	parent   *jsFuncs
+	funcs    []js.Func
+	children map[*jsFuncs]struct{}
+	*sync.Mutex
+}
+
+// newJSFuncs creates javascript functions registry, it is the child of the
+// parent registry if parent is not nil.
+func newJSFuncs(parent *jsFuncs) *jsFuncs {
+	f := &jsFuncs{parent: parent, children: make(map[*jsFuncs]struct{}),
+		Mutex: new(sync.Mutex)}
+	if parent != nil {
+		parent.Lock()
+		parent.children[f] = struct{}{}
+		parent.Unlock()
+	}
+	return f
+}
+
+// method wraps f to the javascript function and keeps it for release.
+func (f *jsFuncs) method(fn func(args []js.Value) js.Value) js.Func {
+	jsFn := js.FuncOf(func(this js.Value, args []js.Value) any {
+		return fn(args)
+	})
+	f.Lock()
+	f.funcs = append(f.funcs, jsFn)
+	f.Unlock()
+	return jsFn
+}
+
+// release releases the functions and the child functions and removes the
+// registry from its parent.
+func (f *jsFuncs) release() {
+	if f.parent != nil {
+		f.parent.Lock()
+		delete(f.parent.children, f)
+		f.parent.Unlock()
+	}
+	f.Lock()
+	funcs, children := f.funcs, f.children
+	f.funcs, f.children = nil, make(map[*jsFuncs]struct{})
+	f.Unlock()
+	for child := range children {
+		child.release()
+	}
+	for _, fn := range funcs {
+		fn.Release()
+	}
+}
+
+// export returns javascript api object with the call, describe and release
+// methods.
+func (api *APIClient) export(funcs *jsFuncs,
+	object func(cmd command.Command, data []byte) js.Value) js.Value {
+
+	method := funcs.method
+	obj := js.Global().Get("Object").New()
+	obj.Set("address", api.addr)
+	obj.Set("release", method(func(args []js.Value) js.Value {
+		funcs.release()
+		return js.Undefined()
+	}))
+	obj.Set("describe", method(func(args []js.Value) js.Value {
+		return object(command.DescribeAPI, []byte(api.addr))
+	}))
+	obj.Set("call", method(func(args []js.Value) js.Value {
+		if len(args) < 1 {
+			return rejected(errors.New("cmd argument required"))
+		}
+		apiCmd := args[0].String()
+		var data []byte
+		if len(args) > 1 {
+			data = jsBytes(args[1])
+		}
+		ctx := context.Background()
+		var options js.Value
+		if len(args) > 2 && args[2].Type() == js.TypeObject {
+			options = args[2]
+		}
+		if options.Truthy() && options.Get("noCache").Truthy() {
+			ctx = NoCache(ctx)
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		release := abortOn(options, cancel)
+		return promise(func() (any, error) {
+			defer release()
+			defer cancel()
+			id, err := api.SendToContext(ctx, apiCmd, data)
+			if err != nil {
+				return nil, err
+			}
+			cmd, err := api.teo.waitAnswer(ctx, api.addr, id)
+			if err == nil {
+				err = cmd.Err
+			}
+			var data []byte
+			if err == nil {
+				data, err = api.teo.openAnswer(api.addr, id, cmd.Data)
+			} else {
+				api.teo.e2e.command(id) // Remove the request api command
+			}
+			if err != nil {
+				return nil, err
+			}
+			answer := js.Global().Get("Uint8Array").New(len(data))
+			js.CopyBytesToJS(answer, data)
+			return answer, nil
+		})
+	}))
+	return obj
+}
+
+// abortOn calls cancel when the AbortSignal of the call options signal
+// field aborts. It returns the function which removes the abort listener.
+func abortOn(options js.Value, cancel func()) (release func()) {
+	release = func() {}
+	if !options.Truthy() {
+		return
+	}
+	signal := options.Get("signal")
+	if signal.Type() != js.TypeObject {
+		return
+	}
+	if signal.Get("aborted").Truthy() {
+		cancel()
+		return
+	}
+	abort := js.FuncOf(func(this js.Value, args []js.Value) any {
+		cancel()
+		return nil
+	})
+	signal.Call("addEventListener", "abort", abort)
+	return func() {
+		signal.Call("removeEventListener", "abort", abort)
+		abort.Release()
+	}
+}
+
+// request sends the command with new packet id and waits for the answer. It
+// returns the answer data or the answer error.
+func (teo *Teonet) request(c command.Command, data []byte) ([]byte, error) {
+	cmd := command.New(c, data)
+	cmd.Id = teo.getNextID()
+	if err := teo.send(cmd); err != nil {
+		return nil, err
+	}
+
+	answer, err := teo.waitAnswer(context.Background(), c.String(), cmd.Id)
+	if err != nil {
+		return nil, err
+	}
+	return answer.Data, answer.Err
+}
+
+// jsBytes converts javascript string or Uint8Array to bytes.
+func jsBytes(v js.Value) []byte {
+	if v.Type() == js.TypeString {
+		return []byte(v.String())
+	}
+	if v.InstanceOf(js.Global().Get("Uint8Array")) {
+		data := make([]byte, v.Length())
+		js.CopyBytesToGo(data, v)
+		return data
+	}
+	return nil
+}
+
+// promise returns javascript Promise resolved with f result or rejected with
+// its error. The f runs in a goroutine because it may block.
+func promise(f func() (any, error)) js.Value {
+	var executor js.Func
+	executor = js.FuncOf(func(this js.Value, args []js.Value) any {
+		resolve, reject := args[0], args[1]
+		go func() {
+			defer executor.Release()
+			v, err := f()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(v)
+		}()
+		return nil
+	})
+	return js.Global().Get("Promise").New(executor)
+}
+
+// rejected returns javascript Promise rejected with the error.
+func rejected(err error) js.Value {
+	return js.Global().Get("Promise").Call("reject",
+		js.Global().Get("Error").New(err.Error()))
+}
@@ -0,0 +1,73 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet client options module.
+
+package client
+
+import (
+	"log/slog"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// Option configures the Teonet client.
+type Option func(o *options)
+
+// options contains Teonet client options.
+type options struct {
+	logger       *slog.Logger // Structured logger
+	logPayload   bool         // Log commands data
+	fragmentSize int          // Commands fragment size, 0 if disabled
+	maxMessage   int          // Answers reassembly buffers size
+	compress     int          // Commands compression threshold
+}
+
+// WithLogger sets structured logger of the Teonet client. By default the
+// slog.Default logger is used.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithPayloadLogging enables logging of commands data. It is off by default
+// because commands data may contain user data.
+func WithPayloadLogging(on bool) Option {
+	return func(o *options) { o.logPayload = on }
+}
+
+// WithFragmentSize sets the maximum data size of commands sent to the proxy
+// server, commands with larger data are sent in fragments. The default size
+// is command.DefaultFragmentSize, zero disables fragmentation. The proxy
+// server reassembles up to its maximum message size / command.MinFragmentSize
+// fragments, so the size should not be less than command.MinFragmentSize.
+func WithFragmentSize(size int) Option {
+	return func(o *options) { o.fragmentSize = size }
+}
+
+// WithMaxMessage sets the maximum size of fragmented answers data buffered
+// by the client and of decompressed answers data. The default size is
+// command.DefaultMaxMessage.
+func WithMaxMessage(size int) Option {
+	return func(o *options) { o.maxMessage = size }
+}
+
+// WithCompression sets the minimum data size of commands which are
+// compressed when the proxy server accepts compression. The client accepts
+// compressed answers when the threshold is not zero. The default threshold
+// is command.DefaultCompressThreshold, zero disables compression.
+func WithCompression(threshold int) Option {
+	return func(o *options) { o.compress = threshold }
+}
+
+// newOptions applies opts to default Teonet client options.
+func newOptions(opts ...Option) (o options) {
+	o.logger = slog.Default()
+	o.fragmentSize = command.DefaultFragmentSize
+	o.maxMessage = command.DefaultMaxMessage
+	o.compress = command.DefaultCompressThreshold
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return
+}
@@ -0,0 +1,36 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet client API Command streams module.
+//
+// The APIClient Stream method opens a stream to the peer api command. Write
+// the request data to the stream, then read the answer from it:
+//
+//	s, err := api.Stream("download")
+//	s.Write(request)
+//	s.CloseWrite()
+//	io.Copy(file, s)
+//	s.Close()
+//
+// The wasm client transfers the request and the answer through the Teonet
+// proxy server in chunks with flow-control, so large payloads do not need
+// huge websocket messages. The native client sends the request to the peer
+// directly when the request is closed.
+
+package client
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// streamTimeout is the time to wait for stream packets from the proxy
+// server.
+const streamTimeout = 10 * time.Second
+
+var ErrStreamClosed = errors.New("stream closed")
+
+// Stream implements io.Reader, io.Writer and io.Closer on both client builds.
+var _ io.ReadWriteCloser = (*Stream)(nil)
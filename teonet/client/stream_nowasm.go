@@ -0,0 +1,73 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !wasm
+
+// Teonet native client API Command streams module.
+
+package client
+
+import "bytes"
+
+// Stream is the API Command stream. The native client collects the request
+// data and sends it to the peer when the request is closed, then reads the
+// answer.
+type Stream struct {
+	api     *APIClient    // Peer api client
+	apiCmd  string        // Peer api command
+	request bytes.Buffer  // Request data
+	answer  *bytes.Reader // Answer data, nil until request closed
+	err     error         // Request error
+	closed  bool          // Stream closed
+}
+
+// Stream opens the stream to the peer api command.
+func (api *APIClient) Stream(apiCmd string) (s *Stream, err error) {
+	s = &Stream{api: api, apiCmd: apiCmd}
+	return
+}
+
+// Write writes the request data.
+func (s *Stream) Write(p []byte) (n int, err error) {
+	if s.closed || s.answer != nil || s.err != nil {
+		return 0, ErrStreamClosed
+	}
+	return s.request.Write(p)
+}
+
+// CloseWrite ends the request and sends it to the peer api.
+func (s *Stream) CloseWrite() (err error) {
+	if s.answer != nil || s.err != nil {
+		return s.err
+	}
+	var id int
+	var data []byte
+	id, s.err = s.api.SendTo(s.apiCmd, s.request.Bytes())
+	if s.err == nil {
+		data, s.err = s.api.WaitFrom(s.apiCmd, uint32(id))
+	}
+	s.answer = bytes.NewReader(data)
+	s.request.Reset()
+	return s.err
+}
+
+// Read reads the answer data. It ends the request if it is not ended yet.
+func (s *Stream) Read(p []byte) (n int, err error) {
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+	if s.answer == nil {
+		s.CloseWrite()
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.answer.Read(p)
+}
+
+// Close closes the stream.
+func (s *Stream) Close() error {
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build wasm
+
+// Teonet wasm client API Command streams module.
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// Stream is the API Command stream through the Teonet proxy server. It sends
+// the request data in StreamChunk packets when the server gives credits, and
+// gives the server credits to send answer chunks as the answer is read.
+type Stream struct {
+	teo      *Teonet // Teonet client
+	id       uint32  // Stream packet id
+	readerId string  // Websocket reader id
+
+	mu        sync.Mutex
+	credit    uint32        // Request chunks allowed to send
+	chunks    [][]byte      // Received answer chunks
+	consumed  uint32        // Answer chunks read since last credit
+	ended     bool          // StreamEnd received
+	err       error         // Stream error
+	requested bool          // Request ended
+	closed    bool          // Stream closed
+	notify    chan struct{} // Signals received packets
+}
+
+// Stream opens the stream to the peer api command. It sends StreamStart
+// command and gives the server credits to send the answer.
+func (api *APIClient) Stream(apiCmd string) (s *Stream, err error) {
+	s = &Stream{teo: api.teo, id: api.teo.getNextID(),
+		notify: make(chan struct{}, 1)}
+	s.readerId = api.teo.ws.AddReader(s.process)
+	s.send(command.New(command.StreamStart, []byte(api.addr+","+apiCmd)))
+	s.send(command.NewCredit(s.id, command.StreamWindow))
+	return
+}
+
+// process processes stream packets received from the server.
+func (s *Stream) process(message []byte) bool {
+	cmd := command.NewEmpty()
+	if err := cmd.UnmarshalBinary(message); err != nil || cmd.Id != s.id ||
+		!cmd.Cmd.IsStream() {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd.Cmd {
+	case command.StreamCredit:
+		n, _ := cmd.Credit()
+		s.credit += n
+	case command.StreamChunk:
+		s.chunks = append(s.chunks, append([]byte(nil), cmd.Data...))
+	case command.StreamEnd:
+		s.ended, s.err = true, cmd.Err
+		go s.teo.ws.RemoveReader(s.readerId)
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// send sends the stream command to the server.
+func (s *Stream) send(cmd *command.TeonetCmd) {
+	cmd.Id = s.id
+	data, _ := cmd.MarshalBinary()
+	s.teo.ws.SendMessage(data)
+}
+
+// wait waits for the next stream packet from the server.
+func (s *Stream) wait() error {
+	select {
+	case <-s.notify:
+		return nil
+	case <-time.After(streamTimeout):
+		return fmt.Errorf("timeout")
+	}
+}
+
+// Write writes the request data. It blocks until the server gives credits
+// to send the data chunks.
+func (s *Stream) Write(p []byte) (n int, err error) {
+	for _, chunk := range command.Chunks(p) {
+		for {
+			s.mu.Lock()
+			if s.closed || s.requested || s.ended {
+				err = s.err
+				if err == nil {
+					err = ErrStreamClosed
+				}
+				s.mu.Unlock()
+				return
+			}
+			if s.credit > 0 {
+				s.credit--
+				s.mu.Unlock()
+				break
+			}
+			s.mu.Unlock()
+			if err = s.wait(); err != nil {
+				return
+			}
+		}
+		s.send(command.New(command.StreamChunk, chunk))
+		n += len(chunk)
+	}
+	return
+}
+
+// CloseWrite ends the request. The server sends the request to the peer api
+// and streams its answer.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.requested || s.closed {
+		return nil
+	}
+	s.requested = true
+	s.send(command.New(command.StreamEnd, nil))
+	return nil
+}
+
+// Read reads the answer data. It ends the request if it is not ended yet,
+// and returns io.EOF at the end of the answer or the answer error.
+func (s *Stream) Read(p []byte) (n int, err error) {
+	s.CloseWrite()
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if len(s.chunks) > 0 {
+			n = copy(p, s.chunks[0])
+			if s.chunks[0] = s.chunks[0][n:]; len(s.chunks[0]) == 0 {
+				s.chunks = s.chunks[1:]
+				s.consumed++
+			}
+
+			// Give more credits when half of them used
+			if s.consumed >= command.StreamWindow/2 && !s.ended {
+				s.send(command.NewCredit(s.id, s.consumed))
+				s.consumed = 0
+			}
+			s.mu.Unlock()
+			return
+		}
+		if s.ended {
+			err = s.err
+			if err == nil {
+				err = io.EOF
+			}
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+		if err = s.wait(); err != nil {
+			return
+		}
+	}
+}
+
+// Close closes the stream. The answer chunks which were not read are
+// dropped.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.chunks = nil
+		go s.teo.ws.RemoveReader(s.readerId)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet peers api requests module.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultTimeout is the default time to wait for Teonet peer api answer.
+const DefaultTimeout = 5 * time.Second
+
+var (
+	ErrTimeout        = errors.New("timeout")
+	ErrShutdown       = errors.New("server shutdown")
+	ErrPeerNotAllowed = errors.New("peer not allowed")
+	ErrNoTeonet       = errors.New("server does not use Teonet backend")
+)
+
+// peerAllowed checks peer address in the allowed peers list. All peers are
+// allowed if the list is empty.
+func (teo *TeonetServer) peerAllowed(addr string) error {
+	if len(teo.allowedPeers) == 0 {
+		return nil
+	}
+	if _, ok := teo.allowedPeers[addr]; !ok {
+		return fmt.Errorf("%w: %s", ErrPeerNotAllowed, addr)
+	}
+	return nil
+}
+
+// connectTo connects to the Teonet peer or its upstream if the peer is
+// allowed.
+func (teo *TeonetServer) connectTo(addr string) (err error) {
+	if err = teo.peerAllowed(addr); err != nil {
+		return
+	}
+	teo.Lock()
+	defer teo.Unlock()
+	b, _ := teo.upstream(addr)
+	if err = b.ConnectTo(addr); err != nil {
+		err = fmt.Errorf("can't connect to peer %s, error: %s", addr, err)
+	}
+	return
+}
+
+// newAPIClient returns the api client of the Teonet peer. It creates the api
+// client and adds it to the api clients map if it does not exist yet.
+func (teo *TeonetServer) newAPIClient(addr string) (
+	api APIClient, err error) {
+
+	if err = teo.peerAllowed(addr); err != nil {
+		return
+	}
+	if api, ok := teo.apiClients.Get(addr); ok {
+		return api, nil
+	}
+	b, _ := teo.upstream(addr)
+	if api, err = b.NewAPIClient(addr); err != nil {
+		err = fmt.Errorf("can't connect to peer %s api, error: %s", addr,
+			err.Error())
+		return
+	}
+	teo.apiClients.Add(addr, api)
+	teo.setMetricsCommands(addr, api)
+	return
+}
+
+// setMetricsCommands sets the peer api commands known by metrics from the
+// peer API description, if the api client implements Describer. Commands of
+// peers without description are counted with the other command label.
+func (teo *TeonetServer) setMetricsCommands(addr string, api APIClient) {
+	describer, ok := api.(Describer)
+	if teo.metrics == nil || !ok {
+		return
+	}
+	d, err := describer.Describe()
+	if err != nil {
+		return
+	}
+	commands := make([]string, 0, len(d.Commands))
+	for _, c := range d.Commands {
+		commands = append(commands, c.Name)
+	}
+	teo.metrics.SetCommands(addr, commands...)
+}
+
+// getAPIClient returns the api client of the Teonet peer the proxy server has
+// connected to with NewApiClient command. The peers with upstream are
+// connected on first request.
+func (teo *TeonetServer) getAPIClient(addr string) (
+	api APIClient, err error) {
+
+	api, ok := teo.apiClients.Get(addr)
+	if ok {
+		return
+	}
+	if _, ok = teo.upstreams.Get(addr); ok {
+		if err = teo.connectTo(addr); err != nil {
+			return
+		}
+		return teo.newAPIClient(addr)
+	}
+	err = fmt.Errorf(
+		"can't get api client, error: has not connected to peer api %s",
+		addr,
+	)
+	return
+}
+
+// apiSendTo sends api command with data to the Teonet peer api and waits for
+// the answer up to the server timeout or until the ctx is canceled.
+func (teo *TeonetServer) apiSendTo(ctx context.Context, logger *slog.Logger,
+	api APIClient, peer, apiCommand string, apiData []byte) (
+	data []byte, err error) {
+
+	if err = teo.peerAllowed(peer); err != nil {
+		return
+	}
+
+	logger = logger.With("peer", peer, "api", apiCommand)
+	logger.Debug("send api command", "len", len(apiData))
+
+	// Api answer struct
+	type apiAnswer struct {
+		data []byte
+		err  error
+	}
+	w := make(chan apiAnswer, 1)
+
+	// Send request to api peer
+	teo.inflight.Add(1)
+	defer teo.inflight.Done()
+	start := time.Now()
+	attrs := trace.WithAttributes(
+		attribute.String("teoproxy.peer", peer),
+		attribute.String("teoproxy.api", apiCommand),
+	)
+	_, span := teo.tracer.Start(ctx, "APIClient.SendTo", attrs,
+		trace.WithSpanKind(trace.SpanKindClient))
+	answer := func(data []byte, err error) {
+		logger.Debug("got response from peer", "len", len(data), "err", err)
+		w <- apiAnswer{data, err}
+	}
+	if cs, ok := api.(ContextSender); ok {
+		// The request is stopped when the server stops waiting for answer
+		sendCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		err = cs.SendToContext(sendCtx, apiCommand, apiData, answer)
+	} else {
+		err = api.SendTo(apiCommand, apiData, answer)
+	}
+	endSpan(span, err)
+	if err != nil {
+		err = fmt.Errorf("can't send api command %s to peer %s, error: %w",
+			apiCommand, peer, err)
+		return
+	}
+	_, span = teo.tracer.Start(ctx, "peer reply wait", attrs)
+
+	// Get answer from api peer or timeout
+	var a apiAnswer
+	select {
+	case a = <-w:
+	case <-time.After(teo.timeout):
+		a = apiAnswer{nil, ErrTimeout}
+		teo.metrics.Timeout(peer, apiCommand)
+	case <-teo.done:
+		a = apiAnswer{nil, ErrShutdown}
+	case <-ctx.Done():
+		a = apiAnswer{nil, ctx.Err()}
+	}
+	teo.metrics.SendTo(peer, apiCommand, time.Since(start))
+	data, err = a.data, a.err
+	endSpan(span, err)
+
+	return
+}
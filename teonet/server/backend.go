@@ -0,0 +1,200 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server backend module.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/teonet-go/teonet"
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// pingTimeout is the time to wait for the Teonet peer answer to ping probe.
+const pingTimeout = 2 * time.Second
+
+// Backend is the network the proxy server forwards clients commands to. The
+// TeonetBackend connects to the Teonet network, the MemoryBackend keeps peers
+// in memory and is used in tests.
+type Backend interface {
+	// ConnectTo connects to the peer.
+	ConnectTo(addr string) error
+
+	// NewAPIClient connects to the peer api and returns its api client. The
+	// peer should be connected with ConnectTo before.
+	NewAPIClient(addr string) (APIClient, error)
+
+	// Subscribe calls the reader with data of packets received from the
+	// connected peer until the returned unsubscribe function is called.
+	Subscribe(addr string, reader func(data []byte)) (unsubscribe func(),
+		err error)
+
+	// Close closes the backend.
+	Close()
+}
+
+// Pinger is the optional Backend interface which measures round-trip time to
+// the peer. The proxy server probes peers of the client Ping commands with
+// backends which implement it.
+type Pinger interface {
+	// Ping returns the round-trip time to the connected peer.
+	Ping(addr string) (time.Duration, error)
+}
+
+// PeerLister is the optional Backend interface which lists connected peers.
+// The proxy server answers the client Peers command with peers of backends
+// which implement it and with upstreams.
+type PeerLister interface {
+	// Peers returns addresses of connected peers.
+	Peers() []string
+}
+
+// APIClient is the peer api client.
+type APIClient interface {
+	// SendTo sends the api command with data to the peer. The answer callback
+	// is called once with the peer answer data or error.
+	SendTo(apiCmd string, data []byte, answer func(data []byte, err error)) error
+}
+
+// ContextSender is the optional APIClient interface which sends the api
+// command with context. The proxy server cancels the ctx when it stops
+// waiting for the answer, so the api client can stop the request.
+type ContextSender interface {
+	// SendToContext sends the api command with data to the peer like SendTo
+	// and stops the request when the ctx is done.
+	SendToContext(ctx context.Context, apiCmd string, data []byte,
+		answer func(data []byte, err error)) error
+}
+
+// Describer is the optional APIClient interface which returns the API
+// description published by the peer. The proxy server answers the client
+// DescribeAPI command with api clients which implement it.
+type Describer interface {
+	// Describe returns the peer API description.
+	Describe() (*command.APIDescription, error)
+}
+
+// TeonetBackend is the Backend which connects to the Teonet network.
+type TeonetBackend struct {
+	*teonet.Teonet
+}
+
+// NewTeonetBackend starts Teonet client with the application name and
+// connects to the Teonet network.
+func NewTeonetBackend(appShort string) (b *TeonetBackend, err error) {
+	teo, err := teonet.New(appShort)
+	if err != nil {
+		return
+	}
+	if err = teo.Connect(); err != nil {
+		teo.Close()
+		return
+	}
+	b = &TeonetBackend{teo}
+	return
+}
+
+// ConnectTo connects to the Teonet peer.
+func (b *TeonetBackend) ConnectTo(addr string) error {
+	return b.Teonet.ConnectTo(addr)
+}
+
+// NewAPIClient connects to the Teonet peer api.
+func (b *TeonetBackend) NewAPIClient(addr string) (APIClient, error) {
+	api, err := b.Teonet.NewAPIClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	return teonetAPIClient{api}, nil
+}
+
+// Subscribe subscribes to data packets received from the Teonet peer.
+func (b *TeonetBackend) Subscribe(addr string, reader func(data []byte)) (
+	unsubscribe func(), err error) {
+
+	s, err := b.Teonet.Subscribe(addr, func(c *teonet.Channel,
+		p *teonet.Packet, e *teonet.Event) bool {
+		if e.Event == teonet.EventData {
+			reader(p.Data())
+		}
+		return false
+	})
+	if err != nil {
+		return
+	}
+	unsubscribe = func() { b.Teonet.Unsubscribe(s) }
+	return
+}
+
+// Ping probes the Teonet peer with the API description request, which every
+// Teonet API server answers, and returns the time of its answer. It returns
+// ErrTimeout if the peer does not answer during pingTimeout.
+func (b *TeonetBackend) Ping(addr string) (rtt time.Duration, err error) {
+	if _, ok := b.Teonet.Channel(addr); !ok {
+		err = fmt.Errorf("%w: %s", ErrPeerNotConnected, addr)
+		return
+	}
+
+	// Subscribe to the answer before the request is sent
+	wr := b.Teonet.MakeWaitReader(byte(teonet.CmdServerAPI), pingTimeout, true)
+	s, err := b.Teonet.Subscribe(addr, wr.Reader())
+	if err != nil {
+		return
+	}
+	defer b.Teonet.Unsubscribe(s)
+
+	start := time.Now()
+	_, err = b.Teonet.Command(byte(teonet.CmdServerAPI), nil).SendTo(addr)
+	if err != nil {
+		return
+	}
+	if _, err = b.Teonet.WaitReaderAnswer(wr.Wait(), wr.Timeout()); err != nil {
+		err = ErrTimeout
+		return
+	}
+	rtt = time.Since(start)
+	return
+}
+
+// Peers returns addresses of connected Teonet peers.
+func (b *TeonetBackend) Peers() []string {
+	return b.Teonet.Peers()
+}
+
+// teonetAPIClient adapts Teonet api client to the APIClient interface.
+type teonetAPIClient struct {
+	*teonet.APIClient
+}
+
+// SendTo sends the api command to the Teonet peer.
+func (api teonetAPIClient) SendTo(apiCmd string, data []byte,
+	answer func(data []byte, err error)) (err error) {
+	_, err = api.APIClient.SendTo(apiCmd, data, answer)
+	return
+}
+
+// Describe returns the API description the Teonet peer sent when the api
+// client connected.
+func (api teonetAPIClient) Describe() (*command.APIDescription, error) {
+	d := &command.APIDescription{
+		Name:     api.AppName(),
+		Short:    api.AppShort(),
+		Long:     api.AppLong(),
+		Commands: make([]command.APICommand, 0, len(api.Apis)),
+	}
+	for _, a := range api.Apis {
+		d.Commands = append(d.Commands, command.APICommand{
+			Name:   a.Name(),
+			Short:  a.Short(),
+			Long:   a.Long(),
+			Usage:  a.Usage(),
+			Return: a.Ret(),
+		})
+	}
+	return d, nil
+}
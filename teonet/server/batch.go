@@ -0,0 +1,48 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server batch of api requests module.
+
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// processBatch sends the Batch command items to peers in parallel and waits
+// for all answers. The answer contains the results of items in the requests
+// order, an item error does not fail other items.
+func (teo *TeonetServer) processBatch(ctx context.Context,
+	logger *slog.Logger, cmd *command.TeonetCmd) (data []byte, err error) {
+
+	items, err := command.UnmarshalBatch(cmd.Data)
+	if err != nil {
+		return
+	}
+	logger.Debug("process batch", "items", len(items))
+
+	results := make([]command.BatchResult, len(items))
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			api, err := teo.getAPIClient(item.Peer)
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			results[i].Data, results[i].Err = teo.cachedSendTo(ctx, logger,
+				api, item.Peer, item.Command, item.Data, cmd.NoCache)
+		}()
+	}
+	wg.Wait()
+
+	data = command.MarshalBatchResults(results)
+	return
+}
@@ -0,0 +1,190 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server api answers cache module.
+
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the default maximum size of cached answers data.
+const DefaultCacheSize = 64 << 20
+
+// CacheRule sets the time to keep the peer api command answers in the cache.
+// The empty Peer or Command matches any peer or api command.
+type CacheRule struct {
+	Peer    string        // Peer name
+	Command string        // Api command
+	TTL     time.Duration // Answer lifetime, zero disables caching
+}
+
+// Cache keeps answers of idempotent peer api commands keyed by peer, api
+// command and request data. Answers of commands matched by the rules are
+// kept up to the rule TTL, and the least recently used answers are removed
+// when the cached data size exceeds the maximum size. It is safe for
+// concurrent use.
+type Cache struct {
+	rules   []CacheRule              // TTL rules, the first matched is used
+	maxSize int                      // Maximum size of cached data
+	size    int                      // Size of cached data
+	m       map[string]*list.Element // Entries by key
+	order   *list.List               // Entries from least to most recently used
+	*sync.Mutex
+}
+
+// cacheEntry is the cached answer.
+type cacheEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+// NewCache creates the answers cache with the maximum size of cached data and
+// TTL rules. The DefaultCacheSize is used if maxSize is zero.
+func NewCache(maxSize int, rules ...CacheRule) *Cache {
+	if maxSize == 0 {
+		maxSize = DefaultCacheSize
+	}
+	return &Cache{
+		rules:   rules,
+		maxSize: maxSize,
+		m:       make(map[string]*list.Element),
+		order:   list.New(),
+		Mutex:   &sync.Mutex{},
+	}
+}
+
+// TTL returns the time to keep the peer api command answers, zero if the
+// command is not cached. It returns zero on a nil *Cache.
+func (c *Cache) TTL(peer, apiCmd string) time.Duration {
+	if c == nil {
+		return 0
+	}
+	for _, r := range c.rules {
+		if (r.Peer == "" || r.Peer == peer) &&
+			(r.Command == "" || r.Command == apiCmd) {
+			return r.TTL
+		}
+	}
+	return 0
+}
+
+// Get returns the cached answer of the peer api command with data.
+func (c *Cache) Get(peer, apiCmd string, data []byte) (answer []byte,
+	ok bool) {
+
+	key := cacheKey(peer, apiCmd, data)
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.order.MoveToBack(e)
+	return entry.data, true
+}
+
+// Set caches the answer of the peer api command with data for ttl.
+func (c *Cache) Set(peer, apiCmd string, data, answer []byte,
+	ttl time.Duration) {
+
+	key := cacheKey(peer, apiCmd, data)
+	if len(key)+len(answer) > c.maxSize {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.m[key]; ok {
+		c.remove(e)
+	}
+	entry := &cacheEntry{key, answer, time.Now().Add(ttl)}
+	c.m[key] = c.order.PushBack(entry)
+	c.size += entry.size()
+	for c.size > c.maxSize {
+		c.remove(c.order.Front())
+	}
+}
+
+// Len returns the number of cached answers.
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.m)
+}
+
+// Size returns the size of cached data.
+func (c *Cache) Size() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.size
+}
+
+// remove removes the cache entry.
+func (c *Cache) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*cacheEntry)
+	delete(c.m, entry.key)
+	c.size -= entry.size()
+}
+
+// size returns the cache entry size.
+func (e *cacheEntry) size() int { return len(e.key) + len(e.data) }
+
+// cacheKey returns the cache key of the peer api command with data.
+func cacheKey(peer, apiCmd string, data []byte) string {
+	h := sha256.New()
+	for _, s := range []string{peer, apiCmd} {
+		h.Write(binary.AppendUvarint(nil, uint64(len(s))))
+		h.Write([]byte(s))
+	}
+	h.Write(data)
+	return string(h.Sum(nil))
+}
+
+// cachedSendTo returns the cached answer of the peer api command if the
+// command is cached, or sends the command to the peer and caches its
+// successful answer. The noCache requests are sent to the peer and refresh
+// the cached answer.
+func (teo *TeonetServer) cachedSendTo(ctx context.Context,
+	logger *slog.Logger, api APIClient, peer, apiCommand string,
+	apiData []byte, noCache bool) (data []byte, err error) {
+
+	ttl := teo.cache.TTL(peer, apiCommand)
+	if ttl == 0 {
+		return teo.coalescedSendTo(ctx, logger, api, peer, apiCommand,
+			apiData)
+	}
+	if err = teo.peerAllowed(peer); err != nil {
+		return
+	}
+
+	if !noCache {
+		if data, ok := teo.cache.Get(peer, apiCommand, apiData); ok {
+			logger.Debug("got api answer from cache", "peer", peer,
+				"api", apiCommand, "len", len(data))
+			teo.metrics.Cache(peer, apiCommand, true)
+			return data, nil
+		}
+	}
+	teo.metrics.Cache(peer, apiCommand, false)
+
+	data, err = teo.coalescedSendTo(ctx, logger, api, peer, apiCommand,
+		apiData)
+	if err == nil {
+		teo.cache.Set(peer, apiCommand, apiData, data, ttl)
+	}
+	return
+}
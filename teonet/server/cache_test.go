@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teonet-go/teoproxy/metrics"
+)
+
+func TestCache(t *testing.T) {
+	c := NewCache(200,
+		CacheRule{Peer: "config", Command: "nocache"},
+		CacheRule{Peer: "config", TTL: time.Minute},
+		CacheRule{Command: "short", TTL: 20 * time.Millisecond},
+	)
+
+	// Test case 1: TTL rules, the first matched rule is used
+	for _, test := range []struct {
+		peer, cmd string
+		ttl       time.Duration
+	}{
+		{"config", "get", time.Minute},
+		{"config", "nocache", 0},
+		{"other", "short", 20 * time.Millisecond},
+		{"other", "get", 0},
+	} {
+		if ttl := c.TTL(test.peer, test.cmd); ttl != test.ttl {
+			t.Errorf("expected %s/%s TTL %v, got: %v", test.peer, test.cmd,
+				test.ttl, ttl)
+		}
+	}
+	var nilCache *Cache
+	if ttl := nilCache.TTL("config", "get"); ttl != 0 {
+		t.Errorf("expected zero TTL of nil cache, got: %v", ttl)
+	}
+
+	// Test case 2: answers are keyed by peer, command and data
+	c.Set("config", "get", []byte("a"), []byte("answer a"), time.Minute)
+	if data, ok := c.Get("config", "get", []byte("a")); !ok ||
+		string(data) != "answer a" {
+		t.Errorf("expected cached answer, got: %q %v", data, ok)
+	}
+	for _, key := range [][]string{
+		{"config", "get", "b"}, {"config", "geta", ""}, {"configget", "", "a"},
+	} {
+		if _, ok := c.Get(key[0], key[1], []byte(key[2])); ok {
+			t.Errorf("expected no cached answer of %v", key)
+		}
+	}
+
+	// Test case 3: expired answer is removed
+	c.Set("other", "short", nil, []byte("short"), 20*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("other", "short", nil); ok || c.Len() != 1 {
+		t.Errorf("expected expired answer removed, got: %v %d", ok, c.Len())
+	}
+
+	// Test case 4: least recently used answers are removed
+	c.Set("config", "get", []byte("b"), bytes.Repeat([]byte("b"), 60),
+		time.Minute)
+	c.Get("config", "get", []byte("a"))
+	c.Set("config", "get", []byte("c"), bytes.Repeat([]byte("c"), 60),
+		time.Minute)
+	if _, ok := c.Get("config", "get", []byte("b")); ok {
+		t.Errorf("expected least recently used answer removed")
+	}
+	if _, ok := c.Get("config", "get", []byte("a")); !ok || c.Len() != 2 ||
+		c.Size() > 200 {
+		t.Errorf("expected 2 answers, got: %d, size %d", c.Len(), c.Size())
+	}
+
+	// Test case 5: answer larger than cache is not cached
+	c.Set("config", "get", []byte("d"), make([]byte, 200), time.Minute)
+	if _, ok := c.Get("config", "get", []byte("d")); ok || c.Len() != 2 {
+		t.Errorf("expected too large answer not cached")
+	}
+}
+
+func TestCacheSendTo(t *testing.T) {
+	var calls atomic.Int32
+	b := NewMemoryBackend()
+	b.AddPeer("config").
+		Handle("get", func(data []byte) ([]byte, error) {
+			return []byte("value " + string(data) + " " +
+				string(rune('0'+calls.Add(1)))), nil
+		}).
+		Handle("set", func(data []byte) ([]byte, error) {
+			calls.Add(1)
+			return []byte("ok"), nil
+		})
+	m := metrics.New()
+	teo, url := newTestServer(t, WithBackend(b), WithMetrics(m),
+		WithUpstream("config", b),
+		WithCache(NewCache(0, CacheRule{Command: "get", TTL: time.Minute})))
+	conn := dial(t, teo, url, JSONRPCSubprotocol)
+
+	for i, test := range []struct{ request, expected string }{
+		// Test case 1: answer is cached
+		{`{"jsonrpc":"2.0","method":"api.call","params":["config","get","a"],"id":1}`,
+			`"data":"value a 1"`},
+		{`{"jsonrpc":"2.0","method":"api.call","params":["config","get","a"],"id":2}`,
+			`"data":"value a 1"`},
+
+		// Test case 2: other data is other key
+		{`{"jsonrpc":"2.0","method":"api.call","params":["config","get","b"],"id":3}`,
+			`"data":"value b 2"`},
+
+		// Test case 3: not cached command
+		{`{"jsonrpc":"2.0","method":"api.call","params":["config","set","a"],"id":4}`,
+			`"data":"ok"`},
+		{`{"jsonrpc":"2.0","method":"api.call","params":["config","set","a"],"id":5}`,
+			`"data":"ok"`},
+
+		// Test case 4: client bypasses cache and refreshes the answer
+		{`{"jsonrpc":"2.0","method":"api.call","params":{"peer":"config",` +
+			`"command":"get","data":"a","noCache":true},"id":6}`,
+			`"data":"value a 5"`},
+		{`{"jsonrpc":"2.0","method":"api.call","params":["config","get","a"],"id":7}`,
+			`"data":"value a 5"`},
+	} {
+		if got := call(t, conn, test.request); !strings.Contains(got,
+			test.expected) {
+			t.Errorf("test %d: expected response with %s, got: %s", i+1,
+				test.expected, got)
+		}
+	}
+	if n := calls.Load(); n != 5 {
+		t.Errorf("expected 5 peer calls, got: %d", n)
+	}
+
+	// Test case 5: cache metrics
+	var buf bytes.Buffer
+	m.Write(&buf)
+	for _, line := range []string{
+		`teoproxy_cache_hits_total{command="get",peer="config"} 2`,
+		`teoproxy_cache_misses_total{command="get",peer="config"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected line: %s, got:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server requests cancellation module.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+	ws "github.com/teonet-go/teoproxy/ws/server"
+)
+
+// Requests stores cancel functions of client requests waiting for peer
+// answers, keyed by session id and request packet id. It uses a Mutex for
+// concurrent access control.
+type Requests struct {
+	m map[streamKey]context.CancelFunc
+	*sync.Mutex
+}
+
+// initRequests initializes the requests field of the TeonetServer.
+func (teo *TeonetServer) initRequests() {
+	teo.requests = &Requests{
+		m:     make(map[streamKey]context.CancelFunc),
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// add adds the request cancel function. It returns false if the request
+// with the same key already exists.
+func (r *Requests) add(key streamKey, cancel context.CancelFunc) bool {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.m[key]; ok {
+		return false
+	}
+	r.m[key] = cancel
+	return true
+}
+
+// remove removes the request.
+func (r *Requests) remove(key streamKey) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.m, key)
+}
+
+// cancel cancels and removes the request. It returns false if the request
+// does not exist.
+func (r *Requests) cancel(key streamKey) bool {
+	r.Lock()
+	cancel, ok := r.m[key]
+	delete(r.m, key)
+	r.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// Len returns the number of requests waiting for peer answers.
+func (r *Requests) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.m)
+}
+
+// cancelable returns true if the command waits for peer answers and may be
+// canceled by the client.
+func cancelable(c command.Command) bool {
+	switch c {
+	case command.ApiSendTo, command.KeyExchange, command.Batch:
+		return true
+	}
+	return false
+}
+
+// processRequest processes the cancelable command in the session goroutine,
+// so the session reads next commands, and the Cancel command among them,
+// while the command waits for peer answers. The request context is canceled
+// by the Cancel command, when the client disconnects and at the shutdown
+// deadline. On server shutdown the session waits for the request and sends
+// its answer before its context is canceled. The canceled command is not
+// answered.
+func (teo *TeonetServer) processRequest(ctx context.Context, sess *ws.Session,
+	logger *slog.Logger, cmd *command.TeonetCmd) (err error) {
+
+	key := streamKey{sess.ID(), cmd.Id}
+	ctx, cancel := context.WithCancel(ctx)
+	if !teo.requests.add(key, cancel) {
+		cancel()
+		return fmt.Errorf("request %d already exists", cmd.Id)
+	}
+
+	sess.Go(func() {
+		defer cancel()
+		go func() {
+			select {
+			case <-teo.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		data, err := teo.execCommand(ctx, logger, sess.ID(), cmd)
+		teo.requests.remove(key)
+		switch {
+		case ctx.Err() != nil:
+			logger.Debug("request canceled")
+		case err != nil:
+			logger.Warn("failed to process message from client",
+				"err", fmt.Errorf("process command, error: %w", err))
+		default:
+			if err = teo.answer(sess, cmd, data); err != nil {
+				logger.Warn("failed to process message from client",
+					"err", err)
+			}
+		}
+	})
+	return
+}
+
+// processCancel cancels the client request or stream with the Cancel command
+// packet id. The request or stream which has already been answered is not
+// found, it is not an error.
+func (teo *TeonetServer) processCancel(sess *ws.Session, logger *slog.Logger,
+	cmd *command.TeonetCmd) {
+
+	if teo.requests.cancel(streamKey{sess.ID(), cmd.Id}) {
+		logger.Debug("request canceled by client")
+		return
+	}
+	if st, ok := teo.streams.get(sess.ID(), cmd.Id); ok {
+		st.cancel()
+		st.finish(context.Canceled)
+		logger.Debug("stream canceled by client")
+		return
+	}
+	logger.Debug("canceled request not found")
+}
@@ -0,0 +1,143 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server api requests coalescing module.
+
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// CoalesceRule enables coalescing of the peer api command requests. The
+// empty Peer or Command matches any peer or api command.
+type CoalesceRule struct {
+	Peer    string // Peer name
+	Command string // Api command
+}
+
+// Coalescer coalesces identical concurrent requests of the peer api commands
+// matched by the rules: the first request is sent to the peer, and the
+// requests with the same peer, api command and data which come while it waits
+// for the answer get the same answer. It is safe for concurrent use.
+type Coalescer struct {
+	rules []CoalesceRule
+	m     map[string]*flight // In-flight requests by key
+	*sync.Mutex
+}
+
+// flight is the in-flight request.
+type flight struct {
+	done    chan struct{} // Closed when the answer is received
+	data    []byte        // Answer data
+	err     error         // Answer error
+	waiters int           // Number of coalesced requests
+}
+
+// NewCoalescer creates requests coalescer with rules.
+func NewCoalescer(rules ...CoalesceRule) *Coalescer {
+	return &Coalescer{
+		rules: rules,
+		m:     make(map[string]*flight),
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// Enabled returns true if the peer api command requests are coalesced. It
+// returns false on a nil *Coalescer.
+func (c *Coalescer) Enabled(peer, apiCmd string) bool {
+	if c == nil {
+		return false
+	}
+	for _, r := range c.rules {
+		if (r.Peer == "" || r.Peer == peer) &&
+			(r.Command == "" || r.Command == apiCmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// Do calls send for the first of identical concurrent requests and returns
+// its answer to all of them. The shared is true if the request got the answer
+// of other request. The request stops waiting when its ctx is canceled, the
+// send goes on for other requests, so it must not depend on the ctx of the
+// first request.
+func (c *Coalescer) Do(ctx context.Context, peer, apiCmd string, data []byte,
+	send func() ([]byte, error)) (answer []byte, shared bool, err error) {
+
+	key := cacheKey(peer, apiCmd, data)
+	c.Lock()
+	f, shared := c.m[key]
+	if shared {
+		f.waiters++
+	} else {
+		f = &flight{done: make(chan struct{})}
+		c.m[key] = f
+		go func() {
+			f.data, f.err = send()
+			c.Lock()
+			delete(c.m, key)
+			c.Unlock()
+			close(f.done)
+		}()
+	}
+	c.Unlock()
+
+	select {
+	case <-f.done:
+		return f.data, shared, f.err
+	case <-ctx.Done():
+		if shared {
+			c.Lock()
+			f.waiters--
+			c.Unlock()
+		}
+		return nil, shared, ctx.Err()
+	}
+}
+
+// Len returns the number of in-flight requests.
+func (c *Coalescer) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.m)
+}
+
+// waiters returns the number of requests waiting for in-flight requests.
+func (c *Coalescer) waiters() (n int) {
+	c.Lock()
+	defer c.Unlock()
+	for _, f := range c.m {
+		n += f.waiters
+	}
+	return
+}
+
+// coalescedSendTo sends api command to the peer and waits for the answer.
+// Identical concurrent requests of commands with coalescing enabled wait for
+// the answer of the first request instead of sending their own. The first
+// request is sent to the peer even if its ctx is canceled while others wait.
+func (teo *TeonetServer) coalescedSendTo(ctx context.Context,
+	logger *slog.Logger, api APIClient, peer, apiCommand string,
+	apiData []byte) (data []byte, err error) {
+
+	if !teo.coalescer.Enabled(peer, apiCommand) {
+		return teo.apiSendTo(ctx, logger, api, peer, apiCommand, apiData)
+	}
+	sendCtx := context.WithoutCancel(ctx)
+	data, shared, err := teo.coalescer.Do(ctx, peer, apiCommand, apiData,
+		func() ([]byte, error) {
+			return teo.apiSendTo(sendCtx, logger, api, peer, apiCommand,
+				apiData)
+		})
+	if shared {
+		logger.Debug("got coalesced api answer", "peer", peer,
+			"api", apiCommand, "len", len(data), "err", err)
+		teo.metrics.Coalesced(peer, apiCommand)
+	}
+	return
+}
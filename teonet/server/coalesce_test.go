@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	const requests = 10
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	b := NewMemoryBackend()
+	b.AddPeer("catalog").
+		Handle("get", func(data []byte) ([]byte, error) {
+			calls.Add(1)
+			<-release
+			return []byte("items " + string(data)), nil
+		}).
+		Handle("fail", func(data []byte) ([]byte, error) {
+			calls.Add(1)
+			<-release
+			return nil, fmt.Errorf("peer error")
+		})
+	teo, _ := newTestServer(t, WithBackend(b), WithUpstream("catalog", b),
+		WithCoalescing(CoalesceRule{Peer: "catalog", Command: "get"},
+			CoalesceRule{Command: "fail"}))
+	ts := httptest.NewServer(teo.RestHandler("/api"))
+	t.Cleanup(ts.Close)
+
+	// post sends concurrent REST requests and returns their answers
+	post := func(n int, path, body string) (answers []string) {
+		answers = make([]string, n)
+		var wg sync.WaitGroup
+		for i := range answers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := http.Post(ts.URL+path, "text/plain",
+					strings.NewReader(body))
+				if err != nil {
+					answers[i] = err.Error()
+					return
+				}
+				data, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+				answers[i] = strings.TrimSpace(string(data))
+			}()
+		}
+		wg.Wait()
+		return answers
+	}
+
+	// wait waits for n coalesced requests and releases the peer
+	wait := func(n int) {
+		for i := 0; teo.coalescer.waiters() != n; i++ {
+			if i > 200 {
+				t.Fatalf("expected %d coalesced requests, got: %d", n,
+					teo.coalescer.waiters())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		release <- struct{}{}
+	}
+
+	for i, test := range []struct {
+		path, body, expected string
+		calls                int32
+	}{
+		// Test case 1: identical requests are sent to the peer once
+		{"/api/catalog/get", "a", "items a", 1},
+
+		// Test case 2: all waiters get the peer error
+		{"/api/catalog/fail", "a", "peer error", 1},
+	} {
+		calls.Store(0)
+		var answers []string
+		done := make(chan struct{})
+		go func() {
+			answers = post(requests, test.path, test.body)
+			close(done)
+		}()
+		wait(requests - 1)
+		<-done
+		if n := calls.Load(); n != test.calls {
+			t.Errorf("test %d: expected %d peer calls, got: %d", i+1,
+				test.calls, n)
+		}
+		for _, answer := range answers {
+			if answer != test.expected {
+				t.Errorf("test %d: expected answer %q, got: %q", i+1,
+					test.expected, answer)
+			}
+		}
+	}
+
+	// Test case 3: requests with other data and not coalesced commands are
+	// sent to the peer
+	if !teo.coalescer.Enabled("catalog", "get") ||
+		teo.coalescer.Enabled("catalog", "set") ||
+		!teo.coalescer.Enabled("other", "fail") {
+		t.Errorf("wrong coalescing rules")
+	}
+	calls.Store(0)
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, body := range []string{"a", "b"} {
+			wg.Add(1)
+			go func() { defer wg.Done(); post(1, "/api/catalog/get", body) }()
+		}
+		wg.Wait()
+		close(done)
+	}()
+	for i := 0; calls.Load() != 2; i++ {
+		if i > 200 {
+			t.Fatalf("expected 2 peer calls, got: %d", calls.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	release <- struct{}{}
+	release <- struct{}{}
+	<-done
+	if n := teo.coalescer.Len(); n != 0 {
+		t.Errorf("expected no in-flight requests, got: %d", n)
+	}
+}
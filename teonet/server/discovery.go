@@ -0,0 +1,114 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server peers discovery module.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// peerAddress returns the Teonet address of the peer upstream, the upstream
+// name is the alias of the address. Addresses of other upstreams are internal
+// service urls and host:port which are never sent to clients.
+func peerAddress(b Backend) (addr string, ok bool) {
+	u, ok := b.(*PeerUpstream)
+	if ok {
+		addr = u.Address()
+	}
+	return
+}
+
+// listPeers returns allowed peers the server backend is connected to and
+// upstreams with addresses of Teonet peer upstreams.
+func (teo *TeonetServer) listPeers() (peers []command.PeerInfo) {
+	names := make(map[string]string)
+	if l, ok := teo.backend.(PeerLister); ok {
+		for _, addr := range l.Peers() {
+			names[addr] = ""
+		}
+	}
+	for _, name := range teo.upstreams.Names() {
+		b, _ := teo.upstreams.Get(name)
+		names[name], _ = peerAddress(b)
+	}
+
+	peers = make([]command.PeerInfo, 0, len(names))
+	for name, addr := range names {
+		if teo.peerAllowed(name) == nil {
+			peers = append(peers, command.PeerInfo{Name: name, Address: addr})
+		}
+	}
+	slices.SortFunc(peers, func(a, b command.PeerInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return
+}
+
+// resolve returns the address of the allowed peer name. The Teonet peer
+// upstream name is resolved to its address, other upstreams names and the
+// connected peer address are resolved to themselves.
+func (teo *TeonetServer) resolve(name string) (addr string, err error) {
+	if err = teo.peerAllowed(name); err != nil {
+		return
+	}
+	if b, ok := teo.upstreams.Get(name); ok {
+		if addr, ok := peerAddress(b); ok {
+			return addr, nil
+		}
+		return name, nil
+	}
+	if l, ok := teo.backend.(PeerLister); ok && slices.Contains(l.Peers(),
+		name) {
+		return name, nil
+	}
+	err = fmt.Errorf("%w: %s", ErrPeerNotFound, name)
+	return
+}
+
+// describeAPI returns the API description of the peer the server has
+// connected to with NewApiClient command.
+func (teo *TeonetServer) describeAPI(peer string) (d *command.APIDescription,
+	err error) {
+
+	if err = teo.peerAllowed(peer); err != nil {
+		return
+	}
+	api, err := teo.getAPIClient(peer)
+	if err != nil {
+		return
+	}
+	describer, ok := api.(Describer)
+	if !ok {
+		err = fmt.Errorf("can't describe peer %s api, error: %w", peer,
+			ErrNotSupported)
+		return
+	}
+	return describer.Describe()
+}
+
+// processDiscovery processes the Peers, Resolve and DescribeAPI commands.
+func (teo *TeonetServer) processDiscovery(cmd *command.TeonetCmd) (
+	data []byte, err error) {
+
+	switch cmd.Cmd {
+	case command.Peers:
+		return json.Marshal(teo.listPeers())
+	case command.Resolve:
+		addr, err := teo.resolve(string(cmd.Data))
+		return []byte(addr), err
+	default:
+		d, err := teo.describeAPI(string(cmd.Data))
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(d)
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+func TestDiscovery(t *testing.T) {
+	const addr = "8agv3IrXQk7INHy5rVlbCxMWVmOOCoQgZBF"
+	b := NewMemoryBackend()
+	b.AddPeer(addr).
+		Handle("fortb", func(data []byte) ([]byte, error) { return nil, nil }).
+		Handle("info", func(data []byte) ([]byte, error) { return nil, nil }).
+		Describe(command.APICommand{Name: "fortb", Short: "get fortune",
+			Return: "text"})
+	b.AddPeer("hidden")
+	teo, url := newTestServer(t, WithBackend(b),
+		WithUpstream("fortune", NewPeerUpstream(b, addr)),
+		WithUpstream("http", NewHTTPUpstream("http://127.0.0.1:1", nil)),
+		WithAllowedPeers("fortune", "http", addr))
+	conn := dial(t, teo, url)
+
+	peers := func(id uint32) (peers []command.PeerInfo) {
+		answer := request(t, conn, id, command.Peers, "")
+		if err := json.Unmarshal(answer.Data, &peers); err != nil {
+			t.Fatalf("can't unmarshal peers: %v", err)
+		}
+		return
+	}
+
+	// Test case 1: upstreams are listed with addresses of Teonet peers only,
+	// internal service urls are not sent to clients
+	expected := []command.PeerInfo{{Name: "fortune", Address: addr},
+		{Name: "http"}}
+	if got := peers(1); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected peers %v, got: %v", expected, got)
+	}
+
+	// Test case 2: connected allowed peers are listed
+	b.ConnectTo("hidden")
+	request(t, conn, 2, command.ConnectTo, addr)
+	expected = append([]command.PeerInfo{{Name: addr}}, expected...)
+	if got := peers(3); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected peers %v, got: %v", expected, got)
+	}
+
+	// Test case 3: resolve aliases and addresses
+	for i, name := range []string{"fortune", addr} {
+		answer := request(t, conn, uint32(i+4), command.Resolve, name)
+		if string(answer.Data) != addr {
+			t.Errorf("expected %s resolved to %s, got: %s", name, addr,
+				answer.Data)
+		}
+	}
+	if answer := request(t, conn, 7, command.Resolve, "http"); string(
+		answer.Data) != "http" {
+		t.Errorf("expected http upstream resolved to its name, got: %s",
+			answer.Data)
+	}
+	if _, err := teo.resolve("hidden"); !errors.Is(err, ErrPeerNotAllowed) {
+		t.Errorf("expected ErrPeerNotAllowed, got: %v", err)
+	}
+
+	// Test case 4: describe peer api
+	answer := request(t, conn, 6, command.DescribeAPI, "fortune")
+	var d command.APIDescription
+	if err := json.Unmarshal(answer.Data, &d); err != nil {
+		t.Fatalf("can't unmarshal api description: %v", err)
+	}
+	if !reflect.DeepEqual(d.Commands, []command.APICommand{
+		{Name: "fortb", Short: "get fortune", Return: "text"},
+		{Name: "info"},
+	}) {
+		t.Errorf("expected fortune api commands, got: %v", d.Commands)
+	}
+	if _, err := teo.describeAPI("http"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, got: %v", err)
+	}
+}
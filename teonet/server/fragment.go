@@ -0,0 +1,109 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server commands fragmentation module.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+	ws "github.com/teonet-go/teoproxy/ws/server"
+)
+
+// Reassemblers stores a map of client sessions fragments reassembly buffers,
+// keyed by session id. It uses a RWMutex for concurrent access control.
+type Reassemblers struct {
+	m map[string]*command.Reassembler
+	*sync.RWMutex
+}
+
+// initReassemblers initializes the reassemblers field of the TeonetServer.
+func (teo *TeonetServer) initReassemblers() {
+	teo.reassemblers = &Reassemblers{
+		m:       make(map[string]*command.Reassembler),
+		RWMutex: &sync.RWMutex{},
+	}
+}
+
+// get returns the session reassembler, it creates the reassembler with create
+// function if the session does not have one yet. The reassembler is removed
+// when the session is closed.
+func (r *Reassemblers) get(sess *ws.Session,
+	create func() *command.Reassembler) *command.Reassembler {
+
+	r.RLock()
+	re, ok := r.m[sess.ID()]
+	r.RUnlock()
+	if ok {
+		return re
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if re, ok = r.m[sess.ID()]; ok {
+		return re
+	}
+	re = create()
+	r.m[sess.ID()] = re
+	go func() {
+		<-sess.Context().Done()
+		r.Lock()
+		delete(r.m, sess.ID())
+		r.Unlock()
+	}()
+	return re
+}
+
+// Len returns the number of sessions reassemblers.
+func (r *Reassemblers) Len() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.m)
+}
+
+// reassemble adds the command fragment to the session reassembly buffer. It
+// returns the whole command and true when all fragments are received. Not
+// fragmented commands are returned as is. The session reassembler buffers up
+// to maxMessage bytes of command.DefaultMaxIncomplete commands, so clients
+// can't allocate more memory with many commands or fragments.
+func (teo *TeonetServer) reassemble(sess *ws.Session,
+	cmd *command.TeonetCmd) (*command.TeonetCmd, bool, error) {
+
+	if cmd.Fragments == 0 {
+		return cmd, true, nil
+	}
+	r := teo.reassemblers.get(sess, func() *command.Reassembler {
+		return command.NewReassembler(teo.maxMessage,
+			command.DefaultFragmentTTL)
+	})
+	whole, ok, err := r.Add(cmd)
+	if err != nil {
+		err = fmt.Errorf("can't reassemble teonet command, error: %w", err)
+	}
+	return whole, ok, err
+}
+
+// sendFragments sends the command to the client session in fragments if its
+// data is larger than the fragment size.
+func (teo *TeonetServer) sendFragments(sess *ws.Session,
+	cmd *command.TeonetCmd) error {
+
+	cmds, err := cmd.Split(teo.fragmentSize)
+	if err != nil {
+		return err
+	}
+	for _, c := range cmds {
+		data, err := c.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err = sess.Send(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+func TestFragment(t *testing.T) {
+	teo, url := newTestServer(t)
+	teo.fragmentSize = 4
+	conn := dial(t, teo, url)
+
+	// Test case 1: fragmented command is processed when all fragments are
+	// received and its answer is sent in fragments
+	cmd := command.New(command.Connect, []byte("fragmented data"))
+	cmd.Id = 1
+	cmds, err := cmd.Split(4)
+	if err != nil {
+		t.Fatalf("can't split command: %v", err)
+	}
+	for _, c := range cmds {
+		sendCmd(t, conn, c)
+	}
+	r := command.NewReassembler(command.DefaultMaxMessage,
+		command.DefaultFragmentTTL)
+	var answer *command.TeonetCmd
+	for n := 0; answer == nil; n++ {
+		fragment := readCmd(t, conn)
+		if fragment.Fragments == 0 {
+			t.Fatalf("expected answer fragment")
+		}
+		whole, ok, err := r.Add(fragment)
+		if err != nil {
+			t.Fatalf("can't reassemble answer: %v", err)
+		}
+		if ok {
+			answer = whole
+		}
+	}
+	if answer.Id != 1 || string(answer.Data) != "Connected to Teonet" {
+		t.Errorf("unexpected answer: %d %s", answer.Id, answer.Data)
+	}
+
+	// Test case 2: fragments larger than the session limit are dropped
+	teo.fragmentSize, teo.maxMessage = 0, 8
+	conn = dial(t, teo, url)
+	cmd.Id = 2
+	for _, c := range cmds {
+		sendCmd(t, conn, c)
+	}
+	cmd = command.New(command.Connect, nil)
+	cmd.Id = 3
+	sendCmd(t, conn, cmd)
+	if answer = readCmd(t, conn); answer.Id != 3 {
+		t.Errorf("expected answer to command 3, got: %d", answer.Id)
+	}
+
+	// Test case 3: incomplete commands and their fragments are limited
+	teo.maxMessage = command.DefaultMaxMessage
+	conn = dial(t, teo, url)
+	for id := uint32(10); id <= 10+command.DefaultMaxIncomplete; id++ {
+		sendCmd(t, conn, &command.TeonetCmd{Id: id, Cmd: command.Connect,
+			Data: []byte("x"), Fragments: 2})
+	}
+	sendCmd(t, conn, &command.TeonetCmd{Id: 100, Cmd: command.Connect,
+		Fragments: 0xFFFF})
+	cmd = command.New(command.Connect, nil)
+	cmd.Id = 4
+	sendCmd(t, conn, cmd)
+	if answer = readCmd(t, conn); answer.Id != 4 {
+		t.Errorf("expected answer to command 4, got: %d", answer.Id)
+	}
+	teo.reassemblers.RLock()
+	defer teo.reassemblers.RUnlock()
+	for _, r := range teo.reassemblers.m {
+		if n := r.Len(); n > command.DefaultMaxIncomplete {
+			t.Errorf("expected up to %d incomplete commands, got: %d",
+				command.DefaultMaxIncomplete, n)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	teo, url := newTestServer(t)
+	conn := dial(t, teo, url)
+
+	// Test case 1: compressed command is decompressed and the answer
+	// announces accepted codecs to the client which accepts compression
+	cmd := command.New(command.Connect,
+		[]byte(strings.Repeat("compressed data ", 100)))
+	cmd.Id, cmd.Accept = 1, command.SupportedCodecs
+	cmd.Compress(command.SupportedCodecs, command.DefaultCompressThreshold)
+	if cmd.Codec != command.CodecDeflate {
+		t.Fatalf("expected compressed command")
+	}
+	sendCmd(t, conn, cmd)
+	answer := readCmd(t, conn)
+	if answer.Id != 1 || answer.Accept != command.SupportedCodecs {
+		t.Errorf("expected answer with accepted codecs, got: %d %d", answer.Id,
+			answer.Accept)
+	}
+
+	// Test case 2: answer to the client which does not accept compression
+	// has no compression header fields
+	cmd = command.New(command.Connect, nil)
+	cmd.Id = 2
+	sendCmd(t, conn, cmd)
+	if answer = readCmd(t, conn); answer.Accept != 0 || answer.Codec != 0 {
+		t.Errorf("expected answer without compression fields")
+	}
+
+	// Test case 3: command with unknown codec is dropped
+	cmd.Id, cmd.Codec = 3, 7
+	sendCmd(t, conn, cmd)
+	cmd.Id, cmd.Codec = 4, 0
+	sendCmd(t, conn, cmd)
+	if answer = readCmd(t, conn); answer.Id != 4 {
+		t.Errorf("expected answer to command 4, got: %d", answer.Id)
+	}
+}
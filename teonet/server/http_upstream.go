@@ -0,0 +1,117 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server HTTP upstream module.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// httpMaxAnswer is the maximum size of HTTP upstream answer body.
+const httpMaxAnswer = 64 << 20
+
+// ErrAnswerTooBig is returned when the upstream answer is larger than the
+// maximum size.
+var ErrAnswerTooBig = errors.New("upstream answer too big")
+
+// HTTPUpstream is the upstream which sends api commands to a HTTP service.
+// The api command is sent as request:
+//
+//	POST {baseURL}/{command}
+//
+// with command data in the request body, and the response body is the
+// answer. Responses with status other than 2xx are errors with the response
+// body text. Answers larger than 64 MB are errors.
+type HTTPUpstream struct {
+	baseURL   string
+	client    *http.Client
+	maxAnswer int64 // Maximum size of answer body
+}
+
+// NewHTTPUpstream creates HTTP upstream with base URL. If client is nil the
+// client with DefaultTimeout is used. Requests are also stopped when the
+// proxy server stops waiting for the answer.
+func NewHTTPUpstream(baseURL string, client *http.Client) *HTTPUpstream {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	return &HTTPUpstream{strings.TrimSuffix(baseURL, "/"), client,
+		httpMaxAnswer}
+}
+
+// ConnectTo does nothing, HTTP requests use their own connections.
+func (u *HTTPUpstream) ConnectTo(string) error { return nil }
+
+// NewAPIClient returns the HTTP service api client.
+func (u *HTTPUpstream) NewAPIClient(string) (APIClient, error) {
+	return u, nil
+}
+
+// Subscribe returns ErrNotSupported, HTTP service does not send data itself.
+func (u *HTTPUpstream) Subscribe(string, func(data []byte)) (func(), error) {
+	return nil, ErrNotSupported
+}
+
+// Address returns the service base URL.
+func (u *HTTPUpstream) Address() string { return u.baseURL }
+
+// Close closes idle connections.
+func (u *HTTPUpstream) Close() { u.client.CloseIdleConnections() }
+
+// SendTo sends the api command request to the HTTP service.
+func (u *HTTPUpstream) SendTo(apiCmd string, data []byte,
+	answer func(data []byte, err error)) (err error) {
+	return u.SendToContext(context.Background(), apiCmd, data, answer)
+}
+
+// SendToContext sends the api command request to the HTTP service and stops
+// it when the ctx is done. The api command is escaped in the request path,
+// the "." and ".." commands are errors.
+func (u *HTTPUpstream) SendToContext(ctx context.Context, apiCmd string,
+	data []byte, answer func(data []byte, err error)) (err error) {
+
+	if apiCmd == "" || apiCmd == "." || apiCmd == ".." {
+		return fmt.Errorf("wrong api command %q", apiCmd)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		u.baseURL+"/"+url.PathEscape(apiCmd), bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	go func() { answer(u.do(req)) }()
+	return
+}
+
+// do sends the request and returns the response body. The body larger than
+// maxAnswer is the error, it is not truncated.
+func (u *HTTPUpstream) do(req *http.Request) (data []byte, err error) {
+	res, err := u.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	data, err = io.ReadAll(io.LimitReader(res.Body, u.maxAnswer+1))
+	if err != nil {
+		return
+	}
+	if int64(len(data)) > u.maxAnswer {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrAnswerTooBig,
+			u.maxAnswer)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		err = fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(data))
+		data = nil
+	}
+	return
+}
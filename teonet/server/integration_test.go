@@ -0,0 +1,491 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/teonet-go/teoproxy/e2e"
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// testTimeout is the peer api answer timeout of integration tests.
+const testTimeout = 200 * time.Millisecond
+
+// newIntegrationServer creates the test server with in-memory peers:
+//
+//	fortune  answers fortb, fail and e2e commands
+//	slow     answers wait command when the release channel is closed
+//	other    is not allowed
+//
+// The started channel gets a value when the slow peer gets a request.
+func newIntegrationServer(t *testing.T, timeout time.Duration) (
+	teo *TeonetServer, url string, peerKey ed25519.PublicKey,
+	started chan struct{}) {
+
+	b := NewMemoryBackend()
+	teo, url = newTestServer(t, WithBackend(b), WithTimeout(timeout),
+		WithAllowedPeers("fortune", "slow", "absent"))
+
+	peerKey, signKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("can't generate peer key: %v", err)
+	}
+	peer := e2e.NewPeer(signKey, e2e.DefaultMaxSessions)
+	b.AddPeer("fortune").
+		Handle("fortb", func(data []byte) ([]byte, error) {
+			return append([]byte("fortune: "), data...), nil
+		}).
+		Handle("fail", func(data []byte) ([]byte, error) {
+			return nil, errors.New("peer error")
+		}).
+		Handle(e2e.KeyExchangeCommand, peer.KeyExchange).
+		Handle("secret", func(data []byte) ([]byte, error) {
+			request, s, err := peer.Open("secret", data)
+			if err != nil {
+				return nil, err
+			}
+			return s.Seal("secret", append([]byte("secret: "), request...)), nil
+		})
+
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	started = make(chan struct{}, 1)
+	b.AddPeer("slow").Handle("wait", func(data []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-release
+		return data, nil
+	})
+	b.AddPeer("other")
+	return
+}
+
+// request sends the binary protocol command and reads the answer.
+func request(t *testing.T, conn *websocket.Conn, id uint32,
+	cmd command.Command, data string) *command.TeonetCmd {
+
+	c := command.New(cmd, []byte(data))
+	c.Id = id
+	sendCmd(t, conn, c)
+	answer := readCmd(t, conn)
+	if answer.Id != id || answer.Cmd != cmd {
+		t.Fatalf("expected answer %d %v, got: %d %v", id, cmd, answer.Id,
+			answer.Cmd)
+	}
+	return answer
+}
+
+func TestIntegration(t *testing.T) {
+	teo, url, peerKey, _ := newIntegrationServer(t, testTimeout)
+	conn := dial(t, teo, url)
+
+	// Test case 1: commands answers
+	for i, test := range []struct {
+		cmd            command.Command
+		data, expected string
+	}{
+		{command.Connect, "", "Connected to Teonet"},
+		{command.Disconnect, "", ""},
+		{command.ConnectTo, "fortune", "Connected to peer fortune"},
+		{command.NewApiClient, "fortune", "Connected to peer fortune api"},
+		{command.ApiSendTo, "fortune,fortb,hello", "fortune: hello"},
+		{command.ApiSendTo, "fortune,fortb,a,b", "fortune: a,b"},
+	} {
+		answer := request(t, conn, uint32(i+1), test.cmd, test.data)
+		if answer.Err != nil || string(answer.Data) != test.expected {
+			t.Errorf("test %d: expected answer %q, got: %q %v", i+1,
+				test.expected, answer.Data, answer.Err)
+		}
+	}
+
+	// Test case 2: encrypted api command after key exchange
+	k, err := e2e.NewKeyExchange(peerKey)
+	if err != nil {
+		t.Fatalf("can't create key exchange: %v", err)
+	}
+	answer := request(t, conn, 10, command.KeyExchange,
+		"fortune,"+string(k.Request()))
+	s, err := k.Session(answer.Data)
+	if err != nil {
+		t.Fatalf("can't create e2e session: %v", err)
+	}
+	answer = request(t, conn, 11, command.ApiSendTo,
+		"fortune,secret,"+string(s.Seal("secret", []byte("hello"))))
+	if data, err := s.Open("secret", answer.Data); err != nil ||
+		string(data) != "secret: hello" {
+		t.Errorf("expected encrypted answer, got: %q %v", data, err)
+	}
+
+	// Test case 3: stream request and answer
+	start := command.New(command.StreamStart, []byte("fortune,fortb"))
+	start.Id = 20
+	sendCmd(t, conn, start)
+	if cmd := readCmd(t, conn); cmd.Cmd != command.StreamCredit {
+		t.Fatalf("expected StreamCredit, got: %v", cmd.Cmd)
+	}
+	for _, cmd := range []*command.TeonetCmd{
+		{Id: 20, Cmd: command.StreamChunk, Data: []byte("str")},
+		{Id: 20, Cmd: command.StreamChunk, Data: []byte("eam")},
+		{Id: 20, Cmd: command.StreamEnd},
+		command.NewCredit(20, command.StreamWindow),
+	} {
+		sendCmd(t, conn, cmd)
+	}
+	if cmd := readCmd(t, conn); cmd.Cmd != command.StreamChunk ||
+		string(cmd.Data) != "fortune: stream" {
+		t.Errorf("expected StreamChunk, got: %v %q", cmd.Cmd, cmd.Data)
+	}
+	if cmd := readCmd(t, conn); cmd.Cmd != command.StreamEnd || cmd.Err != nil {
+		t.Errorf("expected StreamEnd, got: %v %v", cmd.Cmd, cmd.Err)
+	}
+
+	// Test case 4: binary protocol errors are not answered, the next command
+	// is answered
+	for _, cmd := range []*command.TeonetCmd{
+		{Id: 30, Cmd: command.ApiSendTo, Data: []byte("fortune")},
+		{Id: 31, Cmd: command.KeyExchange, Data: []byte("fortune")},
+		{Id: 32, Cmd: command.ConnectTo, Data: []byte("other")},
+		{Id: 33, Cmd: command.StreamChunk, Data: []byte("data")},
+		{Id: 34, Cmd: command.Batch, Data: []byte("wrong")},
+	} {
+		sendCmd(t, conn, cmd)
+	}
+	request(t, conn, 35, command.Connect, "")
+
+	// Test case 5: batch answers contain results and errors of items
+	data, err := command.MarshalBatch([]command.BatchItem{
+		{Peer: "fortune", Command: "fortb", Data: []byte("one")},
+		{Peer: "fortune", Command: "fail"},
+		{Peer: "other", Command: "fortb"},
+		{Peer: "fortune", Command: "fortb", Data: []byte("two")},
+	})
+	if err != nil {
+		t.Fatalf("can't marshal batch: %v", err)
+	}
+	answer = request(t, conn, 40, command.Batch, string(data))
+	results, err := command.UnmarshalBatchResults(answer.Data)
+	if err != nil || len(results) != 4 {
+		t.Fatalf("expected 4 batch results, got: %v %v", results, err)
+	}
+	for i, expected := range []string{"fortune: one", "peer error",
+		"has not connected to peer api other", "fortune: two"} {
+		got := string(results[i].Data)
+		if results[i].Err != nil {
+			got = results[i].Err.Error()
+		}
+		if !strings.Contains(got, expected) {
+			t.Errorf("batch item %d: expected %q, got: %q", i, expected, got)
+		}
+	}
+
+	// Test case 6: request trace context is not sent back in the answer
+	c := command.New(command.ApiSendTo, []byte("fortune,fortb,trace"))
+	c.Id = 50
+	c.TraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sendCmd(t, conn, c)
+	answer = readCmd(t, conn)
+	if answer.Id != 50 || string(answer.Data) != "fortune: trace" ||
+		answer.TraceParent != "" {
+		t.Errorf("expected answer without trace context, got: %d %q %q",
+			answer.Id, answer.Data, answer.TraceParent)
+	}
+}
+
+func TestIntegrationErrors(t *testing.T) {
+	teo, url, _, started := newIntegrationServer(t, testTimeout)
+	conn := dial(t, teo, url, JSONRPCSubprotocol)
+
+	for i, test := range []struct{ request, expected string }{
+		{`{"jsonrpc":"2.0","method":"teonet.connectTo","params":["absent"],"id":1}`,
+			"peer not found: absent"},
+		{`{"jsonrpc":"2.0","method":"teonet.connectTo","params":["other"],"id":2}`,
+			"peer not allowed: other"},
+		{`{"jsonrpc":"2.0","method":"api.newClient","params":["slow"],"id":3}`,
+			"peer not connected: slow"},
+		{`{"jsonrpc":"2.0","method":"api.call","params":["slow","wait"],"id":4}`,
+			"has not connected to peer api slow"},
+		{`{"jsonrpc":"2.0","method":"teonet.connectTo","params":["slow"],"id":5}`,
+			`"result":{"data":"Connected to peer slow"}`},
+		{`{"jsonrpc":"2.0","method":"api.newClient","params":["slow"],"id":6}`,
+			`"result":{"data":"Connected to peer slow api"}`},
+		{`{"jsonrpc":"2.0","method":"api.call","params":["slow","foo"],"id":7}`,
+			"unknown api command: foo"},
+		{`{"jsonrpc":"2.0","method":"api.call","params":["slow","wait"],"id":8}`,
+			`"message":"timeout"`},
+		{`{"jsonrpc":"2.0","method":"teonet.connectTo","params":["fortune"],"id":9}`,
+			`"result"`},
+		{`{"jsonrpc":"2.0","method":"api.newClient","params":["fortune"],"id":10}`,
+			`"result"`},
+		{`{"jsonrpc":"2.0","method":"api.call","params":["fortune","fail"],"id":11}`,
+			`"message":"peer error"`},
+	} {
+		if got := call(t, conn, test.request); !strings.Contains(got,
+			test.expected) {
+			t.Errorf("test %d: expected response with %s, got: %s", i+1,
+				test.expected, got)
+		}
+	}
+	<-started
+}
+
+func TestIntegrationRest(t *testing.T) {
+	teo, _, _, started := newIntegrationServer(t, testTimeout)
+	ts := httptest.NewServer(teo.RestHandler("/api"))
+	t.Cleanup(ts.Close)
+
+	for i, test := range []struct {
+		path, body, expected string
+		status               int
+	}{
+		{"/api/fortune/fortb", "hello", "fortune: hello", http.StatusOK},
+		{"/api/fortune/fail", "", "peer error", http.StatusBadGateway},
+		{"/api/other/fortb", "", "peer not allowed", http.StatusForbidden},
+		{"/api/absent/fortb", "", "peer not found", http.StatusBadGateway},
+		{"/api/slow/wait", "", "timeout", http.StatusGatewayTimeout},
+	} {
+		res, err := http.Post(ts.URL+test.path, "text/plain",
+			strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("test %d: can't send request: %v", i+1, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.status ||
+			!strings.Contains(string(body), test.expected) {
+			t.Errorf("test %d: expected %d %q, got: %d %q", i+1, test.status,
+				test.expected, res.StatusCode, body)
+		}
+	}
+	<-started
+}
+
+func TestIntegrationCancel(t *testing.T) {
+	teo, url, _, started := newIntegrationServer(t, time.Minute)
+	conn := dial(t, teo, url)
+	request(t, conn, 1, command.ConnectTo, "slow")
+	request(t, conn, 2, command.NewApiClient, "slow")
+	request(t, conn, 3, command.ConnectTo, "fortune")
+	request(t, conn, 4, command.NewApiClient, "fortune")
+
+	// Test case 1: the session processes commands while the request waits
+	// for the peer answer
+	sendCmd(t, conn, &command.TeonetCmd{Id: 10, Cmd: command.ApiSendTo,
+		Data: []byte("slow,wait,")})
+	<-started
+	answer := request(t, conn, 11, command.ApiSendTo, "fortune,fortb,hello")
+	if string(answer.Data) != "fortune: hello" {
+		t.Errorf("expected answer while other request waits, got: %q",
+			answer.Data)
+	}
+	if n := teo.requests.Len(); n != 1 {
+		t.Errorf("expected 1 waiting request, got: %d", n)
+	}
+
+	// Test case 2: canceled request is removed and not answered, the cancel
+	// of unknown request is ignored
+	sendCmd(t, conn, command.NewCancel(10))
+	sendCmd(t, conn, command.NewCancel(12))
+	for i := 0; teo.requests.Len() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("expected canceled request removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	request(t, conn, 13, command.Connect, "")
+
+	// Test case 3: canceled request frees the in-flight slot, the shutdown
+	// does not wait for it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := teo.Shutdown(ctx); err != nil {
+		t.Errorf("expected shutdown without waiting requests, got: %v", err)
+	}
+}
+
+func TestIntegrationPing(t *testing.T) {
+	teo, url, _, _ := newIntegrationServer(t, testTimeout)
+	teo.Backend().(*MemoryBackend).AddPeer("fortune").
+		Latency(3 * time.Millisecond)
+	conn := dial(t, teo, url)
+
+	ping := func(id uint32, peer string) (command.PongData, error) {
+		now := time.Now()
+		sendCmd(t, conn, command.NewPing(id, now, peer))
+		answer := readCmd(t, conn)
+		if answer.Id != id || answer.Cmd != command.Pong {
+			t.Fatalf("expected Pong %d, got: %v %d", id, answer.Cmd, answer.Id)
+		}
+		if answer.Err != nil {
+			return command.PongData{}, answer.Err
+		}
+		pong, err := answer.Pong()
+		if err != nil || !pong.Time.Equal(time.Unix(0, now.UnixNano())) ||
+			pong.ServerTime.Before(now) {
+			t.Errorf("expected pong with ping time %v, got: %v %v", now, pong,
+				err)
+		}
+		return pong, nil
+	}
+
+	// Test case 1: ping proxy server
+	if pong, err := ping(1, ""); err != nil || pong.PeerRTT != 0 {
+		t.Errorf("expected pong without peer rtt, got: %v %v", pong, err)
+	}
+
+	// Test case 2: ping not connected and not allowed peers
+	for i, peer := range []string{"fortune", "other"} {
+		if _, err := ping(uint32(i+2), peer); err == nil {
+			t.Errorf("expected %s ping error", peer)
+		}
+	}
+
+	// Test case 3: ping connected peer
+	request(t, conn, 5, command.ConnectTo, "fortune")
+	if pong, err := ping(6, "fortune"); err != nil ||
+		pong.PeerRTT < 3*time.Millisecond {
+		t.Errorf("expected pong with peer rtt, got: %v %v", pong, err)
+	}
+
+	// Test case 4: peer probe does not block commands received after it
+	teo.Backend().(*MemoryBackend).AddPeer("fortune").
+		Latency(200 * time.Millisecond)
+	sendCmd(t, conn, command.NewPing(7, time.Now(), "fortune"))
+	sendCmd(t, conn, command.NewPing(8, time.Now(), ""))
+	for _, id := range []uint32{8, 7} {
+		if answer := readCmd(t, conn); answer.Id != id {
+			t.Errorf("expected Pong %d, got: %v %d", id, answer.Cmd, answer.Id)
+		}
+	}
+}
+
+func TestIntegrationShutdown(t *testing.T) {
+	teo, _, _, started := newIntegrationServer(t, time.Minute)
+	ts := httptest.NewServer(teo.RestHandler("/api"))
+	t.Cleanup(ts.Close)
+
+	// Test case 1: request waiting for the peer answer gets shutdown error
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Post(ts.URL+"/api/slow/wait", "text/plain", nil)
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	if err := teo.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got: %v", err)
+	}
+	if s := <-status; s != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got: %d", http.StatusServiceUnavailable, s)
+	}
+
+	// Test case 2: backend is closed
+	if err := teo.Backend().ConnectTo("fortune"); err != ErrBackendClosed {
+		t.Errorf("expected ErrBackendClosed, got: %v", err)
+	}
+}
+
+func TestIntegrationShutdownWebSocket(t *testing.T) {
+	b := NewMemoryBackend()
+	teo, url := newTestServer(t, WithBackend(b), WithTimeout(time.Minute))
+	started, release := make(chan struct{}), make(chan struct{})
+	b.AddPeer("slow").Handle("wait", func(data []byte) ([]byte, error) {
+		close(started)
+		<-release
+		return data, nil
+	})
+	conn := dial(t, teo, url)
+	request(t, conn, 1, command.ConnectTo, "slow")
+	request(t, conn, 2, command.NewApiClient, "slow")
+
+	// Test case 1: request in flight during shutdown is answered before the
+	// close frame
+	cmd := command.New(command.ApiSendTo, []byte("slow,wait,hello"))
+	cmd.Id = 3
+	sendCmd(t, conn, cmd)
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- teo.Shutdown(ctx)
+	}()
+
+	// Wait for shutdown started, new connections are rejected
+	for i := 0; ; i++ {
+		c, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if i > 100 {
+			t.Fatal("shutdown was not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+
+	if answer := readCmd(t, conn); answer.Id != 3 || answer.Err != nil ||
+		string(answer.Data) != "hello" {
+		t.Errorf("expected answer to request 3, got: %d %q %v", answer.Id,
+			answer.Data, answer.Err)
+	}
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected going away close frame, got: %v", err)
+	}
+	if err = <-shutdown; err != nil {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+}
+
+func TestIntegrationDisconnect(t *testing.T) {
+	started, canceled := make(chan struct{}), make(chan struct{})
+	service := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-r.Context().Done()
+			close(canceled)
+		}))
+	t.Cleanup(service.Close)
+	teo, url := newTestServer(t, WithTimeout(time.Minute),
+		WithUpstream("web", NewHTTPUpstream(service.URL, nil)))
+	conn := dial(t, teo, url)
+
+	// Test case 1: request of disconnected client is canceled and the
+	// session is removed
+	cmd := command.New(command.ApiSendTo, []byte("web,slow,"))
+	cmd.Id = 1
+	sendCmd(t, conn, cmd)
+	<-started
+	conn.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("peer request was not canceled")
+	}
+	for i := 0; teo.Sessions().Len() != 0; i++ {
+		if i > 100 {
+			t.Fatal("session was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := teo.requests.Len(); n != 0 {
+		t.Errorf("expected no requests, got: %d", n)
+	}
+}
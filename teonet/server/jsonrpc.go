@@ -0,0 +1,379 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// JSON-RPC 2.0 websocket protocol module.
+//
+// Clients which request the JSONRPCSubprotocol websocket subprotocol send
+// JSON-RPC 2.0 requests in text messages instead of base64 binary commands.
+// The methods are mapped to the proxy commands:
+//
+//	teonet.connect                               Connect
+//	teonet.disconnect                            Disconnect
+//	teonet.connectTo  {"peer"}                   ConnectTo
+//	api.newClient     {"peer"}                   NewApiClient
+//	api.call          {"peer","command","data"}  ApiSendTo
+//
+// Params may be sent by name or by position in the order shown above. Binary
+// api.call data may be sent base64 encoded in the "dataBase64" param, and
+// the "traceparent" param continues the client trace. The result is an
+// object with the "data" string field, or the "dataBase64" field if the
+// answer is not valid UTF-8. The "noCache" boolean param bypasses the server
+// answers cache. Push messages are sent to the client as teonet.push
+// notifications with the same result object in params plus the "command"
+// field.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+	ws "github.com/teonet-go/teoproxy/ws/server"
+)
+
+// JSONRPCSubprotocol is the websocket subprotocol name of the JSON-RPC 2.0
+// protocol.
+const JSONRPCSubprotocol = "jsonrpc-2.0"
+
+// JSON-RPC methods.
+const (
+	MethodConnect      = "teonet.connect"
+	MethodDisconnect   = "teonet.disconnect"
+	MethodConnectTo    = "teonet.connectTo"
+	MethodNewAPIClient = "api.newClient"
+	MethodAPICall      = "api.call"
+	MethodPush         = "teonet.push" // Server notification
+)
+
+// JSON-RPC error codes.
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCServerError    = -32000 // Command processing error
+)
+
+const jsonrpcVersion = "2.0"
+
+// JSONRPCError is the JSON-RPC error object.
+type JSONRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error implements the error interface.
+func (e *JSONRPCError) Error() string { return e.Message }
+
+// jsonrpcRequest is the JSON-RPC request or notification received from
+// client. The request without id is a notification and is not answered.
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// jsonrpcResponse is the JSON-RPC response sent to client.
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  any             `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// jsonrpcNotification is the JSON-RPC notification sent to client.
+type jsonrpcNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+// jsonrpcParams contains params of all methods.
+type jsonrpcParams struct {
+	Peer        string `json:"peer"`
+	Command     string `json:"command"`
+	Data        string `json:"data"`
+	DataBase64  string `json:"dataBase64"`
+	TraceParent string `json:"traceparent"`
+	NoCache     bool   `json:"noCache"`
+}
+
+// jsonrpcResult is the result of all methods and the push notification
+// params.
+type jsonrpcResult struct {
+	Command    string `json:"command,omitempty"`
+	Data       string `json:"data"`
+	DataBase64 string `json:"dataBase64,omitempty"`
+}
+
+// newJSONRPCResult creates result with data as string, or base64 encoded if
+// data is not valid UTF-8.
+func newJSONRPCResult(data []byte) (res *jsonrpcResult) {
+	res = &jsonrpcResult{}
+	if utf8.Valid(data) {
+		res.Data = string(data)
+	} else {
+		res.DataBase64 = base64.StdEncoding.EncodeToString(data)
+	}
+	return
+}
+
+// processJSONRPC processes a JSON-RPC request or batch of requests received
+// from a client and writes responses back to the client.
+func (teo *TeonetServer) processJSONRPC(msg *ws.Message) (err error) {
+	var res any
+	data := bytes.TrimSpace(msg.Data)
+
+	if len(data) > 0 && data[0] == '[' {
+		// Batch request
+		var reqs []json.RawMessage
+		if err := json.Unmarshal(data, &reqs); err != nil {
+			res = jsonrpcErrorResponse(nil, JSONRPCParseError, err.Error())
+		} else if len(reqs) == 0 {
+			res = jsonrpcErrorResponse(nil, JSONRPCInvalidRequest,
+				"empty batch")
+		} else if len(reqs) > command.MaxBatchItems {
+			res = jsonrpcErrorResponse(nil, JSONRPCInvalidRequest,
+				fmt.Sprintf("too many batch requests, maximum: %d",
+					command.MaxBatchItems))
+		} else if r := teo.processJSONRPCBatch(msg, reqs); len(r) > 0 {
+			res = r
+		}
+	} else if r := teo.processJSONRPCRequest(msg, data); r != nil {
+		res = r
+	}
+	if res == nil {
+		return
+	}
+
+	// Write response to client
+	data, _ = json.Marshal(res)
+	if err = msg.Session.SendText(data); err != nil {
+		err = fmt.Errorf("can't write message to client, error: %w", err)
+	}
+	return
+}
+
+// processJSONRPCBatch processes batch requests in parallel, the batch is
+// limited to command.MaxBatchItems requests like the Batch command. It returns
+// responses in the requests order, or nil if the batch contains
+// notifications only.
+func (teo *TeonetServer) processJSONRPCBatch(msg *ws.Message,
+	reqs []json.RawMessage) []*jsonrpcResponse {
+
+	var wg sync.WaitGroup
+	results := make([]*jsonrpcResponse, len(reqs))
+	for i := range reqs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = teo.processJSONRPCRequest(msg, reqs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var responses []*jsonrpcResponse
+	for _, r := range results {
+		if r != nil {
+			responses = append(responses, r)
+		}
+	}
+	return responses
+}
+
+// processJSONRPCRequest processes one JSON-RPC request. It returns nil for
+// notifications.
+func (teo *TeonetServer) processJSONRPCRequest(msg *ws.Message,
+	data []byte) *jsonrpcResponse {
+
+	req := &jsonrpcRequest{}
+	if err := json.Unmarshal(data, req); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return jsonrpcErrorResponse(nil, JSONRPCParseError, err.Error())
+		}
+		return jsonrpcErrorResponse(nil, JSONRPCInvalidRequest, err.Error())
+	}
+	if req.JSONRPC != jsonrpcVersion || len(req.Method) == 0 {
+		return jsonrpcErrorResponse(req.ID, JSONRPCInvalidRequest,
+			"invalid request")
+	}
+	notification := len(req.ID) == 0
+
+	logger := msg.Session.Logger().With("rpc_id", string(req.ID),
+		"method", req.Method)
+	logger.Debug("got Teonet proxy client JSON-RPC request")
+
+	result, err := teo.processJSONRPCMethod(msg.Context(), logger,
+		msg.Session.ID(), req)
+	if notification {
+		if err != nil {
+			logger.Warn("JSON-RPC notification failed", "err", err)
+		}
+		return nil
+	}
+	if err != nil {
+		var rpcErr *JSONRPCError
+		if errors.As(err, &rpcErr) {
+			return jsonrpcErrorResponse(req.ID, rpcErr.Code, rpcErr.Message)
+		}
+		return jsonrpcErrorResponse(req.ID, JSONRPCServerError, err.Error())
+	}
+	return &jsonrpcResponse{JSONRPC: jsonrpcVersion, Result: result, ID: req.ID}
+}
+
+// processJSONRPCMethod converts JSON-RPC method to the Teonet proxy command
+// and processes it.
+func (teo *TeonetServer) processJSONRPCMethod(ctx context.Context,
+	logger *slog.Logger, sessionID string, req *jsonrpcRequest) (
+	result *jsonrpcResult, err error) {
+
+	params, err := parseJSONRPCParams(req.Params)
+	if err != nil {
+		return
+	}
+
+	// Make Teonet proxy command
+	cmd := &command.TeonetCmd{TraceParent: params.TraceParent,
+		NoCache: params.NoCache}
+	switch req.Method {
+	case MethodConnect:
+		cmd.Cmd = command.Connect
+	case MethodDisconnect:
+		cmd.Cmd = command.Disconnect
+	case MethodConnectTo, MethodNewAPIClient:
+		cmd.Cmd = map[string]command.Command{
+			MethodConnectTo:    command.ConnectTo,
+			MethodNewAPIClient: command.NewApiClient,
+		}[req.Method]
+		if len(params.Peer) == 0 {
+			err = invalidParams("peer param is required")
+			return
+		}
+		cmd.Data = []byte(params.Peer)
+	case MethodAPICall:
+		if len(params.Peer) == 0 || len(params.Command) == 0 {
+			err = invalidParams("peer and command params are required")
+			return
+		}
+		data := []byte(params.Data)
+		if len(params.DataBase64) > 0 {
+			data, err = base64.StdEncoding.DecodeString(params.DataBase64)
+			if err != nil {
+				err = invalidParams("wrong dataBase64 param: " + err.Error())
+				return
+			}
+		}
+		cmd.Cmd = command.ApiSendTo
+		cmd.Data = append([]byte(params.Peer+","+params.Command+","), data...)
+	default:
+		err = &JSONRPCError{JSONRPCMethodNotFound,
+			"method not found: " + req.Method}
+		return
+	}
+
+	// Process command
+	data, err := teo.execCommand(ctx, logger, sessionID, cmd)
+	if err != nil {
+		return
+	}
+	result = newJSONRPCResult(data)
+	return
+}
+
+// parseJSONRPCParams parses params by name or by position.
+func parseJSONRPCParams(raw json.RawMessage) (params *jsonrpcParams,
+	err error) {
+
+	params = &jsonrpcParams{}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return
+	}
+
+	if raw[0] == '[' {
+		var list []string
+		if err = json.Unmarshal(raw, &list); err != nil {
+			err = invalidParams(err.Error())
+			return
+		}
+		for i, p := range []*string{&params.Peer, &params.Command,
+			&params.Data} {
+			if i < len(list) {
+				*p = list[i]
+			}
+		}
+		return
+	}
+
+	if err = json.Unmarshal(raw, params); err != nil {
+		err = invalidParams(err.Error())
+	}
+	return
+}
+
+// invalidParams returns the invalid params JSON-RPC error.
+func invalidParams(message string) error {
+	return &JSONRPCError{JSONRPCInvalidParams, message}
+}
+
+// jsonrpcErrorResponse creates JSON-RPC error response.
+func jsonrpcErrorResponse(id json.RawMessage, code int,
+	message string) *jsonrpcResponse {
+	return &jsonrpcResponse{
+		JSONRPC: jsonrpcVersion,
+		Error:   &JSONRPCError{code, message},
+		ID:      id,
+	}
+}
+
+// Push sends a push message with command and data to the websocket session.
+// Binary protocol clients get the command packet with zero Id, JSON-RPC
+// clients get the teonet.push notification.
+func (teo *TeonetServer) Push(sessionID string, cmd command.Command,
+	data []byte) error {
+
+	sess, ok := teo.Session(sessionID)
+	if !ok {
+		return ws.ErrSessionNotFound
+	}
+	return push(sess, cmd, data)
+}
+
+// PushAll sends a push message with command and data to all connected
+// websocket sessions. It returns the number of sessions the message was sent
+// to.
+func (teo *TeonetServer) PushAll(cmd command.Command, data []byte) (n int) {
+	teo.Sessions().Range(func(sess *ws.Session) bool {
+		if err := push(sess, cmd, data); err != nil {
+			sess.Logger().Debug("can't push message", "err", err)
+		} else {
+			n++
+		}
+		return true
+	})
+	return
+}
+
+// push sends a push message to the session in its protocol.
+func push(sess *ws.Session, cmd command.Command, data []byte) error {
+	if sess.Subprotocol() == JSONRPCSubprotocol {
+		params := newJSONRPCResult(data)
+		params.Command = cmd.String()
+		msg, _ := json.Marshal(&jsonrpcNotification{jsonrpcVersion,
+			MethodPush, params})
+		return sess.SendText(msg)
+	}
+	msg, _ := command.New(cmd, data).MarshalBinary()
+	return sess.Send(msg)
+}
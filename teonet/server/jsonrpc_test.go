@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// newTestServer creates TeonetServer with in-memory backend and starts
+// http test server with its websocket handler. It returns the server and its
+// websocket url. Use teo.Backend() to add peers to the MemoryBackend.
+func newTestServer(t *testing.T, opts ...Option) (teo *TeonetServer,
+	url string) {
+
+	opts = append([]Option{
+		WithBackend(NewMemoryBackend()),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	}, opts...)
+	teo, err := New("test", nil, opts...)
+	if err != nil {
+		t.Fatalf("can't create server: %v", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(teo.HandleWebSocket))
+	t.Cleanup(ts.Close)
+	url = "ws" + strings.TrimPrefix(ts.URL, "http")
+	return
+}
+
+// dial connects to the websocket server with subprotocols and waits for
+// session registered.
+func dial(t *testing.T, teo *TeonetServer, url string,
+	subprotocols ...string) *websocket.Conn {
+
+	n := teo.Sessions().Len()
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("can't dial websocket server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	for i := 0; teo.Sessions().Len() == n; i++ {
+		if i > 100 {
+			t.Fatal("session was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return conn
+}
+
+// call sends JSON-RPC request and returns the answer.
+func call(t *testing.T, conn *websocket.Conn, request string) string {
+	if err := conn.WriteMessage(websocket.TextMessage,
+		[]byte(request)); err != nil {
+		t.Fatalf("can't write message: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("can't read message: %v", err)
+	}
+	return string(message)
+}
+
+func TestJSONRPC(t *testing.T) {
+	teo, url := newTestServer(t)
+	conn := dial(t, teo, url, JSONRPCSubprotocol)
+	if p := conn.Subprotocol(); p != JSONRPCSubprotocol {
+		t.Fatalf("expected subprotocol: %s, got: %s", JSONRPCSubprotocol, p)
+	}
+
+	for i, test := range []struct{ request, response string }{
+		// Test case 1: method mapped to proxy command
+		{`{"jsonrpc":"2.0","method":"teonet.connect","id":1}`,
+			`{"jsonrpc":"2.0","result":{"data":"Connected to Teonet"},"id":1}`},
+
+		// Test case 2: command error
+		{`{"jsonrpc":"2.0","method":"api.call","params":["fortune","fortb"],"id":"a"}`,
+			`{"jsonrpc":"2.0","error":{"code":-32000,"message":"can't get api ` +
+				`client, error: has not connected to peer api fortune"},"id":"a"}`},
+
+		// Test case 3: invalid params
+		{`{"jsonrpc":"2.0","method":"teonet.connectTo","params":{},"id":2}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"peer param is ` +
+				`required"},"id":2}`},
+
+		// Test case 4: unknown method
+		{`{"jsonrpc":"2.0","method":"foo","id":3}`,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"method not ` +
+				`found: foo"},"id":3}`},
+
+		// Test case 5: invalid request
+		{`{"jsonrpc":"1.0","method":"teonet.connect","id":4}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid ` +
+				`request"},"id":4}`},
+
+		// Test case 6: batch with notification
+		{`[{"jsonrpc":"2.0","method":"teonet.connect","id":5},` +
+			`{"jsonrpc":"2.0","method":"teonet.connect"},` +
+			`{"jsonrpc":"2.0","method":"foo","id":6}]`,
+			`[{"jsonrpc":"2.0","result":{"data":"Connected to Teonet"},"id":5},` +
+				`{"jsonrpc":"2.0","error":{"code":-32601,"message":"method not ` +
+				`found: foo"},"id":6}]`},
+	} {
+		if got := call(t, conn, test.request); got != test.response {
+			t.Errorf("test %d: expected response:\n%s\ngot:\n%s", i+1,
+				test.response, got)
+		}
+	}
+
+	// Test case 7: parse error
+	got := call(t, conn, `{"jsonrpc"`)
+	var res jsonrpcResponse
+	if err := json.Unmarshal([]byte(got), &res); err != nil ||
+		res.Error == nil || res.Error.Code != JSONRPCParseError {
+		t.Errorf("expected parse error, got: %s", got)
+	}
+
+	// Test case 8: too large batch
+	batch := "[" + strings.Repeat(`{"jsonrpc":"2.0","method":"teonet.connect"},`,
+		command.MaxBatchItems) + `{"jsonrpc":"2.0","method":"teonet.connect"}]`
+	got = call(t, conn, batch)
+	res = jsonrpcResponse{}
+	if err := json.Unmarshal([]byte(got), &res); err != nil ||
+		res.Error == nil || res.Error.Code != JSONRPCInvalidRequest {
+		t.Errorf("expected invalid request error, got: %s", got)
+	}
+
+	// Test case 9: push to JSON-RPC and binary protocol clients
+	binConn := dial(t, teo, url)
+	if n := teo.PushAll(command.Connect, []byte("hello")); n != 2 {
+		t.Errorf("expected push to 2 sessions, got: %d", n)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, message, _ := conn.ReadMessage()
+	expected := `{"jsonrpc":"2.0","method":"teonet.push",` +
+		`"params":{"command":"Connect","data":"hello"}}`
+	if string(message) != expected {
+		t.Errorf("expected notification:\n%s\ngot:\n%s", expected, message)
+	}
+	binConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, message, _ = binConn.ReadMessage()
+	data, _ := base64.StdEncoding.DecodeString(string(message))
+	cmd := &command.TeonetCmd{}
+	if err := cmd.UnmarshalBinary(data); err != nil || cmd.Id != 0 ||
+		cmd.Cmd != command.Connect || string(cmd.Data) != "hello" {
+		t.Errorf("expected push command, got: %v, %v", cmd, err)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server in-memory backend module.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+var (
+	ErrPeerNotFound     = errors.New("peer not found")
+	ErrPeerNotConnected = errors.New("peer not connected")
+	ErrUnknownAPI       = errors.New("unknown api command")
+	ErrBackendClosed    = errors.New("backend closed")
+)
+
+// MemoryHandler is the in-memory peer api command handler. It returns the
+// answer data or error.
+type MemoryHandler func(data []byte) ([]byte, error)
+
+// MemoryBackend is the in-memory Backend. Peers and their api commands are
+// added with AddPeer and Handle, so the proxy server can be tested without
+// the Teonet network. It is safe for concurrent use.
+//
+//	b := server.NewMemoryBackend()
+//	b.AddPeer("fortune").Handle("fortb", func(data []byte) ([]byte, error) {
+//		return []byte("fortune"), nil
+//	})
+//	teo, err := server.New("test", nil, server.WithBackend(b))
+type MemoryBackend struct {
+	peers     map[string]*MemoryPeer
+	connected map[string]struct{}
+	closed    bool
+	*sync.RWMutex
+}
+
+// MemoryPeer is the MemoryBackend peer.
+type MemoryPeer struct {
+	addr        string
+	handlers    map[string]MemoryHandler
+	subscribers map[int]func(data []byte)
+	next        int
+	latency     time.Duration
+	apis        map[string]command.APICommand
+	*sync.RWMutex
+}
+
+// NewMemoryBackend creates the in-memory backend without peers.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		peers:     make(map[string]*MemoryPeer),
+		connected: make(map[string]struct{}),
+		RWMutex:   &sync.RWMutex{},
+	}
+}
+
+// AddPeer adds the peer with address or returns existing one.
+func (b *MemoryBackend) AddPeer(addr string) *MemoryPeer {
+	b.Lock()
+	defer b.Unlock()
+	if p, ok := b.peers[addr]; ok {
+		return p
+	}
+	p := &MemoryPeer{
+		addr:        addr,
+		handlers:    make(map[string]MemoryHandler),
+		subscribers: make(map[int]func(data []byte)),
+		apis:        make(map[string]command.APICommand),
+		RWMutex:     &sync.RWMutex{},
+	}
+	b.peers[addr] = p
+	return p
+}
+
+// ConnectTo connects to the peer added with AddPeer.
+func (b *MemoryBackend) ConnectTo(addr string) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return ErrBackendClosed
+	}
+	if _, ok := b.peers[addr]; !ok {
+		return fmt.Errorf("%w: %s", ErrPeerNotFound, addr)
+	}
+	b.connected[addr] = struct{}{}
+	return nil
+}
+
+// NewAPIClient returns the api client of the connected peer.
+func (b *MemoryBackend) NewAPIClient(addr string) (APIClient, error) {
+	p, err := b.peer(addr)
+	if err != nil {
+		return nil, err
+	}
+	return memoryAPIClient{b, p}, nil
+}
+
+// Subscribe calls the reader with data sent by the connected peer with
+// MemoryPeer.Send.
+func (b *MemoryBackend) Subscribe(addr string, reader func(data []byte)) (
+	unsubscribe func(), err error) {
+
+	p, err := b.peer(addr)
+	if err != nil {
+		return
+	}
+	p.Lock()
+	id := p.next
+	p.next++
+	p.subscribers[id] = reader
+	p.Unlock()
+
+	unsubscribe = func() {
+		p.Lock()
+		defer p.Unlock()
+		delete(p.subscribers, id)
+	}
+	return
+}
+
+// Ping probes the connected peer, the probe answer is delayed by the peer
+// latency set with MemoryPeer.Latency. It returns the time of the answer.
+func (b *MemoryBackend) Ping(addr string) (rtt time.Duration, err error) {
+	p, err := b.peer(addr)
+	if err != nil {
+		return
+	}
+	p.RLock()
+	latency := p.latency
+	p.RUnlock()
+	start := time.Now()
+	time.Sleep(latency)
+	rtt = time.Since(start)
+	return
+}
+
+// Peers returns addresses of connected peers.
+func (b *MemoryBackend) Peers() (peers []string) {
+	b.RLock()
+	defer b.RUnlock()
+	for addr := range b.connected {
+		peers = append(peers, addr)
+	}
+	slices.Sort(peers)
+	return
+}
+
+// Close disconnects all peers, api clients get ErrBackendClosed error.
+func (b *MemoryBackend) Close() {
+	b.Lock()
+	defer b.Unlock()
+	b.closed = true
+	clear(b.connected)
+}
+
+// peer returns the connected peer.
+func (b *MemoryBackend) peer(addr string) (p *MemoryPeer, err error) {
+	b.RLock()
+	defer b.RUnlock()
+	if b.closed {
+		err = ErrBackendClosed
+		return
+	}
+	if _, ok := b.connected[addr]; !ok {
+		err = fmt.Errorf("%w: %s", ErrPeerNotConnected, addr)
+		return
+	}
+	p = b.peers[addr]
+	return
+}
+
+// Handle sets the peer api command handler. Handlers are called in their own
+// goroutines, so a handler may block to simulate a slow peer.
+func (p *MemoryPeer) Handle(apiCmd string, handler MemoryHandler) *MemoryPeer {
+	p.Lock()
+	defer p.Unlock()
+	p.handlers[apiCmd] = handler
+	return p
+}
+
+// Describe sets the peer api command description returned by the api client
+// Describe method. Commands without description are described by name.
+func (p *MemoryPeer) Describe(c command.APICommand) *MemoryPeer {
+	p.Lock()
+	defer p.Unlock()
+	p.apis[c.Name] = c
+	return p
+}
+
+// Latency sets the peer round-trip time of MemoryBackend.Ping probes.
+func (p *MemoryPeer) Latency(d time.Duration) *MemoryPeer {
+	p.Lock()
+	defer p.Unlock()
+	p.latency = d
+	return p
+}
+
+// Send sends data to the peer subscribers.
+func (p *MemoryPeer) Send(data []byte) {
+	p.RLock()
+	defer p.RUnlock()
+	for _, reader := range p.subscribers {
+		reader(data)
+	}
+}
+
+// memoryAPIClient is the MemoryBackend api client.
+type memoryAPIClient struct {
+	b *MemoryBackend
+	p *MemoryPeer
+}
+
+// SendTo calls the peer api command handler and the answer callback with its
+// result.
+func (api memoryAPIClient) SendTo(apiCmd string, data []byte,
+	answer func(data []byte, err error)) (err error) {
+
+	if _, err = api.b.peer(api.p.addr); err != nil {
+		return
+	}
+	api.p.RLock()
+	handler, ok := api.p.handlers[apiCmd]
+	api.p.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownAPI, apiCmd)
+	}
+	data = append([]byte{}, data...)
+	go func() { answer(handler(data)) }()
+	return
+}
+
+// Describe returns the peer API description with commands of the peer
+// handlers.
+func (api memoryAPIClient) Describe() (*command.APIDescription, error) {
+	if _, err := api.b.peer(api.p.addr); err != nil {
+		return nil, err
+	}
+	api.p.RLock()
+	defer api.p.RUnlock()
+	d := &command.APIDescription{Name: api.p.addr,
+		Commands: make([]command.APICommand, 0, len(api.p.handlers))}
+	for name := range api.p.handlers {
+		c, ok := api.p.apis[name]
+		if !ok {
+			c = command.APICommand{Name: name}
+		}
+		d.Commands = append(d.Commands, c)
+	}
+	slices.SortFunc(d.Commands, func(a, b command.APICommand) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return d, nil
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	b := NewMemoryBackend()
+	p := b.AddPeer("fortune")
+
+	// Test case 1: subscribe to not connected peer
+	reader := func(data []byte) {}
+	if _, err := b.Subscribe("fortune", reader); !errors.Is(err,
+		ErrPeerNotConnected) {
+		t.Errorf("expected ErrPeerNotConnected, got: %v", err)
+	}
+
+	// Test case 2: subscriber gets peer data until unsubscribed
+	if err := b.ConnectTo("fortune"); err != nil {
+		t.Fatalf("can't connect to peer: %v", err)
+	}
+	var got []string
+	unsubscribe, err := b.Subscribe("fortune", func(data []byte) {
+		got = append(got, string(data))
+	})
+	if err != nil {
+		t.Fatalf("can't subscribe: %v", err)
+	}
+	p.Send([]byte("hello"))
+	unsubscribe()
+	p.Send([]byte("bye"))
+	if len(got) != 1 || got[0] != "hello" {
+		t.Errorf("expected [hello], got: %v", got)
+	}
+
+	// Test case 3: api client of closed backend
+	api, err := b.NewAPIClient("fortune")
+	if err != nil {
+		t.Fatalf("can't create api client: %v", err)
+	}
+	b.Close()
+	if err = api.SendTo("fortb", nil, func([]byte, error) {}); err !=
+		ErrBackendClosed {
+		t.Errorf("expected ErrBackendClosed, got: %v", err)
+	}
+}
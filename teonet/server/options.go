@@ -0,0 +1,129 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server options module.
+
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/teonet-go/teoproxy/metrics"
+)
+
+// Option configures the TeonetServer.
+type Option func(teo *TeonetServer)
+
+// WithLogger sets structured logger of the Teonet proxy server and its
+// websocket server. By default the slog.Default logger is used.
+func WithLogger(logger *slog.Logger) Option {
+	return func(teo *TeonetServer) { teo.logger = logger }
+}
+
+// WithPayloadLogging enables logging of commands and messages data. It is off
+// by default because commands data may contain user data.
+func WithPayloadLogging(on bool) Option {
+	return func(teo *TeonetServer) { teo.logPayload = on }
+}
+
+// WithMetrics sets metrics to instrument the Teonet proxy server and its
+// websocket server. Use the metrics Handler to export them.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(teo *TeonetServer) { teo.metrics = m }
+}
+
+// WithBackend sets the network of peers the proxy server forwards clients
+// commands to. By default the server starts Teonet client and uses the
+// TeonetBackend, use MemoryBackend in tests.
+func WithBackend(b Backend) Option {
+	return func(teo *TeonetServer) { teo.backend = b }
+}
+
+// WithUpstream routes commands to the peer name to the upstream backend
+// instead of the server backend. Use it to reach HTTP and TCP services:
+//
+//	server.WithUpstream("users", server.NewHTTPUpstream("http://users:8080/api", nil))
+func WithUpstream(name string, b Backend) Option {
+	return func(teo *TeonetServer) { teo.upstreams.Add(name, b) }
+}
+
+// WithCache enables the cache of api commands answers. Only answers of
+// commands matched by the cache rules are cached:
+//
+//	server.WithCache(server.NewCache(server.DefaultCacheSize,
+//		server.CacheRule{Peer: "config", TTL: time.Minute},
+//		server.CacheRule{Command: "catalog", TTL: 5 * time.Minute},
+//	))
+//
+// Clients bypass the cache with the command no cache flag.
+func WithCache(c *Cache) Option {
+	return func(teo *TeonetServer) { teo.cache = c }
+}
+
+// WithCoalescing enables coalescing of identical concurrent requests of api
+// commands matched by the rules, so they are sent to the peer once and get
+// the same answer:
+//
+//	server.WithCoalescing(server.CoalesceRule{Peer: "catalog"})
+func WithCoalescing(rules ...CoalesceRule) Option {
+	return func(teo *TeonetServer) { teo.coalescer = NewCoalescer(rules...) }
+}
+
+// WithTimeout sets the time to wait for Teonet peer api answer. The default
+// timeout is DefaultTimeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(teo *TeonetServer) { teo.timeout = timeout }
+}
+
+// WithAllowedPeers sets the list of Teonet peers addresses the proxy clients
+// may connect and send api commands to. All peers are allowed by default.
+func WithAllowedPeers(peers ...string) Option {
+	return func(teo *TeonetServer) {
+		teo.allowedPeers = make(map[string]struct{}, len(peers))
+		for _, peer := range peers {
+			teo.allowedPeers[peer] = struct{}{}
+		}
+	}
+}
+
+// WithFragmentSize sets the maximum data size of binary protocol answers,
+// answers with larger data are sent in fragments. The default size is
+// command.DefaultFragmentSize, zero disables fragmentation. Clients
+// reassemble up to maximum message size / command.MinFragmentSize fragments,
+// so the size should not be less than command.MinFragmentSize.
+func WithFragmentSize(size int) Option {
+	return func(teo *TeonetServer) { teo.fragmentSize = size }
+}
+
+// WithCompression sets the minimum data size of binary protocol answers
+// which are compressed. Answers are compressed only for clients which accept
+// compression. The default threshold is command.DefaultCompressThreshold,
+// zero disables compression of answers.
+func WithCompression(threshold int) Option {
+	return func(teo *TeonetServer) { teo.compressThreshold = threshold }
+}
+
+// WithMaxMessage sets the maximum size of fragmented commands data buffered
+// for each client session and of decompressed commands data. The default
+// size is command.DefaultMaxMessage.
+func WithMaxMessage(size int) Option {
+	return func(teo *TeonetServer) { teo.maxMessage = size }
+}
+
+// WithReadLimit sets the maximum size of a websocket message read from a
+// client. Clients send larger commands in fragments, so the limit may be much
+// lower than the maximum message size. The default is ws.DefaultReadLimit
+// which fits fragments of command.DefaultFragmentSize, raise it for JSON-RPC
+// clients which send larger requests. Zero disables the limit.
+func WithReadLimit(limit int64) Option {
+	return func(teo *TeonetServer) { teo.readLimit = limit }
+}
+
+// WithOrigins sets origins of web pages allowed to open websocket
+// connections, f.e. "https://example.com". The "*" origin allows any page.
+// By default only pages of the proxy server host are allowed.
+func WithOrigins(origins ...string) Option {
+	return func(teo *TeonetServer) { teo.origins = origins }
+}
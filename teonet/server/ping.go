@@ -0,0 +1,64 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server ping module.
+
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+	ws "github.com/teonet-go/teoproxy/ws/server"
+)
+
+// processPing answers the client Ping command with the Pong command. If the
+// Ping has the peer name, the Pong contains the round-trip time to the peer
+// or the peer probe error.
+func (teo *TeonetServer) processPing(sess *ws.Session, logger *slog.Logger,
+	cmd *command.TeonetCmd) (err error) {
+
+	t, peer, err := cmd.Ping()
+	if err != nil {
+		return
+	}
+	pong := command.PongData{Time: t}
+	var probeErr error
+	if len(peer) > 0 {
+		pong.PeerRTT, probeErr = teo.pingPeer(peer)
+		logger.Debug("ping peer", "peer", peer, "rtt", pong.PeerRTT,
+			"err", probeErr)
+	}
+	teo.metrics.Command(cmd.Cmd.String(), probeErr)
+
+	pong.ServerTime = time.Now()
+	answer := command.NewPong(cmd.Id, pong)
+	answer.Err = probeErr
+	data, err := answer.MarshalBinary()
+	if err != nil {
+		return
+	}
+	return sess.Send(data)
+}
+
+// pingPeer returns the round-trip time to the allowed peer if its backend
+// implements Pinger.
+func (teo *TeonetServer) pingPeer(addr string) (rtt time.Duration, err error) {
+	if err = teo.peerAllowed(addr); err != nil {
+		return
+	}
+	b, _ := teo.upstream(addr)
+	p, ok := b.(Pinger)
+	if !ok {
+		err = fmt.Errorf("can't ping peer %s, error: %w", addr,
+			ErrNotSupported)
+		return
+	}
+	if rtt, err = p.Ping(addr); err != nil {
+		err = fmt.Errorf("can't ping peer %s, error: %w", addr, err)
+	}
+	return
+}
@@ -0,0 +1,112 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server REST gateway module.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// restMaxBody is the maximum size of REST gateway request body.
+const restMaxBody = 4 << 20
+
+// RestHandler returns http handler of the REST gateway to Teonet peers APIs.
+// It serves requests:
+//
+//	POST {prefix}/{peer}/{command}
+//
+// The request body is sent to the peer api command as command data, and the
+// api answer is returned in the response body. The gateway connects to the
+// peer and its api on first request, and uses the same api clients, allowed
+// peers, timeout and cache as the websocket clients. Requests with the
+// "Cache-Control: no-cache" header bypass the cache. Mount it with the same
+// prefix:
+//
+//	http.Handle("/api/", teo.RestHandler("/api"))
+func (teo *TeonetServer) RestHandler(prefix string) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+prefix+"/{peer}/{command}", teo.handleRest)
+	return mux
+}
+
+// handleRest processes REST gateway api request.
+func (teo *TeonetServer) handleRest(w http.ResponseWriter, r *http.Request) {
+	peer, apiCommand := r.PathValue("peer"), r.PathValue("command")
+	logger := teo.logger.With("remote", r.RemoteAddr, "cmd", "Rest")
+
+	// Start span with client trace context from request headers
+	ctx := propagation.TraceContext{}.Extract(r.Context(),
+		propagation.HeaderCarrier(r.Header))
+	ctx, span := teo.tracer.Start(ctx, "teoproxy Rest",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("teoproxy.peer", peer),
+			attribute.String("teoproxy.api", apiCommand),
+		),
+	)
+
+	data, err := func() (data []byte, err error) {
+
+		// Read request body
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, restMaxBody))
+		if err != nil {
+			return
+		}
+
+		// Connect to peer and its api
+		if !teo.apiClients.Exists(peer) {
+			if err = teo.connectTo(peer); err != nil {
+				return
+			}
+		}
+		api, err := teo.newAPIClient(peer)
+		if err != nil {
+			return
+		}
+
+		// Send request to api peer and wait answer or get it from cache
+		noCache := r.Header.Get("Cache-Control") == "no-cache"
+		return teo.cachedSendTo(ctx, logger, api, peer, apiCommand, body,
+			noCache)
+	}()
+	endSpan(span, err)
+	teo.metrics.Command("Rest", err)
+
+	// Write error or answer
+	if err != nil {
+		logger.Warn("rest api request failed", "peer", peer, "api", apiCommand,
+			"err", err)
+		http.Error(w, err.Error(), restStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// restStatus returns http status code of the REST gateway error.
+func restStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrPeerNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrShutdown):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadGateway
+	}
+}
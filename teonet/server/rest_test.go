@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// newRestTestServer creates TeonetServer without Teonet connection which
+// serves REST gateway requests rejected before connecting to peers.
+func newRestTestServer(t *testing.T) *TeonetServer {
+	teo := &TeonetServer{
+		Mutex:  new(sync.Mutex),
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		done:   make(chan struct{}),
+	}
+	if err := teo.initTracing("test"); err != nil {
+		t.Fatalf("can't init tracing: %v", err)
+	}
+	return teo
+}
+
+func TestRestStatus(t *testing.T) {
+
+	// Test case 1: errors are mapped to http status codes
+	for i, test := range []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("%w: other", ErrPeerNotAllowed), http.StatusForbidden},
+		{ErrTimeout, http.StatusGatewayTimeout},
+		{ErrShutdown, http.StatusServiceUnavailable},
+		{&http.MaxBytesError{Limit: 1}, http.StatusRequestEntityTooLarge},
+		{errors.New("peer error"), http.StatusBadGateway},
+	} {
+		if status := restStatus(test.err); status != test.status {
+			t.Errorf("test %d: expected status %d, got: %d", i+1, test.status,
+				status)
+		}
+	}
+}
+
+func TestRestHandler(t *testing.T) {
+	teo := newRestTestServer(t)
+	ts := httptest.NewServer(teo.RestHandler("/api/"))
+	t.Cleanup(ts.Close)
+
+	// Test case 1: wrong method and paths
+	for i, test := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/api/fortune/fortb", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/fortune", http.StatusNotFound},
+		{http.MethodPost, "/api/fortune/fortb/more", http.StatusNotFound},
+		{http.MethodPost, "/other/fortune/fortb", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(test.method, ts.URL+test.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("test %d: %v", i+1, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("test %d: expected status %d, got: %d", i+1, test.status,
+				res.StatusCode)
+		}
+	}
+
+	// Test case 2: request body larger than limit
+	body := bytes.NewReader(make([]byte, restMaxBody+1))
+	res, err := http.Post(ts.URL+"/api/fortune/fortb", "text/plain", body)
+	if err != nil {
+		t.Fatalf("test case 2: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("test case 2: expected status %d, got: %d",
+			http.StatusRequestEntityTooLarge, res.StatusCode)
+	}
+}
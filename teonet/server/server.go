@@ -6,37 +6,62 @@
 package server
 
 import (
-	"encoding/base64"
+	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/teonet-go/teomon"
 	"github.com/teonet-go/teonet"
+	"github.com/teonet-go/teoproxy/e2e"
+	"github.com/teonet-go/teoproxy/metrics"
+	"github.com/teonet-go/teoproxy/tracing"
 	"github.com/teonet-go/teoproxy/ws/command"
 	ws "github.com/teonet-go/teoproxy/ws/server"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// init initializes the Go program.
-//
-// It sets the log flags to include the standard date and time format, as well
-// as microseconds.
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-}
-
 // TeonetServer is the main server type that contains the core components.
 // It has mutexes for synchronization, the websocket server,
-// the Teonet client, and API clients. As an exported type, it is part of the
+// the Teonet client, and API clients. The Teonet client is nil if the server
+// uses other backend. As an exported type, it is part of the
 // public API.
 type TeonetServer struct {
 	*sync.Mutex
 	*ws.WsServer
 	*teonet.Teonet
 	apiClients *APIClients
+	streams    *Streams
+	requests   *Requests
+	metrics    *metrics.Metrics
+	logger     *slog.Logger
+	logPayload bool
+
+	backend           Backend             // Network of peers
+	upstreams         *Upstreams          // Peers routed to other backends
+	cache             *Cache              // Api answers cache, nil if disabled
+	coalescer         *Coalescer          // Api requests coalescer, nil if disabled
+	timeout           time.Duration       // Peer api answer timeout
+	allowedPeers      map[string]struct{} // Allowed peers, all if empty
+	fragmentSize      int                 // Answers fragment size, 0 if disabled
+	compressThreshold int                 // Answers compression threshold
+	maxMessage        int                 // Session reassembly buffers size
+	readLimit         int64               // Websocket message size limit
+	origins           []string            // Allowed websocket origins
+	reassemblers      *Reassemblers       // Sessions reassembly buffers
+
+	tracingConfig  *tracing.Config
+	tracerProvider trace.TracerProvider
+	tracer         trace.Tracer
+
+	binary ws.Handler // Binary protocol messages handler
+
+	inflight sync.WaitGroup // In-flight ApiSendTo requests
+	done     chan struct{}  // Closed when shutdown deadline expires
+	shutdown sync.Once      // Runs shutdown once
 }
 
 // TeonetMonitor contains monitoring information to send to the Teonet monitor.
@@ -52,30 +77,54 @@ type TeonetMonitor struct {
 // New creates a new TeonetServer instance. It initializes the mutex, API clients,
 // Teonet client, and websocket server. The appShort parameter specifies the
 // application name. The monitor parameter optionally configures connecting to a
-// Teonet monitor for metrics reporting. It returns the TeonetServer instance
-// and any error. As an exported function, this serves as the main constructor for
-// the TeonetServer type.
-func New(appShort string, monitor *TeonetMonitor) (teo *TeonetServer, err error) {
-	teo = &TeonetServer{Mutex: new(sync.Mutex)}
+// Teonet monitor for metrics reporting. The opts parameters configure optional
+// server features, the Teonet client is not started if other backend is set
+// with WithBackend and the monitor is used with the Teonet backend only. It
+// returns the TeonetServer instance and any error.
+func New(appShort string, monitor *TeonetMonitor, opts ...Option) (
+	teo *TeonetServer, err error) {
+
+	teo = &TeonetServer{
+		Mutex:             new(sync.Mutex),
+		upstreams:         newUpstreams(),
+		done:              make(chan struct{}),
+		timeout:           DefaultTimeout,
+		fragmentSize:      command.DefaultFragmentSize,
+		compressThreshold: command.DefaultCompressThreshold,
+		maxMessage:        command.DefaultMaxMessage,
+		readLimit:         ws.DefaultReadLimit,
+	}
+	for _, opt := range opts {
+		opt(teo)
+	}
+	if teo.logger == nil {
+		teo.logger = slog.Default()
+	}
 
 	// Init api clients object
 	teo.initAPIClients()
 
-	// Start Teonet client
-	teo.Teonet, err = teonet.New(appShort)
-	if err != nil {
+	// Init tracer
+	if err = teo.initTracing(appShort); err != nil {
+		err = fmt.Errorf("can't init tracing, error: %w", err)
 		return
 	}
 
-	// Connect to Teonet
-	err = teo.Connect()
-	if err != nil {
-		err = fmt.Errorf("can't connect to Teonet, error: " + err.Error())
-		return
+	// Start Teonet client and connect to Teonet if other backend is not set
+	if teo.backend == nil {
+		var b *TeonetBackend
+		if b, err = NewTeonetBackend(appShort); err != nil {
+			err = fmt.Errorf("can't connect to Teonet, error: %w", err)
+			return
+		}
+		teo.backend = b
+	}
+	if b, ok := teo.backend.(*TeonetBackend); ok {
+		teo.Teonet = b.Teonet
 	}
 
 	// Connect to monitor
-	if monitor != nil && len(monitor.Addr) > 0 {
+	if monitor != nil && len(monitor.Addr) > 0 && teo.Teonet != nil {
 		teomon.Connect(teo.Teonet, monitor.Addr, teomon.Metric{
 			AppName:      monitor.AppName,
 			AppShort:     monitor.AppShort,
@@ -83,59 +132,171 @@ func New(appShort string, monitor *TeonetMonitor) (teo *TeonetServer, err error)
 			TeoVersion:   teonet.Version,
 			AppStartTime: time.Now(),
 		})
+		teo.logger.Info("connected to monitor", "addr", monitor.Addr)
 	}
-	log.Println("Connected to monitor")
 
 	// Create websocket server
-	teo.WsServer = ws.New(teo.processMessage)
+	teo.initWsServer()
 
 	return
 }
 
-// processMessage processes a websocket message received from a client.
-// It decodes the base64 encoded message, unmarshals the teonet command,
-// processes the command by calling processCommand, and writes the response
-// back to the client.
-func (teo *TeonetServer) processMessage(conn *websocket.Conn, message []byte) {
+// initWsServer creates the websocket server. Clients select the JSON-RPC 2.0
+// protocol with websocket subprotocol, other clients use the base64 binary
+// protocol. Middleware added by Use get raw websocket messages of both
+// protocols.
+func (teo *TeonetServer) initWsServer() {
+	teo.initStreams()
+	teo.initRequests()
+	teo.initReassemblers()
+	teo.binary = ws.DecodeBase64(ws.HandlerFunc(teo.processMessage))
+	teo.WsServer = ws.New(ws.HandlerFunc(teo.dispatchMessage),
+		ws.WithLogger(teo.logger),
+		ws.WithPayloadLogging(teo.logPayload),
+		ws.WithMetrics(teo.metrics),
+		ws.WithSubprotocols(JSONRPCSubprotocol),
+		ws.WithReadLimit(teo.readLimit),
+		ws.WithOrigins(teo.origins...),
+	)
+	teo.Use(ws.Recover)
+}
 
-	// decode message base64
-	message, err := base64.StdEncoding.DecodeString(string(message))
-	if err != nil {
-		log.Println("Can't decode message base64, error:", err)
+// SendTo sends data to the Teonet peer. It resolves the ambiguity between
+// the embedded Teonet SendTo and WsServer SendTo methods in favour of Teonet,
+// use WsServer.SendTo to send a message to a websocket session. It returns
+// ErrNoTeonet if the server uses other backend.
+func (teo *TeonetServer) SendTo(addr string, data []byte,
+	attr ...interface{}) (id int, err error) {
+	if teo.Teonet == nil {
+		err = ErrNoTeonet
 		return
 	}
+	return teo.Teonet.SendTo(addr, data, attr...)
+}
+
+// Backend returns the network of peers the server forwards commands to.
+func (teo *TeonetServer) Backend() Backend { return teo.backend }
+
+// dispatchMessage routes a websocket message to the handler of the protocol
+// selected by the client session.
+func (teo *TeonetServer) dispatchMessage(msg *ws.Message) error {
+	if msg.Session.Subprotocol() == JSONRPCSubprotocol {
+		return teo.processJSONRPC(msg)
+	}
+	return teo.binary.ServeMessage(msg)
+}
+
+// processMessage processes a websocket message received from a client.
+// The message is decoded from base64 by the DecodeBase64 middleware. It
+// unmarshals the teonet command, processes the command by calling
+// processCommand, and writes the response back to the client.
+func (teo *TeonetServer) processMessage(msg *ws.Message) (err error) {
 
 	// Check teonet command
 	cmd := &command.TeonetCmd{}
-	err = cmd.UnmarshalBinary(message)
+	err = cmd.UnmarshalBinary(msg.Data)
 	if err != nil {
-		log.Println("Can't unmarshal teonet command, error:", err, string(message))
+		err = fmt.Errorf("can't unmarshal teonet command, error: %w", err)
+		return
+	}
+
+	// Collect fragments until the command is complete
+	cmd, ok, err := teo.reassemble(msg.Session, cmd)
+	if err != nil || !ok {
+		return
+	}
+
+	// Decompress command data
+	if err = cmd.Decompress(teo.maxMessage); err != nil {
+		err = fmt.Errorf("can't decompress teonet command, error: %w", err)
+		return
+	}
+	logger := msg.Session.Logger().With("id", cmd.Id, "cmd", cmd.Cmd.String())
+	if teo.logPayload {
+		logger.Debug("got Teonet proxy client command", "data", string(cmd.Data))
+	} else {
+		logger.Debug("got Teonet proxy client command", "len", len(cmd.Data))
+	}
+
+	// Process stream command, the stream answers the client itself
+	if cmd.Cmd.IsStream() {
+		return teo.processStream(msg.Context(), msg.Session, logger, cmd)
+	}
+
+	// Cancel client request, the Cancel command is not answered
+	if cmd.Cmd == command.Cancel {
+		teo.processCancel(msg.Session, logger, cmd)
+		return
+	}
+
+	// Answer Ping command with Pong in its own goroutine, the peer probe
+	// waits for the peer answer
+	if cmd.Cmd == command.Ping {
+		msg.Session.Go(func() {
+			if err := teo.processPing(msg.Session, logger, cmd); err != nil {
+				logger.Warn("failed to process message from client",
+					"err", err)
+			}
+		})
 		return
 	}
-	log.Println("Got Teonet proxy client command:", cmd.Id, cmd.Cmd.String(),
-		string(cmd.Data))
+
+	// Process command waiting for peer answers in its own goroutine
+	if cancelable(cmd.Cmd) {
+		return teo.processRequest(msg.Context(), msg.Session, logger, cmd)
+	}
 
 	// Process command
-	data, err := teo.processCommand(cmd)
+	data, err := teo.execCommand(msg.Context(), logger, msg.Session.ID(), cmd)
 	if err != nil {
-		log.Println("process command, error:", err)
+		err = fmt.Errorf("process command, error: %w", err)
 		return
 	}
+	return teo.answer(msg.Session, cmd, data)
+}
 
-	// Write response to client
-	cmd.Data, cmd.Err = data, err
-	data, _ = cmd.MarshalBinary()
-	if err = conn.WriteMessage(websocket.TextMessage,
-		[]byte(base64.StdEncoding.EncodeToString(data))); err != nil {
-		log.Println("Can't write message to client, error:", err)
+// answer writes the command answer data to the client session. The answer
+// is compressed if the client accepts compression and sent in fragments if
+// it is larger than the fragment size.
+func (teo *TeonetServer) answer(sess *ws.Session, cmd *command.TeonetCmd,
+	data []byte) (err error) {
+
+	// Write response to client, compress it if the client accepts compression.
+	// The request trace context and no cache flag are not sent back
+	accept := cmd.Accept
+	cmd.Data, cmd.Err, cmd.Accept = data, nil, 0
+	cmd.TraceParent, cmd.NoCache = "", false
+	if teo.compressThreshold > 0 && accept != 0 {
+		cmd.Accept = command.SupportedCodecs
+		if err = cmd.Compress(accept, teo.compressThreshold); err != nil {
+			err = fmt.Errorf("can't compress answer, error: %w", err)
+			return
+		}
 	}
+	if err = teo.sendFragments(sess, cmd); err != nil {
+		err = fmt.Errorf("can't write message to client, error: %w", err)
+	}
+	return
+}
+
+// execCommand processes the command in the command span and counts it in
+// metrics. It is used by all client protocols.
+func (teo *TeonetServer) execCommand(ctx context.Context, logger *slog.Logger,
+	sessionID string, cmd *command.TeonetCmd) (data []byte, err error) {
+
+	ctx, span := teo.startCommandSpan(ctx, cmd, sessionID)
+	data, err = teo.processCommand(ctx, logger, cmd)
+	endSpan(span, err)
+	teo.metrics.Command(cmd.Cmd.String(), err)
+	return
 }
 
 // processCommand processes a Teonet command received from a client.
 // It handles different command types like Connect, Disconnect etc.
-// Returns the response data and error.
-func (teo *TeonetServer) processCommand(cmd *command.TeonetCmd) (data []byte,
-	err error) {
+// The ctx contains the command span, the logger contains the client session
+// and command attributes. Returns the response data and error.
+func (teo *TeonetServer) processCommand(ctx context.Context,
+	logger *slog.Logger, cmd *command.TeonetCmd) (data []byte, err error) {
 
 	switch cmd.Cmd {
 
@@ -149,33 +310,23 @@ func (teo *TeonetServer) processCommand(cmd *command.TeonetCmd) (data []byte,
 
 	// Process ConnectTo peer command
 	case command.ConnectTo:
-		teo.Lock()
-		defer teo.Unlock()
 		addr := string(cmd.Data)
-		if err = teo.ConnectTo(addr); err != nil {
-			err = fmt.Errorf("can't connect to peer %s, error: %s", addr, err)
-			log.Println(err)
+		if err = teo.connectTo(addr); err != nil {
 			return
 		}
 		str := fmt.Sprintf("Connected to peer %s", addr)
 		data = []byte(str)
-		log.Println(str)
+		logger.Info("connected to peer", "peer", addr)
 
 	// Process NewAPIClient command
 	case command.NewApiClient:
 		addr := string(cmd.Data)
-		if !teo.apiClients.Exists(addr) {
-			var cli *teonet.APIClient
-			if cli, err = teo.NewAPIClient(addr); err != nil {
-				err = fmt.Errorf("can't connect to peer %s api, error: %s",
-					addr, err.Error())
-				return
-			}
-			teo.apiClients.Add(addr, cli)
+		if _, err = teo.newAPIClient(addr); err != nil {
+			return
 		}
 		str := fmt.Sprintf("Connected to peer %s api", addr)
 		data = []byte(str)
-		log.Println(str)
+		logger.Info("connected to peer api", "peer", addr)
 
 	// Process SendTo command
 	case command.ApiSendTo:
@@ -191,52 +342,98 @@ func (teo *TeonetServer) processCommand(cmd *command.TeonetCmd) (data []byte,
 		apiCommand := splitData[1]
 		apiCommandData := cmd.Data[len(apiPeerName)+1+len(apiCommand)+1:]
 
-		log.Println("Send api command:", string(apiCommand), " to peer:",
-			apiPeerName, " data len:", len(apiCommandData))
-
-		// Api answer struct
-		type apiAnswer struct {
-			data []byte
-			err  error
-		}
-		w := make(chan apiAnswer, 1)
 		// Get api client by name
-		api, ok := teo.apiClients.Get(apiPeerName)
-		if !ok {
-			err = fmt.Errorf(
-				"can't get api client, error: has not connected to peer api %s",
-				apiPeerName,
-			)
+		var api APIClient
+		if api, err = teo.getAPIClient(apiPeerName); err != nil {
 			return
 		}
-		// Send request to api peer
-		api.SendTo(apiCommand, apiCommandData, func(data []byte, err error) {
-			log.Println("Got response from peer, len:", len(data), " err:", err)
-			w <- apiAnswer{data, err}
-		})
 
-		// Get answer from api peer or timeout
-		var answer apiAnswer
-		select {
-		case answer = <-w:
-		case <-time.After(5 * time.Second):
-			answer = apiAnswer{nil, fmt.Errorf("timeout")}
+		// Send request to api peer and wait answer or get it from cache
+		data, err = teo.cachedSendTo(ctx, logger, api, apiPeerName,
+			apiCommand, apiCommandData, cmd.NoCache)
+
+	// Process KeyExchange command. The client public key is forwarded to the
+	// peer e2e key exchange api command, then the client and the peer share
+	// keys the proxy server does not know
+	case command.KeyExchange:
+		peer, key, ok := bytes.Cut(cmd.Data, []byte(","))
+		if !ok || len(peer) == 0 {
+			err = fmt.Errorf("wrong command data: %s", cmd.Cmd.String())
+			return
 		}
-		data, err = answer.data, answer.err
+		var api APIClient
+		if api, err = teo.getAPIClient(string(peer)); err != nil {
+			return
+		}
+		data, err = teo.apiSendTo(ctx, logger, api, string(peer),
+			e2e.KeyExchangeCommand, key)
+
+	// Process Batch command. The items are sent to peers in parallel and
+	// answered with results of each item
+	case command.Batch:
+		data, err = teo.processBatch(ctx, logger, cmd)
+
+	// Process peers discovery commands
+	case command.Peers, command.Resolve, command.DescribeAPI:
+		data, err = teo.processDiscovery(cmd)
 
 	// Unknown command
 	default:
 		err = fmt.Errorf("unknown command: %s", cmd.Cmd.String())
-		log.Println("Unknown command:", err)
 	}
 
 	return
 }
 
+// Shutdown gracefully shuts down the Teonet proxy server. It stops accepting
+// new websocket connections, sends close frames to connected clients and waits
+// for in-flight ApiSendTo requests up to the context deadline. Then it closes
+// API clients and the Teonet instance. If the context expires before all
+// requests are done, the requests waiting for peer answers get a
+// "server shutdown" error and Shutdown returns the context's error.
+func (teo *TeonetServer) Shutdown(ctx context.Context) (err error) {
+	err = ws.ErrServerClosed
+	teo.shutdown.Do(func() {
+
+		// Stop websocket server and wait for in-flight requests
+		err = teo.WsServer.Shutdown(ctx)
+		if err == nil {
+			err = waitContext(ctx, &teo.inflight)
+		}
+		if err != nil {
+			close(teo.done)
+			teo.inflight.Wait()
+		}
+
+		// Close API clients, backends and tracer provider
+		teo.apiClients.RemoveAll()
+		teo.upstreams.closeAll()
+		teo.backend.Close()
+		if e := teo.shutdownTracing(ctx); e != nil && err == nil {
+			err = e
+		}
+		teo.logger.Info("Teonet proxy server stopped")
+	})
+	return
+}
+
+// waitContext waits for the wait group or the context done. It returns the
+// context's error if the context expires first.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // APIClients stores a map of APIClient instances, keyed by peer name.
 // It uses a RWMutex for concurrent access control.
 type APIClients struct {
-	m map[string]*teonet.APIClient
+	m map[string]APIClient
 	*sync.RWMutex
 }
 
@@ -245,7 +442,7 @@ type APIClients struct {
 // in a concurrent map, protected by an RWMutex.
 func (teo *TeonetServer) initAPIClients() {
 	teo.apiClients = &APIClients{
-		m:       make(map[string]*teonet.APIClient),
+		m:       make(map[string]APIClient),
 		RWMutex: &sync.RWMutex{},
 	}
 }
@@ -255,7 +452,7 @@ func (teo *TeonetServer) initAPIClients() {
 // to prevent concurrent map writes. It first checks if a client
 // already exists for the given name and returns immediately if
 // so to avoid overwriting the existing client.
-func (cli *APIClients) Add(name string, api *teonet.APIClient) {
+func (cli *APIClients) Add(name string, api APIClient) {
 	cli.Lock()
 	defer cli.Unlock()
 
@@ -274,12 +471,19 @@ func (cli *APIClients) Remove(name string) {
 	delete(cli.m, name)
 }
 
+// RemoveAll removes all APIClient instances from the APIClients map.
+func (cli *APIClients) RemoveAll() {
+	cli.Lock()
+	defer cli.Unlock()
+	clear(cli.m)
+}
+
 // Get retrieves the APIClient instance for the given name from the
 // APIClients map. It locks the map for reading during the lookup to
 // prevent concurrent map access. The second return value indicates
 // if a client was found. This is an exported method that is part of
 // the APIClients API.
-func (cli *APIClients) Get(name string) (api *teonet.APIClient, ok bool) {
+func (cli *APIClients) Get(name string) (api APIClient, ok bool) {
 	cli.RLock()
 	defer cli.RUnlock()
 	api, ok = cli.m[name]
@@ -0,0 +1,306 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server command streams module.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/teonet-go/teoproxy/ws/command"
+	ws "github.com/teonet-go/teoproxy/ws/server"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// streamMaxSession is the maximum number of running streams of the client
+// session.
+const streamMaxSession = 16
+
+var (
+	ErrStreamNotFound = errors.New("stream not found")
+	ErrStreamExists   = errors.New("stream already exists")
+	ErrStreamTooBig   = errors.New("stream request too big")
+	ErrStreamLimit    = errors.New("too many streams")
+	ErrStreamCredit   = errors.New("stream chunk without credit")
+)
+
+// stream is the API Command stream of the client session. It collects the
+// request chunks, sends the request to the peer api and sends the answer to
+// the client in chunks when the client gives credits. The Teonet api answers
+// with whole data, so the server holds the answer while it is streamed.
+type stream struct {
+	id      uint32             // Stream packet id
+	sess    *ws.Session        // Client session
+	api     APIClient          // Peer api client
+	peer    string             // Peer address
+	apiCmd  string             // Peer api command
+	request []byte             // Request data
+	chunks  uint32             // Chunks received since last credit
+	granted uint32             // Request chunks the client may send
+	started bool               // Request sent to peer
+	ctx     context.Context    // Stream context with span
+	cancel  context.CancelFunc // Cancels stream
+	span    trace.Span         // Stream span
+	logger  *slog.Logger       // Logger with stream attributes
+
+	mu     sync.Mutex
+	credit uint32        // Chunks allowed to send to client
+	notify chan struct{} // Signals new credits
+
+	finished sync.Once // Finishes stream once
+}
+
+// streamKey is the key of streams map.
+type streamKey struct {
+	session string
+	id      uint32
+}
+
+// Streams stores a map of running client streams, keyed by session id and
+// stream packet id, and the number of streams of each session. It uses a
+// RWMutex for concurrent access control.
+type Streams struct {
+	m        map[streamKey]*stream
+	sessions map[string]int
+	*sync.RWMutex
+}
+
+// initStreams initializes the streams field of the TeonetServer.
+func (teo *TeonetServer) initStreams() {
+	teo.streams = &Streams{
+		m:        make(map[streamKey]*stream),
+		sessions: make(map[string]int),
+		RWMutex:  &sync.RWMutex{},
+	}
+}
+
+// add adds the stream to the Streams map. It returns error if the stream
+// with the same key already exists or the session runs streamMaxSession
+// streams.
+func (s *Streams) add(st *stream) error {
+	s.Lock()
+	defer s.Unlock()
+	key := streamKey{st.sess.ID(), st.id}
+	if _, ok := s.m[key]; ok {
+		return fmt.Errorf("%w: %d", ErrStreamExists, st.id)
+	}
+	if s.sessions[key.session] >= streamMaxSession {
+		return fmt.Errorf("%w: %d", ErrStreamLimit, streamMaxSession)
+	}
+	s.m[key] = st
+	s.sessions[key.session]++
+	return nil
+}
+
+// remove removes the stream from the Streams map.
+func (s *Streams) remove(st *stream) {
+	s.Lock()
+	defer s.Unlock()
+	key := streamKey{st.sess.ID(), st.id}
+	if _, ok := s.m[key]; !ok {
+		return
+	}
+	delete(s.m, key)
+	if s.sessions[key.session]--; s.sessions[key.session] == 0 {
+		delete(s.sessions, key.session)
+	}
+}
+
+// get retrieves the stream of the session with given packet id.
+func (s *Streams) get(sessionID string, id uint32) (st *stream, ok bool) {
+	s.RLock()
+	defer s.RUnlock()
+	st, ok = s.m[streamKey{sessionID, id}]
+	return
+}
+
+// Len returns the number of running streams.
+func (s *Streams) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.m)
+}
+
+// processStream processes the stream command received from the client.
+func (teo *TeonetServer) processStream(ctx context.Context, sess *ws.Session,
+	logger *slog.Logger, cmd *command.TeonetCmd) (err error) {
+
+	// Start new stream
+	if cmd.Cmd == command.StreamStart {
+		return teo.startStream(ctx, sess, logger, cmd)
+	}
+
+	st, ok := teo.streams.get(sess.ID(), cmd.Id)
+	if !ok {
+		err = fmt.Errorf("%w: %d", ErrStreamNotFound, cmd.Id)
+		return
+	}
+
+	if st.started && cmd.Cmd != command.StreamCredit {
+		err = fmt.Errorf("stream %d request already ended", cmd.Id)
+		return
+	}
+
+	switch cmd.Cmd {
+
+	// Process request chunk, give more credits when half of them used. The
+	// request is limited by the maximum message size, as the reassembled
+	// messages are
+	case command.StreamChunk:
+		switch {
+		case st.granted == 0:
+			err = ErrStreamCredit
+		case len(cmd.Data) > command.StreamChunkSize,
+			len(st.request)+len(cmd.Data) > teo.maxMessage:
+			err = ErrStreamTooBig
+		}
+		if err != nil {
+			st.finish(err)
+			return
+		}
+		st.granted--
+		st.request = append(st.request, cmd.Data...)
+		if st.chunks++; st.chunks >= command.StreamWindow/2 {
+			err = st.send(command.NewCredit(st.id, st.chunks))
+			st.granted += st.chunks
+			st.chunks = 0
+		}
+
+	// Add credits to send answer chunks
+	case command.StreamCredit:
+		var n uint32
+		if n, err = cmd.Credit(); err != nil {
+			return
+		}
+		st.mu.Lock()
+		st.credit += n
+		st.mu.Unlock()
+		select {
+		case st.notify <- struct{}{}:
+		default:
+		}
+
+	// Send request to peer and stream the answer
+	case command.StreamEnd:
+		st.started = true
+		sess.Go(func() { teo.sendStream(st) })
+	}
+
+	return
+}
+
+// startStream creates the stream with "peer,command" from StreamStart
+// command data and gives request chunk credits to the client.
+func (teo *TeonetServer) startStream(ctx context.Context, sess *ws.Session,
+	logger *slog.Logger, cmd *command.TeonetCmd) (err error) {
+
+	peer, apiCmd, ok := strings.Cut(string(cmd.Data), ",")
+	if !ok || len(peer) == 0 || len(apiCmd) == 0 {
+		err = fmt.Errorf("wrong command data: %s", cmd.Cmd.String())
+		return
+	}
+
+	st := &stream{id: cmd.Id, sess: sess, peer: peer, apiCmd: apiCmd,
+		logger: logger, notify: make(chan struct{}, 1)}
+	st.ctx, st.span = teo.startCommandSpan(ctx, cmd, sess.ID())
+	st.ctx, st.cancel = context.WithCancel(st.ctx)
+	if err = teo.streams.add(st); err != nil {
+		// The client waits for the stream started over the limit, the stream
+		// with existing id is not answered to not end the running one
+		if errors.Is(err, ErrStreamLimit) {
+			st.send(&command.TeonetCmd{Id: st.id, Cmd: command.StreamEnd,
+				Err: err})
+		}
+		st.cancel()
+		endSpan(st.span, err)
+		return
+	}
+
+	// Remove stream when it is done or the client disconnects
+	go func() {
+		<-st.ctx.Done()
+		teo.streams.remove(st)
+	}()
+
+	// Get api client by name
+	if st.api, err = teo.getAPIClient(peer); err != nil {
+		st.finish(err)
+		teo.metrics.Command("Stream", err)
+		return
+	}
+
+	st.granted = command.StreamWindow
+	return st.send(command.NewCredit(st.id, command.StreamWindow))
+}
+
+// sendStream sends the request to the peer api and sends the answer to the
+// client in chunks.
+func (teo *TeonetServer) sendStream(st *stream) {
+	data, err := teo.apiSendTo(st.ctx, st.logger, st.api, st.peer, st.apiCmd,
+		st.request)
+	st.request = nil
+	if err == nil {
+		for _, chunk := range command.Chunks(data) {
+			if err = teo.streamCredit(st); err != nil {
+				break
+			}
+			cmd := &command.TeonetCmd{Id: st.id, Cmd: command.StreamChunk,
+				Data: chunk}
+			if err = st.send(cmd); err != nil {
+				break
+			}
+		}
+	}
+	st.finish(err)
+	teo.metrics.Command("Stream", err)
+}
+
+// streamCredit waits for the client credit to send a chunk and takes it.
+func (teo *TeonetServer) streamCredit(st *stream) error {
+	for {
+		st.mu.Lock()
+		if st.credit > 0 {
+			st.credit--
+			st.mu.Unlock()
+			return nil
+		}
+		st.mu.Unlock()
+
+		select {
+		case <-st.notify:
+		case <-st.ctx.Done():
+			return st.ctx.Err()
+		case <-teo.done:
+			return ErrShutdown
+		}
+	}
+}
+
+// send sends the stream command to the client.
+func (st *stream) send(cmd *command.TeonetCmd) error {
+	data, err := cmd.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return st.sess.Send(data)
+}
+
+// finish sends StreamEnd command with error if any to the client, ends the
+// stream span and removes the stream.
+func (st *stream) finish(err error) {
+	st.finished.Do(func() {
+		if st.ctx.Err() == nil {
+			st.send(&command.TeonetCmd{Id: st.id, Cmd: command.StreamEnd,
+				Err: err})
+		}
+		endSpan(st.span, err)
+		st.cancel()
+	})
+}
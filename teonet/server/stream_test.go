@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/teonet-go/teoproxy/ws/command"
+)
+
+// sendCmd sends the binary protocol command to the websocket server.
+func sendCmd(t *testing.T, conn *websocket.Conn, cmd *command.TeonetCmd) {
+	data, err := cmd.MarshalBinary()
+	if err != nil {
+		t.Fatalf("can't marshal command: %v", err)
+	}
+	err = conn.WriteMessage(websocket.TextMessage,
+		[]byte(base64.StdEncoding.EncodeToString(data)))
+	if err != nil {
+		t.Fatalf("can't write message: %v", err)
+	}
+}
+
+// readCmd reads the binary protocol command from the websocket server.
+func readCmd(t *testing.T, conn *websocket.Conn) *command.TeonetCmd {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("can't read message: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(string(message))
+	if err != nil {
+		t.Fatalf("can't decode message: %v", err)
+	}
+	cmd := command.NewEmpty()
+	if err = cmd.UnmarshalBinary(data); err != nil {
+		t.Fatalf("can't unmarshal command: %v", err)
+	}
+	return cmd
+}
+
+func TestStream(t *testing.T) {
+	teo, url := newTestServer(t)
+	conn := dial(t, teo, url)
+
+	// Test case 1: stream to not connected peer api ends with error
+	start := command.New(command.StreamStart, []byte("fortune,fortb"))
+	start.Id = 1
+	sendCmd(t, conn, start)
+	cmd := readCmd(t, conn)
+	if cmd.Id != 1 || cmd.Cmd != command.StreamEnd || cmd.Err == nil {
+		t.Fatalf("expected StreamEnd with error, got: %v %v", cmd.Cmd, cmd.Err)
+	}
+	for i := 0; teo.streams.Len() != 0; i++ {
+		if i > 100 {
+			t.Fatal("stream was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Test case 2: chunk of unknown stream is ignored and does not create
+	// the stream
+	chunk := command.New(command.StreamChunk, []byte("data"))
+	chunk.Id = 2
+	sendCmd(t, conn, chunk)
+
+	// Test case 3: stream is started and gives initial credits
+	teo.apiClients.Add("fortune", nil)
+	start.Id = 3
+	sendCmd(t, conn, start)
+	cmd = readCmd(t, conn)
+	n, err := cmd.Credit()
+	if cmd.Id != 3 || cmd.Cmd != command.StreamCredit || err != nil ||
+		n != command.StreamWindow {
+		t.Fatalf("expected StreamCredit %d, got: %v %d %v",
+			command.StreamWindow, cmd.Cmd, n, err)
+	}
+	if l := teo.streams.Len(); l != 1 {
+		t.Errorf("expected 1 stream, got: %d", l)
+	}
+
+	// Test case 4: too large chunk ends the stream with error
+	chunk = command.New(command.StreamChunk,
+		make([]byte, command.StreamChunkSize+1))
+	chunk.Id = 3
+	sendCmd(t, conn, chunk)
+	cmd = readCmd(t, conn)
+	if cmd.Id != 3 || cmd.Cmd != command.StreamEnd || cmd.Err == nil {
+		t.Fatalf("expected StreamEnd with error, got: %v %v", cmd.Cmd, cmd.Err)
+	}
+	for i := 0; teo.streams.Len() != 0; i++ {
+		if i > 100 {
+			t.Fatal("stream was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Test case 5: streams over the session limit are ended with error
+	for i := 0; i <= streamMaxSession; i++ {
+		start.Id = uint32(10 + i)
+		sendCmd(t, conn, start)
+		cmd = readCmd(t, conn)
+		if i < streamMaxSession && cmd.Cmd != command.StreamCredit {
+			t.Fatalf("expected StreamCredit, got: %v %v", cmd.Cmd, cmd.Err)
+		}
+	}
+	if cmd.Cmd != command.StreamEnd || cmd.Err == nil {
+		t.Errorf("expected StreamEnd with error, got: %v", cmd.Cmd)
+	}
+	if l := teo.streams.Len(); l != streamMaxSession {
+		t.Errorf("expected %d streams, got: %d", streamMaxSession, l)
+	}
+
+	// Test case 6: stream is removed when the client disconnects
+	conn.Close()
+	for i := 0; teo.streams.Len() != 0; i++ {
+		if i > 100 {
+			t.Fatal("stream was not removed on disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
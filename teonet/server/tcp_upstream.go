@@ -0,0 +1,196 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server TCP line protocol upstream module.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// tcpMaxLine is the maximum length of TCP upstream answer line.
+const tcpMaxLine = 4 << 20
+
+var (
+	ErrLineData   = errors.New("line protocol data contains new line")
+	ErrLineAnswer = errors.New("wrong line protocol answer")
+)
+
+// TCPUpstream is the upstream which sends api commands to a TCP service with
+// line protocol. The api command is sent as line:
+//
+//	<command> <data>\n
+//
+// and the service answers with line:
+//
+//	OK <data>\n
+//	ERR <error message>\n
+//
+// Requests are sent one by one over one connection, which is dialed again
+// after errors. Requests waiting for the connection stop when their context
+// is done. The data must not contain new lines, encode binary data.
+type TCPUpstream struct {
+	addr    string
+	timeout time.Duration
+	conn    net.Conn
+	r       *bufio.Reader
+	sem     chan struct{} // Holds the connection of running request
+}
+
+// NewTCPUpstream creates TCP upstream with service address. The timeout is
+// the dial and answer timeout, the DefaultTimeout is used if it is zero.
+func NewTCPUpstream(addr string, timeout time.Duration) *TCPUpstream {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return &TCPUpstream{addr: addr, timeout: timeout,
+		sem: make(chan struct{}, 1)}
+}
+
+// lock takes the connection. It returns the ctx error if the ctx is done
+// before the connection is released by the running request.
+func (u *TCPUpstream) lock(ctx context.Context) error {
+	select {
+	case u.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// unlock releases the connection.
+func (u *TCPUpstream) unlock() { <-u.sem }
+
+// ConnectTo connects to the TCP service if it is not connected.
+func (u *TCPUpstream) ConnectTo(string) (err error) {
+	u.lock(context.Background())
+	defer u.unlock()
+	return u.dial()
+}
+
+// NewAPIClient returns the TCP service api client.
+func (u *TCPUpstream) NewAPIClient(string) (APIClient, error) {
+	return u, nil
+}
+
+// Subscribe returns ErrNotSupported, the line protocol service answers
+// requests only.
+func (u *TCPUpstream) Subscribe(string, func(data []byte)) (func(), error) {
+	return nil, ErrNotSupported
+}
+
+// Address returns the service address.
+func (u *TCPUpstream) Address() string { return u.addr }
+
+// Close closes the connection.
+func (u *TCPUpstream) Close() {
+	u.lock(context.Background())
+	defer u.unlock()
+	u.drop()
+}
+
+// SendTo sends the api command line to the TCP service.
+func (u *TCPUpstream) SendTo(apiCmd string, data []byte,
+	answer func(data []byte, err error)) (err error) {
+	return u.SendToContext(context.Background(), apiCmd, data, answer)
+}
+
+// SendToContext sends the api command line to the TCP service. The request
+// stops waiting for the connection, and the connection is closed if the
+// request is running, when the ctx is done.
+func (u *TCPUpstream) SendToContext(ctx context.Context, apiCmd string,
+	data []byte, answer func(data []byte, err error)) (err error) {
+
+	if bytes.ContainsAny(data, "\r\n") ||
+		bytes.ContainsAny([]byte(apiCmd), " \r\n") {
+		return ErrLineData
+	}
+	line := make([]byte, 0, len(apiCmd)+len(data)+2)
+	line = append(append(append(line, apiCmd...), ' '), data...)
+	line = append(line, '\n')
+	go func() { answer(u.request(ctx, line)) }()
+	return
+}
+
+// request sends the request line and reads the answer line. The connection
+// is closed after network and protocol errors and when the ctx is done
+// during the request.
+func (u *TCPUpstream) request(ctx context.Context, line []byte) (data []byte,
+	err error) {
+
+	if err = u.lock(ctx); err != nil {
+		return
+	}
+	defer u.unlock()
+	if err = u.dial(); err != nil {
+		return
+	}
+
+	conn := u.conn
+	conn.SetDeadline(time.Now().Add(u.timeout))
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	if _, err = conn.Write(line); err != nil {
+		err = u.fail(ctx, err)
+		return
+	}
+	answer, err := u.r.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			err = fmt.Errorf("%w: line too long", ErrLineAnswer)
+		}
+		err = u.fail(ctx, err)
+		return
+	}
+	answer = bytes.TrimRight(answer, "\r\n")
+
+	switch status, rest, _ := bytes.Cut(answer, []byte(" ")); string(status) {
+	case "OK":
+		data = append([]byte{}, rest...)
+	case "ERR":
+		err = errors.New(string(rest))
+	default:
+		err = fmt.Errorf("%w: %q", ErrLineAnswer, status)
+		u.drop()
+	}
+	return
+}
+
+// dial connects to the TCP service if it is not connected.
+func (u *TCPUpstream) dial() (err error) {
+	if u.conn != nil {
+		return
+	}
+	conn, err := net.DialTimeout("tcp", u.addr, u.timeout)
+	if err != nil {
+		return
+	}
+	u.conn, u.r = conn, bufio.NewReaderSize(conn, tcpMaxLine)
+	return
+}
+
+// fail drops the connection after the request error. The error is replaced
+// with the ctx error if the request was stopped by the ctx.
+func (u *TCPUpstream) fail(ctx context.Context, err error) error {
+	u.drop()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// drop closes the connection, the next request dials again.
+func (u *TCPUpstream) drop() {
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn, u.r = nil, nil
+	}
+}
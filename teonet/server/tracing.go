@@ -0,0 +1,98 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server tracing module.
+
+package server
+
+import (
+	"context"
+
+	"github.com/teonet-go/teoproxy/tracing"
+	"github.com/teonet-go/teoproxy/ws/command"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the Teonet proxy server tracer.
+const tracerName = "github.com/teonet-go/teoproxy/teonet/server"
+
+// WithTracerProvider sets OpenTelemetry tracer provider used to create spans
+// around commands processing. The provider is managed by the caller. By
+// default the global otel tracer provider is used.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(teo *TeonetServer) { teo.tracerProvider = tp }
+}
+
+// WithTracing creates tracer provider with stdout or OTLP exporter from the
+// tracing config. The provider is shut down by the TeonetServer Shutdown.
+func WithTracing(cfg tracing.Config) Option {
+	return func(teo *TeonetServer) { teo.tracingConfig = &cfg }
+}
+
+// initTracing initializes the Teonet proxy server tracer.
+func (teo *TeonetServer) initTracing(appShort string) (err error) {
+	if teo.tracingConfig != nil {
+		cfg := *teo.tracingConfig
+		if cfg.ServiceName == "" {
+			cfg.ServiceName = appShort
+		}
+		teo.tracerProvider, err = tracing.NewProvider(context.Background(), cfg)
+		if err != nil {
+			return
+		}
+	}
+	if teo.tracerProvider == nil {
+		teo.tracerProvider = otel.GetTracerProvider()
+	}
+	teo.tracer = teo.tracerProvider.Tracer(tracerName)
+	return
+}
+
+// shutdownTracing shuts down the tracer provider created by WithTracing
+// option and flushes its spans.
+func (teo *TeonetServer) shutdownTracing(ctx context.Context) error {
+	if teo.tracingConfig == nil {
+		return nil
+	}
+	tp, ok := teo.tracerProvider.(interface {
+		Shutdown(ctx context.Context) error
+	})
+	if !ok {
+		return nil
+	}
+	return tp.Shutdown(ctx)
+}
+
+// startCommandSpan extracts client trace context from the command and starts
+// the command processing span.
+func (teo *TeonetServer) startCommandSpan(ctx context.Context,
+	cmd *command.TeonetCmd, sessionID string) (context.Context, trace.Span) {
+
+	if len(cmd.TraceParent) > 0 {
+		ctx = propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{
+			"traceparent": cmd.TraceParent,
+		})
+	}
+	return teo.tracer.Start(ctx, "teoproxy "+cmd.Cmd.String(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("teoproxy.session", sessionID),
+			attribute.Int64("teoproxy.id", int64(cmd.Id)),
+			attribute.String("teoproxy.command", cmd.Cmd.String()),
+		),
+	)
+}
+
+// endSpan records error in the span if any and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
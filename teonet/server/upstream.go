@@ -0,0 +1,145 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Teonet proxy server upstreams module.
+//
+// Upstreams route clients commands by peer name to other backends than the
+// server Teonet backend: a Teonet peer with other address, a HTTP service or
+// a TCP line protocol service. Clients use the same commands with all
+// upstreams, and the allowed peers list contains upstream names.
+
+package server
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrNotSupported = errors.New("not supported by upstream")
+
+// Upstreams stores a map of upstream backends, keyed by peer name. It uses a
+// RWMutex for concurrent access control.
+type Upstreams struct {
+	m map[string]Backend
+	*sync.RWMutex
+}
+
+// newUpstreams creates empty upstreams registry.
+func newUpstreams() *Upstreams {
+	return &Upstreams{
+		m:       make(map[string]Backend),
+		RWMutex: &sync.RWMutex{},
+	}
+}
+
+// Add adds the upstream backend of the peer name or replaces existing one.
+func (u *Upstreams) Add(name string, b Backend) {
+	u.Lock()
+	defer u.Unlock()
+	u.m[name] = b
+}
+
+// Remove removes the upstream backend of the peer name.
+func (u *Upstreams) Remove(name string) {
+	u.Lock()
+	defer u.Unlock()
+	delete(u.m, name)
+}
+
+// Get returns the upstream backend of the peer name.
+func (u *Upstreams) Get(name string) (b Backend, ok bool) {
+	u.RLock()
+	defer u.RUnlock()
+	b, ok = u.m[name]
+	return
+}
+
+// Names returns sorted names of upstreams.
+func (u *Upstreams) Names() (names []string) {
+	u.RLock()
+	defer u.RUnlock()
+	for name := range u.m {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return
+}
+
+// closeAll closes all upstream backends.
+func (u *Upstreams) closeAll() {
+	u.RLock()
+	defer u.RUnlock()
+	for _, b := range u.m {
+		b.Close()
+	}
+}
+
+// AddUpstream routes commands to the peer name to the upstream backend. The
+// peer api client connected to the previous backend is removed.
+func (teo *TeonetServer) AddUpstream(name string, b Backend) {
+	teo.upstreams.Add(name, b)
+	teo.apiClients.Remove(name)
+}
+
+// RemoveUpstream removes the upstream, commands to the peer name are sent to
+// the server backend again.
+func (teo *TeonetServer) RemoveUpstream(name string) {
+	teo.upstreams.Remove(name)
+	teo.apiClients.Remove(name)
+}
+
+// upstream returns the backend of the peer name, it is the server backend if
+// the peer has no upstream. The ok is true if the peer has upstream.
+func (teo *TeonetServer) upstream(name string) (b Backend, ok bool) {
+	if b, ok = teo.upstreams.Get(name); ok {
+		return
+	}
+	return teo.backend, false
+}
+
+// PeerUpstream is the upstream which sends commands to the Teonet peer with
+// other address, so clients can use a short peer name.
+type PeerUpstream struct {
+	Backend        // Teonet backend
+	addr    string // Peer address
+}
+
+// NewPeerUpstream creates upstream to the peer address of the backend.
+func NewPeerUpstream(b Backend, addr string) *PeerUpstream {
+	return &PeerUpstream{b, addr}
+}
+
+// ConnectTo connects to the upstream peer.
+func (u *PeerUpstream) ConnectTo(string) error {
+	return u.Backend.ConnectTo(u.addr)
+}
+
+// NewAPIClient connects to the upstream peer api.
+func (u *PeerUpstream) NewAPIClient(string) (APIClient, error) {
+	return u.Backend.NewAPIClient(u.addr)
+}
+
+// Subscribe subscribes to data packets received from the upstream peer.
+func (u *PeerUpstream) Subscribe(_ string, reader func(data []byte)) (
+	func(), error) {
+	return u.Backend.Subscribe(u.addr, reader)
+}
+
+// Ping returns the round-trip time to the upstream peer if the backend
+// implements Pinger.
+func (u *PeerUpstream) Ping(string) (time.Duration, error) {
+	p, ok := u.Backend.(Pinger)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	return p.Ping(u.addr)
+}
+
+// Address returns the upstream peer address.
+func (u *PeerUpstream) Address() string { return u.addr }
+
+// Close does nothing, the Teonet backend is shared with the server.
+func (u *PeerUpstream) Close() {}
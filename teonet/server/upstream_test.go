@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLineServer starts TCP line protocol test service. It answers the echo
+// command with its data and other commands with error.
+func newLineServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s := bufio.NewScanner(conn)
+				for s.Scan() {
+					cmd, data, _ := strings.Cut(s.Text(), " ")
+					if cmd == "echo" {
+						io.WriteString(conn, "OK "+data+"\n")
+					} else {
+						io.WriteString(conn, "ERR unknown command "+cmd+"\n")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestUpstream(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/hello" {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			w.Write(append([]byte("hello "), data...))
+		}))
+	t.Cleanup(service.Close)
+
+	b := NewMemoryBackend()
+	b.AddPeer("fortune-peer-address").Handle("fortb",
+		func(data []byte) ([]byte, error) { return []byte("fortune"), nil })
+	teo, url := newTestServer(t, WithBackend(b),
+		WithUpstream("web", NewHTTPUpstream(service.URL+"/api/", nil)),
+		WithUpstream("line", NewTCPUpstream(newLineServer(t), 0)),
+		WithUpstream("fortune", NewPeerUpstream(b, "fortune-peer-address")),
+	)
+	conn := dial(t, teo, url, JSONRPCSubprotocol)
+
+	for i, test := range []struct{ request, expected string }{
+		// Test case 1: api commands are routed to upstreams without connect
+		{`{"jsonrpc":"2.0","method":"api.call","params":["web","hello","world"],"id":1}`,
+			`"result":{"data":"hello world"}`},
+		{`{"jsonrpc":"2.0","method":"api.call","params":["line","echo","hi"],"id":2}`,
+			`"result":{"data":"hi"}`},
+		{`{"jsonrpc":"2.0","method":"api.call","params":["fortune","fortb"],"id":3}`,
+			`"result":{"data":"fortune"}`},
+
+		// Test case 2: connect commands to upstreams
+		{`{"jsonrpc":"2.0","method":"teonet.connectTo","params":["line"],"id":4}`,
+			`"result":{"data":"Connected to peer line"}`},
+		{`{"jsonrpc":"2.0","method":"api.newClient","params":["web"],"id":5}`,
+			`"result":{"data":"Connected to peer web api"}`},
+
+		// Test case 3: upstreams errors
+		{`{"jsonrpc":"2.0","method":"api.call","params":["web","foo"],"id":6}`,
+			`"message":"404 Not Found: not found"`},
+		{`{"jsonrpc":"2.0","method":"api.call","params":["line","foo"],"id":7}`,
+			`"message":"unknown command foo"`},
+		{`{"jsonrpc":"2.0","method":"api.call","params":["line","echo","a\nb"],"id":8}`,
+			"line protocol data contains new line"},
+
+		// Test case 4: the connection is reused after error answer
+		{`{"jsonrpc":"2.0","method":"api.call","params":["line","echo","again"],"id":9}`,
+			`"result":{"data":"again"}`},
+	} {
+		if got := call(t, conn, test.request); !strings.Contains(got,
+			test.expected) {
+			t.Errorf("test %d: expected response with %s, got: %s", i+1,
+				test.expected, got)
+		}
+	}
+
+	// Test case 5: removed upstream peer is sent to the server backend
+	teo.RemoveUpstream("web")
+	got := call(t, conn,
+		`{"jsonrpc":"2.0","method":"api.call","params":["web","hello"],"id":10}`)
+	if !strings.Contains(got, "has not connected to peer api web") {
+		t.Errorf("expected not connected error, got: %s", got)
+	}
+}
+
+func TestHTTPUpstream(t *testing.T) {
+	paths := make(chan string, 1)
+	started, canceled := make(chan struct{}), make(chan struct{})
+	service := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/slow" {
+				close(started)
+				<-r.Context().Done()
+				close(canceled)
+				return
+			}
+			paths <- r.URL.EscapedPath() + "?" + r.URL.RawQuery
+			if r.URL.Path == "/api/ok" {
+				w.Write([]byte("ok"))
+			} else if r.URL.Path == "/api/big" {
+				w.Write([]byte("big"))
+			}
+		}))
+	t.Cleanup(service.Close)
+	u := NewHTTPUpstream(service.URL+"/api", nil)
+
+	// Test case 1: the api command is escaped in the request path
+	for _, apiCmd := range []string{"../admin", "x?y=1", "#", "a b"} {
+		answers := make(chan error, 1)
+		err := u.SendTo(apiCmd, nil, func(_ []byte, err error) {
+			answers <- err
+		})
+		if err != nil {
+			t.Fatalf("test case 1: %s: %v", apiCmd, err)
+		}
+		if err := <-answers; err != nil {
+			t.Fatalf("test case 1: %s: %v", apiCmd, err)
+		}
+		expected := "/api/" + url.PathEscape(apiCmd) + "?"
+		if path := <-paths; path != expected {
+			t.Errorf("test case 1: %s: expected %s, got: %s", apiCmd,
+				expected, path)
+		}
+	}
+
+	// Test case 2: dot commands are errors
+	for _, apiCmd := range []string{"", ".", ".."} {
+		if err := u.SendTo(apiCmd, nil, func([]byte, error) {}); err == nil {
+			t.Errorf("test case 2: no error of api command %q", apiCmd)
+		}
+	}
+
+	// Test case 3: the request is stopped when the ctx is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	answers := make(chan error, 1)
+	err := u.SendToContext(ctx, "slow", nil, func(_ []byte, err error) {
+		answers <- err
+	})
+	if err != nil {
+		t.Fatalf("test case 3: %v", err)
+	}
+	<-started
+	cancel()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("test case 3: request was not canceled")
+	}
+	if err := <-answers; !errors.Is(err, context.Canceled) {
+		t.Errorf("test case 3: expected canceled error, got: %v", err)
+	}
+
+	// Test case 4: too large answer is the error, it is not truncated
+	u.maxAnswer = 2
+	for i, test := range []struct {
+		apiCmd string
+		err    error
+	}{{"ok", nil}, {"big", ErrAnswerTooBig}} {
+		answers := make(chan error, 1)
+		u.SendTo(test.apiCmd, nil, func(_ []byte, err error) { answers <- err })
+		<-paths
+		if err := <-answers; !errors.Is(err, test.err) {
+			t.Errorf("test case 4.%d: expected error %v, got: %v", i+1,
+				test.err, err)
+		}
+	}
+}
+
+func TestTCPUpstream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	u := NewTCPUpstream(ln.Addr().String(), time.Minute)
+	t.Cleanup(u.Close)
+
+	// send sends the request and returns channel with its answer error
+	send := func(ctx context.Context) chan error {
+		answers := make(chan error, 1)
+		err := u.SendToContext(ctx, "echo", nil, func(_ []byte, err error) {
+			answers <- err
+		})
+		if err != nil {
+			t.Fatalf("can't send request: %v", err)
+		}
+		return answers
+	}
+	wait := func(answers chan error) error {
+		select {
+		case err := <-answers:
+			return err
+		case <-time.After(time.Second):
+			t.Fatal("request was not stopped")
+		}
+		return nil
+	}
+
+	// Test case 1: the request waiting for the connection stops when its ctx
+	// is done
+	ctx, cancel := context.WithCancel(context.Background())
+	running := send(ctx)
+	conn := <-accepted
+	t.Cleanup(func() { conn.Close() })
+	waitCtx, waitCancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer waitCancel()
+	if err := wait(send(waitCtx)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("test case 1: expected deadline error, got: %v", err)
+	}
+
+	// Test case 2: the running request stops when its ctx is canceled
+	cancel()
+	if err := wait(running); !errors.Is(err, context.Canceled) {
+		t.Errorf("test case 2: expected canceled error, got: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tracing creates OpenTelemetry tracer providers for the Teonet proxy
+// server.
+//
+// The proxy clients send W3C trace context (traceparent) in the command
+// packet header, and the server creates spans around command processing,
+// Teonet api requests and peer replies wait. This package creates the tracer
+// provider which exports these spans to stdout or to OTLP collector.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Supported exporters.
+const (
+	ExporterStdout = "stdout" // Print spans to stdout
+	ExporterOTLP   = "otlp"   // Send spans to OTLP collector over http
+)
+
+// Config contains tracer provider configuration.
+type Config struct {
+	Exporter    string  // Exporter name: stdout or otlp
+	Endpoint    string  // OTLP collector host:port, default localhost:4318
+	Insecure    bool    // Use http instead of https to connect OTLP collector
+	ServiceName string  // Service name resource attribute
+	SampleRatio float64 // Ratio of traces sampled, 0 means sample all
+}
+
+// NewProvider creates a new tracer provider with exporter from config. The
+// provider should be shut down to flush spans when the application exits.
+func NewProvider(ctx context.Context, cfg Config) (
+	tp *sdktrace.TracerProvider, err error) {
+
+	// Create exporter
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		err = fmt.Errorf("unknown tracing exporter: %s", cfg.Exporter)
+	}
+	if err != nil {
+		return
+	}
+
+	// Create resource
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL, semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return
+	}
+
+	// Create sampler
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+
+	tp = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+	return
+}
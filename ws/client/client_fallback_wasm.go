@@ -0,0 +1,200 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build wasm
+
+// Websocket client http fallback transport module.
+
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// fallback contains the http fallback transport session. The client uses
+// long-poll events requests because proxies which drop websocket upgrades
+// often buffer Server-Sent Events streams too.
+type fallback struct {
+	url     string         // Fallback transport base url
+	session string         // Session id, empty if not connected
+	queue   []fallbackSend // Messages waiting to be sent
+	sending bool           // The sender goroutine is running
+	sync.RWMutex
+}
+
+// fallbackSend is the message waiting to be sent to the session.
+type fallbackSend struct {
+	url     string // Fallback transport base url
+	session string // Session id
+	message string // Base64 message
+}
+
+// active returns true if the client is connected with http fallback
+// transport.
+func (f *fallback) active() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.session != ""
+}
+
+// set sets the fallback transport url and session id.
+func (f *fallback) set(url, session string) {
+	f.Lock()
+	defer f.Unlock()
+	f.url, f.session = url, session
+}
+
+// get returns the fallback transport url and session id.
+func (f *fallback) get() (url, session string) {
+	f.RLock()
+	defer f.RUnlock()
+	return f.url, f.session
+}
+
+// runFallback connects to the server with http fallback transport and
+// receives messages. It reconnects when the session is lost and calls
+// onOpen after each connection.
+func (ws *WsClient) runFallback(url string, reconnect bool, onOpen func()) {
+	for ; ; reconnect = true {
+		query := "/open"
+		if reconnect {
+			query += "?reconnect=1"
+		}
+		status, session, err := fetch(url+query, http.MethodPost, "")
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("status %d: %s", status, session)
+		}
+		if err != nil {
+			ws.logger.Warn("can't open http fallback session", "err", err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		ws.fallback.set(url, session)
+		ws.logger.Info("http fallback connection established")
+		onOpen()
+
+		// Receive messages until the session is closed
+		err = ws.pollFallback(url, session)
+		ws.fallback.set(url, "")
+		ws.logger.Info("http fallback connection closed", "err", err)
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// pollFallback receives messages with long-poll requests until the session
+// is closed.
+func (ws *WsClient) pollFallback(url, session string) error {
+	for {
+		status, text, err := fetch(url+"/events?session="+session,
+			http.MethodGet, "")
+		switch {
+		case err != nil:
+			ws.logger.Debug("http fallback poll error", "err", err)
+			time.Sleep(1 * time.Second)
+			continue
+		case status == http.StatusNoContent:
+			continue
+		case status != http.StatusOK:
+			return fmt.Errorf("status %d: %s", status, text)
+		}
+
+		for _, message := range strings.Split(text, "\n") {
+			data, err := base64.StdEncoding.DecodeString(message)
+			if err != nil {
+				ws.logger.Warn("can't decode message base64", "err", err)
+				continue
+			}
+			ws.processReaders(data)
+		}
+	}
+}
+
+// sendFallback sends base64 message with http fallback transport. Messages
+// are sent one by one in the send order, so the server processes them in the
+// same order as messages of the websocket connection.
+func (ws *WsClient) sendFallback(message string) {
+	f := ws.fallback
+	f.Lock()
+	defer f.Unlock()
+	f.queue = append(f.queue, fallbackSend{f.url, f.session, message})
+	if f.sending {
+		return
+	}
+	f.sending = true
+	go ws.sendFallbackQueue()
+}
+
+// sendFallbackQueue sends queued messages with one request at a time until
+// the queue is empty.
+func (ws *WsClient) sendFallbackQueue() {
+	f := ws.fallback
+	for {
+		f.Lock()
+		if len(f.queue) == 0 {
+			f.sending = false
+			f.Unlock()
+			return
+		}
+		m := f.queue[0]
+		f.queue[0] = fallbackSend{}
+		f.queue = f.queue[1:]
+		f.Unlock()
+
+		status, text, err := fetch(m.url+"/send?session="+m.session,
+			http.MethodPost, m.message)
+		if err == nil && status != http.StatusNoContent {
+			err = fmt.Errorf("status %d: %s", status, text)
+		}
+		if err != nil {
+			ws.logger.Warn("can't send http fallback message", "err", err)
+		}
+	}
+}
+
+// fetch calls javascript fetch with method and body and returns response
+// status and text. It should not be called from javascript callbacks.
+func fetch(url, method, body string) (status int, text string, err error) {
+	opts := map[string]any{"method": method, "cache": "no-store"}
+	if body != "" {
+		opts["body"] = body
+	}
+	resp, err := await(js.Global().Call("fetch", url, opts))
+	if err != nil {
+		return
+	}
+	status = resp.Get("status").Int()
+	v, err := await(resp.Call("text"))
+	if err != nil {
+		return
+	}
+	text = v.String()
+	return
+}
+
+// await waits for the javascript promise and returns its value or error.
+func await(promise js.Value) (v js.Value, err error) {
+	done := make(chan struct{})
+	then := js.FuncOf(func(this js.Value, args []js.Value) any {
+		v = args[0]
+		close(done)
+		return nil
+	})
+	defer then.Release()
+	catch := js.FuncOf(func(this js.Value, args []js.Value) any {
+		err = errors.New(args[0].Call("toString").String())
+		close(done)
+		return nil
+	})
+	defer catch.Release()
+	promise.Call("then", then, catch)
+	<-done
+	return
+}
@@ -9,7 +9,7 @@
 package client
 
 import (
-	"log"
+	"log/slog"
 	"net/url"
 
 	"github.com/gorilla/websocket"
@@ -18,6 +18,8 @@ import (
 // WsClient is javascript websocket client to use in wasm application.
 type WsClient struct {
 	*websocket.Conn
+	logger     *slog.Logger
+	logPayload bool
 }
 
 // NewWsClient creates a new instance of the WsClient struct.
@@ -25,9 +27,16 @@ type WsClient struct {
 // The function accepts a variadic parameter `processMessage` of type
 // `func(message []byte) bool`. It returns a pointer to a WsClient instance.
 func NewWsClient(processMessage ...func(message []byte) bool) *WsClient {
-	return &WsClient{}
+	return &WsClient{logger: slog.Default()}
 }
 
+// SetLogger sets structured logger of the websocket client. By default the
+// slog.Default logger is used.
+func (ws *WsClient) SetLogger(logger *slog.Logger) { ws.logger = logger }
+
+// SetPayloadLogging enables logging of messages data. It is off by default.
+func (ws *WsClient) SetPayloadLogging(on bool) { ws.logPayload = on }
+
 // SendMessage sends a message to the websocket server.
 func (ws *WsClient) SendMessage(message []byte) {
 	ws.Conn.WriteMessage(websocket.TextMessage, message)
@@ -41,12 +50,15 @@ func (ws *WsClient) receiveMessages() {
 		// Read a message from the server
 		_, message, err := ws.Conn.ReadMessage()
 		if err != nil {
-			log.Println("Error receiving message from WebSocket server:", err)
+			ws.logger.Debug("error receiving message from websocket server",
+				"err", err)
 			return
 		}
 
 		// Process the received message
-		log.Println("Received message from server:", string(message))
+		if ws.logPayload {
+			ws.logger.Debug("received message from server", "data", message)
+		}
 	}
 }
 
@@ -61,7 +73,7 @@ func (ws *WsClient) Connect() (err error) {
 	// Establish a WebSocket connection
 	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
-		log.Println("Error connecting to WebSocket server:", err)
+		ws.logger.Warn("error connecting to websocket server", "err", err)
 		return
 	}
 	ws.Conn = conn
@@ -72,7 +84,7 @@ func (ws *WsClient) Connect() (err error) {
 	// Send a message to the server
 	err = conn.WriteMessage(websocket.TextMessage, []byte("Hello, server! (inside go)"))
 	if err != nil {
-		log.Println("Error sending message to WebSocket server:", err)
+		ws.logger.Warn("error sending message to websocket server", "err", err)
 		return
 	}
 
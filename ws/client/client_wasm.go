@@ -11,44 +11,70 @@ package client
 import (
 	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/url"
 	"syscall/js"
 	"time"
 )
 
-// init initializes the logger by setting the log flags. This ensures
-// log messages include microseconds in the timestamp for more granular
-// timestamps.
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-}
-
 // WsClient is the client implementation for connecting to the proxy server
 // via a WebSocket. It contains the underlying JavaScript WebSocket value
 // and the message readers.
 type WsClient struct {
 	js.Value
 	*Readers
+	fallback   *fallback // Http fallback transport session
+	logger     *slog.Logger
+	logPayload bool
 }
 
+const (
+	// wsAttempts is the number of failed websocket connection attempts
+	// after which the client switches to the http fallback transport.
+	wsAttempts = 3
+
+	// connectTimeout is the time to wait for the first connection, it
+	// includes failed websocket attempts and the http fallback connection.
+	connectTimeout = 10 * time.Second
+)
+
 // NewWsClient creates a new WsClient instance.
 // processMessage are optional ReaderFunc callbacks that will be used to process
 // incoming messages from the server.
 func NewWsClient(processMessage ...ReaderFunc) *WsClient {
-	ws := &WsClient{}
+	ws := &WsClient{logger: slog.Default(), fallback: new(fallback)}
 	ws.newReaders(processMessage...)
 	return ws
 }
 
+// SetLogger sets structured logger of the websocket client. By default the
+// slog.Default logger is used.
+func (ws *WsClient) SetLogger(logger *slog.Logger) { ws.logger = logger }
+
+// SetPayloadLogging enables logging of messages data. It is off by default.
+func (ws *WsClient) SetPayloadLogging(on bool) { ws.logPayload = on }
+
 // Connect establishes a WebSocket connection to the proxy server.
 // It handles creating the WebSocket, setting up event handlers,
 // reconnecting on close/errors, and waiting for the initial
-// connection.
+// connection. If the websocket connection fails several times in a row,
+// f.e. when a proxy drops websocket upgrades, the client switches to the
+// http fallback transport served at the /ws/http path.
 func (ws *WsClient) Connect(onReconnected func()) (err error) {
-	var connected bool
+	var connected, opened bool
+	var failures int
 	done := make(chan struct{}, 0)
 
+	// onOpen signals the first connection or calls onReconnected
+	onOpen := func() {
+		if !connected {
+			connected = true
+			done <- struct{}{}
+		} else {
+			onReconnected()
+		}
+	}
+
 	// wsScheme returns "ws" or "wss" depending on the given URL scheme
 	wsScheme := func(httpScheme string) string {
 		if httpScheme == "https" {
@@ -61,38 +87,41 @@ func (ws *WsClient) Connect(onReconnected func()) (err error) {
 	href := js.Global().Get("location").Get("href")
 	u, err := url.Parse(href.String())
 	if err != nil {
-		log.Fatal(err)
+		err = fmt.Errorf("can't parse location url, error: %w", err)
+		return
 	}
 	url := fmt.Sprintf("%s://%s/ws", wsScheme(u.Scheme), u.Host)
-	log.Println("Websocket URL defined:", url)
-
-	// Call the JavaScript function to create the WebSocket connection
-	connect := func() {
+	ws.logger.Debug("websocket url defined", "url", url)
+	fallbackURL := fmt.Sprintf("%s://%s/ws/http", u.Scheme, u.Host)
+
+	// Call the JavaScript function to create the WebSocket connection. The
+	// reconnect query parameter lets the server count client reconnections
+	connect := func(reconnect bool) {
+		if reconnect {
+			js.Global().Call("socket", url+"?reconnect=1")
+			return
+		}
 		js.Global().Call("socket", url)
 	}
 
 	// Create a JavaScript WebSocket object
 	js.Global().Set("socket", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 		if len(args) != 1 {
-			log.Println("Invalid number of arguments")
+			ws.logger.Error("invalid number of socket arguments", "n", len(args))
 			return nil
 		}
 
 		url := args[0].String()
-		log.Println("Connect to websocket:", url)
+		ws.logger.Debug("connect to websocket", "url", url)
 
 		// Create a WebSocket connection
 		ws.Value = js.Global().Get("WebSocket").New(url)
 
 		// WebSocket open event handler
 		ws.Value.Set("onopen", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-			log.Println("WebSocket connection established.")
-			if !connected {
-				connected = true
-				done <- struct{}{}
-			} else {
-				onReconnected()
-			}
+			ws.logger.Info("websocket connection established")
+			opened, failures = true, 0
+			onOpen()
 			return nil
 		}))
 
@@ -103,7 +132,7 @@ func (ws *WsClient) Connect(onReconnected func()) (err error) {
 			message := args[0].Get("data").String()
 			data, err := base64.StdEncoding.DecodeString(message)
 			if err != nil {
-				log.Println("Can't decode message base64, error:", err)
+				ws.logger.Warn("can't decode message base64", "err", err)
 				return nil
 			}
 
@@ -115,18 +144,30 @@ func (ws *WsClient) Connect(onReconnected func()) (err error) {
 
 		// WebSocket close event handler
 		ws.Value.Set("onclose", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-			log.Println("WebSocket connection closed.")
+			ws.logger.Info("websocket connection closed")
+			if !opened {
+				failures++
+			}
+			opened = false
+
+			// Switch to http fallback transport
+			if failures >= wsAttempts {
+				ws.logger.Info("websocket is not available, use http fallback",
+					"url", fallbackURL)
+				go ws.runFallback(fallbackURL, connected, onOpen)
+				return nil
+			}
 			time.Sleep(1 * time.Second)
 
 			// Reconnect
-			connect()
+			connect(true)
 			return nil
 		}))
 
 		// WebSocket error event handler
 		ws.Value.Set("onerror", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 			message := args[0].Get("error").String()
-			log.Println("WebSocket error:", message)
+			ws.logger.Warn("websocket error", "err", message)
 			return nil
 		}))
 
@@ -134,12 +175,12 @@ func (ws *WsClient) Connect(onReconnected func()) (err error) {
 	}))
 
 	// Call the JavaScript function to create the WebSocket connection
-	connect()
+	connect(false)
 
 	// Wait for the WebSocket connection to be established or timeout
 	select {
 	case <-done:
-	case <-time.After(5 * time.Second):
+	case <-time.After(connectTimeout):
 		err = fmt.Errorf("timeout")
 	}
 
@@ -148,6 +189,12 @@ func (ws *WsClient) Connect(onReconnected func()) (err error) {
 
 // SendMessage sends a message to the websocket server.
 func (ws *WsClient) SendMessage(message []byte) {
-	ws.Value.Call("send", base64.StdEncoding.EncodeToString(message))
-	log.Println("Send message to server:", message)
+	if ws.fallback.active() {
+		ws.sendFallback(base64.StdEncoding.EncodeToString(message))
+	} else {
+		ws.Value.Call("send", base64.StdEncoding.EncodeToString(message))
+	}
+	if ws.logPayload {
+		ws.logger.Debug("send message to server", "data", message)
+	}
 }
@@ -0,0 +1,163 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Batch command module.
+//
+// The Batch command carries many API Command requests to different peers in
+// one packet. The server sends them in parallel and answers with the results
+// in the requests order. The request data contains the items:
+//
+//	<count uint16>{<item len uint32><peer>,<command>,<data>}
+//
+// and the answer data contains the results:
+//
+//	<count uint16>{<status byte><result len uint32><data or error message>}
+//
+// The status is 0 if the item succeeded and 1 if it failed. Integers are
+// little endian.
+
+package command
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxBatchItems is the maximum number of items in the Batch command.
+const MaxBatchItems = 256
+
+var (
+	ErrWrongBatch    = fmt.Errorf("wrong batch data")
+	ErrBatchTooBig   = fmt.Errorf("too many batch items")
+	ErrWrongBatchCmd = fmt.Errorf("wrong batch item peer or command")
+)
+
+// BatchItem is the API Command request of the Batch command.
+type BatchItem struct {
+	Peer    string // Peer address
+	Command string // Peer api command
+	Data    []byte // Api command data
+}
+
+// BatchResult is the result of the Batch command item.
+type BatchResult struct {
+	Data []byte // Answer data
+	Err  error  // Answer error
+}
+
+// Batch result statuses.
+const (
+	batchOK  = 0
+	batchErr = 1
+)
+
+// MarshalBatch returns the Batch command data with items.
+func MarshalBatch(items []BatchItem) (data []byte, err error) {
+	if len(items) > MaxBatchItems {
+		err = ErrBatchTooBig
+		return
+	}
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(items)))
+	for _, item := range items {
+		if len(item.Peer) == 0 || len(item.Command) == 0 ||
+			strings.Contains(item.Peer, ",") ||
+			strings.Contains(item.Command, ",") {
+			err = ErrWrongBatchCmd
+			return
+		}
+		l := len(item.Peer) + 1 + len(item.Command) + 1 + len(item.Data)
+		data = binary.LittleEndian.AppendUint32(data, uint32(l))
+		data = append(data, item.Peer...)
+		data = append(data, ',')
+		data = append(data, item.Command...)
+		data = append(data, ',')
+		data = append(data, item.Data...)
+	}
+	return
+}
+
+// UnmarshalBatch returns the items of the Batch command data.
+func UnmarshalBatch(data []byte) (items []BatchItem, err error) {
+	err = unmarshalBatch(data, 0, func(_ byte, item []byte) error {
+		peer, rest, ok := strings.Cut(string(item), ",")
+		command, _, ok2 := strings.Cut(rest, ",")
+		if !ok || !ok2 || len(peer) == 0 || len(command) == 0 {
+			return ErrWrongBatchCmd
+		}
+		items = append(items, BatchItem{Peer: peer, Command: command,
+			Data: item[len(peer)+1+len(command)+1:]})
+		return nil
+	})
+	return
+}
+
+// MarshalBatchResults returns the Batch command answer data with results.
+func MarshalBatchResults(results []BatchResult) (data []byte) {
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(results)))
+	for _, r := range results {
+		status, d := byte(batchOK), r.Data
+		if r.Err != nil {
+			status, d = batchErr, []byte(r.Err.Error())
+		}
+		data = append(data, status)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(d)))
+		data = append(data, d...)
+	}
+	return
+}
+
+// UnmarshalBatchResults returns the results of the Batch command answer data.
+func UnmarshalBatchResults(data []byte) (results []BatchResult, err error) {
+	err = unmarshalBatch(data, 1, func(status byte, d []byte) error {
+		switch status {
+		case batchOK:
+			results = append(results, BatchResult{Data: d})
+		case batchErr:
+			results = append(results, BatchResult{Err: errors.New(string(d))})
+		default:
+			return ErrWrongBatch
+		}
+		return nil
+	})
+	return
+}
+
+// unmarshalBatch calls f with each element of the batch data. The element
+// has the status byte if statusLen is 1.
+func unmarshalBatch(data []byte, statusLen int,
+	f func(status byte, d []byte) error) (err error) {
+
+	if len(data) < 2 {
+		return ErrWrongBatch
+	}
+	n := int(binary.LittleEndian.Uint16(data))
+	if n > MaxBatchItems {
+		return ErrBatchTooBig
+	}
+	data = data[2:]
+	for i := 0; i < n; i++ {
+		if len(data) < statusLen+4 {
+			return ErrWrongBatch
+		}
+		var status byte
+		if statusLen > 0 {
+			status = data[0]
+		}
+		l := binary.LittleEndian.Uint32(data[statusLen:])
+		data = data[statusLen+4:]
+		if uint64(len(data)) < uint64(l) {
+			return ErrWrongBatch
+		}
+		if err = f(status, data[:l:l]); err != nil {
+			return
+		}
+		data = data[l:]
+	}
+	if len(data) > 0 {
+		return ErrWrongBatch
+	}
+	return
+}
@@ -18,6 +18,18 @@ const (
 	ConnectTo            // Connect to peer
 	NewApiClient         // New API Client
 	ApiSendTo            // Send API Command to peer
+	StreamStart          // Start API Command stream
+	StreamChunk          // Stream data chunk
+	StreamEnd            // End of stream data
+	StreamCredit         // Stream flow-control credit
+	KeyExchange          // E2E encryption key exchange with peer
+	Batch                // Batch of API Commands
+	Cancel               // Cancel request with the packet id
+	Ping                 // Ping proxy server and optionally peer
+	Pong                 // Answer to Ping
+	Peers                // List peers
+	Resolve              // Resolve peer alias to address
+	DescribeAPI          // Get peer API description
 	cmdCount             // Number of commands
 )
 
@@ -28,12 +40,19 @@ var (
 )
 
 // TeonetCmd represents a command packet in the Teonet proxy protocol. It
-// contains a command byte and a data slice.
+// contains a command byte, optional header extension fields and a data slice.
 type TeonetCmd struct {
 	Id   uint32  // Packet ID
 	Cmd  Command // Command
 	Data []byte  // Data
 	Err  error   // Error
+
+	TraceParent string // W3C trace context traceparent (optional)
+	Fragment    uint16 // Fragment index (optional)
+	Fragments   uint16 // Number of fragments, zero if not fragmented
+	Codec       Codec  // Codec of compressed data, zero if not compressed
+	Accept      Codecs // Codecs the sender accepts in answers (optional)
+	NoCache     bool   // Answer must not be taken from cache (optional)
 }
 
 // Command represents the command type for Teonet proxy commands.
@@ -47,7 +66,7 @@ type Command byte
 // the corresponding string. Otherwise, it returns "Unknown".
 // String is part of the fmt.Stringer interface.
 func (c Command) String() string {
-	switch c & 0x7F {
+	switch c & cmdMask {
 	case Connect:
 		return "Connect"
 	case Disconnect:
@@ -58,6 +77,30 @@ func (c Command) String() string {
 		return "NewApiClient"
 	case ApiSendTo:
 		return "ApiSendTo"
+	case StreamStart:
+		return "StreamStart"
+	case StreamChunk:
+		return "StreamChunk"
+	case StreamEnd:
+		return "StreamEnd"
+	case StreamCredit:
+		return "StreamCredit"
+	case KeyExchange:
+		return "KeyExchange"
+	case Batch:
+		return "Batch"
+	case Cancel:
+		return "Cancel"
+	case Ping:
+		return "Ping"
+	case Pong:
+		return "Pong"
+	case Peers:
+		return "Peers"
+	case Resolve:
+		return "Resolve"
+	case DescribeAPI:
+		return "DescribeAPI"
 	default:
 		return "Unknown"
 	}
@@ -81,6 +124,12 @@ func NewEmpty() *TeonetCmd {
 	return &TeonetCmd{}
 }
 
+// NewCancel creates Cancel command which cancels the request with packet id.
+// The canceled request is not answered.
+func NewCancel(id uint32) *TeonetCmd {
+	return &TeonetCmd{Id: id, Cmd: Cancel}
+}
+
 // MarshalBinary converts the TeonetCmd struct into a binary representation.
 //
 // It returns a byte slice containing the binary representation of the struct
@@ -92,12 +141,24 @@ func (c TeonetCmd) MarshalBinary() (data []byte, err error) {
 	binary.LittleEndian.PutUint32(idBinarySlice, c.Id)
 	data = append(data, idBinarySlice...)
 
-	// Add command and data
+	// Get header extension
+	header, err := c.marshalHeader()
+	if err != nil {
+		return
+	}
+	cmd := byte(c.Cmd)
+	if header != nil {
+		cmd |= cmdExtBit
+	}
+
+	// Add command, header extension and data
 	if c.Err != nil {
-		data = append(data, byte(c.Cmd|0x80))
+		data = append(data, cmd|cmdErrBit)
+		data = append(data, header...)
 		data = append(data, []byte(c.Err.Error())...)
 	} else {
-		data = append(data, byte(c.Cmd))
+		data = append(data, cmd)
+		data = append(data, header...)
 		data = append(data, c.Data...)
 	}
 
@@ -115,9 +176,11 @@ func (c TeonetCmd) MarshalBinary() (data []byte, err error) {
 //     error `ErrNotEnoughData`.
 //   - Checks the checksum of the data. If it does not match the checksum at the
 //     end of the data slice, it returns an error `ErrWrongChecksum`.
-//   - Sets the command byte from the data slice at index 0.
-//   - Sets the data slice from the data slice at index 1 to the second last
-//     element.
+//   - Sets the command byte from the data slice at index 4.
+//   - Gets the header extension fields if the command byte extension bit is
+//     set.
+//   - Sets the data slice from the data slice after the command byte and
+//     header extension to the second last element.
 //   - Returns any error encountered during the unmarshaling process.
 //
 // Parameters:
@@ -146,8 +209,10 @@ func (c *TeonetCmd) UnmarshalBinary(data []byte) (err error) {
 		return
 	}
 
-	cmd := data[cmdIdx] & 0x7F      // Command
-	isErr := data[cmdIdx]&0x80 != 0 // The data contains error message
+	cmd := data[cmdIdx] & cmdMask        // Command
+	isErr := data[cmdIdx]&cmdErrBit != 0 // The data contains error message
+	isExt := data[cmdIdx]&cmdExtBit != 0 // The packet has header extension
+	idx := dataIdx                       // Index of data after header
 
 	// Check command number
 	if !(cmd > byte(cmdNone) && cmd < byte(cmdCount)) {
@@ -158,12 +223,23 @@ func (c *TeonetCmd) UnmarshalBinary(data []byte) (err error) {
 	// Get packet id
 	c.Id = binary.LittleEndian.Uint32(data[:idLen])
 
+	// Get header extension
+	c.resetHeader()
+	if isExt {
+		var n int
+		n, err = c.unmarshalHeader(data[idx : len(data)-1])
+		if err != nil {
+			return
+		}
+		idx += n
+	}
+
 	// Get command and data or error message
 	c.Cmd = Command(cmd)
 	if !isErr {
-		c.Data = data[dataIdx : len(data)-1]
+		c.Data = data[idx : len(data)-1]
 	} else {
-		c.Err = errors.New(string(data[dataIdx : len(data)-1]))
+		c.Err = errors.New(string(data[idx : len(data)-1]))
 	}
 
 	return
@@ -3,7 +3,9 @@ package command
 import (
 	"bytes"
 	"errors"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestUnmarshalBinary(t *testing.T) {
@@ -39,7 +41,7 @@ func TestUnmarshalBinary(t *testing.T) {
 	}
 
 	// Test case 4: unknown command
-	data = []byte{0, 0, 0, 0, 10, 2, 12}
+	data = []byte{0, 0, 0, 0, 30, 2, 32}
 	err = cmd.UnmarshalBinary(data)
 	if err != ErrUnknownCommand {
 		t.Errorf("Expected ErrUnknownCommand, got: %v", err)
@@ -109,3 +111,385 @@ func TestMarshalBinary(t *testing.T) {
 		t.Errorf("expected error: %v, got: %v", cmd.Data, unmarshaledCmd.Data)
 	}
 }
+
+func TestHeaderExtension(t *testing.T) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	// Test case 1: command with trace context
+	cmd := &TeonetCmd{Id: 7, Cmd: ApiSendTo, Data: []byte("peer,cmd,data"),
+		TraceParent: traceParent}
+	data, err := cmd.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error converting to binary, error: %v", err)
+	}
+	if data[4] != byte(ApiSendTo)|cmdExtBit || data[5] != byte(FlagTrace) {
+		t.Errorf("expected extension bit and trace flag, got: %v", data[4:6])
+	}
+
+	unmarshaledCmd := &TeonetCmd{}
+	err = unmarshaledCmd.UnmarshalBinary(data)
+	if err != nil {
+		t.Errorf("error unmarshaling binary data: %v", err)
+	}
+	if unmarshaledCmd.TraceParent != traceParent {
+		t.Errorf("expected trace: %v, got: %v", traceParent,
+			unmarshaledCmd.TraceParent)
+	}
+	if !bytes.Equal(unmarshaledCmd.Data, cmd.Data) {
+		t.Errorf("expected data: %v, got: %v", cmd.Data, unmarshaledCmd.Data)
+	}
+
+	// Test case 2: command without extension resets header fields
+	data, _ = (&TeonetCmd{Cmd: Connect}).MarshalBinary()
+	if err = unmarshaledCmd.UnmarshalBinary(data); err != nil {
+		t.Errorf("error unmarshaling binary data: %v", err)
+	}
+	if unmarshaledCmd.TraceParent != "" {
+		t.Errorf("expected empty trace, got: %v", unmarshaledCmd.TraceParent)
+	}
+
+	// Test case 3: unknown header flags
+	data = []byte{0, 0, 0, 0, byte(Connect) | cmdExtBit, 0x80}
+	data = append(data, cmd.checksum(data))
+	if err = unmarshaledCmd.UnmarshalBinary(data); err != ErrWrongHeader {
+		t.Errorf("expected ErrWrongHeader, got: %v", err)
+	}
+
+	// Test case 4: truncated header field
+	data = []byte{0, 0, 0, 0, byte(Connect) | cmdExtBit, byte(FlagTrace), 10, 1}
+	data = append(data, cmd.checksum(data))
+	if err = unmarshaledCmd.UnmarshalBinary(data); err != ErrNotEnoughData {
+		t.Errorf("expected ErrNotEnoughData, got: %v", err)
+	}
+
+	// Test case 5: no cache flag without fields
+	cmd = &TeonetCmd{Id: 8, Cmd: ApiSendTo, Data: []byte("data"), NoCache: true}
+	data, _ = cmd.MarshalBinary()
+	if data[5] != byte(FlagNoCache) || !bytes.Equal(data[6:10], cmd.Data) {
+		t.Errorf("expected no cache flag without fields, got: %v", data[5:])
+	}
+	if err = unmarshaledCmd.UnmarshalBinary(data); err != nil ||
+		!unmarshaledCmd.NoCache {
+		t.Errorf("expected no cache flag, got: %v", err)
+	}
+
+	// Test case 6: command with all header fields and without data has the
+	// maximum header size
+	cmd = &TeonetCmd{Cmd: ApiSendTo, TraceParent: strings.Repeat("0", 0xFF),
+		Fragment: 1, Fragments: 2, Codec: CodecDeflate, Accept: SupportedCodecs,
+		NoCache: true}
+	if data, _ = cmd.MarshalBinary(); len(data) != MaxHeaderSize {
+		t.Errorf("expected size %d, got: %d", MaxHeaderSize, len(data))
+	}
+}
+
+func TestStream(t *testing.T) {
+
+	// Test case 1: credit command
+	cmd := NewCredit(3, StreamWindow)
+	data, _ := cmd.MarshalBinary()
+	unmarshaledCmd := &TeonetCmd{}
+	if err := unmarshaledCmd.UnmarshalBinary(data); err != nil {
+		t.Fatalf("error unmarshaling binary data: %v", err)
+	}
+	if n, err := unmarshaledCmd.Credit(); err != nil || n != StreamWindow ||
+		unmarshaledCmd.Id != 3 {
+		t.Errorf("expected credit: %d, got: %d, %v", StreamWindow, n, err)
+	}
+	if _, err := New(StreamCredit, nil).Credit(); err != ErrWrongCredit {
+		t.Errorf("expected ErrWrongCredit, got: %v", err)
+	}
+
+	// Test case 2: stream commands
+	for c, isStream := range map[Command]bool{ApiSendTo: false,
+		StreamStart: true, StreamCredit: true, StreamEnd | cmdErrBit: true} {
+		if c.IsStream() != isStream {
+			t.Errorf("expected %s is stream: %v", c, isStream)
+		}
+	}
+
+	// Test case 3: split data to chunks
+	chunks := Chunks(make([]byte, 2*StreamChunkSize+1))
+	if len(chunks) != 3 || len(chunks[2]) != 1 {
+		t.Errorf("expected 3 chunks, got: %d", len(chunks))
+	}
+	if chunks = Chunks(nil); len(chunks) != 0 {
+		t.Errorf("expected no chunks, got: %d", len(chunks))
+	}
+}
+
+func TestFragment(t *testing.T) {
+	data := make([]byte, 2*DefaultFragmentSize+1)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	cmd := &TeonetCmd{Id: 5, Cmd: ApiSendTo, Data: data}
+
+	// Test case 1: split command to fragments
+	cmds, err := cmd.Split(DefaultFragmentSize)
+	if err != nil || len(cmds) != 3 {
+		t.Fatalf("expected 3 fragments, got: %d, %v", len(cmds), err)
+	}
+	if small, _ := New(Connect, nil).Split(DefaultFragmentSize); len(small) != 1 ||
+		small[0].Fragments != 0 {
+		t.Errorf("expected not fragmented command")
+	}
+
+	// Test case 2: marshal and reassemble fragments in any order
+	r := NewReassembler(DefaultMaxMessage, DefaultFragmentTTL)
+	for i, idx := range []int{2, 0, 1} {
+		packet, err := cmds[idx].MarshalBinary()
+		if err != nil {
+			t.Fatalf("error converting to binary, error: %v", err)
+		}
+		fragment := &TeonetCmd{}
+		if err = fragment.UnmarshalBinary(packet); err != nil {
+			t.Fatalf("error unmarshaling binary data: %v", err)
+		}
+		whole, ok, err := r.Add(fragment)
+		if err != nil || ok != (i == 2) {
+			t.Fatalf("fragment %d: unexpected result: %v, %v", idx, ok, err)
+		}
+		if ok && (whole.Id != 5 || whole.Cmd != ApiSendTo ||
+			!bytes.Equal(whole.Data, data)) {
+			t.Errorf("wrong reassembled command")
+		}
+	}
+	if r.Len() != 0 {
+		t.Errorf("expected no incomplete commands, got: %d", r.Len())
+	}
+
+	// Test case 3: reassembled data size limit, the slot table is counted in
+	// buffered data size
+	r = NewReassembler(DefaultFragmentSize+DefaultFragmentSize/2,
+		DefaultFragmentTTL)
+	if _, _, err = r.Add(cmds[0]); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, _, err = r.Add(cmds[1]); !errors.Is(err, ErrMessageTooBig) {
+		t.Errorf("expected ErrMessageTooBig, got: %v", err)
+	}
+	if r.Len() != 0 {
+		t.Errorf("expected dropped buffer, got: %d", r.Len())
+	}
+
+	// Test case 4: duplicate fragment
+	r.Add(cmds[0])
+	if _, _, err = r.Add(cmds[0]); !errors.Is(err, ErrWrongFragment) {
+		t.Errorf("expected ErrWrongFragment, got: %v", err)
+	}
+
+	// Test case 5: wrong fragment index
+	packet := []byte{0, 0, 0, 0, byte(ApiSendTo) | cmdExtBit,
+		byte(FlagFragment), 2, 0, 2, 0}
+	packet = append(packet, cmd.checksum(packet))
+	if err = NewEmpty().UnmarshalBinary(packet); err != ErrWrongHeader {
+		t.Errorf("expected ErrWrongHeader, got: %v", err)
+	}
+
+	// Test case 6: number of fragments is limited by maximum size divided by
+	// minimum fragment size
+	r = NewReassembler(4*MinFragmentSize, DefaultFragmentTTL)
+	fragment := &TeonetCmd{Id: 6, Cmd: ApiSendTo, Fragments: 5}
+	if _, _, err = r.Add(fragment); !errors.Is(err, ErrTooManyFragments) {
+		t.Errorf("expected ErrTooManyFragments, got: %v", err)
+	}
+	fragment.Fragments = 4
+	if _, _, err = r.Add(fragment); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Test case 7: slot tables are counted in buffered data size
+	fragment.Data = make([]byte, 4*MinFragmentSize-4*fragmentSlotSize)
+	fragment.Fragment = 1
+	if _, _, err = r.Add(fragment); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	fragment = &TeonetCmd{Id: 7, Cmd: ApiSendTo, Fragments: 1}
+	if _, _, err = r.Add(fragment); !errors.Is(err, ErrMessageTooBig) ||
+		r.Len() != 1 {
+		t.Errorf("expected ErrMessageTooBig, got: %v, %d", err, r.Len())
+	}
+
+	// Test case 8: number of incomplete commands is limited
+	r = NewReassembler(DefaultMaxMessage, DefaultFragmentTTL)
+	for id := uint32(0); id <= DefaultMaxIncomplete; id++ {
+		_, _, err = r.Add(&TeonetCmd{Id: id, Cmd: ApiSendTo, Data: []byte{1},
+			Fragments: 2})
+	}
+	if !errors.Is(err, ErrTooManyCommands) || r.Len() != DefaultMaxIncomplete {
+		t.Errorf("expected ErrTooManyCommands, got: %v, %d", err, r.Len())
+	}
+}
+
+func TestCompress(t *testing.T) {
+	data := bytes.Repeat([]byte("fortune "), 1024)
+
+	// Test case 1: compress, marshal, unmarshal and decompress data
+	cmd := &TeonetCmd{Id: 1, Cmd: ApiSendTo, Data: data, Accept: SupportedCodecs}
+	if err := cmd.Compress(SupportedCodecs, DefaultCompressThreshold); err != nil {
+		t.Fatalf("can't compress data: %v", err)
+	}
+	if cmd.Codec != CodecDeflate || len(cmd.Data) >= len(data) {
+		t.Fatalf("expected compressed data, got codec: %v, len: %d", cmd.Codec,
+			len(cmd.Data))
+	}
+	packet, _ := cmd.MarshalBinary()
+	unmarshaledCmd := &TeonetCmd{}
+	if err := unmarshaledCmd.UnmarshalBinary(packet); err != nil {
+		t.Fatalf("error unmarshaling binary data: %v", err)
+	}
+	if unmarshaledCmd.Codec != CodecDeflate ||
+		unmarshaledCmd.Accept != SupportedCodecs {
+		t.Errorf("expected codec and accept header fields")
+	}
+	if err := unmarshaledCmd.Decompress(DefaultMaxDecompressed); err != nil {
+		t.Fatalf("can't decompress data: %v", err)
+	}
+	if !bytes.Equal(unmarshaledCmd.Data, data) || unmarshaledCmd.Codec != 0 {
+		t.Errorf("wrong decompressed data")
+	}
+
+	// Test case 2: data is not compressed below threshold or without
+	// accepted codec
+	for _, accept := range []Codecs{0, SupportedCodecs} {
+		cmd = &TeonetCmd{Cmd: ApiSendTo, Data: []byte("fortune")}
+		if accept == 0 {
+			cmd.Data = data
+		}
+		cmd.Compress(accept, DefaultCompressThreshold)
+		if cmd.Codec != 0 {
+			t.Errorf("expected not compressed data, accept: %d", accept)
+		}
+	}
+
+	// Test case 3: decompressed data limit
+	cmd = &TeonetCmd{Cmd: ApiSendTo, Data: data}
+	cmd.Compress(SupportedCodecs, DefaultCompressThreshold)
+	if err := cmd.Decompress(len(data) - 1); !errors.Is(err, ErrMessageTooBig) {
+		t.Errorf("expected ErrMessageTooBig, got: %v", err)
+	}
+
+	// Test case 4: unknown codec
+	cmd = &TeonetCmd{Cmd: ApiSendTo, Data: data, Codec: 7}
+	if err := cmd.Decompress(len(data)); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("expected ErrUnknownCodec, got: %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+
+	// Test case 1: batch items
+	items := []BatchItem{
+		{Peer: "fortune", Command: "fortb"},
+		{Peer: "config", Command: "get", Data: []byte("a,b\x00")},
+	}
+	data, err := MarshalBatch(items)
+	if err != nil {
+		t.Fatalf("can't marshal batch: %v", err)
+	}
+	got, err := UnmarshalBatch(data)
+	if err != nil || len(got) != 2 || got[0].Peer != "fortune" ||
+		got[0].Command != "fortb" || len(got[0].Data) != 0 ||
+		got[1].Peer != "config" || string(got[1].Data) != "a,b\x00" {
+		t.Errorf("expected batch items %v, got: %v %v", items, got, err)
+	}
+
+	// Test case 2: batch results
+	results := []BatchResult{{Data: []byte("answer")},
+		{Err: errors.New("timeout")}, {}}
+	res, err := UnmarshalBatchResults(MarshalBatchResults(results))
+	if err != nil || len(res) != 3 || string(res[0].Data) != "answer" ||
+		res[0].Err != nil || res[1].Err == nil ||
+		res[1].Err.Error() != "timeout" || res[2].Err != nil {
+		t.Errorf("expected batch results %v, got: %v %v", results, res, err)
+	}
+
+	// Test case 3: wrong batch data
+	for i, test := range []struct {
+		data []byte
+		err  error
+	}{
+		{nil, ErrWrongBatch},
+		{[]byte{1, 0, 5, 0, 0, 0, 'a'}, ErrWrongBatch},
+		{append(data, 0), ErrWrongBatch},
+		{[]byte{1, 0, 3, 0, 0, 0, 'a', ',', 'b'}, ErrWrongBatchCmd},
+		{[]byte{0xFF, 0xFF}, ErrBatchTooBig},
+	} {
+		if _, err = UnmarshalBatch(test.data); err != test.err {
+			t.Errorf("test %d: expected %v, got: %v", i+1, test.err, err)
+		}
+	}
+	if _, err = UnmarshalBatchResults([]byte{1, 0, 2, 0, 0, 0, 0}); err !=
+		ErrWrongBatch {
+		t.Errorf("expected ErrWrongBatch of wrong status, got: %v", err)
+	}
+	if _, err = MarshalBatch([]BatchItem{{Peer: "a,b", Command: "c"}}); err !=
+		ErrWrongBatchCmd {
+		t.Errorf("expected ErrWrongBatchCmd, got: %v", err)
+	}
+	if _, err = MarshalBatch(make([]BatchItem, MaxBatchItems+1)); err !=
+		ErrBatchTooBig {
+		t.Errorf("expected ErrBatchTooBig, got: %v", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+
+	// Test case 1: cancel command has the request id and no data
+	data, err := NewCancel(7).MarshalBinary()
+	if err != nil {
+		t.Fatalf("can't marshal cancel command: %v", err)
+	}
+	cmd := NewEmpty()
+	if err = cmd.UnmarshalBinary(data); err != nil {
+		t.Fatalf("can't unmarshal cancel command: %v", err)
+	}
+	if cmd.Id != 7 || cmd.Cmd != Cancel || len(cmd.Data) != 0 ||
+		cmd.Cmd.String() != "Cancel" {
+		t.Errorf("expected Cancel 7, got: %d %v %q", cmd.Id, cmd.Cmd, cmd.Data)
+	}
+}
+
+func TestPing(t *testing.T) {
+	now := time.Unix(0, time.Now().UnixNano())
+
+	// Test case 1: ping with peer
+	cmd := NewEmpty()
+	data, _ := NewPing(3, now, "fortune").MarshalBinary()
+	if err := cmd.UnmarshalBinary(data); err != nil {
+		t.Fatalf("can't unmarshal ping: %v", err)
+	}
+	tm, peer, err := cmd.Ping()
+	if err != nil || !tm.Equal(now) || peer != "fortune" || cmd.Id != 3 {
+		t.Errorf("expected ping 3 fortune %v, got: %d %s %v %v", now, cmd.Id,
+			peer, tm, err)
+	}
+
+	// Test case 2: ping without peer
+	if _, peer, err = NewPing(4, now, "").Ping(); err != nil || peer != "" {
+		t.Errorf("expected ping without peer, got: %q %v", peer, err)
+	}
+
+	// Test case 3: pong
+	expected := PongData{now, now.Add(time.Second), 5 * time.Millisecond}
+	data, _ = NewPong(3, expected).MarshalBinary()
+	if err = cmd.UnmarshalBinary(data); err != nil {
+		t.Fatalf("can't unmarshal pong: %v", err)
+	}
+	if pong, err := cmd.Pong(); err != nil || !pong.Time.Equal(expected.Time) ||
+		!pong.ServerTime.Equal(expected.ServerTime) ||
+		pong.PeerRTT != expected.PeerRTT {
+		t.Errorf("expected pong %v, got: %v %v", expected, pong, err)
+	}
+
+	// Test case 4: wrong data
+	if _, _, err = (&TeonetCmd{Cmd: Ping, Data: []byte{1}}).Ping(); err !=
+		ErrWrongPing {
+		t.Errorf("expected ErrWrongPing, got: %v", err)
+	}
+	if _, err = (&TeonetCmd{Cmd: Pong, Data: make([]byte, 8)}).Pong(); err !=
+		ErrWrongPing {
+		t.Errorf("expected ErrWrongPing, got: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command data compression module.
+//
+// The command data may be compressed with a codec, the header extension of
+// compressed command contains the codec. The sender announces codecs it can
+// decompress in the Accept header field, and the other side compresses data
+// only with an accepted codec. So compression is negotiated per command and
+// does not depend on the transport. Commands are compressed before they are
+// split to fragments and decompressed after reassembly.
+
+package command
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Codec is the command data compression codec.
+type Codec byte
+
+// Compression codecs.
+const (
+	CodecDeflate Codec = 1 // Raw deflate, RFC 1951
+)
+
+// Codecs is the mask of compression codecs.
+type Codecs byte
+
+// SupportedCodecs is the mask of codecs supported by this package.
+const SupportedCodecs = Codecs(1 << (CodecDeflate - 1))
+
+const (
+	DefaultCompressThreshold = 1 << 10 // Default minimum compressed data size
+	DefaultMaxDecompressed   = DefaultMaxMessage
+)
+
+var (
+	ErrUnknownCodec = fmt.Errorf("unknown codec")
+	ErrDecompress   = fmt.Errorf("can't decompress data")
+)
+
+// Has returns true if the codecs mask contains the codec.
+func (cs Codecs) Has(c Codec) bool {
+	return c > 0 && c <= 8 && cs&(1<<(c-1)) != 0
+}
+
+// String returns the codec name.
+func (c Codec) String() string {
+	switch c {
+	case 0:
+		return "none"
+	case CodecDeflate:
+		return "deflate"
+	default:
+		return "unknown"
+	}
+}
+
+// Compress compresses the command data with a codec from accepted codecs if
+// the data is not smaller than threshold. The data is left uncompressed if
+// there is no supported codec in accept, threshold is zero or the compressed
+// data is not smaller than the original.
+func (c *TeonetCmd) Compress(accept Codecs, threshold int) (err error) {
+	if c.Codec != 0 || c.Err != nil || threshold <= 0 ||
+		len(c.Data) < threshold || !(accept & SupportedCodecs).Has(CodecDeflate) {
+		return
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(c.Data); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	if buf.Len() < len(c.Data) {
+		c.Data, c.Codec = buf.Bytes(), CodecDeflate
+	}
+	return
+}
+
+// Decompress decompresses the command data if it is compressed. The limit is
+// the maximum size of decompressed data.
+func (c *TeonetCmd) Decompress(limit int) (err error) {
+	switch c.Codec {
+	case 0:
+		return
+	case CodecDeflate:
+	default:
+		return fmt.Errorf("%w: %d", ErrUnknownCodec, c.Codec)
+	}
+
+	r := flate.NewReader(bytes.NewReader(c.Data))
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDecompress, err)
+	}
+	if len(data) > limit {
+		return fmt.Errorf("%w: %w", ErrDecompress, ErrMessageTooBig)
+	}
+	c.Data, c.Codec = data, 0
+	return
+}
@@ -0,0 +1,37 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Peers discovery commands module.
+//
+// The Peers command has no data and is answered with JSON array of PeerInfo
+// of peers the server is connected to. The Resolve command data is the peer
+// name, it is answered with the peer address. The DescribeAPI command data
+// is the peer name, it is answered with JSON APIDescription published by the
+// peer api.
+
+package command
+
+// PeerInfo is the peer of the Peers command answer.
+type PeerInfo struct {
+	Name    string `json:"name"`              // Peer name used in commands
+	Address string `json:"address,omitempty"` // Peer address if name is alias
+}
+
+// APIDescription is the peer API description of the DescribeAPI command
+// answer.
+type APIDescription struct {
+	Name     string       `json:"name"`            // Application name
+	Short    string       `json:"short,omitempty"` // Application short name
+	Long     string       `json:"long,omitempty"`  // Application description
+	Commands []APICommand `json:"commands"`        // API commands
+}
+
+// APICommand is the peer API command description.
+type APICommand struct {
+	Name   string `json:"name"`             // Command name
+	Short  string `json:"short,omitempty"`  // Short description
+	Long   string `json:"long,omitempty"`   // Long description
+	Usage  string `json:"usage,omitempty"`  // Parameters
+	Return string `json:"return,omitempty"` // Return type
+}
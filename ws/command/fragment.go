@@ -0,0 +1,200 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command fragmentation module.
+//
+// A command with large data may be sent in several packets, so the websocket
+// messages size stays limited. All fragments have the same packet Id and
+// command, the header extension of each fragment contains the fragment index
+// and the number of fragments. The receiver collects fragments with the
+// Reassembler and gets the whole command when the last fragment is received.
+// Error packets are not fragmented.
+//
+// The Reassembler limits the memory a peer can allocate: the number of
+// incomplete commands, the number of fragments of the command which should
+// not be smaller than MinFragmentSize except the last one, and the size of
+// buffered data with the fragments slot tables.
+
+package command
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFragmentSize  = 64 << 10 // Default maximum fragment data size
+	MinFragmentSize      = 1 << 10  // Minimum fragment data size, except the last one
+	DefaultMaxMessage    = 16 << 20 // Default maximum reassembled data size
+	DefaultMaxIncomplete = 16       // Default maximum number of incomplete commands
+	DefaultFragmentTTL   = time.Minute
+)
+
+// fragmentSlotSize is the size of the fragment slot in the reassembly buffer
+// slot table, it is the byte slice header size on 64-bit platforms.
+const fragmentSlotSize = 24
+
+var (
+	ErrTooManyFragments = fmt.Errorf("too many fragments")
+	ErrTooManyCommands  = fmt.Errorf("too many incomplete commands")
+	ErrWrongFragment    = fmt.Errorf("wrong fragment")
+	ErrMessageTooBig    = fmt.Errorf("message too big")
+)
+
+// Split splits the command to fragments with data not larger than size.
+// It returns the command itself if its data is not larger than size or size
+// is zero.
+func (c *TeonetCmd) Split(size int) (cmds []*TeonetCmd, err error) {
+	if size <= 0 || len(c.Data) <= size || c.Err != nil {
+		cmds = []*TeonetCmd{c}
+		return
+	}
+
+	n := (len(c.Data) + size - 1) / size
+	if n > 0xFFFF {
+		err = ErrTooManyFragments
+		return
+	}
+	for i, data := 0, c.Data; i < n; i++ {
+		l := min(size, len(data))
+		cmds = append(cmds, &TeonetCmd{Id: c.Id, Cmd: c.Cmd, Data: data[:l],
+			TraceParent: c.TraceParent, Fragment: uint16(i),
+			Fragments: uint16(n), Codec: c.Codec, Accept: c.Accept,
+			NoCache: c.NoCache})
+		data = data[l:]
+	}
+	return
+}
+
+// fragments is the reassembly buffer of fragmented command.
+type fragments struct {
+	cmd      Command   // Command of fragments
+	data     [][]byte  // Fragments data by index
+	received int       // Number of received fragments
+	size     int       // Size of received data and slot table
+	started  time.Time // Time of first fragment
+}
+
+// Reassembler collects fragments of commands by packet Id. The total size of
+// buffered data, the number of incomplete commands and the number of command
+// fragments are limited, incomplete commands are dropped when their first
+// fragment is older than ttl. It is safe for concurrent use.
+type Reassembler struct {
+	maxSize       int                   // Maximum size of buffered data
+	maxIncomplete int                   // Maximum number of incomplete commands
+	ttl           time.Duration         // Incomplete command time to live
+	m             map[uint32]*fragments // Reassembly buffers by packet Id
+	size          int                   // Size of buffered data
+	*sync.Mutex
+}
+
+// NewReassembler creates a Reassembler which buffers up to maxSize bytes of
+// fragments data and slot tables of up to DefaultMaxIncomplete commands and
+// drops incomplete commands after ttl. Commands may have up to maxSize /
+// MinFragmentSize fragments.
+func NewReassembler(maxSize int, ttl time.Duration) *Reassembler {
+	return &Reassembler{
+		maxSize:       maxSize,
+		maxIncomplete: DefaultMaxIncomplete,
+		ttl:           ttl,
+		m:             make(map[uint32]*fragments),
+		Mutex:         &sync.Mutex{},
+	}
+}
+
+// Add adds the command fragment. It returns the whole command and true when
+// all fragments are received, and false while the command is incomplete. Not
+// fragmented commands are returned as is. On error the command reassembly
+// buffer is dropped.
+func (r *Reassembler) Add(c *TeonetCmd) (cmd *TeonetCmd, ok bool, err error) {
+	if c.Fragments == 0 {
+		return c, true, nil
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.expire()
+
+	// Get or create reassembly buffer, its slot table is counted in the
+	// buffered data size
+	f, exists := r.m[c.Id]
+	if !exists {
+		slots := int(c.Fragments) * fragmentSlotSize
+		switch {
+		case int(c.Fragments) > max(1, r.maxSize/MinFragmentSize):
+			err = fmt.Errorf("%w: %d of packet %d", ErrTooManyFragments,
+				c.Fragments, c.Id)
+			return
+		case len(r.m) >= r.maxIncomplete:
+			err = fmt.Errorf("%w: packet %d", ErrTooManyCommands, c.Id)
+			return
+		case r.size+slots > r.maxSize:
+			err = fmt.Errorf("%w: packet %d", ErrMessageTooBig, c.Id)
+			return
+		}
+		f = &fragments{cmd: c.Cmd, data: make([][]byte, c.Fragments),
+			size: slots, started: time.Now()}
+		r.m[c.Id] = f
+		r.size += slots
+	}
+	if f.cmd != c.Cmd || len(f.data) != int(c.Fragments) ||
+		f.data[c.Fragment] != nil {
+		r.drop(c.Id, f)
+		err = fmt.Errorf("%w: %d of packet %d", ErrWrongFragment, c.Fragment,
+			c.Id)
+		return
+	}
+	if r.size+len(c.Data) > r.maxSize {
+		r.drop(c.Id, f)
+		err = fmt.Errorf("%w: packet %d", ErrMessageTooBig, c.Id)
+		return
+	}
+
+	// Add fragment, empty data is stored as not nil slice
+	f.data[c.Fragment] = append([]byte{}, c.Data...)
+	f.received++
+	f.size += len(c.Data)
+	r.size += len(c.Data)
+	if f.received < len(f.data) {
+		return
+	}
+
+	// Join fragments
+	data := make([]byte, 0, f.size-len(f.data)*fragmentSlotSize)
+	for _, d := range f.data {
+		data = append(data, d...)
+	}
+	r.drop(c.Id, f)
+	cmd = &TeonetCmd{Id: c.Id, Cmd: c.Cmd, Data: data,
+		TraceParent: c.TraceParent, Codec: c.Codec, Accept: c.Accept,
+		NoCache: c.NoCache}
+	ok = true
+	return
+}
+
+// Len returns the number of incomplete commands.
+func (r *Reassembler) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.m)
+}
+
+// drop removes the reassembly buffer.
+func (r *Reassembler) drop(id uint32, f *fragments) {
+	r.size -= f.size
+	delete(r.m, id)
+}
+
+// expire drops reassembly buffers older than ttl.
+func (r *Reassembler) expire() {
+	if r.ttl <= 0 {
+		return
+	}
+	for id, f := range r.m {
+		if time.Since(f.started) > r.ttl {
+			r.drop(id, f)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command packet header extension module.
+
+package command
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Command byte bits. The low bits of the command byte contain the command
+// number, the high bits mark error packets and packets with the header
+// extension.
+const (
+	cmdErrBit = 0x80 // The data contains error message
+	cmdExtBit = 0x40 // The packet contains header extension
+	cmdMask   = 0x3F // Command number mask
+)
+
+// Flags are the header extension flags. The header extension follows the
+// command byte when the command byte extension bit is set. It starts with the
+// flags byte, followed by the fields of the set flags in the flags order:
+//
+//	<flags byte>[<trace len byte><traceparent>][<fragment index><fragments>]
+//	[<codec byte>][<accepted codecs byte>]
+//
+// The no cache flag has no fields.
+// The fragment index and the number of fragments are uint16 little endian.
+type Flags byte
+
+// Header extension flags.
+const (
+	FlagTrace    Flags = 1 << iota // W3C trace context traceparent field
+	FlagFragment                   // Fragment index and number of fragments
+	FlagCompress                   // Codec of compressed data
+	FlagAccept                     // Codecs accepted in answers
+	FlagNoCache                    // Answer must not be taken from cache
+	flagsAll                       // All known flags mask (next flag bit)
+)
+
+// MaxHeaderSize is the maximum size of the binary command without data: the
+// packet id, the command byte, the header extension with all fields and the
+// checksum.
+const MaxHeaderSize = 4 + 1 + 1 + 1 + 0xFF + 4 + 1 + 1 + 1
+
+var (
+	ErrWrongHeader = fmt.Errorf("wrong header extension")
+	ErrFieldTooBig = fmt.Errorf("header extension field too big")
+)
+
+// flags returns header extension flags of the command.
+func (c TeonetCmd) flags() (f Flags) {
+	if len(c.TraceParent) > 0 {
+		f |= FlagTrace
+	}
+	if c.Fragments > 0 {
+		f |= FlagFragment
+	}
+	if c.Codec != 0 {
+		f |= FlagCompress
+	}
+	if c.Accept != 0 {
+		f |= FlagAccept
+	}
+	if c.NoCache {
+		f |= FlagNoCache
+	}
+	return
+}
+
+// marshalHeader returns binary header extension of the command or nil if the
+// command has no extension fields.
+func (c TeonetCmd) marshalHeader() (data []byte, err error) {
+	f := c.flags()
+	if f == 0 {
+		return
+	}
+	data = append(data, byte(f))
+
+	// Add trace context
+	if f&FlagTrace != 0 {
+		if len(c.TraceParent) > 0xFF {
+			err = ErrFieldTooBig
+			return
+		}
+		data = append(data, byte(len(c.TraceParent)))
+		data = append(data, c.TraceParent...)
+	}
+
+	// Add fragment index and number of fragments
+	if f&FlagFragment != 0 {
+		data = binary.LittleEndian.AppendUint16(data, c.Fragment)
+		data = binary.LittleEndian.AppendUint16(data, c.Fragments)
+	}
+
+	// Add compression codec and accepted codecs
+	if f&FlagCompress != 0 {
+		data = append(data, byte(c.Codec))
+	}
+	if f&FlagAccept != 0 {
+		data = append(data, byte(c.Accept))
+	}
+
+	return
+}
+
+// resetHeader clears header extension fields of the command.
+func (c *TeonetCmd) resetHeader() {
+	c.TraceParent = ""
+	c.Fragment, c.Fragments = 0, 0
+	c.Codec, c.Accept = 0, 0
+	c.NoCache = false
+}
+
+// unmarshalHeader unmarshals header extension from the data and returns the
+// header extension length.
+func (c *TeonetCmd) unmarshalHeader(data []byte) (n int, err error) {
+
+	// Get flags
+	if len(data) < 1 {
+		err = ErrNotEnoughData
+		return
+	}
+	f := Flags(data[n])
+	if f == 0 || f&^(flagsAll-1) != 0 {
+		err = ErrWrongHeader
+		return
+	}
+	n++
+
+	// Get trace context
+	if f&FlagTrace != 0 {
+		if len(data) < n+1 || len(data) < n+1+int(data[n]) {
+			err = ErrNotEnoughData
+			return
+		}
+		l := int(data[n])
+		c.TraceParent = string(data[n+1 : n+1+l])
+		n += 1 + l
+	}
+
+	// Get fragment index and number of fragments
+	if f&FlagFragment != 0 {
+		if len(data) < n+4 {
+			err = ErrNotEnoughData
+			return
+		}
+		c.Fragment = binary.LittleEndian.Uint16(data[n:])
+		c.Fragments = binary.LittleEndian.Uint16(data[n+2:])
+		if c.Fragment >= c.Fragments {
+			err = ErrWrongHeader
+			return
+		}
+		n += 4
+	}
+
+	// Get compression codec and accepted codecs
+	if f&FlagCompress != 0 {
+		if len(data) < n+1 {
+			err = ErrNotEnoughData
+			return
+		}
+		c.Codec = Codec(data[n])
+		n++
+	}
+	if f&FlagAccept != 0 {
+		if len(data) < n+1 {
+			err = ErrNotEnoughData
+			return
+		}
+		c.Accept = Codecs(data[n])
+		n++
+	}
+
+	// Get no cache flag
+	c.NoCache = f&FlagNoCache != 0
+
+	return
+}
@@ -0,0 +1,81 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Ping command module.
+//
+// The client sends the Ping command with its time and optional peer name:
+//
+//	<time int64>[<peer>]
+//
+// and the server answers with the Pong command of the same id with the
+// client time, the server time and the round-trip time to the peer:
+//
+//	<time int64><server time int64><peer rtt int64>
+//
+// Times are Unix nanoseconds, the peer rtt is nanoseconds and zero if the
+// Ping has no peer. Integers are little endian.
+
+package command
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// pongLen is the Pong command data length.
+const pongLen = 24
+
+var ErrWrongPing = fmt.Errorf("wrong ping data")
+
+// PongData is the Pong command data.
+type PongData struct {
+	Time       time.Time     // Client time of the Ping
+	ServerTime time.Time     // Server time of the answer
+	PeerRTT    time.Duration // Round-trip time to the peer, zero if no peer
+}
+
+// NewPing creates Ping command with the client time t and the peer name to
+// probe, the peer is not probed if it is empty.
+func NewPing(id uint32, t time.Time, peer string) *TeonetCmd {
+	data := binary.LittleEndian.AppendUint64(nil, uint64(t.UnixNano()))
+	data = append(data, peer...)
+	return &TeonetCmd{Id: id, Cmd: Ping, Data: data}
+}
+
+// Ping returns the client time and the peer name of the Ping command.
+func (c *TeonetCmd) Ping() (t time.Time, peer string, err error) {
+	if c.Cmd != Ping || len(c.Data) < 8 {
+		err = ErrWrongPing
+		return
+	}
+	t = time.Unix(0, int64(binary.LittleEndian.Uint64(c.Data)))
+	peer = string(c.Data[8:])
+	return
+}
+
+// NewPong creates Pong command which answers the Ping command id.
+func NewPong(id uint32, pong PongData) *TeonetCmd {
+	data := make([]byte, 0, pongLen)
+	for _, v := range []int64{pong.Time.UnixNano(),
+		pong.ServerTime.UnixNano(), int64(pong.PeerRTT)} {
+		data = binary.LittleEndian.AppendUint64(data, uint64(v))
+	}
+	return &TeonetCmd{Id: id, Cmd: Pong, Data: data}
+}
+
+// Pong returns the Pong command data.
+func (c *TeonetCmd) Pong() (pong PongData, err error) {
+	if c.Cmd != Pong || len(c.Data) != pongLen {
+		err = ErrWrongPing
+		return
+	}
+	v := func(i int) int64 {
+		return int64(binary.LittleEndian.Uint64(c.Data[i*8:]))
+	}
+	pong.Time = time.Unix(0, v(0))
+	pong.ServerTime = time.Unix(0, v(1))
+	pong.PeerRTT = time.Duration(v(2))
+	return
+}
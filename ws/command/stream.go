@@ -0,0 +1,67 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command streams module.
+//
+// A stream transfers large API Command request and answer data in chunks.
+// All stream packets have the same packet Id. The client starts the stream
+// with StreamStart packet with "peer,command" data, sends request data in
+// StreamChunk packets and ends the request with StreamEnd packet. Then the
+// server sends the answer in StreamChunk packets and ends it with StreamEnd
+// packet, which contains error message if the request failed.
+//
+// Each side sends StreamChunk packets only when it has credits given by the
+// other side. The receiver gives StreamWindow credits with the StreamCredit
+// packet when the stream starts and gives more credits as it consumes the
+// received chunks. A chunk data is not larger than StreamChunkSize.
+
+package command
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	StreamChunkSize = 32 << 10 // Maximum size of stream chunk data
+	StreamWindow    = 16       // Initial number of stream chunk credits
+)
+
+var ErrWrongCredit = fmt.Errorf("wrong stream credit")
+
+// IsStream returns true if the command is a stream command.
+func (c Command) IsStream() bool {
+	c &= cmdMask
+	return c >= StreamStart && c <= StreamCredit
+}
+
+// NewCredit creates StreamCredit command which gives n chunk credits to the
+// other side of stream id.
+func NewCredit(id uint32, n uint32) *TeonetCmd {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, n)
+	return &TeonetCmd{Id: id, Cmd: StreamCredit, Data: data}
+}
+
+// Credit returns number of chunk credits of StreamCredit command.
+func (c TeonetCmd) Credit() (n uint32, err error) {
+	if c.Cmd != StreamCredit || len(c.Data) != 4 {
+		err = ErrWrongCredit
+		return
+	}
+	n = binary.LittleEndian.Uint32(c.Data)
+	return
+}
+
+// Chunks splits data to stream chunks of StreamChunkSize.
+func Chunks(data []byte) (chunks [][]byte) {
+	for len(data) > StreamChunkSize {
+		chunks = append(chunks, data[:StreamChunkSize])
+		data = data[StreamChunkSize:]
+	}
+	if len(data) > 0 {
+		chunks = append(chunks, data)
+	}
+	return
+}
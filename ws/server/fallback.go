@@ -0,0 +1,442 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Websocket server http fallback transport module.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	fallbackMaxMessage  = 4 << 20          // Maximum size of sent message
+	fallbackMaxQueue    = 16 << 20         // Maximum size of queued messages
+	fallbackPollTimeout = 25 * time.Second // Long-poll request wait time
+	fallbackIdleTimeout = time.Minute      // Closes session without polls
+	fallbackKeepAlive   = 15 * time.Second // SSE keep alive interval
+	fallbackLinger      = 5 * time.Second  // Keeps closed session messages
+)
+
+var (
+	// errFallbackClosed is returned when writing to closed http session.
+	errFallbackClosed = errors.New("http session closed")
+
+	// errFallbackOverflow is returned when the client does not receive
+	// messages and the queue exceeds fallbackMaxQueue.
+	errFallbackOverflow = errors.New("http session queue overflow")
+)
+
+// FallbackHandler returns http handler of the http fallback transport for
+// clients which can't establish websocket connection, f.e. behind proxies
+// which drop websocket upgrades. It carries the same messages as websocket
+// text messages and processes them with the same handler. It serves
+// requests:
+//
+//	POST {prefix}/open[?protocol=<subprotocol>]  opens session, returns its id
+//	POST {prefix}/send?session=<id>              sends message in body
+//	GET  {prefix}/events?session=<id>            receives messages
+//	POST {prefix}/close?session=<id>             closes session
+//
+// The events request streams messages as Server-Sent Events if the client
+// accepts text/event-stream. Otherwise it is a long-poll request, answered
+// with queued messages separated by new line, or with 204 No Content if
+// there were no messages during the poll timeout. When the session is closed
+// the SSE stream gets the "close" event and the long-poll request gets 410
+// Gone, both with the close code and reason. Messages must not contain new
+// lines, base64 messages and JSON-RPC messages do not. The session is closed
+// if the client does not request events for a minute, or if its queued
+// messages exceed 16 MB. Requests from pages of other origins are rejected
+// as the websocket upgrade is, see WithOrigins. Mount it with the same
+// prefix:
+//
+//	http.Handle("/ws/http/", s.FallbackHandler("/ws/http"))
+func (s *WsServer) FallbackHandler(prefix string) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+prefix+"/open", s.fallbackOpen)
+	mux.HandleFunc("POST "+prefix+"/send", s.fallbackSend)
+	mux.HandleFunc("GET "+prefix+"/events", s.fallbackEvents)
+	mux.HandleFunc("POST "+prefix+"/close", s.fallbackClose)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkOrigin(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// httpAddr is the http client remote address.
+type httpAddr string
+
+func (a httpAddr) Network() string { return "http" }
+func (a httpAddr) String() string  { return string(a) }
+
+// httpTransport is the http fallback transport. It queues messages until
+// the client receives them with events request.
+type httpTransport struct {
+	protocol string        // Selected subprotocol
+	notify   chan struct{} // Signals new messages
+	taken    chan struct{} // Signals messages received by client
+	done     chan struct{} // Closed when the transport is closed
+
+	mu       sync.Mutex
+	queue    [][]byte  // Messages waiting for client
+	size     int       // Size of queued messages
+	closed   bool      // Transport is closed
+	reason   string    // Close code and text
+	polls    int       // Number of running events requests
+	lastPoll time.Time // Time of last events request
+	draining bool      // Server shutdown, new messages are rejected
+
+	posts   sync.WaitGroup // Running send requests
+	serveMu sync.Mutex     // Serializes messages processing
+}
+
+// newHTTPTransport creates a new http fallback transport.
+func newHTTPTransport(protocol string) *httpTransport {
+	return &httpTransport{
+		protocol: protocol,
+		notify:   make(chan struct{}, 1),
+		taken:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		lastPoll: time.Now(),
+	}
+}
+
+// write queues the message. It closes the transport if the client does not
+// receive messages and they exceed fallbackMaxQueue, the single message is
+// queued whatever its size.
+func (t *httpTransport) write(data []byte) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return errFallbackClosed
+	}
+	if len(t.queue) > 0 && t.size+len(data) > fallbackMaxQueue {
+		t.mu.Unlock()
+		t.close(websocket.ClosePolicyViolation, "messages queue overflow")
+		return errFallbackOverflow
+	}
+	t.queue = append(t.queue, append([]byte(nil), data...))
+	t.size += len(data)
+	t.signal()
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *httpTransport) close(code int, text string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed, t.reason = true, fmt.Sprintf("%d %s", code, text)
+	close(t.done)
+	return nil
+}
+
+func (t *httpTransport) subprotocol() string { return t.protocol }
+
+// signal wakes up waiting events request. It should be called under lock.
+func (t *httpTransport) signal() {
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns queued messages and the transport close state.
+func (t *httpTransport) take() (messages [][]byte, closed bool, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	messages, t.queue, t.size = t.queue, nil, 0
+	closed, reason = t.closed, t.reason
+	if len(messages) > 0 {
+		select {
+		case t.taken <- struct{}{}:
+		default:
+		}
+	}
+	return
+}
+
+// queued returns true if there are messages waiting for client.
+func (t *httpTransport) queued() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.queue) > 0
+}
+
+// poll counts running events requests, n is 1 when request starts and -1
+// when it ends.
+func (t *httpTransport) poll(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.polls += n
+	t.lastPoll = time.Now()
+}
+
+// idle returns true if the client has not requested events for timeout.
+func (t *httpTransport) idle(timeout time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.polls == 0 && time.Since(t.lastPoll) > timeout
+}
+
+// beginPost counts running send request. It returns false if the server is
+// shutting down.
+func (t *httpTransport) beginPost() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining || t.closed {
+		return false
+	}
+	t.posts.Add(1)
+	return true
+}
+
+// drain rejects new send requests and waits for running ones.
+func (t *httpTransport) drain() {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+	t.posts.Wait()
+}
+
+// fallbackOpen opens the http fallback session.
+func (s *WsServer) fallbackOpen(w http.ResponseWriter, r *http.Request) {
+	protocol := r.URL.Query().Get("protocol")
+	if protocol != "" && !slices.Contains(s.subprotocols, protocol) {
+		http.Error(w, "unsupported protocol", http.StatusBadRequest)
+		return
+	}
+
+	t := newHTTPTransport(protocol)
+	sess, ok := s.addSession(func(id string) *Session {
+		return newSession(id, t, httpAddr(r.RemoteAddr), s.logger, s.metrics)
+	})
+	if !ok {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if s.identify != nil {
+		sess.SetIdentity(s.identify(r))
+	}
+	s.metrics.SessionOpened(r.URL.Query().Has("reconnect"))
+
+	// Handle http session
+	go s.handleFallbackSession(sess, t)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, sess.ID())
+}
+
+// fallbackSession returns the http fallback session from request. It
+// answers 404 Not Found if the session does not exist.
+func (s *WsServer) fallbackSession(w http.ResponseWriter, r *http.Request) (
+	sess *Session, t *httpTransport, ok bool) {
+
+	sess, ok = s.sessions.Get(r.URL.Query().Get("session"))
+	if ok {
+		t, ok = sess.transport.(*httpTransport)
+	}
+	if !ok {
+		http.Error(w, ErrSessionNotFound.Error(), http.StatusNotFound)
+	}
+	return
+}
+
+// fallbackSend processes message received in the request body.
+func (s *WsServer) fallbackSend(w http.ResponseWriter, r *http.Request) {
+	sess, t, ok := s.fallbackSession(w, r)
+	if !ok {
+		return
+	}
+	if !t.beginPost() {
+		http.Error(w, "session closed", http.StatusGone)
+		return
+	}
+	defer t.posts.Done()
+
+	limit := int64(fallbackMaxMessage)
+	if s.readLimit > 0 {
+		limit = s.readLimit
+	}
+	message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		status := http.StatusBadRequest
+		if _, ok := err.(*http.MaxBytesError); ok {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// Process messages one by one like the websocket connection does
+	t.serveMu.Lock()
+	s.serveMessage(Chain(s.handler, s.middleware...), sess, message)
+	t.serveMu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fallbackEvents sends queued messages to the client as Server-Sent Events
+// stream or as long-poll answer.
+func (s *WsServer) fallbackEvents(w http.ResponseWriter, r *http.Request) {
+	_, t, ok := s.fallbackSession(w, r)
+	if !ok {
+		return
+	}
+	t.poll(1)
+	defer t.poll(-1)
+
+	w.Header().Set("Cache-Control", "no-store")
+	flusher, ok := w.(http.Flusher)
+	if ok && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamEvents(w, flusher, r, t)
+		return
+	}
+	pollEvents(w, r, t)
+}
+
+// streamEvents writes messages as Server-Sent Events until the session is
+// closed or the client disconnects.
+func streamEvents(w http.ResponseWriter, flusher http.Flusher, r *http.Request,
+	t *httpTransport) {
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(fallbackKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		messages, closed, reason := t.take()
+		for _, message := range messages {
+			fmt.Fprintf(w, "data: %s\n\n", message)
+		}
+		if closed {
+			fmt.Fprintf(w, "event: close\ndata: %s\n\n", reason)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-t.notify:
+		case <-t.done:
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// pollEvents answers long-poll request with queued messages. It waits for
+// messages up to the poll timeout.
+func pollEvents(w http.ResponseWriter, r *http.Request, t *httpTransport) {
+	timer := time.NewTimer(fallbackPollTimeout)
+	defer timer.Stop()
+	for {
+		messages, closed, reason := t.take()
+		if len(messages) > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write(bytes.Join(messages, []byte("\n")))
+			return
+		}
+		if closed {
+			http.Error(w, reason, http.StatusGone)
+			return
+		}
+
+		select {
+		case <-t.notify:
+		case <-t.done:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// fallbackClose closes the http fallback session by client request.
+func (s *WsServer) fallbackClose(w http.ResponseWriter, r *http.Request) {
+	sess, _, ok := s.fallbackSession(w, r)
+	if !ok {
+		return
+	}
+	sess.Close(websocket.CloseNormalClosure, "closed by client")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleFallbackSession runs until the http fallback session is closed by
+// client, by server, by idle timeout or by server shutdown. On shutdown it
+// lets messages being processed, in goroutines too, finish before closing the
+// session. The
+// closed session stays registered until the client receives its queued
+// messages, up to the linger timeout.
+func (s *WsServer) handleFallbackSession(sess *Session, t *httpTransport) {
+	defer s.wg.Done()
+	defer s.metrics.SessionClosed()
+	defer s.sessions.remove(sess.ID())
+	defer sess.cancel()
+
+	logger := sess.Logger()
+	logger.Info("http client connected", "remote", sess.RemoteAddr())
+	idle := time.NewTicker(fallbackIdleTimeout / 4)
+	defer idle.Stop()
+	quit := s.quit
+	for done := false; !done; {
+		select {
+		case <-t.done:
+			done = true
+		case <-idle.C:
+			if t.idle(fallbackIdleTimeout) {
+				logger.Debug("http client idle timeout")
+				sess.Close(websocket.CloseGoingAway, "idle timeout")
+			}
+		case <-quit:
+			quit = nil
+			go func() {
+				t.drain()
+				sess.wait()
+				sess.Close(websocket.CloseGoingAway, "server shutdown")
+			}()
+		}
+	}
+
+	// Stop messages being processed for the closed session, on shutdown they
+	// are done before close
+	sess.cancel()
+	sess.wait()
+
+	// Let the client receive messages sent before the session was closed
+	linger := time.NewTimer(fallbackLinger)
+	defer linger.Stop()
+	for t.queued() {
+		select {
+		case <-t.taken:
+		case <-linger.C:
+			logger.Debug("http client messages dropped")
+			t.take()
+		}
+	}
+	logger.Info("http client disconnected", "remote", sess.RemoteAddr())
+}
@@ -0,0 +1,96 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Websocket message handlers and middleware module.
+
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ErrCloseSession may be returned (or wrapped) by a Handler to close the
+// client session after the message processed, f.e. when an auth middleware
+// rejects the client.
+var ErrCloseSession = errors.New("close session")
+
+// Message is a websocket message received from a client Session.
+type Message struct {
+	Session *Session // Client session
+	Data    []byte   // Message data
+	ctx     context.Context
+}
+
+// Context returns the message context. It is canceled when the client
+// session is disconnected.
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// WithContext returns a shallow copy of the message with its context changed
+// to ctx. Middleware use it to pass values to next handlers.
+func (m *Message) WithContext(ctx context.Context) *Message {
+	m2 := *m
+	m2.ctx = ctx
+	return &m2
+}
+
+// Handler processes a websocket message. Returned error is logged by the
+// server. If the error is ErrCloseSession the session is closed.
+type Handler interface {
+	ServeMessage(msg *Message) error
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as
+// message handlers.
+type HandlerFunc func(msg *Message) error
+
+// ServeMessage calls f(msg).
+func (f HandlerFunc) ServeMessage(msg *Message) error { return f(msg) }
+
+// Middleware wraps a Handler with additional processing. A middleware may
+// process the message before and after calling next handler, change the
+// message, or stop the chain by returning without calling next handler.
+type Middleware func(next Handler) Handler
+
+// Chain wraps the handler with middleware. The first middleware is the
+// outermost one, so it gets the message first.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Recover is a middleware that recovers from panics in next handlers and
+// returns the panic as an error.
+func Recover(next Handler) Handler {
+	return HandlerFunc(func(msg *Message) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return next.ServeMessage(msg)
+	})
+}
+
+// DecodeBase64 is a middleware that decodes base64 message data before
+// calling next handler.
+func DecodeBase64(next Handler) Handler {
+	return HandlerFunc(func(msg *Message) error {
+		data, err := base64.StdEncoding.DecodeString(string(msg.Data))
+		if err != nil {
+			return fmt.Errorf("can't decode message base64, error: %w", err)
+		}
+		msg.Data = data
+		return next.ServeMessage(msg)
+	})
+}
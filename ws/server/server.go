@@ -6,88 +6,382 @@
 package server
 
 import (
-	"encoding/base64"
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/teonet-go/teoproxy/metrics"
+	"github.com/teonet-go/teoproxy/ws/command"
 )
 
+// closeWriteWait is the time allowed to write a close frame to a client.
+const closeWriteWait = time.Second
+
+// ErrServerClosed is returned by Shutdown when the server is already shut
+// down.
+var ErrServerClosed = errors.New("ws server closed")
+
+// DefaultReadLimit is the default maximum size of a message read from a
+// client. It fits the base64 encoded binary command fragment of the default
+// size with the largest header, clients send larger commands in fragments.
+const DefaultReadLimit = (command.DefaultFragmentSize + command.MaxHeaderSize +
+	2) / 3 * 4
+
 // WsServer is a WebSocket server that handles WebSocket connections.
-// It contains a processMessage field which is a slice of functions to process
-// incoming WebSocket messages.
+// It contains a message handler wrapped with middleware to process incoming
+// WebSocket messages, and the registry of connected sessions which is used
+// to address clients and to close them on Shutdown.
 type WsServer struct {
-	processMessage []func(conn *websocket.Conn, message []byte)
+	handler      Handler
+	middleware   []Middleware
+	identify     func(r *http.Request) string
+	subprotocols []string
+	origins      []string
+	readLimit    int64
+	sessions     *Sessions
+	metrics      *metrics.Metrics
+	logger       *slog.Logger
+	logPayload   bool
+
+	mu      sync.Mutex     // Protects closing
+	closing bool           // Server is shutting down
+	quit    chan struct{}  // Closed when server starts shutting down
+	wg      sync.WaitGroup // Running connection handlers
+}
+
+// Option configures the WsServer.
+type Option func(s *WsServer)
+
+// WithLogger sets structured logger of the websocket server. By default the
+// slog.Default logger is used.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *WsServer) { s.logger = logger }
+}
+
+// WithPayloadLogging enables logging of messages data. It is off by default
+// because messages may contain user data.
+func WithPayloadLogging(on bool) Option {
+	return func(s *WsServer) { s.logPayload = on }
+}
+
+// WithMetrics sets metrics to instrument the websocket server.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(s *WsServer) { s.metrics = m }
+}
+
+// WithSubprotocols sets websocket subprotocols supported by the server in
+// order of preference. The subprotocol selected during the handshake is
+// available from the client Session, clients which do not request any
+// subprotocol use the default base64 binary protocol.
+func WithSubprotocols(protocols ...string) Option {
+	return func(s *WsServer) { s.subprotocols = protocols }
+}
+
+// WithReadLimit sets the maximum size of a message read from a client. The
+// connection of the client which sends larger message is closed. The limit
+// applies to http fallback messages too. The default is DefaultReadLimit,
+// raise it for JSON-RPC clients which send larger requests, they do not
+// fragment them. Zero disables the limit of websocket messages, http
+// fallback messages are limited to 4 MB then.
+func WithReadLimit(limit int64) Option {
+	return func(s *WsServer) { s.readLimit = limit }
+}
+
+// WithOrigins sets origins of web pages allowed to open websocket
+// connections, f.e. "https://example.com". The "*" origin allows any page.
+// By default only pages of the server host are allowed.
+func WithOrigins(origins ...string) Option {
+	return func(s *WsServer) { s.origins = origins }
+}
+
+// New creates a new WsServer instance with the provided message handler.
+// The handler wrapped with middleware added by Use will be called to handle
+// each incoming WebSocket message. If handler is nil the default handler,
+// which answers "Message received", is used.
+func New(handler Handler, opts ...Option) *WsServer {
+	if handler == nil {
+		handler = HandlerFunc(processMessage)
+	}
+	s := &WsServer{handler: handler, sessions: newSessions(),
+		readLimit: DefaultReadLimit, quit: make(chan struct{})}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	return s
+}
+
+// Use adds middleware to the message handler chain. Middleware are applied
+// in the order they are added, the first one gets the message first. Use
+// should be called before the server starts handling connections.
+func (s *WsServer) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
 }
 
-// New creates a new WsServer instance with the provided message processing
-// functions. The processMessage functions will be called to handle each
-// incoming WebSocket message.
-func New(processMessage ...func(conn *websocket.Conn, message []byte)) *WsServer {
-	return &WsServer{processMessage: processMessage}
+// SetIdentify sets the function which returns client identity from the
+// websocket upgrade request, f.e. an authenticated user name. The identity is
+// stored in the client Session.
+func (s *WsServer) SetIdentify(identify func(r *http.Request) string) {
+	s.identify = identify
 }
 
 // HandleWebSocket handles websocket requests by upgrading
-// the HTTP connection to a WebSocket connection.
+// the HTTP connection to a WebSocket connection. When the server is shutting
+// down it answers with 503 Service Unavailable instead.
 func (s *WsServer) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{}
+	if s.isClosing() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	upgrader := websocket.Upgrader{Subprotocols: s.subprotocols}
+	if len(s.origins) > 0 {
+		upgrader.CheckOrigin = s.checkOrigin
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Failed to upgrade connection:", err)
+		s.logger.Warn("failed to upgrade connection", "remote", r.RemoteAddr,
+			"err", err)
 		return
 	}
+	if s.readLimit > 0 {
+		conn.SetReadLimit(s.readLimit)
+	}
+
+	// Register session, the server may start shutting down during upgrade
+	sess, ok := s.addSession(func(id string) *Session {
+		return newWsSession(id, conn, s.logger, s.metrics)
+	})
+	if !ok {
+		writeShutdown(conn)
+		conn.Close()
+		return
+	}
+	if s.identify != nil {
+		sess.SetIdentity(s.identify(r))
+	}
+	s.metrics.SessionOpened(r.URL.Query().Has("reconnect"))
 
 	// Handle websocket connection
-	go s.handleConnection(conn)
+	go s.handleConnection(sess)
+}
+
+// checkOrigin returns true if the websocket request origin is the server host
+// or one of the allowed origins.
+func (s *WsServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range s.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// Sessions returns the registry of connected sessions.
+func (s *WsServer) Sessions() *Sessions { return s.sessions }
+
+// Session returns the connected session with given id.
+func (s *WsServer) Session(id string) (sess *Session, ok bool) {
+	return s.sessions.Get(id)
+}
+
+// Broadcast sends a message to all connected sessions. It returns the number
+// of sessions the message was sent to.
+func (s *WsServer) Broadcast(message []byte) (n int) {
+	s.sessions.Range(func(sess *Session) bool {
+		if err := sess.Send(message); err != nil {
+			sess.Logger().Warn("failed to broadcast message to client", "err", err)
+			return true
+		}
+		n++
+		return true
+	})
+	return
+}
+
+// SendTo sends a message to the session with given id.
+func (s *WsServer) SendTo(sessionID string, message []byte) error {
+	sess, ok := s.sessions.Get(sessionID)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return sess.Send(message)
+}
+
+// Disconnect sends close frame to the session with given id and closes its
+// connection.
+func (s *WsServer) Disconnect(sessionID string) error {
+	sess, ok := s.sessions.Get(sessionID)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return sess.Close(websocket.CloseNormalClosure, "disconnected by server")
+}
+
+// Shutdown gracefully shuts down the websocket server. It stops accepting
+// new connections, stops reading new messages from connected clients, lets
+// messages being processed finish and sends a close frame to every client.
+// Shutdown returns when all connection handlers have finished or when the
+// context expires. In the last case the remaining connections are closed
+// and the context's error is returned. The http fallback sessions are closed
+// the same way, after their messages being processed are done.
+//
+// The http.Server does not track hijacked websocket connections, so Shutdown
+// should be called in addition to http.Server.Shutdown.
+func (s *WsServer) Shutdown(ctx context.Context) (err error) {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closing = true
+	close(s.quit)
+	s.mu.Unlock()
+
+	// Interrupt blocked reads, a connection handler sends close frame to
+	// its client when the message it processes is done. The http fallback
+	// sessions are closed by their handlers on quit
+	s.sessions.Range(func(sess *Session) bool {
+		if sess.conn != nil {
+			sess.conn.SetReadDeadline(time.Now())
+		}
+		return true
+	})
+
+	// Wait for connection handlers or context done
+	done := make(chan struct{})
+	go func() { s.wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.sessions.Range(func(sess *Session) bool {
+			if sess.conn != nil {
+				sess.conn.Close()
+			} else {
+				sess.Close(websocket.CloseGoingAway, "server shutdown")
+			}
+			return true
+		})
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// addSession adds session created by the create function to the sessions
+// registry. It returns false if the server is shutting down.
+func (s *WsServer) addSession(create func(id string) *Session) (sess *Session,
+	ok bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return
+	}
+	sess, ok = s.sessions.add(create), true
+	s.wg.Add(1)
+	return
+}
+
+// isClosing returns true if the server is shutting down.
+func (s *WsServer) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// writeShutdown sends the going away close frame to the websocket client.
+func writeShutdown(conn *websocket.Conn) error {
+	return conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"),
+		time.Now().Add(closeWriteWait))
 }
 
 // handleConnection handles an incoming WebSocket connection.
-// It reads messages from the client, processes them by calling functions in
-// processMessage, and runs until the connection is closed.
-func (s *WsServer) handleConnection(conn *websocket.Conn) {
-	defer conn.Close()
+// It reads messages from the client, processes them by calling the message
+// handler chain, and runs until the connection is closed.
+func (s *WsServer) handleConnection(sess *Session) {
+	defer s.wg.Done()
+	defer s.metrics.SessionClosed()
+	defer s.sessions.remove(sess.ID())
+	defer sess.conn.Close()
+	defer sess.cancel()
+
+	handler := Chain(s.handler, s.middleware...)
 
-	log.Println("A ws client connected", conn.RemoteAddr())
+	logger := sess.Logger()
+	logger.Info("ws client connected", "remote", sess.RemoteAddr())
 	for {
 		// Read message from client
-		_, message, err := conn.ReadMessage()
+		_, message, err := sess.conn.ReadMessage()
 		if err != nil {
-			log.Println("Failed to read message from client:", err)
+			if s.isClosing() {
+				// Answer messages being processed before close frame, the
+				// connection is closed by Shutdown at its deadline
+				sess.wait()
+				writeShutdown(sess.conn)
+				break
+			}
+			logger.Debug("failed to read message from client", "err", err)
 			break
 		}
 
 		// Process message
-		if len(s.processMessage) == 0 {
-			processMessage(conn, message)
-			continue
-		}
-		for _, f := range s.processMessage {
-			f(conn, message)
+		if !s.serveMessage(handler, sess, message) {
+			break
 		}
 	}
-	log.Println("A ws client disconnected", conn.RemoteAddr())
+
+	// Stop messages being processed for the disconnected client and wait for
+	// them, so the session is removed when they are done
+	sess.cancel()
+	sess.wait()
+	logger.Info("ws client disconnected", "remote", sess.RemoteAddr())
 }
 
-// processMessage handles incoming WebSocket messages from clients.
-// It logs the message, processes it, and writes a response.
-func processMessage(conn *websocket.Conn, message []byte) {
-	// Print message to console
-	log.Println("Received message:", message, string(message))
+// serveMessage processes a message received from the session client with
+// the handler. It closes the session and returns false if the handler
+// returns ErrCloseSession.
+func (s *WsServer) serveMessage(handler Handler, sess *Session,
+	message []byte) bool {
 
-	// Write response to client
-	sendMessage(conn, []byte("Message received"))
+	s.metrics.BytesIn(len(message))
+	logger := sess.Logger()
+	if s.logPayload {
+		logger.Debug("received message", "data", message)
+	}
+
+	msg := &Message{Session: sess, Data: message, ctx: sess.Context()}
+	if err := handler.ServeMessage(msg); err != nil {
+		logger.Warn("failed to process message from client", "err", err)
+		if errors.Is(err, ErrCloseSession) {
+			sess.Close(websocket.ClosePolicyViolation, "session closed")
+			return false
+		}
+	}
+	return true
 }
 
-// SendMessage sends a message to the websocket client
-// sendMessage sends a message to the websocket client.
-// It encodes the message as base64 text and writes it to the client.
-// Returns any error from writing the message.
-func sendMessage(conn *websocket.Conn, message []byte) (err error) {
-	if err = conn.WriteMessage(websocket.TextMessage,
-		[]byte(base64.StdEncoding.EncodeToString(message))); err != nil {
-		log.Println("Failed to write message to client:", err)
-		return
+// processMessage handles incoming WebSocket messages from clients.
+// It writes a response to the client.
+func processMessage(msg *Message) (err error) {
+	// Write response to client
+	if err = msg.Session.Send([]byte("Message received")); err != nil {
+		err = fmt.Errorf("failed to write message to client: %w", err)
 	}
-	log.Println("Message sent to client:", message)
 	return
 }
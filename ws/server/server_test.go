@@ -0,0 +1,360 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer starts http test server with websocket server handler and
+// returns its websocket url.
+func newTestServer(t *testing.T, s *WsServer) string {
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	t.Cleanup(ts.Close)
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// dial connects to the websocket server and waits for session registered.
+func dial(t *testing.T, s *WsServer, url string) *websocket.Conn {
+	n := s.Sessions().Len()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("can't dial websocket server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	for i := 0; s.Sessions().Len() == n; i++ {
+		if i > 100 {
+			t.Fatal("session was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return conn
+}
+
+// read reads base64 message from the websocket connection.
+func read(t *testing.T, conn *websocket.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("can't read message: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(string(message))
+	if err != nil {
+		t.Fatalf("can't decode message: %v", err)
+	}
+	return string(data)
+}
+
+func TestSessions(t *testing.T) {
+	s := New(nil)
+	s.SetIdentify(func(r *http.Request) string { return "user" })
+	url := newTestServer(t, s)
+
+	conn1 := dial(t, s, url)
+	conn2 := dial(t, s, url)
+
+	// Test case 1: broadcast message to all sessions
+	if n := s.Broadcast([]byte("hello")); n != 2 {
+		t.Errorf("expected broadcast to 2 sessions, got: %d", n)
+	}
+	for _, conn := range []*websocket.Conn{conn1, conn2} {
+		if msg := read(t, conn); msg != "hello" {
+			t.Errorf("expected message: hello, got: %s", msg)
+		}
+	}
+
+	// Test case 2: send message to one session
+	var ids []string
+	s.Sessions().Range(func(sess *Session) bool {
+		if sess.Identity() != "user" {
+			t.Errorf("expected identity: user, got: %s", sess.Identity())
+		}
+		ids = append(ids, sess.ID())
+		return true
+	})
+	if err := s.SendTo(ids[0], []byte("to one")); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if err := s.SendTo("unknown", nil); err != ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got: %v", err)
+	}
+
+	// Test case 3: disconnect sessions
+	for _, id := range ids {
+		if err := s.Disconnect(id); err != nil {
+			t.Errorf("expected no error, got: %v", err)
+		}
+	}
+	for i := 0; s.Sessions().Len() > 0; i++ {
+		if i > 100 {
+			t.Fatal("sessions were not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	s := New(nil)
+	conn := dial(t, s, newTestServer(t, s))
+
+	// Test case 1: message up to the default read limit is received
+	conn.WriteMessage(websocket.TextMessage, make([]byte, DefaultReadLimit))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("expected answer, got: %v", err)
+	}
+
+	// Test case 2: larger message closes the connection
+	conn.WriteMessage(websocket.TextMessage, make([]byte, DefaultReadLimit+1))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err,
+		websocket.CloseMessageTooBig) {
+		t.Errorf("expected message too big close, got: %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := New(HandlerFunc(func(msg *Message) error {
+		time.Sleep(100 * time.Millisecond)
+		return msg.Session.Send([]byte("done"))
+	}))
+	url := newTestServer(t, s)
+	conn := dial(t, s, url)
+
+	// Message being processed is answered before close frame
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	time.Sleep(20 * time.Millisecond)
+	errs := make(chan error, 1)
+	go func() { errs <- s.Shutdown(context.Background()) }()
+	if msg := read(t, conn); msg != "done" {
+		t.Errorf("expected message: done, got: %s", msg)
+	}
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected going away close error, got: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+
+	// New connections are rejected after shutdown
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got: %v", err)
+	}
+	if err := s.Shutdown(context.Background()); err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got: %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	mw := func(name string, stop bool) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(msg *Message) error {
+				order = append(order, name)
+				if stop {
+					return nil
+				}
+				return next.ServeMessage(msg)
+			})
+		}
+	}
+	handler := HandlerFunc(func(msg *Message) error {
+		order = append(order, "handler:"+string(msg.Data))
+		return nil
+	})
+
+	// Test case 1: middleware are called in order and decode message
+	msg := &Message{Data: []byte(base64.StdEncoding.EncodeToString([]byte("hi")))}
+	err := Chain(handler, mw("a", false), DecodeBase64, mw("b", false)).
+		ServeMessage(msg)
+	if err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if got := strings.Join(order, ","); got != "a,b,handler:hi" {
+		t.Errorf("expected order: a,b,handler:hi, got: %s", got)
+	}
+
+	// Test case 2: middleware stops the chain
+	order = nil
+	Chain(handler, mw("a", true), mw("b", false)).ServeMessage(msg)
+	if got := strings.Join(order, ","); got != "a" {
+		t.Errorf("expected order: a, got: %s", got)
+	}
+
+	// Test case 3: recover from panic
+	err = Chain(HandlerFunc(func(msg *Message) error { panic("test") }),
+		Recover).ServeMessage(msg)
+	if err == nil || err.Error() != "panic: test" {
+		t.Errorf("expected panic error, got: %v", err)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	s := New(nil)
+	ts := httptest.NewServer(s.FallbackHandler("/ws/http"))
+	t.Cleanup(ts.Close)
+	url := ts.URL + "/ws/http"
+
+	// post sends http request and returns response status and body
+	post := func(method, path, body string, header ...string) (int, string) {
+		req, _ := http.NewRequest(method, url+path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("can't send request: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	// Test case 1: open session and exchange messages with long-poll
+	status, id := post("POST", "/open", "")
+	if status != http.StatusOK || s.Sessions().Len() != 1 {
+		t.Fatalf("expected opened session, got: %d %s", status, id)
+	}
+	if status, _ = post("POST", "/send?session="+id, encode("hello")); status !=
+		http.StatusNoContent {
+		t.Errorf("expected status 204, got: %d", status)
+	}
+	status, body := post("GET", "/events?session="+id, "")
+	if status != http.StatusOK || body != encode("Message received") {
+		t.Errorf("expected message received, got: %d %s", status, body)
+	}
+
+	// Test case 2: receive messages with Server-Sent Events
+	s.SendTo(id, []byte("one"))
+	s.SendTo(id, []byte("two"))
+	s.Disconnect(id)
+	status, body = post("GET", "/events?session="+id, "",
+		"Accept", "text/event-stream")
+	expected := "data: " + encode("one") + "\n\ndata: " + encode("two") +
+		"\n\nevent: close\ndata: 1000 disconnected by server\n\n"
+	if status != http.StatusOK || body != expected {
+		t.Errorf("expected events:\n%s\ngot: %d\n%s", expected, status, body)
+	}
+	for i := 0; s.Sessions().Len() > 0; i++ {
+		if i > 100 {
+			t.Fatal("session was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status, _ = post("POST", "/send?session="+id, ""); status !=
+		http.StatusNotFound {
+		t.Errorf("expected status 404, got: %d", status)
+	}
+
+	// Test case 3: unsupported subprotocol
+	if status, _ = post("POST", "/open?protocol=foo", ""); status !=
+		http.StatusBadRequest {
+		t.Errorf("expected status 400, got: %d", status)
+	}
+
+	// Test case 4: session is closed when the client does not receive
+	// messages
+	_, id = post("POST", "/open", "")
+	message := make([]byte, 1<<20)
+	var err error
+	for i := 0; err == nil; i++ {
+		if i > fallbackMaxQueue/len(message) {
+			t.Fatal("queue overflow did not close session")
+		}
+		err = s.SendTo(id, message)
+	}
+	if status, _ = post("POST", "/send?session="+id, encode("hello")); status !=
+		http.StatusGone {
+		t.Errorf("expected status 410, got: %d", status)
+	}
+	post("GET", "/events?session="+id, "")
+
+	// Test case 5: shutdown closes session
+	_, id = post("POST", "/open", "")
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if status, _ = post("POST", "/open", ""); status !=
+		http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got: %d", status)
+	}
+	if status, _ = post("GET", "/events?session="+id, ""); status !=
+		http.StatusNotFound {
+		t.Errorf("expected status 404, got: %d", status)
+	}
+}
+
+func TestOrigins(t *testing.T) {
+	// dialOrigin dials the websocket server with the Origin header
+	dialOrigin := func(url, origin string) error {
+		conn, _, err := websocket.DefaultDialer.Dial(url,
+			http.Header{"Origin": {origin}})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// Test case 1: only the server host is allowed by default
+	url := newTestServer(t, New(nil))
+	host := "http" + strings.TrimPrefix(url, "ws")
+	if err := dialOrigin(url, host); err != nil {
+		t.Errorf("test case 1: server host origin rejected: %v", err)
+	}
+	if err := dialOrigin(url, "https://example.com"); err == nil {
+		t.Error("test case 1: other origin allowed")
+	}
+
+	// Test case 2: allowed origins and the server host
+	url = newTestServer(t, New(nil, WithOrigins("https://example.com")))
+	host = "http" + strings.TrimPrefix(url, "ws")
+	for _, origin := range []string{host, "https://EXAMPLE.com"} {
+		if err := dialOrigin(url, origin); err != nil {
+			t.Errorf("test case 2: origin %s rejected: %v", origin, err)
+		}
+	}
+	if err := dialOrigin(url, "https://other.com"); err == nil {
+		t.Error("test case 2: not allowed origin allowed")
+	}
+
+	// Test case 3: any origin
+	url = newTestServer(t, New(nil, WithOrigins("*")))
+	if err := dialOrigin(url, "https://other.com"); err != nil {
+		t.Errorf("test case 3: origin rejected: %v", err)
+	}
+
+	// Test case 4: http fallback checks origins too
+	ts := httptest.NewServer(New(nil).FallbackHandler("/ws/http"))
+	t.Cleanup(ts.Close)
+	for i, test := range []struct {
+		path, origin string
+		status       int
+	}{
+		{"/open", ts.URL, http.StatusOK},
+		{"/open", "https://example.com", http.StatusForbidden},
+		{"/send?session=1", "https://example.com", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest("POST", ts.URL+"/ws/http"+test.path, nil)
+		req.Header.Set("Origin", test.origin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("test case 4.%d: %v", i+1, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("test case 4.%d: expected status %d, got: %d", i+1,
+				test.status, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2023-2024 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Websocket sessions registry module.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/teonet-go/teoproxy/metrics"
+)
+
+// ErrSessionNotFound is returned when a session with requested id is not
+// connected to the server.
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session represents a connected websocket client. It contains the session
+// id, remote address, connect time and identity of the client. Session writes
+// are serialized so it is safe to send messages to a session from different
+// goroutines.
+type Session struct {
+	conn        *websocket.Conn // Websocket connection, nil for http sessions
+	transport   transport       // Client connection used to send messages
+	id          string          // Session id
+	remoteAddr  net.Addr        // Client remote address
+	connectedAt time.Time       // Time when client connected
+
+	ctx    context.Context    // Canceled when client disconnected
+	cancel context.CancelFunc // Cancels session context
+	wg     sync.WaitGroup     // Messages processed in goroutines
+
+	mu       sync.RWMutex // Protects identity
+	identity string       // Client identity
+
+	writeMu sync.Mutex       // Serializes writes to connection
+	logger  *slog.Logger     // Logger with session attributes
+	metrics *metrics.Metrics // Server metrics
+}
+
+// transport is the client connection used by Session to send messages. The
+// websocket connection and the http fallback transport implement it.
+type transport interface {
+	write(data []byte) error           // Writes text message to client
+	close(code int, text string) error // Closes connection with reason
+	subprotocol() string               // Returns negotiated subprotocol
+}
+
+// wsTransport is the websocket connection transport.
+type wsTransport struct{ conn *websocket.Conn }
+
+func (t wsTransport) write(data []byte) error {
+	return t.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (t wsTransport) close(code int, text string) error {
+	t.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text),
+		time.Now().Add(closeWriteWait))
+	return t.conn.Close()
+}
+
+func (t wsTransport) subprotocol() string { return t.conn.Subprotocol() }
+
+// newWsSession creates a new Session for the websocket connection.
+func newWsSession(id string, conn *websocket.Conn, logger *slog.Logger,
+	m *metrics.Metrics) (sess *Session) {
+	sess = newSession(id, wsTransport{conn}, conn.RemoteAddr(), logger, m)
+	sess.conn = conn
+	return
+}
+
+// newSession creates a new Session for the client transport.
+func newSession(id string, t transport, remoteAddr net.Addr,
+	logger *slog.Logger, m *metrics.Metrics) *Session {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{
+		transport:   t,
+		id:          id,
+		remoteAddr:  remoteAddr,
+		connectedAt: time.Now(),
+		ctx:         ctx,
+		cancel:      cancel,
+		logger:      logger.With("session", id),
+		metrics:     m,
+	}
+}
+
+// ID returns the session id.
+func (sess *Session) ID() string { return sess.id }
+
+// RemoteAddr returns the client remote address.
+func (sess *Session) RemoteAddr() net.Addr { return sess.remoteAddr }
+
+// ConnectedAt returns the time when the client connected.
+func (sess *Session) ConnectedAt() time.Time { return sess.connectedAt }
+
+// Context returns the session context. It is canceled when the client is
+// disconnected.
+func (sess *Session) Context() context.Context { return sess.ctx }
+
+// Go processes the session message in the f goroutine. The session waits for
+// the goroutines on server shutdown before its context is canceled and it is
+// closed, so their answers are sent to the client. When the client
+// disconnects the session context is canceled first, so the goroutines which
+// use it stop, and the session waits for them before it is removed.
+func (sess *Session) Go(f func()) {
+	sess.wg.Add(1)
+	go func() {
+		defer sess.wg.Done()
+		f()
+	}()
+}
+
+// wait waits for the session message goroutines started with Go.
+func (sess *Session) wait() { sess.wg.Wait() }
+
+// Logger returns the server logger with the session id attribute.
+func (sess *Session) Logger() *slog.Logger { return sess.logger }
+
+// Conn returns the underlying websocket connection, it is nil for sessions
+// connected with the http fallback transport. Use the Session Send method to
+// write messages, it is safe for concurrent use.
+func (sess *Session) Conn() *websocket.Conn { return sess.conn }
+
+// Subprotocol returns the websocket subprotocol negotiated with the client.
+// It is empty for clients using the default base64 binary protocol.
+func (sess *Session) Subprotocol() string { return sess.transport.subprotocol() }
+
+// Identity returns the client identity. It is empty until set by the server
+// identity function or by SetIdentity.
+func (sess *Session) Identity() string {
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	return sess.identity
+}
+
+// SetIdentity sets the client identity, f.e. after the client authenticated.
+func (sess *Session) SetIdentity(identity string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.identity = identity
+}
+
+// Send sends a message to the websocket client. It encodes the message as
+// base64 text and writes it to the client.
+func (sess *Session) Send(message []byte) error {
+	return sess.writeMessage([]byte(base64.StdEncoding.EncodeToString(message)))
+}
+
+// SendText sends a text message to the websocket client as is, without
+// base64 encoding. It is used by subprotocols with text messages like
+// JSON-RPC.
+func (sess *Session) SendText(message []byte) error {
+	return sess.writeMessage(message)
+}
+
+// Close sends close frame with the code and text to the client and closes
+// the connection.
+func (sess *Session) Close(code int, text string) error {
+	return sess.transport.close(code, text)
+}
+
+// writeMessage writes text message to the connection. It locks the write
+// mutex because websocket connection supports one concurrent writer only.
+func (sess *Session) writeMessage(data []byte) error {
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	if err := sess.transport.write(data); err != nil {
+		return err
+	}
+	sess.metrics.BytesOut(len(data))
+	return nil
+}
+
+// Sessions stores a map of connected Session instances, keyed by session id.
+// It uses a RWMutex for concurrent access control.
+type Sessions struct {
+	m map[string]*Session
+	*sync.RWMutex
+}
+
+// newSessions creates a new Sessions registry.
+func newSessions() *Sessions {
+	return &Sessions{m: make(map[string]*Session), RWMutex: new(sync.RWMutex)}
+}
+
+// add creates a new Session with unique id by the create function and adds
+// it to the Sessions map.
+func (s *Sessions) add(create func(id string) *Session) (sess *Session) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	// newId generates random string with n bytes
+	newId := func(n int) string {
+		b := make([]byte, n)
+		rand.Read(b)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	// Create and check new id
+	var id string
+	for {
+		id = newId(12)
+		if _, ok := s.m[id]; !ok {
+			break
+		}
+	}
+
+	sess = create(id)
+	s.m[id] = sess
+	return
+}
+
+// remove removes the Session with given id from the Sessions map.
+func (s *Sessions) remove(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.m, id)
+}
+
+// Get retrieves the Session with given id from the Sessions map. The second
+// return value indicates if a session was found.
+func (s *Sessions) Get(id string) (sess *Session, ok bool) {
+	s.RLock()
+	defer s.RUnlock()
+	sess, ok = s.m[id]
+	return
+}
+
+// Len returns the number of connected sessions.
+func (s *Sessions) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.m)
+}
+
+// Range calls f sequentially for each connected session. If f returns false,
+// Range stops the iteration. Range works on a snapshot of the sessions, so f
+// may send messages to or disconnect sessions.
+func (s *Sessions) Range(f func(sess *Session) bool) {
+	for _, sess := range s.list() {
+		if !f(sess) {
+			break
+		}
+	}
+}
+
+// list returns a snapshot slice of connected sessions.
+func (s *Sessions) list() (list []*Session) {
+	s.RLock()
+	defer s.RUnlock()
+	list = make([]*Session, 0, len(s.m))
+	for _, sess := range s.m {
+		list = append(list, sess)
+	}
+	return
+}